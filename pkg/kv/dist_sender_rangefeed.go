@@ -181,10 +181,16 @@ func (ds *DistSender) partialRangeFeed(
 				case roachpb.RangeFeedRetryError_REASON_REPLICA_REMOVED,
 					roachpb.RangeFeedRetryError_REASON_RAFT_SNAPSHOT,
 					roachpb.RangeFeedRetryError_REASON_LOGICAL_OPS_MISSING,
-					roachpb.RangeFeedRetryError_REASON_SLOW_CONSUMER:
+					roachpb.RangeFeedRetryError_REASON_SLOW_CONSUMER,
+					roachpb.RangeFeedRetryError_REASON_STALENESS_EXCEEDED,
+					roachpb.RangeFeedRetryError_REASON_PROCESSOR_STOPPED,
+					roachpb.RangeFeedRetryError_REASON_RATE_LIMIT_BACKLOG:
 					// Try again with same descriptor. These are transient
 					// errors that should not show up again.
 					continue
+				case roachpb.RangeFeedRetryError_REASON_STREAM_CANCELED:
+					// The consumer is no longer interested in the rangefeed.
+					return t
 				case roachpb.RangeFeedRetryError_REASON_RANGE_SPLIT,
 					roachpb.RangeFeedRetryError_REASON_RANGE_MERGED:
 					// Evict the decriptor from the cache.
@@ -1193,6 +1193,18 @@ func (e *RangeFeedEvent) ShallowCopy() *RangeFeedEvent {
 	case *RangeFeedError:
 		cpyErr := *t
 		cpy.MustSetValue(&cpyErr)
+	case *RangeFeedSplit:
+		cpySplit := *t
+		cpy.MustSetValue(&cpySplit)
+	case *RangeFeedDeleteRange:
+		cpyDelRng := *t
+		cpy.MustSetValue(&cpyDelRng)
+	case *RangeFeedBatch:
+		cpyBatch := *t
+		cpy.MustSetValue(&cpyBatch)
+	case *RangeFeedSSTable:
+		cpySST := *t
+		cpy.MustSetValue(&cpySST)
 	default:
 		panic(fmt.Sprintf("unexpected RangeFeedEvent variant: %v", t))
 	}
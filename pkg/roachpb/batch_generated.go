@@ -70,6 +70,8 @@ func (ru ErrorDetail) GetInner() error {
 		return t.RangefeedRetry
 	case *ErrorDetail_IndeterminateCommit:
 		return t.IndeterminateCommit
+	case *ErrorDetail_DataGarbageCollected:
+		return t.DataGarbageCollected
 	default:
 		return nil
 	}
@@ -327,6 +329,8 @@ func (ru *ErrorDetail) SetInner(r error) bool {
 		union = &ErrorDetail_RangefeedRetry{t}
 	case *IndeterminateCommitError:
 		union = &ErrorDetail_IndeterminateCommit{t}
+	case *DataGarbageCollectedError:
+		union = &ErrorDetail_DataGarbageCollected{t}
 	default:
 		return false
 	}
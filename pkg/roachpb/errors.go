@@ -844,6 +844,21 @@ func (e *IndeterminateCommitError) message(pErr *Error) string {
 
 var _ ErrorDetailInterface = &IndeterminateCommitError{}
 
+// NewDataGarbageCollectedError initializes a new DataGarbageCollectedError.
+func NewDataGarbageCollectedError(threshold hlc.Timestamp) *DataGarbageCollectedError {
+	return &DataGarbageCollectedError{Threshold: threshold}
+}
+
+func (e *DataGarbageCollectedError) Error() string {
+	return e.message(nil)
+}
+
+func (e *DataGarbageCollectedError) message(_ *Error) string {
+	return fmt.Sprintf("rangefeed data garbage collected below GC threshold %v", e.Threshold)
+}
+
+var _ ErrorDetailInterface = &DataGarbageCollectedError{}
+
 // IsRangeNotFoundError returns true if err contains a *RangeNotFoundError.
 func IsRangeNotFoundError(err error) bool {
 	// TODO(ajwerner): adopt errors.IsType once the pull request to add it merges.
@@ -0,0 +1,38 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package batchevaltest provides utilities for testing the evaluation of
+// individual batcheval commands in isolation, without a Store or Replica.
+package batchevaltest
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+)
+
+// EvaluateCommandForTest looks up the command registered for the provided
+// method and evaluates it directly against the given engine.ReadWriter, which
+// will typically be an in-memory engine or a batch on top of one. The
+// response is populated in resp, which must be of the type corresponding to
+// the method. Unlike evaluation on a Replica, no keys are declared, no latches
+// are acquired and the AppliesTo predicate of the command is not consulted.
+func EvaluateCommandForTest(
+	ctx context.Context,
+	method roachpb.Method,
+	rw engine.ReadWriter,
+	cArgs batcheval.CommandArgs,
+	resp roachpb.Response,
+) (result.Result, error) {
+	return batcheval.EvaluateCommand(ctx, method, rw, cArgs, resp)
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batchevaltest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateCommandForTest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	key := roachpb.Key("a")
+	h := roachpb.Header{Timestamp: hlc.Timestamp{WallTime: 1}}
+	var ms enginepb.MVCCStats
+
+	// Evaluate a read-write command.
+	put := &roachpb.PutRequest{
+		RequestHeader: roachpb.RequestHeader{Key: key},
+		Value:         roachpb.MakeValueFromString("val"),
+	}
+	_, err := EvaluateCommandForTest(ctx, roachpb.Put, eng, batcheval.CommandArgs{
+		Header: h, Args: put, Stats: &ms,
+	}, &roachpb.PutResponse{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), ms.KeyCount)
+
+	// Evaluate a read-only command that observes the write.
+	get := &roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: key}}
+	var getResp roachpb.GetResponse
+	_, err = EvaluateCommandForTest(ctx, roachpb.Get, eng, batcheval.CommandArgs{
+		Header: h, Args: get,
+	}, &getResp)
+	require.NoError(t, err)
+	require.NotNil(t, getResp.Value)
+	val, err := getResp.Value.GetBytes()
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+}
@@ -179,6 +179,21 @@ func EvalAddSSTable(
 
 	ms.Add(stats)
 
+	// Log the ingestion so that rangefeeds can publish the SST. When the SST is
+	// ingested as a side effect, its data is attached to the logical op below
+	// Raft to avoid carrying a second copy of it in the command.
+	var opData []byte
+	if args.IngestAsWrites {
+		opData = args.Data
+	}
+	readWriter.LogLogicalOp(engine.MVCCIngestSSTableOpType, engine.MVCCLogicalOpDetails{
+		Key:       args.Key,
+		EndKey:    args.EndKey,
+		Timestamp: h.Timestamp,
+		Data:      opData,
+		Safe:      true,
+	})
+
 	if args.IngestAsWrites {
 		log.VEventf(ctx, 2, "ingesting SST (%d keys/%d bytes) via regular write batch", stats.KeyCount, len(args.Data))
 		dataIter.SeekGE(engine.MVCCKey{Key: keys.MinKey})
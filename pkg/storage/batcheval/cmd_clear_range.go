@@ -14,12 +14,10 @@ import (
 	"context"
 	"errors"
 
-	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
-	"github.com/cockroachdb/cockroach/pkg/storage/spanset"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
@@ -33,16 +31,10 @@ import (
 const ClearRangeBytesThreshold = 512 << 10 // 512KiB
 
 func init() {
-	RegisterReadWriteCommand(roachpb.ClearRange, declareKeysClearRange, ClearRange)
-}
-
-func declareKeysClearRange(
-	desc *roachpb.RangeDescriptor, header roachpb.Header, req roachpb.Request, spans *spanset.SpanSet,
-) {
-	DefaultDeclareKeys(desc, header, req, spans)
 	// We look up the range descriptor key to check whether the span
 	// is equal to the entire range for fast stats updating.
-	spans.AddNonMVCC(spanset.SpanReadOnly, roachpb.Span{Key: keys.RangeDescriptorKey(desc.StartKey)})
+	RegisterReadWriteCommand(roachpb.ClearRange, DefaultDeclareKeysAndDescriptor, ClearRange)
+	SetCommandAdmissionPriority(roachpb.ClearRange, LowAdmissionPriority)
 }
 
 // ClearRange wipes all MVCC versions of keys covered by the specified
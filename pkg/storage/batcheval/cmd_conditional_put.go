@@ -20,6 +20,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.ConditionalPut, DefaultDeclareKeys, ConditionalPut)
+	AddCommandFlags(roachpb.ConditionalPut, FlagIsTxn)
 }
 
 // ConditionalPut sets the value for a specified key only if
@@ -20,6 +20,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.Delete, DefaultDeclareKeys, Delete)
+	AddCommandFlags(roachpb.Delete, FlagIsTxn)
 }
 
 // Delete deletes the key and value specified by key.
@@ -23,6 +23,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.DeleteRange, declareKeysDeleteRange, DeleteRange)
+	AddCommandFlags(roachpb.DeleteRange, FlagIsTxn)
 }
 
 func declareKeysDeleteRange(
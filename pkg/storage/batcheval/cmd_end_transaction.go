@@ -38,6 +38,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.EndTxn, declareKeysEndTxn, EndTxn)
+	AddCommandFlags(roachpb.EndTxn, FlagIsTxn)
 }
 
 // declareKeysWriteTransaction is the shared portion of
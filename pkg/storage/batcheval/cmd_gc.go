@@ -24,6 +24,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.GC, declareKeysGC, GC)
+	SetCommandAdmissionPriority(roachpb.GC, LowAdmissionPriority)
 }
 
 func declareKeysGC(
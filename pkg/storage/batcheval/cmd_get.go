@@ -21,6 +21,9 @@ import (
 
 func init() {
 	RegisterReadOnlyCommand(roachpb.Get, DefaultDeclareKeys, Get)
+	AllowFollowerReads(roachpb.Get, NonWritingTxnReads)
+	MarkCommandIdempotent(roachpb.Get)
+	AddCommandFlags(roachpb.Get, FlagIsTxn)
 }
 
 // Get returns the value for a specified key.
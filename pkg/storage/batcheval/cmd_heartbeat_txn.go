@@ -24,6 +24,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.HeartbeatTxn, declareKeysHeartbeatTransaction, HeartbeatTxn)
+	AddCommandFlags(roachpb.HeartbeatTxn, FlagIsTxn)
 }
 
 func declareKeysHeartbeatTransaction(
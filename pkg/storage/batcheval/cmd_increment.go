@@ -20,6 +20,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.Increment, DefaultDeclareKeys, Increment)
+	AddCommandFlags(roachpb.Increment, FlagIsTxn)
 }
 
 // Increment increments the value (interpreted as varint64 encoded) and
@@ -20,6 +20,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.InitPut, DefaultDeclareKeys, InitPut)
+	AddCommandFlags(roachpb.InitPut, FlagIsTxn)
 }
 
 // InitPut sets the value for a specified key only if it doesn't exist. It
@@ -20,6 +20,8 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.RequestLease, declareKeysRequestLease, RequestLease)
+	// Lease requests are verified against the previous lease below Raft.
+	ExemptCommandFromLease(roachpb.RequestLease)
 }
 
 // RequestLease sets the range lease for this range. The command fails
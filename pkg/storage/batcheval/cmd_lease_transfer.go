@@ -35,6 +35,8 @@ func declareKeysTransferLease(
 
 func init() {
 	RegisterReadWriteCommand(roachpb.TransferLease, declareKeysTransferLease, TransferLease)
+	// Lease transfers are verified against the previous lease below Raft.
+	ExemptCommandFromLease(roachpb.TransferLease)
 }
 
 // TransferLease sets the lease holder for the range.
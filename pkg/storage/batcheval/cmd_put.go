@@ -23,6 +23,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.Put, declareKeysPut, Put)
+	AddCommandFlags(roachpb.Put, FlagIsTxn)
 }
 
 func declareKeysPut(
@@ -26,6 +26,7 @@ import (
 
 func init() {
 	RegisterReadOnlyCommand(roachpb.QueryTxn, declareKeysQueryTransaction, QueryTxn)
+	MarkCommandIdempotent(roachpb.QueryTxn)
 }
 
 func declareKeysQueryTransaction(
@@ -22,6 +22,8 @@ import (
 
 func init() {
 	RegisterReadOnlyCommand(roachpb.Refresh, DefaultDeclareKeys, Refresh)
+	AllowFollowerReads(roachpb.Refresh, NonWritingTxnReads)
+	MarkCommandIdempotent(roachpb.Refresh)
 }
 
 // Refresh checks whether the key has any values written in the interval
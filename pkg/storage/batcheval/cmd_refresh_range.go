@@ -22,6 +22,8 @@ import (
 
 func init() {
 	RegisterReadOnlyCommand(roachpb.RefreshRange, DefaultDeclareKeys, RefreshRange)
+	AllowFollowerReads(roachpb.RefreshRange, NonWritingTxnReads)
+	MarkCommandIdempotent(roachpb.RefreshRange)
 }
 
 // RefreshRange checks whether the key range specified has any values written in
@@ -23,6 +23,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.ResolveIntent, declareKeysResolveIntent, ResolveIntent)
+	MarkCommandIdempotent(roachpb.ResolveIntent)
 }
 
 func declareKeysResolveIntentCombined(
@@ -21,6 +21,7 @@ import (
 
 func init() {
 	RegisterReadWriteCommand(roachpb.ResolveIntentRange, declareKeysResolveIntentRange, ResolveIntentRange)
+	MarkCommandIdempotent(roachpb.ResolveIntentRange)
 }
 
 func declareKeysResolveIntentRange(
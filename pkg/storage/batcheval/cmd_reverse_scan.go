@@ -21,6 +21,9 @@ import (
 
 func init() {
 	RegisterReadOnlyCommand(roachpb.ReverseScan, DefaultDeclareKeys, ReverseScan)
+	AllowFollowerReads(roachpb.ReverseScan, NonWritingTxnReads)
+	MarkCommandIdempotent(roachpb.ReverseScan)
+	AddCommandFlags(roachpb.ReverseScan, FlagIsTxn)
 }
 
 // ReverseScan scans the key range specified by start key through
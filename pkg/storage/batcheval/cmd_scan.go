@@ -21,6 +21,9 @@ import (
 
 func init() {
 	RegisterReadOnlyCommand(roachpb.Scan, DefaultDeclareKeys, Scan)
+	AllowFollowerReads(roachpb.Scan, NonWritingTxnReads)
+	MarkCommandIdempotent(roachpb.Scan)
+	AddCommandFlags(roachpb.Scan, FlagIsTxn)
 }
 
 // Scan scans the key range specified by start key through end key
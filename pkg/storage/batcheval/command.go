@@ -12,12 +12,55 @@ package batcheval
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/storage/spanset"
+	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// CommandFlags describe the properties of a Command. See Command.Flags.
+type CommandFlags int
+
+const (
+	// FlagNeedsLease is set on commands that may only be evaluated on the
+	// leaseholder of the range. It is derived from Command.RequiresLease.
+	FlagNeedsLease CommandFlags = 1 << iota
+	// FlagIsWrite is set on commands that are always evaluated read-write.
+	// It is derived from Command.EvalRW and Command.ReadOnlyFor, so it is not
+	// set on header-dependent commands.
+	FlagIsWrite
+	// FlagIsTxn is set on commands that may be part of a transaction.
+	FlagIsTxn
+)
+
+// AdmissionPriority is the priority at which requests for a command are
+// admitted relative to requests for other commands. See
+// Command.AdmissionPriority.
+type AdmissionPriority int8
+
+const (
+	// LowAdmissionPriority is used by background commands, such as GC and bulk
+	// deletions, which should not delay foreground traffic.
+	LowAdmissionPriority AdmissionPriority = -1
+	// NormalAdmissionPriority is the priority of commands that don't declare
+	// one.
+	NormalAdmissionPriority AdmissionPriority = 0
+	// HighAdmissionPriority is used by commands that other requests wait on.
+	HighAdmissionPriority AdmissionPriority = 1
 )
 
 // A Command is the implementation of a single request within a BatchRequest.
@@ -26,63 +69,956 @@ type Command struct {
 	// TODO(nvanbenschoten): rationalize this RangeDescriptor. Can it change
 	// between key declaration and cmd evaluation?
 	DeclareKeys func(*roachpb.RangeDescriptor, roachpb.Header, roachpb.Request, *spanset.SpanSet)
+	// DeclareKeysVersion is the version of the DeclareKeys logic. It must be
+	// incremented whenever DeclareKeys changes the spans it declares, so that
+	// nodes in a mixed-version cluster can detect that they would declare
+	// different latch spans for the same request. See CheckDeclareKeysVersion.
+	DeclareKeysVersion int
 
 	// Eval{RW,RO} evaluates a read-{write,only} command respectively on the
 	// given engine.{ReadWriter,Reader}. It should populate the supplied
 	// response (always a non-nil pointer to the correct type) and return
 	// special side effects (if any) in the Result. If it writes to the engine
 	// it should also update *CommandArgs.Stats. It should treat the provided
-	// request as immutable.
+	// request as immutable. A read-write command whose evaluation turns out to
+	// be a no-op should leave the engine untouched and return a zero Result,
+	// in which case a batch consisting of such commands is not proposed to
+	// Raft (see needConsensus in Replica.evaluateProposal).
 	//
-	// Only one of these is ever set at a time.
+	// Only one of these is set at a time, unless ReadOnlyFor is set, in which
+	// case both are. This is verified when the command is registered.
 	EvalRW func(context.Context, engine.ReadWriter, CommandArgs, roachpb.Response) (result.Result, error)
 	EvalRO func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error)
+
+	// ReadOnlyFor, if set, determines at dispatch time whether the command is
+	// evaluated read-only, through EvalRO, or read-write, through EvalRW, for a
+	// request with the given header. Both EvalRO and EvalRW are set on such
+	// commands. See RegisterHeaderDependentCommand.
+	ReadOnlyFor func(roachpb.Header) bool
+
+	// MightWriteFor, if set, determines whether evaluating the command for a
+	// request with the given header might write to the engine. It allows a
+	// command that is evaluated read-write to declare that it does not write
+	// under certain headers. See MightWrite and SetCommandMightWrite.
+	MightWriteFor func(roachpb.Header) bool
+
+	// AppliesTo, if set, restricts the ranges that the command may be
+	// evaluated on to those whose descriptor it returns true for. Commands
+	// without a predicate may be evaluated on any range.
+	AppliesTo func(*roachpb.RangeDescriptor) bool
+
+	// MaxResponseBytes, if positive, is the maximum encoded size of the
+	// response that the command may produce. Responses that exceed it are
+	// rejected with a ResponseTooLargeError. Commands that paginate their
+	// results should keep their responses below this size by returning a
+	// resume span. 0 for no limit.
+	MaxResponseBytes int64
+
+	// RequiresLease indicates whether the command may only be evaluated on the
+	// leaseholder of the range. Commands registered through
+	// RegisterReadWriteCommand and RegisterReadOnlyCommand require the lease,
+	// since evaluating without it is only safe for commands that verify the
+	// lease themselves, such as lease requests. See ExemptCommandFromLease.
+	//
+	// RequiresLease is only an assertion and does not affect lease routing:
+	// replicas acquire the lease for every consistent read and every write,
+	// except for the lease requests identified by
+	// roachpb.BatchRequest.IsSingleSkipLeaseCheckRequest. Such lease requests
+	// whose command requires the lease are rejected with a
+	// NotLeaseHolderError.
+	RequiresLease bool
+
+	// FollowerReadEligible, if set, returns whether the request may be served
+	// by a follower replica at the batch's timestamp, provided that timestamp
+	// has been closed. It may only be set on read-only commands. Commands
+	// without a predicate must be served by the leaseholder. See
+	// AllowFollowerReads.
+	FollowerReadEligible func(roachpb.Header, roachpb.Request) bool
+
+	// Compensate, if set, undoes the external side effects of a successful
+	// evaluation of the command that are declared in its Result. It is called
+	// with the arguments and Result of the evaluation if the batch containing
+	// the command fails after the command itself succeeded, in which case the
+	// Result is never applied. It is not called if the command fails.
+	Compensate func(context.Context, CommandArgs, result.Result)
+
+	// IsIdempotent indicates whether evaluating the command more than once
+	// with the same arguments has the same effect as evaluating it once, so
+	// that a retried request may safely be re-evaluated without additional
+	// sequencing. Commands are assumed not to be idempotent unless marked
+	// with MarkCommandIdempotent.
+	IsIdempotent bool
+
+	// ResultBudget, if positive, is the maximum number of keys that a single
+	// evaluation of the command may return, regardless of the remaining key
+	// budget of its batch. The command is passed the smaller of the two in
+	// CommandArgs.MaxKeys and must truncate its results and return a resume
+	// span when it is exceeded. If the remaining budget is exhausted, the
+	// command is not evaluated at all and its entire span is returned as the
+	// resume span. 0 to only apply the batch's budget. See
+	// SetCommandResultBudget.
+	ResultBudget int64
+
+	// Flags are the properties of the command declared with AddCommandFlags.
+	// FlagNeedsLease and FlagIsWrite are derived from the other fields of the
+	// command and should not be set here. See HasFlags.
+	Flags CommandFlags
+
+	// RequiredCapabilities are the capabilities that the evaluation context
+	// must provide for the command to be evaluated. They are verified before
+	// the command is evaluated, which fails with a CapabilityError if any is
+	// missing. See RequireCapabilities.
+	RequiredCapabilities []Capability
+
+	// EnforceDeclaredSpans, if set, narrows the span assertions performed in
+	// race builds to the command itself. Race builds already wrap the batch
+	// of every request in a spanset.NewBatch (writes) or
+	// spanset.NewReadWriterAt (reads) that checks accesses against the spans
+	// declared by all commands in the batch; with this set, the command is
+	// additionally evaluated against a wrapper that panics on any access
+	// outside of the spans declared by its own DeclareKeys. No command opts
+	// in by default. See EnforceCommandSpans.
+	EnforceDeclaredSpans bool
+
+	// AdmissionPriority is the priority at which requests for the command are
+	// admitted, which allows the admission layer to classify requests directly
+	// from the registry. Commands default to NormalAdmissionPriority. See
+	// SetCommandAdmissionPriority.
+	AdmissionPriority AdmissionPriority
+
+	// EvalTimeout, if positive, bounds the duration of a single evaluation of
+	// the command. The command is evaluated with a context carrying the
+	// corresponding deadline, which it should observe while iterating, and its
+	// evaluation fails with a *contextutil.TimeoutError if the deadline is
+	// exceeded, even if the command itself ignored it. In that case anything
+	// the command wrote is discarded along with the rest of its batch. 0 for
+	// no timeout. See SetCommandEvalTimeout.
+	EvalTimeout time.Duration
+}
+
+// A Capability is a condition that the evaluation context of a command must
+// satisfy for the command to be evaluated. See Command.RequiredCapabilities.
+type Capability struct {
+	// Name describes the capability in errors and in ListCommands.
+	Name string
+	// Check returns whether the capability is provided for the evaluation of
+	// a command with the given arguments.
+	Check func(context.Context, CommandArgs) bool
+}
+
+// ClusterVersionCapability returns a Capability that is provided once the
+// cluster version with the given key is active.
+func ClusterVersionCapability(key cluster.VersionKey) Capability {
+	return Capability{
+		Name: fmt.Sprintf("cluster version %s", key),
+		Check: func(ctx context.Context, cArgs CommandArgs) bool {
+			return cluster.Version.IsActive(ctx, cArgs.EvalCtx.ClusterSettings(), key)
+		},
+	}
+}
+
+// SettingCapability returns a Capability that is provided while the given
+// boolean cluster setting, whose name is provided, is enabled.
+func SettingCapability(name string, setting *settings.BoolSetting) Capability {
+	return Capability{
+		Name: fmt.Sprintf("setting %s", name),
+		Check: func(_ context.Context, cArgs CommandArgs) bool {
+			return setting.Get(&cArgs.EvalCtx.ClusterSettings().SV)
+		},
+	}
+}
+
+// CapabilityError is returned when a command is evaluated in a context that
+// does not provide one of its required capabilities.
+type CapabilityError struct {
+	Method     roachpb.Method
+	Capability string
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("command %s requires %s", e.Method, e.Capability)
+}
+
+// CheckCapabilities returns a CapabilityError if the evaluation context of the
+// provided arguments does not provide one of the command's required
+// capabilities.
+func (c Command) CheckCapabilities(ctx context.Context, cArgs CommandArgs) error {
+	for _, capability := range c.RequiredCapabilities {
+		if !capability.Check(ctx, cArgs) {
+			return &CapabilityError{Method: cArgs.Args.Method(), Capability: capability.Name}
+		}
+	}
+	return nil
+}
+
+// HasFlags returns whether all of the provided flags are set on the command,
+// either because they were declared in Flags or because they are derived from
+// the command's other fields.
+func (c Command) HasFlags(flags CommandFlags) bool {
+	f := c.Flags
+	if c.RequiresLease {
+		f |= FlagNeedsLease
+	}
+	if c.EvalRW != nil && c.ReadOnlyFor == nil {
+		f |= FlagIsWrite
+	}
+	return f&flags == flags
+}
+
+// IsReadOnly returns whether the command is evaluated read-only for a request
+// with the provided header.
+func (c Command) IsReadOnly(h roachpb.Header) bool {
+	if c.ReadOnlyFor != nil {
+		return c.ReadOnlyFor(h)
+	}
+	return c.EvalRO != nil
+}
+
+// MightWrite returns whether evaluating the command for a request with the
+// provided header might write to the engine. Unless the command declares
+// otherwise through MightWriteFor, this is the case whenever the command is
+// evaluated read-write.
+func (c Command) MightWrite(h roachpb.Header) bool {
+	if c.MightWriteFor != nil {
+		return c.MightWriteFor(h)
+	}
+	return !c.IsReadOnly(h)
+}
+
+// Eval evaluates the command on the given engine.ReadWriter through EvalRO or
+// EvalRW, depending on whether the command is read-only for the request's
+// header. See IsReadOnly. The command's required capabilities are verified
+// first. The evaluation is bounded by the command's EvalTimeout, if any, is
+// wrapped in the registered EvalInterceptors, if any, and its latency is
+// recorded in the EvalMetrics installed with SetEvalMetrics, if any.
+func (c Command) Eval(
+	ctx context.Context, rw engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
+) (result.Result, error) {
+	if err := c.CheckCapabilities(ctx, cArgs); err != nil {
+		return result.Result{}, err
+	}
+	if c.ResultBudget > 0 {
+		if cArgs.MaxKeys > c.ResultBudget {
+			cArgs.MaxKeys = c.ResultBudget
+		}
+		if cArgs.MaxKeys <= 0 {
+			resumeExhaustedBudget(cArgs.Args, resp)
+			return result.Result{}, nil
+		}
+	}
+	if c.EvalTimeout <= 0 {
+		return c.eval(ctx, rw, cArgs, resp)
+	}
+	var res result.Result
+	op := fmt.Sprintf("evaluating %s", cArgs.Args.Method())
+	if err := contextutil.RunWithTimeout(ctx, op, c.EvalTimeout, func(ctx context.Context) error {
+		var err error
+		res, err = c.eval(ctx, rw, cArgs, resp)
+		if err == nil && ctx.Err() == context.DeadlineExceeded {
+			// The command completed, but too late.
+			err = ctx.Err()
+		}
+		return err
+	}); err != nil {
+		return result.Result{}, err
+	}
+	return res, nil
+}
+
+// eval evaluates the command, wrapped in the registered EvalInterceptors. See
+// Eval.
+func (c Command) eval(
+	ctx context.Context, rw engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
+) (result.Result, error) {
+	eval := func() (result.Result, error) {
+		if m := loadEvalMetrics(); m != nil {
+			defer func(start time.Time) {
+				m.Record(cArgs.Args.Method(), timeutil.Since(start))
+			}(timeutil.Now())
+		}
+		if c.IsReadOnly(cArgs.Header) {
+			return c.EvalRO(ctx, rw, cArgs, resp)
+		}
+		return c.EvalRW(ctx, rw, cArgs, resp)
+	}
+	interceptors := evalInterceptors.load()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], eval
+		eval = func() (result.Result, error) {
+			return interceptor(ctx, cArgs.Args.Method(), cArgs, next)
+		}
+	}
+	return eval()
+}
+
+// resumeExhaustedBudget populates the response of a request that was not
+// evaluated because its batch's result budget was exhausted with a resume span
+// covering the request's entire span.
+func resumeExhaustedBudget(req roachpb.Request, resp roachpb.Response) {
+	span := req.Header().Span()
+	h := resp.Header()
+	h.NumKeys = 0
+	h.ResumeSpan = &span
+	h.ResumeReason = roachpb.RESUME_KEY_LIMIT
+	resp.SetHeader(h)
+}
+
+// An EvalInterceptor is invoked around the evaluation of every command. It
+// must call eval exactly once to evaluate the command (or the next
+// interceptor) and should return its Result and error, which it may inspect
+// or replace.
+type EvalInterceptor func(
+	ctx context.Context,
+	method roachpb.Method,
+	cArgs CommandArgs,
+	eval func() (result.Result, error),
+) (result.Result, error)
+
+// evalInterceptorList holds the registered EvalInterceptors. Like the
+// commandRegistry, it is copy-on-write, so that evaluation reads it without
+// synchronization.
+type evalInterceptorList struct {
+	mu  syncutil.Mutex
+	fns atomic.Value // []EvalInterceptor
+}
+
+var evalInterceptors evalInterceptorList
+
+// load returns the registered interceptors. The returned slice must not be
+// modified.
+func (l *evalInterceptorList) load() []EvalInterceptor {
+	fns, _ := l.fns.Load().([]EvalInterceptor)
+	return fns
 }
 
-var cmds = make(map[roachpb.Method]Command)
+// RegisterEvalInterceptor installs an EvalInterceptor around the evaluation of
+// every command. Interceptors compose in registration order, with the first
+// registered interceptor outermost. It may be called while commands are being
+// evaluated, which observe the interceptors either with or without it.
+func RegisterEvalInterceptor(fn EvalInterceptor) {
+	evalInterceptors.mu.Lock()
+	defer evalInterceptors.mu.Unlock()
+	prev := evalInterceptors.load()
+	next := make([]EvalInterceptor, len(prev), len(prev)+1)
+	copy(next, prev)
+	evalInterceptors.fns.Store(append(next, fn))
+}
+
+// ClearEvalInterceptors is provided for testing and removes all registered
+// EvalInterceptors.
+func ClearEvalInterceptors() {
+	evalInterceptors.mu.Lock()
+	defer evalInterceptors.mu.Unlock()
+	evalInterceptors.fns.Store([]EvalInterceptor(nil))
+}
+
+// AppliesToRange returns whether the command may be evaluated on the range
+// with the provided descriptor.
+func (c Command) AppliesToRange(desc *roachpb.RangeDescriptor) bool {
+	return c.AppliesTo == nil || c.AppliesTo(desc)
+}
+
+// SystemRangesOnly is a Command.AppliesTo predicate that restricts a command
+// to ranges which lie entirely below the user table data keyspace.
+func SystemRangesOnly(desc *roachpb.RangeDescriptor) bool {
+	return desc.EndKey.AsRawKey().Compare(keys.UserTableDataMin) <= 0
+}
+
+// UserRangesOnly is a Command.AppliesTo predicate that restricts a command to
+// ranges which lie entirely within the user table data keyspace.
+func UserRangesOnly(desc *roachpb.RangeDescriptor) bool {
+	return desc.StartKey.AsRawKey().Compare(keys.UserTableDataMin) >= 0
+}
+
+// InapplicableCommandError is returned when a command is evaluated on a range
+// that its Command.AppliesTo predicate rejects.
+type InapplicableCommandError struct {
+	Method  roachpb.Method
+	RangeID roachpb.RangeID
+	Span    roachpb.RSpan
+}
+
+// NewInapplicableCommandError creates an InapplicableCommandError for the
+// given method and range descriptor.
+func NewInapplicableCommandError(
+	method roachpb.Method, desc *roachpb.RangeDescriptor,
+) *InapplicableCommandError {
+	return &InapplicableCommandError{
+		Method:  method,
+		RangeID: desc.RangeID,
+		Span:    desc.RSpan(),
+	}
+}
+
+func (e *InapplicableCommandError) Error() string {
+	return fmt.Sprintf("command %s cannot be evaluated on r%d %s", e.Method, e.RangeID, e.Span)
+}
+
+// DeclareKeysVersionError is returned when a command is to be evaluated with a
+// version of its DeclareKeys logic other than the one that the node implements.
+type DeclareKeysVersionError struct {
+	Method      roachpb.Method
+	Version     int
+	Implemented int
+}
+
+func (e *DeclareKeysVersionError) Error() string {
+	return fmt.Sprintf("command %s declares keys with version %d, not the requested version %d",
+		e.Method, e.Implemented, e.Version)
+}
+
+// CheckDeclareKeysVersion returns a DeclareKeysVersionError if the command
+// does not implement the provided version of its DeclareKeys logic.
+func (c Command) CheckDeclareKeysVersion(method roachpb.Method, version int) error {
+	if version != c.DeclareKeysVersion {
+		return &DeclareKeysVersionError{
+			Method: method, Version: version, Implemented: c.DeclareKeysVersion,
+		}
+	}
+	return nil
+}
+
+// CheckResponseSize returns a ResponseTooLargeError if the provided response
+// exceeds the command's MaxResponseBytes.
+func (c Command) CheckResponseSize(method roachpb.Method, resp roachpb.Response) error {
+	if c.MaxResponseBytes <= 0 {
+		return nil
+	}
+	if size := int64(resp.Size()); size > c.MaxResponseBytes {
+		return &ResponseTooLargeError{Method: method, Size: size, MaxSize: c.MaxResponseBytes}
+	}
+	return nil
+}
+
+// ResponseTooLargeError is returned when the response produced by a command
+// exceeds the command's MaxResponseBytes.
+type ResponseTooLargeError struct {
+	Method  roachpb.Method
+	Size    int64
+	MaxSize int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("%s response of %d bytes exceeds maximum of %d bytes",
+		e.Method, e.Size, e.MaxSize)
+}
+
+// commandRegistry holds the registered commands. Lookups load an immutable
+// map, which requires neither locking nor allocation, while updates copy the
+// map, modify the copy and publish it. Updates are serialized by a mutex and
+// are relatively expensive, but commands are rarely modified after they are
+// registered.
+type commandRegistry struct {
+	mu   syncutil.Mutex
+	cmds atomic.Value // map[roachpb.Method]Command
+}
+
+var registry = newCommandRegistry()
+
+func newCommandRegistry() *commandRegistry {
+	r := &commandRegistry{}
+	r.cmds.Store(map[roachpb.Method]Command{})
+	return r
+}
+
+// load returns the registered commands. The returned map must not be
+// modified.
+func (r *commandRegistry) load() map[roachpb.Method]Command {
+	return r.cmds.Load().(map[roachpb.Method]Command)
+}
+
+// update publishes a copy of the registered commands modified by fn.
+func (r *commandRegistry) update(fn func(map[roachpb.Method]Command)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.load()
+	next := make(map[roachpb.Method]Command, len(prev)+1)
+	for method, cmd := range prev {
+		next[method] = cmd
+	}
+	fn(next)
+	r.cmds.Store(next)
+}
+
+// updateCommand modifies the previously registered command for the given
+// method with fn. It fatals with the provided format, which receives the
+// method, if the method is not registered.
+func updateCommand(method roachpb.Method, format string, fn func(*Command)) {
+	registry.update(func(cmds map[roachpb.Method]Command) {
+		cmd, ok := cmds[method]
+		if !ok {
+			log.Fatalf(context.TODO(), format, method)
+		}
+		fn(&cmd)
+		cmds[method] = cmd
+	})
+}
 
 // RegisterReadWriteCommand makes a read-write command available for execution.
-// It must only be called before any evaluation takes place.
+// It may be called concurrently with evaluation.
 func RegisterReadWriteCommand(
 	method roachpb.Method,
 	declare func(*roachpb.RangeDescriptor, roachpb.Header, roachpb.Request, *spanset.SpanSet),
 	impl func(context.Context, engine.ReadWriter, CommandArgs, roachpb.Response) (result.Result, error),
 ) {
 	register(method, Command{
-		DeclareKeys: declare,
-		EvalRW:      impl,
+		DeclareKeys:   declare,
+		EvalRW:        impl,
+		RequiresLease: true,
 	})
 }
 
 // RegisterReadOnlyCommand makes a read-only command available for execution. It
-// must only be called before any evaluation takes place.
+// may be called concurrently with evaluation.
 func RegisterReadOnlyCommand(
 	method roachpb.Method,
 	declare func(*roachpb.RangeDescriptor, roachpb.Header, roachpb.Request, *spanset.SpanSet),
 	impl func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error),
 ) {
 	register(method, Command{
-		DeclareKeys: declare,
-		EvalRO:      impl,
+		DeclareKeys:   declare,
+		EvalRO:        impl,
+		RequiresLease: true,
+	})
+}
+
+// RegisterHeaderDependentCommand makes a command available for execution that
+// is evaluated read-only or read-write depending on the header of the request,
+// as determined by the readOnly predicate. It may be called concurrently with
+// evaluation.
+func RegisterHeaderDependentCommand(
+	method roachpb.Method,
+	declare func(*roachpb.RangeDescriptor, roachpb.Header, roachpb.Request, *spanset.SpanSet),
+	readOnly func(roachpb.Header) bool,
+	implRO func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error),
+	implRW func(context.Context, engine.ReadWriter, CommandArgs, roachpb.Response) (result.Result, error),
+) {
+	register(method, Command{
+		DeclareKeys:   declare,
+		EvalRW:        implRW,
+		EvalRO:        implRO,
+		ReadOnlyFor:   readOnly,
+		RequiresLease: true,
 	})
 }
 
+// RegisterCommand makes the provided command available for execution. Unlike
+// the other registration functions, the command is registered as provided, so
+// it only requires the lease if RequiresLease is set. It fatals if the command
+// does not set exactly one of EvalRW and EvalRO (both if ReadOnlyFor is set) or
+// if the method is already registered. It may be called concurrently with
+// evaluation.
+func RegisterCommand(method roachpb.Method, cmd Command) {
+	register(method, cmd)
+}
+
 func register(method roachpb.Method, command Command) {
-	if _, ok := cmds[method]; ok {
-		log.Fatalf(context.TODO(), "cannot overwrite previously registered method %v", method)
+	if err := checkedRegister(method, command); err != nil {
+		log.Fatal(context.TODO(), err)
+	}
+}
+
+// checkedRegister is like register, but returns an error instead of fataling
+// if the command is malformed or the method is already registered.
+func checkedRegister(method roachpb.Method, command Command) error {
+	if command.ReadOnlyFor != nil {
+		if command.EvalRW == nil || command.EvalRO == nil {
+			return errors.Errorf("header-dependent command %v must set both EvalRW and EvalRO", method)
+		}
+	} else if (command.EvalRW == nil) == (command.EvalRO == nil) {
+		return errors.Errorf("command %v must set exactly one of EvalRW and EvalRO", method)
+	}
+	var err error
+	registry.update(func(cmds map[roachpb.Method]Command) {
+		if _, ok := cmds[method]; ok {
+			err = errors.Errorf("cannot overwrite previously registered method %v", method)
+			return
+		}
+		cmds[method] = command
+	})
+	return err
+}
+
+// RestrictCommandToRanges restricts the previously registered command for the
+// given method to the ranges for which the provided predicate returns true. See
+// Command.AppliesTo. It must only be called before any evaluation takes place.
+func RestrictCommandToRanges(
+	method roachpb.Method, appliesTo func(*roachpb.RangeDescriptor) bool,
+) {
+	updateCommand(method, "cannot restrict unregistered method %v", func(cmd *Command) {
+		cmd.AppliesTo = appliesTo
+	})
+}
+
+// LimitCommandResponseSize sets the maximum response size of the previously
+// registered command for the given method. See Command.MaxResponseBytes. It
+// must only be called before any evaluation takes place.
+func LimitCommandResponseSize(method roachpb.Method, maxBytes int64) {
+	updateCommand(method, "cannot limit unregistered method %v", func(cmd *Command) {
+		cmd.MaxResponseBytes = maxBytes
+	})
+}
+
+// ExemptCommandFromLease allows the previously registered command for the
+// given method to be evaluated on replicas that do not hold the range lease.
+// See Command.RequiresLease. It must only be called before any evaluation
+// takes place.
+func ExemptCommandFromLease(method roachpb.Method) {
+	updateCommand(method, "cannot exempt unregistered method %v", func(cmd *Command) {
+		cmd.RequiresLease = false
+	})
+}
+
+// AllowFollowerReads sets the follower read eligibility predicate of the
+// previously registered read-only command for the given method. See
+// Command.FollowerReadEligible. It must only be called before any evaluation
+// takes place.
+func AllowFollowerReads(
+	method roachpb.Method, eligible func(roachpb.Header, roachpb.Request) bool,
+) {
+	updateCommand(method, "cannot allow follower reads of unregistered method %v", func(cmd *Command) {
+		if cmd.EvalRO == nil {
+			log.Fatalf(context.TODO(), "cannot allow follower reads of read-write method %v", method)
+		}
+		cmd.FollowerReadEligible = eligible
+	})
+}
+
+// NonWritingTxnReads is a Command.FollowerReadEligible predicate that allows
+// requests to be served by followers unless they belong to a transaction that
+// has performed writes, whose intents a follower may not be able to observe.
+func NonWritingTxnReads(h roachpb.Header, _ roachpb.Request) bool {
+	return h.Txn == nil || !h.Txn.IsWriting()
+}
+
+// CanServeFollowerRead returns whether the request with the provided header
+// may be served by a follower replica. Requests for which the command might
+// write never may. See MightWrite.
+func (c Command) CanServeFollowerRead(h roachpb.Header, req roachpb.Request) bool {
+	return c.FollowerReadEligible != nil && !c.MightWrite(h) && c.FollowerReadEligible(h, req)
+}
+
+// SetCommandMightWrite declares, for the previously registered command for the
+// given method, whether its evaluation for a request with a given header might
+// write to the engine. See Command.MightWriteFor. It must only be called
+// before any evaluation takes place.
+func SetCommandMightWrite(method roachpb.Method, mightWrite func(roachpb.Header) bool) {
+	updateCommand(method, "cannot declare writes of unregistered method %v", func(cmd *Command) {
+		cmd.MightWriteFor = mightWrite
+	})
+}
+
+// SetDeclareKeysVersion sets the version of the DeclareKeys logic of the
+// previously registered command for the given method. See
+// Command.DeclareKeysVersion. It must only be called before any evaluation
+// takes place.
+func SetDeclareKeysVersion(method roachpb.Method, version int) {
+	updateCommand(method, "cannot set declare keys version of unregistered method %v", func(cmd *Command) {
+		cmd.DeclareKeysVersion = version
+	})
+}
+
+// SetCommandCompensation sets the compensation function of the previously
+// registered command for the given method. See Command.Compensate. It must only
+// be called before any evaluation takes place.
+func SetCommandCompensation(
+	method roachpb.Method, compensate func(context.Context, CommandArgs, result.Result),
+) {
+	updateCommand(method, "cannot set compensation of unregistered method %v", func(cmd *Command) {
+		cmd.Compensate = compensate
+	})
+}
+
+// MarkCommandIdempotent marks the previously registered command for the given
+// method as idempotent. See Command.IsIdempotent. It must only be called before
+// any evaluation takes place.
+func MarkCommandIdempotent(method roachpb.Method) {
+	updateCommand(method, "cannot mark unregistered method %v as idempotent", func(cmd *Command) {
+		cmd.IsIdempotent = true
+	})
+}
+
+// EnforceCommandSpans enables span enforcement for the previously registered
+// command for the given method. See Command.EnforceDeclaredSpans. It must only
+// be called before any evaluation takes place.
+func EnforceCommandSpans(method roachpb.Method) {
+	updateCommand(method, "cannot enforce spans of unregistered method %v", func(cmd *Command) {
+		cmd.EnforceDeclaredSpans = true
+	})
+}
+
+// SetCommandResultBudget sets the maximum number of keys that a single
+// evaluation of the previously registered command for the given method may
+// return. See Command.ResultBudget. It must only be called before any
+// evaluation takes place.
+func SetCommandResultBudget(method roachpb.Method, maxKeys int64) {
+	updateCommand(method, "cannot set result budget of unregistered method %v", func(cmd *Command) {
+		cmd.ResultBudget = maxKeys
+	})
+}
+
+// AddCommandFlags sets the provided flags on the previously registered command
+// for the given method. See Command.Flags. It must only be called before any
+// evaluation takes place.
+func AddCommandFlags(method roachpb.Method, flags CommandFlags) {
+	updateCommand(method, "cannot add flags to unregistered method %v", func(cmd *Command) {
+		cmd.Flags |= flags
+	})
+}
+
+// MethodHasFlags returns whether all of the provided flags are set on the
+// command registered for the given method. It returns false if no command is
+// registered for the method.
+func MethodHasFlags(method roachpb.Method, flags CommandFlags) bool {
+	cmd, ok := LookupCommand(method)
+	return ok && cmd.HasFlags(flags)
+}
+
+// RequireCapabilities adds the provided capabilities to those required by the
+// previously registered command for the given method. See
+// Command.RequiredCapabilities. It must only be called before any evaluation
+// takes place.
+func RequireCapabilities(method roachpb.Method, capabilities ...Capability) {
+	updateCommand(method, "cannot require capabilities of unregistered method %v", func(cmd *Command) {
+		cmd.RequiredCapabilities = append(
+			cmd.RequiredCapabilities[:len(cmd.RequiredCapabilities):len(cmd.RequiredCapabilities)],
+			capabilities...)
+	})
+}
+
+// SetCommandAdmissionPriority sets the admission priority of the previously
+// registered command for the given method. See Command.AdmissionPriority. It
+// must only be called before any evaluation takes place.
+func SetCommandAdmissionPriority(method roachpb.Method, priority AdmissionPriority) {
+	updateCommand(method, "cannot set admission priority of unregistered method %v", func(cmd *Command) {
+		cmd.AdmissionPriority = priority
+	})
+}
+
+// MethodAdmissionPriority returns the admission priority of the command
+// registered for the given method. It returns NormalAdmissionPriority if no
+// command is registered for the method.
+func MethodAdmissionPriority(method roachpb.Method) AdmissionPriority {
+	if cmd, ok := LookupCommand(method); ok {
+		return cmd.AdmissionPriority
+	}
+	return NormalAdmissionPriority
+}
+
+// SetCommandEvalTimeout sets the maximum duration of a single evaluation of the
+// previously registered command for the given method. See Command.EvalTimeout.
+// It must only be called before any evaluation takes place.
+func SetCommandEvalTimeout(method roachpb.Method, timeout time.Duration) {
+	updateCommand(method, "cannot set eval timeout of unregistered method %v", func(cmd *Command) {
+		cmd.EvalTimeout = timeout
+	})
+}
+
+// BatchIsIdempotent returns whether every request in the batch is idempotent,
+// in which case the batch may safely be re-evaluated if it is retried. Requests
+// without a registered command are assumed not to be idempotent.
+func BatchIsIdempotent(ba *roachpb.BatchRequest) bool {
+	for _, union := range ba.Requests {
+		if cmd, ok := LookupCommand(union.GetInner().Method()); !ok || !cmd.IsIdempotent {
+			return false
+		}
+	}
+	return true
+}
+
+// Compensations collects the compensation functions of the commands in a batch
+// that evaluated successfully, so that their side effects can be undone if the
+// batch fails. The zero value is ready to use.
+type Compensations struct {
+	pending []pendingCompensation
+}
+
+type pendingCompensation struct {
+	fn    func(context.Context, CommandArgs, result.Result)
+	cArgs CommandArgs
+	res   result.Result
+}
+
+// Add records the successful evaluation of the command with the provided
+// arguments and Result. It is a no-op if the command has no compensation
+// function.
+func (c *Compensations) Add(cmd Command, cArgs CommandArgs, res result.Result) {
+	if cmd.Compensate == nil {
+		return
+	}
+	c.pending = append(c.pending, pendingCompensation{fn: cmd.Compensate, cArgs: cArgs, res: res})
+}
+
+// Run invokes the recorded compensation functions in the reverse order of the
+// evaluation of their commands. It must be called at most once, when the batch
+// has failed.
+func (c *Compensations) Run(ctx context.Context) {
+	for i := len(c.pending) - 1; i >= 0; i-- {
+		p := c.pending[i]
+		p.fn(ctx, p.cArgs, p.res)
+	}
+	c.pending = nil
+}
+
+// BatchRequiresLease returns whether any request in the batch must be
+// evaluated on the leaseholder. Requests without a registered command are
+// assumed to require the lease. It is used to assert that batches evaluated
+// without the lease are exempt from it, not to decide whether to acquire the
+// lease. See Command.RequiresLease.
+func BatchRequiresLease(ba *roachpb.BatchRequest) bool {
+	for _, union := range ba.Requests {
+		if cmd, ok := LookupCommand(union.GetInner().Method()); !ok || cmd.RequiresLease {
+			return true
+		}
+	}
+	return false
+}
+
+// BatchCanServeFollowerRead returns whether every request in the batch may be
+// served by a follower replica. Requests without a registered command must be
+// served by the leaseholder.
+func BatchCanServeFollowerRead(ba *roachpb.BatchRequest) bool {
+	for _, union := range ba.Requests {
+		req := union.GetInner()
+		if cmd, ok := LookupCommand(req.Method()); !ok || !cmd.CanServeFollowerRead(ba.Header, req) {
+			return false
+		}
 	}
-	cmds[method] = command
+	return true
 }
 
 // UnregisterCommand is provided for testing and allows removing a command.
 // It is a no-op if the command is not registered.
 func UnregisterCommand(method roachpb.Method) {
-	delete(cmds, method)
+	registry.update(func(cmds map[roachpb.Method]Command) {
+		delete(cmds, method)
+	})
+}
+
+// OverrideCommand is provided for testing and atomically replaces the command
+// registered for the given method, which must exist, with the provided one. It
+// returns the replaced command, which can be restored by overriding it again.
+// Unlike unregistering and re-registering the method, it may be called while
+// commands are being evaluated, which observe either command but never find
+// the method unregistered.
+func OverrideCommand(method roachpb.Method, cmd Command) Command {
+	var prev Command
+	updateCommand(method, "cannot override unregistered method %v", func(c *Command) {
+		prev, *c = *c, cmd
+	})
+	return prev
+}
+
+// A RegistrySnapshot captures the full set of registered commands. See
+// SnapshotRegistry.
+type RegistrySnapshot struct {
+	cmds map[roachpb.Method]Command
+}
+
+// SnapshotRegistry is provided for testing and captures the commands that are
+// currently registered, so that they can later be restored with
+// RestoreRegistry regardless of how the registry was modified in between.
+func SnapshotRegistry() RegistrySnapshot {
+	return RegistrySnapshot{cmds: registry.load()}
+}
+
+// RestoreRegistry is provided for testing and atomically replaces all
+// registered commands with those captured by the provided snapshot. Like
+// OverrideCommand, it may be called while commands are being evaluated.
+func RestoreRegistry(snap RegistrySnapshot) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.cmds.Store(snap.cmds)
 }
 
 // LookupCommand returns the command for the given method, with the boolean
 // indicating success or failure.
 func LookupCommand(method roachpb.Method) (Command, bool) {
-	cmd, ok := cmds[method]
+	cmd, ok := registry.load()[method]
 	return cmd, ok
 }
+
+// UnsupportedMethodError is returned when a method without a registered
+// command is evaluated.
+type UnsupportedMethodError struct {
+	Method roachpb.Method
+}
+
+func (e *UnsupportedMethodError) Error() string {
+	return fmt.Sprintf("no command registered for method %s", e.Method)
+}
+
+// EvaluateCommand looks up the command registered for the provided method and
+// evaluates it on the given engine.ReadWriter. See Command.Eval. It returns an
+// UnsupportedMethodError if no command is registered for the method.
+func EvaluateCommand(
+	ctx context.Context,
+	method roachpb.Method,
+	rw engine.ReadWriter,
+	cArgs CommandArgs,
+	resp roachpb.Response,
+) (result.Result, error) {
+	cmd, ok := LookupCommand(method)
+	if !ok {
+		return result.Result{}, &UnsupportedMethodError{Method: method}
+	}
+	return cmd.Eval(ctx, rw, cArgs, resp)
+}
+
+// EvaluateCommandDryRun is like EvaluateCommand, but it evaluates the command
+// against a batch on top of the provided engine that is discarded afterwards,
+// so that the engine is never mutated. It returns the Result of the evaluation
+// and the delta to the MVCC stats that it would have applied; the Result's
+// side effects are not applied either. cArgs.Stats is ignored.
+func EvaluateCommandDryRun(
+	ctx context.Context,
+	method roachpb.Method,
+	eng engine.Engine,
+	cArgs CommandArgs,
+	resp roachpb.Response,
+) (result.Result, enginepb.MVCCStats, error) {
+	batch := eng.NewBatch()
+	defer batch.Close()
+
+	var ms enginepb.MVCCStats
+	cArgs.Stats = &ms
+	res, err := EvaluateCommand(ctx, method, batch, cArgs, resp)
+	return res, ms, err
+}
+
+// CommandInfo describes a registered command. See ListCommands.
+type CommandInfo struct {
+	Method roachpb.Method
+	// ReadOnly is true if the command has an EvalRO implementation and false
+	// if it has an EvalRW implementation. Commands whose read/write nature
+	// depends on the request header have both and are reported as read-write.
+	ReadOnly bool
+	// HeaderDependent is true if the command is evaluated read-only or
+	// read-write depending on the request header. See Command.ReadOnlyFor.
+	HeaderDependent bool
+	// RequiredCapabilities are the names of the capabilities required by the
+	// command. See Command.RequiredCapabilities.
+	RequiredCapabilities []string
+}
+
+// ListCommands returns a description of every registered command, ordered by
+// method.
+func ListCommands() []CommandInfo {
+	cmds := registry.load()
+	infos := make([]CommandInfo, 0, len(cmds))
+	for method, cmd := range cmds {
+		info := CommandInfo{
+			Method:          method,
+			ReadOnly:        cmd.ReadOnlyFor == nil && cmd.EvalRO != nil,
+			HeaderDependent: cmd.ReadOnlyFor != nil,
+		}
+		for _, capability := range cmd.RequiredCapabilities {
+			info.RequiredCapabilities = append(info.RequiredCapabilities, capability.Name)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Method < infos[j].Method
+	})
+	return infos
+}
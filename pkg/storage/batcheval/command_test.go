@@ -0,0 +1,1090 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandAppliesToRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	systemDesc := &roachpb.RangeDescriptor{
+		RangeID: 1, StartKey: roachpb.RKeyMin, EndKey: roachpb.RKey(keys.UserTableDataMin),
+	}
+	userDesc := &roachpb.RangeDescriptor{
+		RangeID: 2, StartKey: roachpb.RKey(keys.UserTableDataMin), EndKey: roachpb.RKeyMax,
+	}
+	spanningDesc := &roachpb.RangeDescriptor{
+		RangeID: 3, StartKey: roachpb.RKeyMin, EndKey: roachpb.RKeyMax,
+	}
+
+	testCases := []struct {
+		name      string
+		appliesTo func(*roachpb.RangeDescriptor) bool
+		system    bool
+		user      bool
+		spanning  bool
+	}{
+		{"none", nil, true, true, true},
+		{"system", SystemRangesOnly, true, false, false},
+		{"user", UserRangesOnly, false, true, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := Command{AppliesTo: tc.appliesTo}
+			require.Equal(t, tc.system, cmd.AppliesToRange(systemDesc))
+			require.Equal(t, tc.user, cmd.AppliesToRange(userDesc))
+			require.Equal(t, tc.spanning, cmd.AppliesToRange(spanningDesc))
+		})
+	}
+
+	// Restrict a registered command and make sure the restriction is visible
+	// through LookupCommand.
+	const method = roachpb.Get
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	RestrictCommandToRanges(method, UserRangesOnly)
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.True(t, cmd.AppliesToRange(userDesc))
+	require.False(t, cmd.AppliesToRange(systemDesc))
+
+	err := NewInapplicableCommandError(method, systemDesc)
+	require.Equal(t, roachpb.RangeID(1), err.RangeID)
+	require.Contains(t, err.Error(), "command Get cannot be evaluated on r1")
+}
+
+func TestCommandMaxResponseBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+	ts := hlc.Timestamp{WallTime: 1}
+	for i := 0; i < 100; i++ {
+		key := roachpb.Key(fmt.Sprintf("key-%03d", i))
+		require.NoError(t, engine.MVCCPut(
+			ctx, eng, nil, key, ts, roachpb.MakeValueFromString("value"), nil,
+		))
+	}
+
+	const method = roachpb.Scan
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	LimitCommandResponseSize(method, 256)
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.Equal(t, int64(256), cmd.MaxResponseBytes)
+
+	scan := func(endKey roachpb.Key) *roachpb.ScanResponse {
+		var resp roachpb.ScanResponse
+		_, err := cmd.EvalRO(ctx, eng, CommandArgs{
+			Header: roachpb.Header{Timestamp: ts},
+			Args: &roachpb.ScanRequest{
+				RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("key"), EndKey: endKey},
+			},
+			MaxKeys: math.MaxInt64,
+		}, &resp)
+		require.NoError(t, err)
+		return &resp
+	}
+
+	// A small scan fits in the budget.
+	require.NoError(t, cmd.CheckResponseSize(method, scan(roachpb.Key("key-001"))))
+
+	// A large scan exceeds it.
+	resp := scan(roachpb.Key("key-999"))
+	require.Len(t, resp.Rows, 100)
+	err := cmd.CheckResponseSize(method, resp)
+	require.Error(t, err)
+	tooLarge, ok := err.(*ResponseTooLargeError)
+	require.True(t, ok)
+	require.Equal(t, method, tooLarge.Method)
+	require.Equal(t, int64(resp.Size()), tooLarge.Size)
+	require.Equal(t, int64(256), tooLarge.MaxSize)
+
+	// Commands without a limit are unbounded.
+	require.NoError(t, prev.CheckResponseSize(method, resp))
+}
+
+func TestCommandRequiresLease(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		method roachpb.Method
+		exp    bool
+	}{
+		{roachpb.Get, true},
+		{roachpb.Put, true},
+		{roachpb.RequestLease, false},
+		{roachpb.TransferLease, false},
+	} {
+		cmd, ok := LookupCommand(tc.method)
+		require.True(t, ok)
+		require.Equal(t, tc.exp, cmd.RequiresLease, "%s", tc.method)
+	}
+
+	var ba roachpb.BatchRequest
+	ba.Add(&roachpb.RequestLeaseRequest{})
+	require.False(t, BatchRequiresLease(&ba))
+	ba.Add(&roachpb.GetRequest{})
+	require.True(t, BatchRequiresLease(&ba))
+
+	// Exempt a registered command.
+	const method = roachpb.Get
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	ExemptCommandFromLease(method)
+	require.False(t, BatchRequiresLease(&ba))
+}
+
+func TestCommandFollowerReadEligible(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		method roachpb.Method
+		exp    bool
+	}{
+		{roachpb.Get, true},
+		{roachpb.Scan, true},
+		{roachpb.ReverseScan, true},
+		{roachpb.Put, false},
+		{roachpb.QueryTxn, false},
+	} {
+		cmd, ok := LookupCommand(tc.method)
+		require.True(t, ok)
+		require.Equal(t, tc.exp, cmd.FollowerReadEligible != nil, "%s", tc.method)
+	}
+
+	// Reads from transactions that have performed writes are not eligible.
+	var ba roachpb.BatchRequest
+	ba.Add(&roachpb.GetRequest{}, &roachpb.ScanRequest{})
+	require.True(t, BatchCanServeFollowerRead(&ba))
+	ba.Txn = &roachpb.Transaction{}
+	require.True(t, BatchCanServeFollowerRead(&ba))
+	ba.Txn.Key = roachpb.Key("a")
+	require.False(t, BatchCanServeFollowerRead(&ba))
+	ba.Txn = nil
+
+	// A single ineligible request makes the batch ineligible.
+	ba.Add(&roachpb.QueryTxnRequest{})
+	require.False(t, BatchCanServeFollowerRead(&ba))
+
+	// Allow follower reads of a registered command.
+	const method = roachpb.QueryTxn
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	AllowFollowerReads(method, func(_ roachpb.Header, req roachpb.Request) bool {
+		return req.(*roachpb.QueryTxnRequest).WaitForUpdate
+	})
+	require.False(t, BatchCanServeFollowerRead(&ba))
+	ba.Requests[2].GetQueryTxn().WaitForUpdate = true
+	require.True(t, BatchCanServeFollowerRead(&ba))
+}
+
+func TestCommandIsIdempotent(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		method roachpb.Method
+		exp    bool
+	}{
+		{roachpb.Get, true},
+		{roachpb.Scan, true},
+		{roachpb.ResolveIntent, true},
+		{roachpb.ResolveIntentRange, true},
+		{roachpb.Put, false},
+		{roachpb.Increment, false},
+		{roachpb.EndTxn, false},
+	} {
+		cmd, ok := LookupCommand(tc.method)
+		require.True(t, ok)
+		require.Equal(t, tc.exp, cmd.IsIdempotent, "%s", tc.method)
+	}
+
+	var ba roachpb.BatchRequest
+	ba.Add(&roachpb.GetRequest{}, &roachpb.ResolveIntentRequest{})
+	require.True(t, BatchIsIdempotent(&ba))
+	ba.Add(&roachpb.IncrementRequest{})
+	require.False(t, BatchIsIdempotent(&ba))
+
+	// Mark a registered command as idempotent.
+	const method = roachpb.Increment
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	MarkCommandIdempotent(method)
+	require.True(t, BatchIsIdempotent(&ba))
+}
+
+func TestListCommands(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Methods that are not evaluated through a registered command, either
+	// because they are handled by the replica directly or because their
+	// commands are registered outside of this package.
+	unregistered := map[roachpb.Method]bool{
+		roachpb.AdminSplit:                    true,
+		roachpb.AdminUnsplit:                  true,
+		roachpb.AdminMerge:                    true,
+		roachpb.AdminTransferLease:            true,
+		roachpb.AdminChangeReplicas:           true,
+		roachpb.AdminRelocateRange:            true,
+		roachpb.AdminScatter:                  true,
+		roachpb.AdminVerifyProtectedTimestamp: true,
+		roachpb.CheckConsistency:              true,
+		roachpb.WriteBatch:                    true,
+		roachpb.Export:                        true,
+		roachpb.Import:                        true,
+	}
+
+	infos := ListCommands()
+	listed := make(map[roachpb.Method]bool, len(infos))
+	for i, info := range infos {
+		if i > 0 {
+			require.True(t, infos[i-1].Method < info.Method, "commands not ordered by method")
+		}
+		cmd, ok := LookupCommand(info.Method)
+		require.True(t, ok, "%s", info.Method)
+		require.Equal(t, cmd.ReadOnlyFor == nil && cmd.EvalRO != nil, info.ReadOnly, "%s", info.Method)
+		require.Equal(t, cmd.ReadOnlyFor != nil, info.HeaderDependent, "%s", info.Method)
+		listed[info.Method] = true
+	}
+	for method := roachpb.Get; method <= roachpb.AdminVerifyProtectedTimestamp; method++ {
+		if unregistered[method] {
+			continue
+		}
+		require.True(t, listed[method], "no command registered for %s", method)
+	}
+
+	for _, tc := range []struct {
+		method   roachpb.Method
+		readOnly bool
+	}{
+		{roachpb.Get, true},
+		{roachpb.Scan, true},
+		{roachpb.Put, false},
+		{roachpb.EndTxn, false},
+	} {
+		var found bool
+		for _, info := range infos {
+			if info.Method == tc.method {
+				require.Equal(t, tc.readOnly, info.ReadOnly, "%s", tc.method)
+				found = true
+			}
+		}
+		require.True(t, found, "%s", tc.method)
+	}
+}
+
+func TestHeaderDependentCommand(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// Register a command for a method that is not otherwise registered. It is
+	// evaluated read-only for non-transactional requests.
+	const method = roachpb.AdminScatter
+	_, ok := LookupCommand(method)
+	require.False(t, ok)
+	defer UnregisterCommand(method)
+
+	var evaluated string
+	RegisterHeaderDependentCommand(method, DefaultDeclareKeys,
+		func(h roachpb.Header) bool { return h.Txn == nil },
+		func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error) {
+			evaluated = "ro"
+			return result.Result{}, nil
+		},
+		func(context.Context, engine.ReadWriter, CommandArgs, roachpb.Response) (result.Result, error) {
+			evaluated = "rw"
+			return result.Result{}, nil
+		},
+	)
+	AllowFollowerReads(method, func(roachpb.Header, roachpb.Request) bool { return true })
+
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.NotNil(t, cmd.EvalRO)
+	require.NotNil(t, cmd.EvalRW)
+	// The command may be evaluated read-only, so it is not a write.
+	require.False(t, cmd.HasFlags(FlagIsWrite))
+	require.True(t, cmd.HasFlags(FlagNeedsLease))
+
+	nonTxnHeader := roachpb.Header{}
+	txnHeader := roachpb.Header{Txn: &roachpb.Transaction{}}
+	req := &roachpb.AdminScatterRequest{}
+
+	require.True(t, cmd.IsReadOnly(nonTxnHeader))
+	_, err := cmd.Eval(ctx, nil /* rw */, CommandArgs{Header: nonTxnHeader, Args: req}, nil /* resp */)
+	require.NoError(t, err)
+	require.Equal(t, "ro", evaluated)
+	require.True(t, cmd.CanServeFollowerRead(nonTxnHeader, req))
+
+	require.False(t, cmd.IsReadOnly(txnHeader))
+	_, err = cmd.Eval(ctx, nil /* rw */, CommandArgs{Header: txnHeader, Args: req}, nil /* resp */)
+	require.NoError(t, err)
+	require.Equal(t, "rw", evaluated)
+	require.False(t, cmd.CanServeFollowerRead(txnHeader, req))
+
+	var found bool
+	for _, info := range ListCommands() {
+		if info.Method == method {
+			require.False(t, info.ReadOnly)
+			require.True(t, info.HeaderDependent)
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestEvalInterceptor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	defer ClearEvalInterceptors()
+
+	cmd := Command{
+		EvalRW: func(
+			_ context.Context, _ engine.ReadWriter, cArgs CommandArgs, _ roachpb.Response,
+		) (result.Result, error) {
+			if cArgs.MaxKeys < 0 {
+				return result.Result{}, errors.New("boom")
+			}
+			return result.Result{}, nil
+		},
+	}
+	var calls []string
+	intercept := func(name string) EvalInterceptor {
+		return func(
+			_ context.Context, method roachpb.Method, _ CommandArgs, eval func() (result.Result, error),
+		) (result.Result, error) {
+			calls = append(calls, fmt.Sprintf("pre %s %s", name, method))
+			res, err := eval()
+			calls = append(calls, fmt.Sprintf("post %s %v", name, err))
+			return res, err
+		}
+	}
+	RegisterEvalInterceptor(intercept("a"))
+	RegisterEvalInterceptor(intercept("b"))
+
+	// Interceptors compose in registration order.
+	cArgs := CommandArgs{Args: &roachpb.PutRequest{}}
+	_, err := cmd.Eval(ctx, nil /* rw */, cArgs, nil /* resp */)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"pre a Put", "pre b Put", "post b <nil>", "post a <nil>",
+	}, calls)
+
+	// Interceptors observe the evaluation error.
+	calls = nil
+	cArgs.MaxKeys = -1
+	_, err = cmd.Eval(ctx, nil /* rw */, cArgs, nil /* resp */)
+	require.EqualError(t, err, "boom")
+	require.Equal(t, []string{
+		"pre a Put", "pre b Put", "post b boom", "post a boom",
+	}, calls)
+
+	// Interceptors may replace the evaluation error.
+	RegisterEvalInterceptor(func(
+		_ context.Context, _ roachpb.Method, _ CommandArgs, eval func() (result.Result, error),
+	) (result.Result, error) {
+		_, _ = eval()
+		return result.Result{}, errors.New("injected")
+	})
+	cArgs.MaxKeys = 0
+	_, err = cmd.Eval(ctx, nil /* rw */, cArgs, nil /* resp */)
+	require.EqualError(t, err, "injected")
+
+	// Cleared interceptors are no longer invoked.
+	ClearEvalInterceptors()
+	calls = nil
+	_, err = cmd.Eval(ctx, nil /* rw */, cArgs, nil /* resp */)
+	require.NoError(t, err)
+	require.Empty(t, calls)
+
+	// Interceptors can be registered and cleared concurrently with evaluation.
+	passthrough := func(
+		_ context.Context, _ roachpb.Method, _ CommandArgs, eval func() (result.Result, error),
+	) (result.Result, error) {
+		return eval()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			RegisterEvalInterceptor(passthrough)
+			RegisterEvalInterceptor(passthrough)
+			ClearEvalInterceptors()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if _, err := cmd.Eval(ctx, nil /* rw */, cArgs, nil /* resp */); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestEvaluateCommand(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	key := roachpb.Key("a")
+	ts := hlc.Timestamp{WallTime: 1}
+	require.NoError(t, engine.MVCCPut(
+		ctx, eng, nil, key, ts, roachpb.MakeValueFromString("value"), nil,
+	))
+
+	// A registered method is looked up and evaluated.
+	var resp roachpb.GetResponse
+	_, err := EvaluateCommand(ctx, roachpb.Get, eng, CommandArgs{
+		Header: roachpb.Header{Timestamp: ts},
+		Args:   &roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: key}},
+	}, &resp)
+	require.NoError(t, err)
+	require.NotNil(t, resp.Value)
+
+	// An unregistered method returns an UnsupportedMethodError.
+	_, err = EvaluateCommand(ctx, roachpb.AdminScatter, eng, CommandArgs{
+		Args: &roachpb.AdminScatterRequest{},
+	}, &roachpb.AdminScatterResponse{})
+	require.Error(t, err)
+	unsupported, ok := err.(*UnsupportedMethodError)
+	require.True(t, ok)
+	require.Equal(t, roachpb.AdminScatter, unsupported.Method)
+	require.EqualError(t, err, "no command registered for method AdminScatter")
+}
+
+func TestCommandResultBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	ts := hlc.Timestamp{WallTime: 1}
+	for i := 0; i < 10; i++ {
+		key := roachpb.Key(fmt.Sprintf("key-%d", i))
+		require.NoError(t, engine.MVCCPut(
+			ctx, eng, nil, key, ts, roachpb.MakeValueFromString("value"), nil,
+		))
+	}
+
+	const method = roachpb.Scan
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	SetCommandResultBudget(method, 4)
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.Equal(t, int64(4), cmd.ResultBudget)
+
+	span := roachpb.Span{Key: roachpb.Key("key-0"), EndKey: roachpb.Key("key-9\x00")}
+	scan := func(maxKeys int64) *roachpb.ScanResponse {
+		var resp roachpb.ScanResponse
+		_, err := cmd.Eval(ctx, eng, CommandArgs{
+			Header:  roachpb.Header{Timestamp: ts},
+			Args:    &roachpb.ScanRequest{RequestHeader: roachpb.RequestHeaderFromSpan(span)},
+			MaxKeys: maxKeys,
+		}, &resp)
+		require.NoError(t, err)
+		return &resp
+	}
+
+	// Without a batch limit, the command's budget applies.
+	resp := scan(math.MaxInt64)
+	require.Len(t, resp.Rows, 4)
+	require.NotNil(t, resp.ResumeSpan)
+	require.Equal(t, roachpb.Key("key-4"), resp.ResumeSpan.Key)
+	require.Equal(t, roachpb.RESUME_KEY_LIMIT, resp.ResumeReason)
+
+	// A smaller remaining batch budget takes precedence.
+	resp = scan(2)
+	require.Len(t, resp.Rows, 2)
+	require.Equal(t, roachpb.Key("key-2"), resp.ResumeSpan.Key)
+
+	// An exhausted batch budget skips evaluation entirely.
+	resp = scan(0)
+	require.Empty(t, resp.Rows)
+	require.Zero(t, resp.NumKeys)
+	require.Equal(t, span, *resp.ResumeSpan)
+	require.Equal(t, roachpb.RESUME_KEY_LIMIT, resp.ResumeReason)
+}
+
+func TestEvaluateCommandDryRun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	key := roachpb.Key("a")
+	ts := hlc.Timestamp{WallTime: 1}
+	put := &roachpb.PutRequest{
+		RequestHeader: roachpb.RequestHeader{Key: key},
+		Value:         roachpb.MakeValueFromString("value"),
+	}
+	_, ms, err := EvaluateCommandDryRun(ctx, roachpb.Put, eng, CommandArgs{
+		Header: roachpb.Header{Timestamp: ts},
+		Args:   put,
+	}, &roachpb.PutResponse{})
+	require.NoError(t, err)
+
+	// The stats delta of the write is computed.
+	require.Equal(t, int64(1), ms.KeyCount)
+	require.Equal(t, int64(1), ms.ValCount)
+
+	// But the engine is untouched.
+	val, _, err := engine.MVCCGet(ctx, eng, key, ts, engine.MVCCGetOptions{})
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	// Unregistered methods are rejected.
+	_, _, err = EvaluateCommandDryRun(ctx, roachpb.AdminScatter, eng, CommandArgs{
+		Args: &roachpb.AdminScatterRequest{},
+	}, &roachpb.AdminScatterResponse{})
+	_, ok := err.(*UnsupportedMethodError)
+	require.True(t, ok)
+}
+
+func TestCommandFlags(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The flags of registered commands agree with the flags of the
+	// corresponding requests.
+	for _, req := range []roachpb.Request{
+		&roachpb.GetRequest{},
+		&roachpb.ScanRequest{},
+		&roachpb.ReverseScanRequest{},
+		&roachpb.PutRequest{},
+		&roachpb.ConditionalPutRequest{},
+		&roachpb.InitPutRequest{},
+		&roachpb.IncrementRequest{},
+		&roachpb.DeleteRequest{},
+		&roachpb.DeleteRangeRequest{},
+		&roachpb.EndTxnRequest{},
+		&roachpb.HeartbeatTxnRequest{},
+		&roachpb.PushTxnRequest{},
+		&roachpb.QueryTxnRequest{},
+		&roachpb.ResolveIntentRequest{},
+		&roachpb.GCRequest{},
+		&roachpb.LeaseInfoRequest{},
+	} {
+		method := req.Method()
+		cmd, ok := LookupCommand(method)
+		require.True(t, ok, "%s", method)
+		require.Equal(t, roachpb.IsTransactional(req), cmd.HasFlags(FlagIsTxn), "%s", method)
+		require.Equal(t, !roachpb.IsReadOnly(req), cmd.HasFlags(FlagIsWrite), "%s", method)
+		require.Equal(t, cmd.RequiresLease, cmd.HasFlags(FlagNeedsLease), "%s", method)
+		// Only the declared flags are stored on the command.
+		require.Zero(t, cmd.Flags&^FlagIsTxn, "%s", method)
+	}
+
+	require.True(t, MethodHasFlags(roachpb.Put, FlagIsWrite|FlagIsTxn|FlagNeedsLease))
+	require.False(t, MethodHasFlags(roachpb.Get, FlagIsWrite|FlagIsTxn))
+	require.False(t, MethodHasFlags(roachpb.AdminScatter, 0))
+
+	// Flags can be added to, and the lease flag cleared from, registered
+	// commands.
+	const method = roachpb.QueryTxn
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	require.True(t, MethodHasFlags(method, FlagNeedsLease))
+	require.False(t, MethodHasFlags(method, FlagIsTxn))
+	AddCommandFlags(method, FlagIsTxn)
+	ExemptCommandFromLease(method)
+	require.True(t, MethodHasFlags(method, FlagIsTxn))
+	require.False(t, MethodHasFlags(method, FlagNeedsLease))
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.Equal(t, FlagIsTxn, cmd.Flags)
+}
+
+func TestOverrideCommand(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const method = roachpb.Increment
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+
+	mock := prev
+	mock.EvalRW = func(
+		context.Context, engine.ReadWriter, CommandArgs, roachpb.Response,
+	) (result.Result, error) {
+		return result.Result{}, errors.New("mock")
+	}
+
+	// Concurrent lookups always find the method registered, with either the
+	// original or the mock command.
+	stop := make(chan struct{})
+	lookupErrC := make(chan error, 1)
+	go func() {
+		defer close(lookupErrC)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, ok := LookupCommand(method); !ok {
+				lookupErrC <- errors.Errorf("%s not registered", method)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		require.Equal(t, prev.Flags, OverrideCommand(method, mock).Flags)
+		OverrideCommand(method, prev)
+	}
+	close(stop)
+	require.NoError(t, <-lookupErrC)
+
+	// The override takes effect and is reverted by overriding again.
+	restored := OverrideCommand(method, mock)
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	_, err := cmd.EvalRW(context.Background(), nil /* rw */, CommandArgs{}, nil /* resp */)
+	require.EqualError(t, err, "mock")
+	require.Equal(t, mock.Flags, OverrideCommand(method, restored).Flags)
+	cmd, ok = LookupCommand(method)
+	require.True(t, ok)
+	require.True(t, cmd.HasFlags(FlagIsWrite|FlagIsTxn))
+}
+
+func TestCommandRegistryConcurrency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Lookups don't allocate.
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, ok := LookupCommand(roachpb.Get); !ok {
+			t.Fatal("Get not registered")
+		}
+	})
+	require.Zero(t, allocs)
+
+	// Commands can be registered and unregistered concurrently with lookups.
+	const method = roachpb.AdminScatter
+	defer UnregisterCommand(method)
+	evalRO := func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error) {
+		return result.Result{}, nil
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			RegisterReadOnlyCommand(method, DefaultDeclareKeys, evalRO)
+			UnregisterCommand(method)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if cmd, ok := LookupCommand(method); ok && cmd.EvalRO == nil {
+				t.Error("found partially registered command")
+			}
+			if _, ok := LookupCommand(roachpb.Get); !ok {
+				t.Error("Get not registered")
+			}
+		}
+	}()
+	wg.Wait()
+	_, ok := LookupCommand(method)
+	require.False(t, ok)
+}
+
+var testCapabilityEnabled = settings.RegisterBoolSetting(
+	"kv.test.batcheval_capability.enabled", "for testing only", false,
+)
+
+func TestCommandRequiredCapabilities(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	const method = roachpb.Increment
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.Empty(t, prev.RequiredCapabilities)
+	defer OverrideCommand(method, prev)
+
+	RequireCapabilities(method,
+		ClusterVersionCapability(cluster.VersionContainsEstimatesCounter),
+		SettingCapability("kv.test.batcheval_capability.enabled", testCapabilityEnabled),
+	)
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.Len(t, cmd.RequiredCapabilities, 2)
+
+	var info CommandInfo
+	for _, i := range ListCommands() {
+		if i.Method == method {
+			info = i
+		}
+	}
+	require.Equal(t, []string{
+		"cluster version VersionContainsEstimatesCounter",
+		"setting kv.test.batcheval_capability.enabled",
+	}, info.RequiredCapabilities)
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+	st := cluster.MakeTestingClusterSettings()
+	key := roachpb.Key("a")
+	increment := func() error {
+		_, err := cmd.Eval(ctx, eng, CommandArgs{
+			EvalCtx: &mockEvalCtx{clusterSettings: st},
+			Header:  roachpb.Header{Timestamp: hlc.Timestamp{WallTime: 1}},
+			Args: &roachpb.IncrementRequest{
+				RequestHeader: roachpb.RequestHeader{Key: key}, Increment: 1,
+			},
+			Stats: &enginepb.MVCCStats{},
+		}, &roachpb.IncrementResponse{})
+		return err
+	}
+
+	// The disabled setting prevents the command from being evaluated.
+	err := increment()
+	require.EqualError(t, err,
+		"command Increment requires setting kv.test.batcheval_capability.enabled")
+	capErr, ok := err.(*CapabilityError)
+	require.True(t, ok)
+	require.Equal(t, method, capErr.Method)
+	val, _, err := engine.MVCCGet(ctx, eng, key, hlc.Timestamp{WallTime: 1}, engine.MVCCGetOptions{})
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	// Once all capabilities are provided, the command is evaluated.
+	testCapabilityEnabled.Override(&st.SV, true)
+	require.NoError(t, increment())
+	val, _, err = engine.MVCCGet(ctx, eng, key, hlc.Timestamp{WallTime: 1}, engine.MVCCGetOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, val)
+}
+
+func TestCommandDeclareKeysVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const method = roachpb.Get
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+
+	// Commands declare keys with version 0 unless specified otherwise.
+	require.Zero(t, prev.DeclareKeysVersion)
+	require.NoError(t, prev.CheckDeclareKeysVersion(method, 0))
+	require.Regexp(t, "command Get declares keys with version 0, not the requested version 1",
+		prev.CheckDeclareKeysVersion(method, 1))
+
+	SetDeclareKeysVersion(method, 2)
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.NoError(t, cmd.CheckDeclareKeysVersion(method, 2))
+	err := cmd.CheckDeclareKeysVersion(method, 1)
+	require.IsType(t, &DeclareKeysVersionError{}, err)
+	require.Equal(t, &DeclareKeysVersionError{Method: method, Version: 1, Implemented: 2}, err)
+}
+
+func TestCommandCompensation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	const method = roachpb.Put
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	var compensated []roachpb.Key
+	SetCommandCompensation(method, func(_ context.Context, cArgs CommandArgs, _ result.Result) {
+		compensated = append(compensated, cArgs.Args.Header().Key)
+	})
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+
+	put := func(key string) CommandArgs {
+		return CommandArgs{Args: &roachpb.PutRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		}}
+	}
+
+	// Commands without a compensation function are not recorded.
+	var c Compensations
+	c.Add(cmd, put("a"), result.Result{})
+	c.Add(prev, put("b"), result.Result{})
+	c.Add(cmd, put("c"), result.Result{})
+	require.Nil(t, compensated)
+
+	// Compensations run in reverse order, exactly once.
+	c.Run(ctx)
+	require.Equal(t, []roachpb.Key{roachpb.Key("c"), roachpb.Key("a")}, compensated)
+	c.Run(ctx)
+	require.Len(t, compensated, 2)
+}
+
+func TestCommandArgsReportProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// Commands may report progress regardless of whether it is consumed.
+	require.NotPanics(t, func() { CommandArgs{}.ReportProgress(ctx, 0.5) })
+
+	var reported []float64
+	cArgs := CommandArgs{Progress: func(_ context.Context, fraction float64) {
+		reported = append(reported, fraction)
+	}}
+	cArgs.ReportProgress(ctx, 0.25)
+	cArgs.ReportProgress(ctx, 1)
+	require.Equal(t, []float64{0.25, 1}, reported)
+
+	// TraceProgress records the progress in the trace.
+	traceCtx, collect, cancel := tracing.ContextWithRecordingSpan(ctx, "test-recording")
+	defer cancel()
+	CommandArgs{Progress: TraceProgress}.ReportProgress(traceCtx, 0.5)
+	require.NotEqual(t, -1, tracing.FindMsgInRecording(collect(), "evaluation 50.0% complete"))
+}
+
+func TestCommandAdmissionPriority(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	require.Equal(t, LowAdmissionPriority, MethodAdmissionPriority(roachpb.GC))
+	require.Equal(t, LowAdmissionPriority, MethodAdmissionPriority(roachpb.ClearRange))
+	require.Equal(t, NormalAdmissionPriority, MethodAdmissionPriority(roachpb.Get))
+	require.Equal(t, NormalAdmissionPriority, MethodAdmissionPriority(roachpb.AdminScatter))
+
+	const method = roachpb.Get
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+
+	SetCommandAdmissionPriority(method, HighAdmissionPriority)
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.Equal(t, HighAdmissionPriority, cmd.AdmissionPriority)
+}
+
+func TestCommandEvalTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	const method = roachpb.AdminScatter
+	_, ok := LookupCommand(method)
+	require.False(t, ok)
+	defer UnregisterCommand(method)
+
+	// The command either blocks until its context is done or sleeps past its
+	// deadline while ignoring it.
+	var ignoreCtx bool
+	RegisterReadWriteCommand(method, DefaultDeclareKeys,
+		func(ctx context.Context, _ engine.ReadWriter, _ CommandArgs, _ roachpb.Response) (result.Result, error) {
+			if ignoreCtx {
+				time.Sleep(20 * time.Millisecond)
+				return result.Result{Local: result.LocalResult{GossipFirstRange: true}}, nil
+			}
+			<-ctx.Done()
+			return result.Result{}, ctx.Err()
+		})
+	cArgs := CommandArgs{Args: &roachpb.AdminScatterRequest{}}
+
+	// Without a timeout, the command is evaluated with the caller's context.
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	ignoreCtx = true
+	res, err := cmd.Eval(ctx, nil /* rw */, cArgs, nil /* resp */)
+	require.NoError(t, err)
+	require.True(t, res.Local.GossipFirstRange)
+
+	SetCommandEvalTimeout(method, time.Millisecond)
+	cmd, ok = LookupCommand(method)
+	require.True(t, ok)
+	require.Equal(t, time.Millisecond, cmd.EvalTimeout)
+
+	for _, ignore := range []bool{false, true} {
+		ignoreCtx = ignore
+		res, err := cmd.Eval(ctx, nil /* rw */, cArgs, nil /* resp */)
+		require.True(t, res.IsZero(), "ignoreCtx=%t", ignore)
+		var timeoutErr *contextutil.TimeoutError
+		require.True(t, errors.As(err, &timeoutErr), "ignoreCtx=%t: %v", ignore, err)
+	}
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	snap := SnapshotRegistry()
+	numCommands := len(ListCommands())
+	get, ok := LookupCommand(roachpb.Get)
+	require.True(t, ok)
+
+	// Register an experimental command and modify and remove existing ones.
+	RegisterReadOnlyCommand(roachpb.AdminScatter, DefaultDeclareKeys,
+		func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error) {
+			return result.Result{}, nil
+		})
+	LimitCommandResponseSize(roachpb.Get, 1)
+	UnregisterCommand(roachpb.Put)
+	_, ok = LookupCommand(roachpb.AdminScatter)
+	require.True(t, ok)
+
+	// Restoring the snapshot rolls back all of the changes.
+	RestoreRegistry(snap)
+	require.Len(t, ListCommands(), numCommands)
+	_, ok = LookupCommand(roachpb.AdminScatter)
+	require.False(t, ok)
+	_, ok = LookupCommand(roachpb.Put)
+	require.True(t, ok)
+	cmd, ok := LookupCommand(roachpb.Get)
+	require.True(t, ok)
+	require.Equal(t, get.MaxResponseBytes, cmd.MaxResponseBytes)
+}
+
+func TestRegisterValidatesEval(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalRW := func(context.Context, engine.ReadWriter, CommandArgs, roachpb.Response) (result.Result, error) {
+		return result.Result{}, nil
+	}
+	evalRO := func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error) {
+		return result.Result{}, nil
+	}
+	readOnly := func(roachpb.Header) bool { return true }
+
+	const method = roachpb.AdminScatter
+	for _, tc := range []struct {
+		name string
+		cmd  Command
+		err  string
+	}{
+		{"neither", Command{}, "must set exactly one of EvalRW and EvalRO"},
+		{"both", Command{EvalRW: evalRW, EvalRO: evalRO}, "must set exactly one of EvalRW and EvalRO"},
+		{"header-dependent without RO", Command{EvalRW: evalRW, ReadOnlyFor: readOnly},
+			"must set both EvalRW and EvalRO"},
+		{"read-write", Command{EvalRW: evalRW}, ""},
+		{"read-only", Command{EvalRO: evalRO}, ""},
+		{"header-dependent", Command{EvalRW: evalRW, EvalRO: evalRO, ReadOnlyFor: readOnly}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer UnregisterCommand(method)
+			err := checkedRegister(method, tc.cmd)
+			_, registered := LookupCommand(method)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				require.False(t, registered)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, registered)
+
+			// Registering the method again is rejected.
+			require.Error(t, checkedRegister(method, tc.cmd))
+		})
+	}
+}
+
+func TestCommandMightWrite(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var h roachpb.Header
+	for _, tc := range []struct {
+		method roachpb.Method
+		exp    bool
+	}{
+		{roachpb.Get, false},
+		{roachpb.Scan, false},
+		{roachpb.Put, true},
+		{roachpb.ResolveIntent, true},
+	} {
+		cmd, ok := LookupCommand(tc.method)
+		require.True(t, ok)
+		require.Equal(t, tc.exp, cmd.MightWrite(h), "%s", tc.method)
+	}
+
+	// A read-write command may declare that it only writes under some
+	// headers, in which case it may serve follower reads under the others.
+	const method = roachpb.QueryTxn
+	prev, ok := LookupCommand(method)
+	require.True(t, ok)
+	defer OverrideCommand(method, prev)
+	OverrideCommand(method, Command{
+		EvalRW: func(context.Context, engine.ReadWriter, CommandArgs, roachpb.Response) (result.Result, error) {
+			return result.Result{}, nil
+		},
+		FollowerReadEligible: func(roachpb.Header, roachpb.Request) bool { return true },
+	})
+	req := &roachpb.QueryTxnRequest{}
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.True(t, cmd.MightWrite(h))
+	require.False(t, cmd.CanServeFollowerRead(h, req))
+
+	SetCommandMightWrite(method, func(h roachpb.Header) bool { return h.Txn != nil })
+	cmd, ok = LookupCommand(method)
+	require.True(t, ok)
+	require.False(t, cmd.MightWrite(h))
+	require.True(t, cmd.CanServeFollowerRead(h, req))
+	txnHeader := roachpb.Header{Txn: &roachpb.Transaction{}}
+	require.True(t, cmd.MightWrite(txnHeader))
+	require.False(t, cmd.CanServeFollowerRead(txnHeader, req))
+}
+
+func TestRegisterCommand(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const method = roachpb.AdminScatter
+	defer UnregisterCommand(method)
+	RegisterCommand(method, Command{
+		DeclareKeys: DefaultDeclareKeys,
+		EvalRW: func(context.Context, engine.ReadWriter, CommandArgs, roachpb.Response) (result.Result, error) {
+			return result.Result{}, nil
+		},
+		RequiresLease:     true,
+		IsIdempotent:      true,
+		EvalTimeout:       time.Second,
+		AdmissionPriority: LowAdmissionPriority,
+	})
+
+	cmd, ok := LookupCommand(method)
+	require.True(t, ok)
+	require.True(t, cmd.IsIdempotent)
+	require.Equal(t, time.Second, cmd.EvalTimeout)
+	require.Equal(t, LowAdmissionPriority, cmd.AdmissionPriority)
+	require.True(t, cmd.HasFlags(FlagNeedsLease|FlagIsWrite))
+	require.Zero(t, cmd.Flags)
+}
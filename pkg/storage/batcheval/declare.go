@@ -17,6 +17,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/storage/spanset"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 )
 
 // DefaultDeclareKeys is the default implementation of Command.DeclareKeys.
@@ -37,6 +38,51 @@ func DefaultDeclareKeys(
 	}
 }
 
+// DefaultDeclareIsolatedKeys is like DefaultDeclareKeys, but it declares the
+// request's span without a timestamp, regardless of whether the span is local.
+// Non-MVCC spans conflict with all overlapping spans irrespective of their
+// timestamps, which isolates the command from all other commands accessing
+// its keys, e.g. when it needs to observe intents written at any timestamp.
+func DefaultDeclareIsolatedKeys(
+	_ *roachpb.RangeDescriptor, _ roachpb.Header, req roachpb.Request, spans *spanset.SpanSet,
+) {
+	access := spanset.SpanReadWrite
+	if roachpb.IsReadOnly(req) {
+		access = spanset.SpanReadOnly
+	}
+	spans.AddNonMVCC(access, req.Header().Span())
+}
+
+// DefaultDeclareKeysAndDescriptor is like DefaultDeclareKeys, but it also
+// declares a read of the range descriptor key, which blocks splits and merges
+// of the range while the command is evaluated. Commands that compare their
+// span to the bounds of the range, e.g. to update the MVCC stats of the entire
+// range more efficiently, should use it.
+func DefaultDeclareKeysAndDescriptor(
+	desc *roachpb.RangeDescriptor, header roachpb.Header, req roachpb.Request, spans *spanset.SpanSet,
+) {
+	DefaultDeclareKeys(desc, header, req, spans)
+	spans.AddNonMVCC(spanset.SpanReadOnly, roachpb.Span{Key: keys.RangeDescriptorKey(desc.StartKey)})
+}
+
+// DeclareKeysForMethod returns the SpanSet that the command registered for the
+// provided method declares for the given request, without evaluating it. The
+// SpanSet is empty if the command does not declare keys. It returns an
+// UnsupportedMethodError if no command is registered for the method.
+func DeclareKeysForMethod(
+	method roachpb.Method, desc *roachpb.RangeDescriptor, header roachpb.Header, req roachpb.Request,
+) (*spanset.SpanSet, error) {
+	cmd, ok := LookupCommand(method)
+	if !ok {
+		return nil, &UnsupportedMethodError{Method: method}
+	}
+	var spans spanset.SpanSet
+	if cmd.DeclareKeys != nil {
+		cmd.DeclareKeys(desc, header, req, &spans)
+	}
+	return &spans, nil
+}
+
 // DeclareKeysForBatch adds all keys that the batch with the provided header
 // touches to the given SpanSet. This does not include keys touched during the
 // processing of the batch's individual commands.
@@ -64,11 +110,31 @@ type CommandArgs struct {
 	Header  roachpb.Header
 	Args    roachpb.Request
 
-	// If MaxKeys is non-zero, span requests should limit themselves to
-	// that many keys. Commands using this feature should also set
-	// NumKeys and ResumeSpan in their responses.
+	// MaxKeys is the number of keys remaining in the batch's result budget
+	// (MaxInt64 for no limit), limited further by the command's ResultBudget.
+	// Span requests should limit themselves to that many keys. Commands using
+	// this feature should also set NumKeys and ResumeSpan in their responses.
 	MaxKeys int64
 
 	// *Stats should be mutated to reflect any writes made by the command.
 	Stats *enginepb.MVCCStats
+
+	// Progress, if set, receives the progress reported by long-running
+	// commands through ReportProgress.
+	Progress func(ctx context.Context, fraction float64)
+}
+
+// ReportProgress reports that the provided fraction of the command's work,
+// between 0 and 1, is complete. It is a no-op if the command's arguments do
+// not carry a Progress callback.
+func (c CommandArgs) ReportProgress(ctx context.Context, fraction float64) {
+	if c.Progress != nil {
+		c.Progress(ctx, fraction)
+	}
+}
+
+// TraceProgress is a CommandArgs.Progress callback that records the progress
+// of a command as an event in the trace of the provided context.
+func TraceProgress(ctx context.Context, fraction float64) {
+	log.Eventf(ctx, "evaluation %.1f%% complete", 100*fraction)
 }
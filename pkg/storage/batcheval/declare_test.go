@@ -0,0 +1,153 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/spanset"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultDeclareKeysHelpers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	desc := &roachpb.RangeDescriptor{
+		RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("z"),
+	}
+	ts := hlc.Timestamp{WallTime: 10}
+	header := roachpb.Header{Timestamp: ts}
+	span := roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")}
+	localSpan := roachpb.Span{Key: keys.RangeDescriptorKey(desc.StartKey)}
+	descSpan := spanset.Span{Span: roachpb.Span{Key: keys.RangeDescriptorKey(desc.StartKey)}}
+
+	scan := &roachpb.ScanRequest{RequestHeader: roachpb.RequestHeaderFromSpan(span)}
+	put := &roachpb.PutRequest{RequestHeader: roachpb.RequestHeaderFromSpan(roachpb.Span{Key: span.Key})}
+	localPut := &roachpb.PutRequest{RequestHeader: roachpb.RequestHeaderFromSpan(localSpan)}
+
+	type declared struct {
+		access spanset.SpanAccess
+		scope  spanset.SpanScope
+		spans  []spanset.Span
+	}
+	for _, tc := range []struct {
+		name    string
+		declare func(*roachpb.RangeDescriptor, roachpb.Header, roachpb.Request, *spanset.SpanSet)
+		req     roachpb.Request
+		exp     []declared
+	}{
+		{
+			name:    "default read",
+			declare: DefaultDeclareKeys,
+			req:     scan,
+			exp: []declared{
+				{spanset.SpanReadOnly, spanset.SpanGlobal, []spanset.Span{{Span: span, Timestamp: ts}}},
+			},
+		},
+		{
+			name:    "default write",
+			declare: DefaultDeclareKeys,
+			req:     put,
+			exp: []declared{
+				{spanset.SpanReadWrite, spanset.SpanGlobal, []spanset.Span{{Span: put.Span(), Timestamp: ts}}},
+			},
+		},
+		{
+			name:    "default local write",
+			declare: DefaultDeclareKeys,
+			req:     localPut,
+			exp: []declared{
+				{spanset.SpanReadWrite, spanset.SpanLocal, []spanset.Span{{Span: localSpan}}},
+			},
+		},
+		{
+			name:    "isolated read",
+			declare: DefaultDeclareIsolatedKeys,
+			req:     scan,
+			exp: []declared{
+				{spanset.SpanReadOnly, spanset.SpanGlobal, []spanset.Span{{Span: span}}},
+			},
+		},
+		{
+			name:    "isolated write",
+			declare: DefaultDeclareIsolatedKeys,
+			req:     put,
+			exp: []declared{
+				{spanset.SpanReadWrite, spanset.SpanGlobal, []spanset.Span{{Span: put.Span()}}},
+			},
+		},
+		{
+			name:    "with descriptor",
+			declare: DefaultDeclareKeysAndDescriptor,
+			req:     put,
+			exp: []declared{
+				{spanset.SpanReadWrite, spanset.SpanGlobal, []spanset.Span{{Span: put.Span(), Timestamp: ts}}},
+				{spanset.SpanReadOnly, spanset.SpanLocal, []spanset.Span{descSpan}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var spans spanset.SpanSet
+			tc.declare(desc, header, tc.req, &spans)
+			var n int
+			for _, d := range tc.exp {
+				require.Equal(t, d.spans, spans.GetSpans(d.access, d.scope), "%s %s", d.access, d.scope)
+				n += len(d.spans)
+			}
+			require.Equal(t, n, spans.Len())
+		})
+	}
+}
+
+func TestDeclareKeysForMethod(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	desc := &roachpb.RangeDescriptor{
+		RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("z"),
+	}
+	ts := hlc.Timestamp{WallTime: 10}
+	header := roachpb.Header{Timestamp: ts}
+	key := roachpb.Key("b")
+
+	// The spans declared by the registered command are returned.
+	spans, err := DeclareKeysForMethod(roachpb.Put, desc, header, &roachpb.PutRequest{
+		RequestHeader: roachpb.RequestHeader{Key: key},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []spanset.Span{{Span: roachpb.Span{Key: key}, Timestamp: ts}},
+		spans.GetSpans(spanset.SpanReadWrite, spanset.SpanGlobal))
+	require.Equal(t, 1, spans.Len())
+
+	// Commands that declare no keys return an empty SpanSet.
+	const method = roachpb.AdminScatter
+	defer UnregisterCommand(method)
+	register(method, Command{
+		EvalRO: func(context.Context, engine.Reader, CommandArgs, roachpb.Response) (result.Result, error) {
+			return result.Result{}, nil
+		},
+	})
+	spans, err = DeclareKeysForMethod(method, desc, header, &roachpb.AdminScatterRequest{})
+	require.NoError(t, err)
+	require.Zero(t, spans.Len())
+	UnregisterCommand(method)
+
+	// Unregistered methods are rejected.
+	_, err = DeclareKeysForMethod(method, desc, header, &roachpb.AdminScatterRequest{})
+	_, ok := err.(*UnsupportedMethodError)
+	require.True(t, ok)
+}
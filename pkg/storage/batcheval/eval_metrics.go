@@ -0,0 +1,98 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/codahale/hdrhistogram"
+)
+
+// globalEvalMetrics holds the *EvalMetrics that command evaluation records
+// into, which is nil if evaluation latencies are not recorded. See
+// SetEvalMetrics.
+var globalEvalMetrics atomic.Value
+
+// loadEvalMetrics returns the EvalMetrics installed with SetEvalMetrics, or
+// nil if there is none.
+func loadEvalMetrics() *EvalMetrics {
+	m, _ := globalEvalMetrics.Load().(*EvalMetrics)
+	return m
+}
+
+// SetEvalMetrics installs the EvalMetrics that command evaluation records the
+// latency of each EvalRW or EvalRO call into. A nil EvalMetrics disables the
+// recording, which is the default. It may be called while commands are being
+// evaluated.
+func SetEvalMetrics(m *EvalMetrics) {
+	globalEvalMetrics.Store(m)
+}
+
+// lastMethod is the last roachpb.Method, up to which EvalMetrics creates
+// histograms.
+const lastMethod = roachpb.AdminVerifyProtectedTimestamp
+
+// EvalMetrics tracks a latency histogram of command evaluation per
+// roachpb.Method. It contains a histogram for every method, so that commands
+// registered after it was created are recorded as well.
+type EvalMetrics struct {
+	// latencies is immutable after creation, while the histograms it contains
+	// synchronize internally.
+	latencies map[roachpb.Method]*metric.Histogram
+}
+
+// NewEvalMetrics creates an EvalMetrics with a latency histogram for each
+// method, whose windowed portion retains values for approximately
+// histogramWindow.
+func NewEvalMetrics(histogramWindow time.Duration) *EvalMetrics {
+	m := &EvalMetrics{latencies: make(map[roachpb.Method]*metric.Histogram, lastMethod+1)}
+	for method := roachpb.Method(0); method <= lastMethod; method++ {
+		m.latencies[method] = metric.NewLatency(metric.Metadata{
+			Name:        fmt.Sprintf("eval.%s.latency", strings.ToLower(method.String())),
+			Help:        fmt.Sprintf("Latency histogram for evaluating %s commands", method),
+			Measurement: "Latency",
+			Unit:        metric.Unit_NANOSECONDS,
+		}, histogramWindow)
+	}
+	return m
+}
+
+// Record records an evaluation of the command for the provided method that
+// took the given duration. It is a no-op for unknown methods.
+func (m *EvalMetrics) Record(method roachpb.Method, d time.Duration) {
+	if h, ok := m.latencies[method]; ok {
+		h.RecordValue(d.Nanoseconds())
+	}
+}
+
+// Histograms returns the latency histogram of each method, so that they can
+// be added to a metric.Registry.
+func (m *EvalMetrics) Histograms() map[roachpb.Method]*metric.Histogram {
+	res := make(map[roachpb.Method]*metric.Histogram, len(m.latencies))
+	for method, h := range m.latencies {
+		res[method] = h
+	}
+	return res
+}
+
+// Snapshot returns a copy of the cumulative latency histogram of each method.
+func (m *EvalMetrics) Snapshot() map[roachpb.Method]*hdrhistogram.Histogram {
+	res := make(map[roachpb.Method]*hdrhistogram.Histogram, len(m.latencies))
+	for method, h := range m.latencies {
+		res[method] = h.Snapshot()
+	}
+	return res
+}
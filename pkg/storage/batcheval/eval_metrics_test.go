@@ -0,0 +1,73 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvalMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	m := NewEvalMetrics(time.Minute)
+	SetEvalMetrics(m)
+	defer SetEvalMetrics(nil)
+
+	// Every method has a histogram, including those of commands that are not
+	// registered.
+	hists := m.Histograms()
+	for _, info := range ListCommands() {
+		h, ok := hists[info.Method]
+		require.True(t, ok, "%s", info.Method)
+		require.Zero(t, h.TotalCount())
+	}
+	require.Len(t, hists, int(lastMethod)+1)
+	require.Equal(t, "eval.put.latency", hists[roachpb.Put].GetMetadata().Name)
+	require.Regexp(t, `^Method\(\d+\)$`, (lastMethod + 1).String(), "lastMethod is not the last method")
+
+	cmd := Command{
+		EvalRW: func(
+			context.Context, engine.ReadWriter, CommandArgs, roachpb.Response,
+		) (result.Result, error) {
+			return result.Result{}, nil
+		},
+	}
+	for i := 0; i < 3; i++ {
+		_, err := cmd.Eval(ctx, nil /* rw */, CommandArgs{Args: &roachpb.PutRequest{}}, nil /* resp */)
+		require.NoError(t, err)
+	}
+
+	// Evaluations of methods that were not registered when the EvalMetrics
+	// was created are recorded.
+	_, ok := LookupCommand(roachpb.AdminScatter)
+	require.False(t, ok)
+	_, err := cmd.Eval(ctx, nil /* rw */, CommandArgs{Args: &roachpb.AdminScatterRequest{}}, nil /* resp */)
+	require.NoError(t, err)
+
+	snap := m.Snapshot()
+	require.Equal(t, int64(3), snap[roachpb.Put].TotalCount())
+	require.Zero(t, snap[roachpb.Get].TotalCount())
+	require.Equal(t, int64(1), snap[roachpb.AdminScatter].TotalCount())
+
+	// The snapshot is a copy.
+	m.Record(roachpb.Put, time.Millisecond)
+	require.Equal(t, int64(3), snap[roachpb.Put].TotalCount())
+	require.Equal(t, int64(4), m.Snapshot()[roachpb.Put].TotalCount())
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/spanset"
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// latchSpanReportEnabled controls whether command evaluation records the
+// spans that each command declares against the spans it actually accesses.
+// This is a diagnostic aid for tightening DeclareKeys implementations and
+// comes with a significant evaluation overhead.
+var latchSpanReportEnabled = envutil.EnvOrDefaultBool("COCKROACH_LATCH_SPAN_REPORT", false)
+
+var globalLatchSpanReport = NewLatchSpanReport()
+
+// GlobalLatchSpanReport returns the process-wide LatchSpanReport that command
+// evaluation contributes to, or nil if the COCKROACH_LATCH_SPAN_REPORT
+// environment variable is not set.
+func GlobalLatchSpanReport() *LatchSpanReport {
+	if !latchSpanReportEnabled {
+		return nil
+	}
+	return globalLatchSpanReport
+}
+
+// TestingSetLatchSpanReportEnabled is a testing helper that enables or
+// disables the latch span report, returning a function which restores the
+// previous setting.
+func TestingSetLatchSpanReportEnabled(to bool) func() {
+	prev := latchSpanReportEnabled
+	latchSpanReportEnabled = to
+	return func() { latchSpanReportEnabled = prev }
+}
+
+// LatchSpanReport accumulates, per roachpb.Method, a comparison between the
+// spans that commands declare through DeclareKeys and the spans they access
+// during evaluation. A declared span is considered over-declared if it was
+// never accessed, or if it was declared for writing but only ever read.
+type LatchSpanReport struct {
+	mu struct {
+		syncutil.Mutex
+		methods map[roachpb.Method]*LatchSpanStats
+	}
+}
+
+// LatchSpanStats are the statistics collected by a LatchSpanReport for a
+// single method.
+type LatchSpanStats struct {
+	// Evaluations is the number of recorded command evaluations.
+	Evaluations int
+	// DeclaredSpans is the total number of spans declared across all recorded
+	// evaluations.
+	DeclaredSpans int
+	// UnaccessedSpans is the number of declared spans that were not accessed
+	// at all during evaluation.
+	UnaccessedSpans int
+	// ReadOnlyWriteSpans is the number of spans declared for writing that were
+	// only read during evaluation.
+	ReadOnlyWriteSpans int
+}
+
+// OverDeclared returns whether any over-declaration was observed.
+func (s LatchSpanStats) OverDeclared() bool {
+	return s.UnaccessedSpans > 0 || s.ReadOnlyWriteSpans > 0
+}
+
+// NewLatchSpanReport creates an empty LatchSpanReport.
+func NewLatchSpanReport() *LatchSpanReport {
+	r := &LatchSpanReport{}
+	r.mu.methods = make(map[roachpb.Method]*LatchSpanStats)
+	return r
+}
+
+// Record adds the evaluation of a single command with the provided method to
+// the report. declared is the SpanSet populated by the command's DeclareKeys
+// and accessed is the recording SpanSet captured during its evaluation (see
+// spanset.NewRecordingReadWriter).
+func (r *LatchSpanReport) Record(method roachpb.Method, declared, accessed *spanset.SpanSet) {
+	var declaredSpans, unaccessed, readOnlyWrites int
+	for sa := spanset.SpanAccess(0); sa < spanset.NumSpanAccess; sa++ {
+		for ss := spanset.SpanScope(0); ss < spanset.NumSpanScope; ss++ {
+			for _, d := range declared.GetSpans(sa, ss) {
+				declaredSpans++
+				read := spanAccessed(accessed, spanset.SpanReadOnly, ss, d.Span)
+				written := spanAccessed(accessed, spanset.SpanReadWrite, ss, d.Span)
+				switch {
+				case !read && !written:
+					unaccessed++
+				case sa == spanset.SpanReadWrite && !written:
+					readOnlyWrites++
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats, ok := r.mu.methods[method]
+	if !ok {
+		stats = &LatchSpanStats{}
+		r.mu.methods[method] = stats
+	}
+	stats.Evaluations++
+	stats.DeclaredSpans += declaredSpans
+	stats.UnaccessedSpans += unaccessed
+	stats.ReadOnlyWriteSpans += readOnlyWrites
+}
+
+// spanAccessed returns whether any span accessed with the given access and
+// scope overlaps the provided declared span.
+func spanAccessed(
+	accessed *spanset.SpanSet, sa spanset.SpanAccess, ss spanset.SpanScope, span roachpb.Span,
+) bool {
+	for _, a := range accessed.GetSpans(sa, ss) {
+		if a.Span.Overlaps(span) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns a copy of the statistics collected for each method.
+func (r *LatchSpanReport) Stats() map[roachpb.Method]LatchSpanStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make(map[roachpb.Method]LatchSpanStats, len(r.mu.methods))
+	for m, s := range r.mu.methods {
+		res[m] = *s
+	}
+	return res
+}
+
+// Reset clears all statistics collected by the report.
+func (r *LatchSpanReport) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.methods = make(map[roachpb.Method]*LatchSpanStats)
+}
+
+// String prints one line per recorded method, flagging methods for which
+// over-declaration was observed.
+func (r *LatchSpanReport) String() string {
+	stats := r.Stats()
+	methods := make([]roachpb.Method, 0, len(stats))
+	for m := range stats {
+		methods = append(methods, m)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+
+	var buf strings.Builder
+	for _, m := range methods {
+		s := stats[m]
+		fmt.Fprintf(&buf, "%s: %d evaluations, %d declared spans, %d unaccessed, %d write-declared but only read",
+			m, s.Evaluations, s.DeclaredSpans, s.UnaccessedSpans, s.ReadOnlyWriteSpans)
+		if s.OverDeclared() {
+			buf.WriteString(" (over-declared)")
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/spanset"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatchSpanReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	ts := hlc.Timestamp{WallTime: 1}
+	keyA, keyB, keyC := roachpb.Key("a"), roachpb.Key("b"), roachpb.Key("c")
+
+	// Declare a write on a, a write on b and a read on c, but only write a and
+	// read b through the recording ReadWriter.
+	var declared spanset.SpanSet
+	declared.AddMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keyA}, ts)
+	declared.AddMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keyB}, ts)
+	declared.AddMVCC(spanset.SpanReadOnly, roachpb.Span{Key: keyC}, ts)
+
+	accessed := spanset.MakeRecordingSpanSet()
+	rw := spanset.NewRecordingReadWriter(eng, &accessed)
+	require.NoError(t, rw.Put(engine.MakeMVCCMetadataKey(keyA), []byte("val")))
+	//lint:ignore SA1019 the deprecated Get is a convenient way to read a key
+	_, err := rw.Get(engine.MakeMVCCMetadataKey(keyB))
+	require.NoError(t, err)
+
+	r := NewLatchSpanReport()
+	r.Record(roachpb.Put, &declared, &accessed)
+	r.Record(roachpb.Get, &spanset.SpanSet{}, &spanset.SpanSet{})
+
+	stats := r.Stats()
+	require.Equal(t, LatchSpanStats{
+		Evaluations:        1,
+		DeclaredSpans:      3,
+		UnaccessedSpans:    1,
+		ReadOnlyWriteSpans: 1,
+	}, stats[roachpb.Put])
+	require.True(t, stats[roachpb.Put].OverDeclared())
+	require.Equal(t, LatchSpanStats{Evaluations: 1}, stats[roachpb.Get])
+	require.False(t, stats[roachpb.Get].OverDeclared())
+
+	require.Equal(t,
+		"Get: 1 evaluations, 0 declared spans, 0 unaccessed, 0 write-declared but only read\n"+
+			"Put: 1 evaluations, 3 declared spans, 1 unaccessed, 1 write-declared but only read (over-declared)\n",
+		r.String())
+
+	r.Reset()
+	require.Empty(t, r.Stats())
+}
@@ -13,8 +13,10 @@ package result
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/kr/pretty"
@@ -134,9 +136,16 @@ func (lResult *LocalResult) DetachEndTxns(alwaysOnly bool) []EndTxnIntents {
 // c) data which isn't sent to the followers but the proposer needs for tasks
 //    it must run when the command has applied (such as resolving intents).
 type Result struct {
-	Local        LocalResult
-	Replicated   storagepb.ReplicatedEvalResult
-	WriteBatch   *storagepb.WriteBatch
+	Local      LocalResult
+	Replicated storagepb.ReplicatedEvalResult
+	WriteBatch *storagepb.WriteBatch
+	// LogicalOpLog holds the logical MVCC operations produced by the command,
+	// which are forwarded through Raft to the range's rangefeed Processor via
+	// ConsumeLogicalOps once the command applies. Operations performed through
+	// the engine are logged by the replication layer itself when a rangefeed
+	// may be active; commands use AddLogicalOps only for effects that the
+	// engine cannot observe, and such ops are appended after the engine's.
+	// They are dropped if the replica is not logging ops for rangefeeds.
 	LogicalOpLog *storagepb.LogicalOpLog
 }
 
@@ -157,12 +166,77 @@ func (p *Result) IsZero() bool {
 	return true
 }
 
+// AddLogicalOps appends the supplied logical ops to the Result's
+// LogicalOpLog, allocating it if necessary. See the comment on LogicalOpLog.
+func (p *Result) AddLogicalOps(ops ...enginepb.MVCCLogicalOp) {
+	if len(ops) == 0 {
+		return
+	}
+	if p.LogicalOpLog == nil {
+		p.LogicalOpLog = &storagepb.LogicalOpLog{}
+	}
+	p.LogicalOpLog.Ops = append(p.LogicalOpLog.Ops, ops...)
+}
+
 // coalesceBool ORs rhs into lhs and then zeroes rhs.
 func coalesceBool(lhs *bool, rhs *bool) {
 	*lhs = *lhs || *rhs
 	*rhs = false
 }
 
+// MergeConflictError is returned by MergeChecked when two Results set the same
+// side effect, of which a merged Result can only carry one.
+type MergeConflictError struct {
+	// Fields names the conflicting fields.
+	Fields []string
+}
+
+func (e *MergeConflictError) Error() string {
+	return fmt.Sprintf("conflicting %s", strings.Join(e.Fields, ", "))
+}
+
+// conflicts returns the names of the mutually exclusive side effects that are
+// set on both p and q.
+func (p *Result) conflicts(q *Result) []string {
+	var fields []string
+	check := func(name string, pSet, qSet bool) {
+		if pSet && qSet {
+			fields = append(fields, name)
+		}
+	}
+	if ps, qs := p.Replicated.State, q.Replicated.State; ps != nil && qs != nil {
+		check("RangeDescriptor", ps.Desc != nil, qs.Desc != nil)
+		check("Lease", ps.Lease != nil, qs.Lease != nil)
+		check("TruncatedState", ps.TruncatedState != nil, qs.TruncatedState != nil)
+	}
+	check("Split", p.Replicated.Split != nil, q.Replicated.Split != nil)
+	check("Merge", p.Replicated.Merge != nil, q.Replicated.Merge != nil)
+	check("ChangeReplicas", p.Replicated.ChangeReplicas != nil, q.Replicated.ChangeReplicas != nil)
+	check("ComputeChecksum", p.Replicated.ComputeChecksum != nil, q.Replicated.ComputeChecksum != nil)
+	check("RaftLogDelta", p.Replicated.RaftLogDelta != 0, q.Replicated.RaftLogDelta != 0)
+	check("AddSSTable", p.Replicated.AddSSTable != nil, q.Replicated.AddSSTable != nil)
+	check("lease expiration", p.Replicated.PrevLeaseProposal != nil, q.Replicated.PrevLeaseProposal != nil)
+	check("MaybeGossipNodeLiveness", p.Local.MaybeGossipNodeLiveness != nil, q.Local.MaybeGossipNodeLiveness != nil)
+	check("Reply", p.Local.Reply != nil, q.Local.Reply != nil)
+	check("WriteBatch", p.WriteBatch != nil, q.WriteBatch != nil)
+	return fields
+}
+
+// MergeChecked is like MergeAndDestroy, but first verifies that the supplied
+// Result does not set any of the mutually exclusive side effects that are
+// already set on p. If it does, a *MergeConflictError naming all of them is
+// returned and p is left unmodified, whereas MergeAndDestroy may have absorbed
+// part of q by the time it detects a conflict, and fatals on conflicting
+// fields that it does not handle.
+//
+// The passed Result must not be used once passed to MergeChecked.
+func (p *Result) MergeChecked(q Result) error {
+	if fields := p.conflicts(&q); len(fields) > 0 {
+		return &MergeConflictError{Fields: fields}
+	}
+	return p.MergeAndDestroy(q)
+}
+
 // MergeAndDestroy absorbs the supplied EvalResult while validating that the
 // resulting EvalResult makes sense. For example, it is forbidden to absorb
 // two lease updates or log truncations, or multiple splits and/or merges.
@@ -14,6 +14,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 )
@@ -84,3 +85,70 @@ func TestMergeAndDestroy(t *testing.T) {
 		t.Fatalf("expected %d, got %d", exp, f)
 	}
 }
+
+func TestAddLogicalOps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	makeOp := func(key string) enginepb.MVCCLogicalOp {
+		var op enginepb.MVCCLogicalOp
+		op.MustSetValue(&enginepb.MVCCWriteValueOp{Key: []byte(key)})
+		return op
+	}
+
+	var r0, r1 Result
+	r0.AddLogicalOps()
+	if !r0.IsZero() {
+		t.Fatalf("%v unexpectedly non-zero", r0)
+	}
+
+	r0.AddLogicalOps(makeOp("a"))
+	r1.AddLogicalOps(makeOp("b"), makeOp("c"))
+	if err := r0.MergeAndDestroy(r1); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, op := range r0.LogicalOpLog.Ops {
+		keys = append(keys, string(op.WriteValue.Key))
+	}
+	if exp := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected ops for keys %v, got %v", exp, keys)
+	}
+}
+
+func TestMergeChecked(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var p Result
+	p.Replicated.Split = &storagepb.Split{}
+	p.WriteBatch = &storagepb.WriteBatch{}
+
+	// Results that set different side effects merge.
+	var q Result
+	q.Replicated.Merge = &storagepb.Merge{}
+	q.Local.GossipFirstRange = true
+	if err := p.MergeChecked(q); err != nil {
+		t.Fatal(err)
+	}
+	if p.Replicated.Merge == nil || !p.Local.GossipFirstRange {
+		t.Fatalf("result not absorbed: %v", p)
+	}
+
+	// Results that set the same mutually exclusive side effects are rejected,
+	// and the receiver is left unmodified.
+	var r Result
+	r.Replicated.Split = &storagepb.Split{}
+	r.Replicated.ChangeReplicas = &storagepb.ChangeReplicas{}
+	r.WriteBatch = &storagepb.WriteBatch{}
+	err := p.MergeChecked(r)
+	conflict, ok := err.(*MergeConflictError)
+	if !ok {
+		t.Fatalf("expected MergeConflictError, got %v", err)
+	}
+	if exp := []string{"Split", "WriteBatch"}; !reflect.DeepEqual(conflict.Fields, exp) {
+		t.Fatalf("expected conflicting fields %v, got %v", exp, conflict.Fields)
+	}
+	if p.Replicated.ChangeReplicas != nil {
+		t.Fatalf("result unexpectedly modified: %v", p)
+	}
+}
@@ -1756,6 +1756,7 @@ func mvccPutInternal(
 	logicalOpDetails := MVCCLogicalOpDetails{
 		Key:       key,
 		Timestamp: writeTimestamp,
+		Deleted:   buf.newMeta.Deleted,
 		Safe:      true,
 	}
 	if txn := buf.newMeta.Txn; txn != nil {
@@ -2875,6 +2876,7 @@ func mvccResolveWriteIntent(
 			Txn:       intent.Txn,
 			Key:       intent.Key,
 			Timestamp: intent.Txn.WriteTimestamp,
+			Deleted:   meta.Deleted,
 		})
 
 		return true, nil
@@ -43,6 +43,8 @@ const (
 	MVCCCommitIntentOpType
 	// MVCCAbortIntentOpType corresponds to the MVCCAbortIntentOp variant.
 	MVCCAbortIntentOpType
+	// MVCCIngestSSTableOpType corresponds to the MVCCIngestSSTableOp variant.
+	MVCCIngestSSTableOpType
 )
 
 // MVCCLogicalOpDetails contains details about the occurrence of an MVCC logical
@@ -50,7 +52,12 @@ const (
 type MVCCLogicalOpDetails struct {
 	Txn       enginepb.TxnMeta
 	Key       roachpb.Key
+	EndKey    roachpb.Key
 	Timestamp hlc.Timestamp
+	Data      []byte
+	// Deleted indicates that the value written or committed by the operation
+	// is a deletion tombstone.
+	Deleted bool
 
 	// Safe indicates that the values in this struct will never be invalidated
 	// at a later point. If the details object cannot promise that its values
@@ -104,6 +111,7 @@ func (ol *OpLoggerBatch) logLogicalOp(op MVCCLogicalOpType, details MVCCLogicalO
 		ol.recordOp(&enginepb.MVCCWriteValueOp{
 			Key:       details.Key,
 			Timestamp: details.Timestamp,
+			Deleted:   details.Deleted,
 		})
 	case MVCCWriteIntentOpType:
 		if !details.Safe {
@@ -130,11 +138,25 @@ func (ol *OpLoggerBatch) logLogicalOp(op MVCCLogicalOpType, details MVCCLogicalO
 			TxnID:     details.Txn.ID,
 			Key:       details.Key,
 			Timestamp: details.Timestamp,
+			Deleted:   details.Deleted,
 		})
 	case MVCCAbortIntentOpType:
 		ol.recordOp(&enginepb.MVCCAbortIntentOp{
 			TxnID: details.Txn.ID,
 		})
+	case MVCCIngestSSTableOpType:
+		if !details.Safe {
+			ol.opsAlloc, details.Key = ol.opsAlloc.Copy(details.Key, 0)
+			ol.opsAlloc, details.EndKey = ol.opsAlloc.Copy(details.EndKey, 0)
+			details.Data = append([]byte(nil), details.Data...)
+		}
+
+		ol.recordOp(&enginepb.MVCCIngestSSTableOp{
+			Data:      details.Data,
+			StartKey:  details.Key,
+			EndKey:    details.EndKey,
+			Timestamp: details.Timestamp,
+		})
 	default:
 		panic(fmt.Sprintf("unexpected op type %v", op))
 	}
@@ -167,3 +167,64 @@ func TestMVCCOpLogWriter(t *testing.T) {
 		})
 	}
 }
+
+func TestMVCCOpLogWriterDeletions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	for _, engineImpl := range mvccEngineImpls {
+		t.Run(engineImpl.name, func(t *testing.T) {
+			engine := engineImpl.create()
+			defer engine.Close()
+
+			batch := engine.NewBatch()
+			ol := NewOpLoggerBatch(batch)
+			defer ol.Close()
+
+			// Delete a key outside of a transaction, and delete another key in a
+			// transaction that then commits.
+			if err := MVCCDelete(ctx, ol, nil, testKey1, hlc.Timestamp{Logical: 1}, nil); err != nil {
+				t.Fatal(err)
+			}
+			txn1ts := makeTxn(*txn1, hlc.Timestamp{Logical: 2})
+			if err := MVCCDelete(ctx, ol, nil, testKey2, txn1ts.ReadTimestamp, txn1ts); err != nil {
+				t.Fatal(err)
+			}
+			txn1CommitTS := *txn1Commit
+			txn1CommitTS.WriteTimestamp = hlc.Timestamp{Logical: 2}
+			if _, err := MVCCResolveWriteIntent(ctx, ol, nil,
+				roachpb.MakeIntent(&txn1CommitTS, roachpb.Span{Key: testKey2}),
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			// Both tombstones are marked as deletions.
+			makeOp := func(val interface{}) enginepb.MVCCLogicalOp {
+				var op enginepb.MVCCLogicalOp
+				op.MustSetValue(val)
+				return op
+			}
+			exp := []enginepb.MVCCLogicalOp{
+				makeOp(&enginepb.MVCCWriteValueOp{
+					Key:       testKey1,
+					Timestamp: hlc.Timestamp{Logical: 1},
+					Deleted:   true,
+				}),
+				makeOp(&enginepb.MVCCWriteIntentOp{
+					TxnID:           txn1.ID,
+					TxnKey:          txn1.Key,
+					TxnMinTimestamp: txn1.MinTimestamp,
+					Timestamp:       hlc.Timestamp{Logical: 2},
+				}),
+				makeOp(&enginepb.MVCCCommitIntentOp{
+					TxnID:     txn1.ID,
+					Key:       testKey2,
+					Timestamp: hlc.Timestamp{Logical: 2},
+					Deleted:   true,
+				}),
+			}
+			if diff := pretty.Diff(exp, ol.LogicalOps()); diff != nil {
+				t.Errorf("unexpected logical op differences:\n%s", strings.Join(diff, "\n"))
+			}
+		})
+	}
+}
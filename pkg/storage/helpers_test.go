@@ -434,11 +434,12 @@ func SetMockAddSSTable() (undo func()) {
 		}, nil
 	}
 
-	batcheval.UnregisterCommand(roachpb.AddSSTable)
-	batcheval.RegisterReadWriteCommand(roachpb.AddSSTable, batcheval.DefaultDeclareKeys, evalAddSSTable)
+	mock := prev
+	mock.DeclareKeys = batcheval.DefaultDeclareKeys
+	mock.EvalRW = evalAddSSTable
+	batcheval.OverrideCommand(roachpb.AddSSTable, mock)
 	return func() {
-		batcheval.UnregisterCommand(roachpb.AddSSTable)
-		batcheval.RegisterReadWriteCommand(roachpb.AddSSTable, prev.DeclareKeys, prev.EvalRW)
+		batcheval.OverrideCommand(roachpb.AddSSTable, prev)
 	}
 }
 
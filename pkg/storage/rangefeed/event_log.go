@@ -0,0 +1,179 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package rangefeed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/pkg/errors"
+)
+
+// EventLog is a write-ahead log of the events published by a Processor. When
+// configured, each value and checkpoint event is appended to the log before it
+// is delivered to any registration, allowing events that were not delivered
+// before a crash to be replayed to consumers when they reconnect. See
+// ReplayEventLog.
+type EventLog interface {
+	// Append adds the event to the log. If an error is returned, the event is
+	// not delivered and the Processor stops, so the log is not appended to
+	// again.
+	Append(event *roachpb.RangeFeedEvent) error
+}
+
+// SyncPolicy determines when a FileEventLog syncs appended events to disk.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves syncing to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncOnCheckpoint syncs the log before each checkpoint is delivered, such
+	// that all values beneath a delivered checkpoint are durable.
+	SyncOnCheckpoint
+	// SyncAlways syncs the log before each event is delivered.
+	SyncAlways
+)
+
+// FileEventLog is an EventLog that appends length-prefixed, protobuf-encoded
+// events to a file.
+//
+// The log is never truncated. It grows with every appended event and
+// ReplayEventLog always reads it from the start, so callers must bound its
+// size themselves, e.g. by switching to a new log for a new Processor once
+// all consumers have observed a checkpoint past the events of the old one.
+// A FileEventLog must not be used after an operation on it fails, since its
+// buffered writer retains the first error.
+type FileEventLog struct {
+	f      *os.File
+	w      *bufio.Writer
+	policy SyncPolicy
+	buf    []byte
+}
+
+var _ EventLog = &FileEventLog{}
+
+// OpenFileEventLog opens the event log at the provided path, creating it if it
+// does not exist. New events are appended after any existing events.
+func OpenFileEventLog(path string, policy SyncPolicy) (*FileEventLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileEventLog{f: f, w: bufio.NewWriter(f), policy: policy}, nil
+}
+
+// Append implements the EventLog interface.
+func (l *FileEventLog) Append(event *roachpb.RangeFeedEvent) error {
+	size := event.Size()
+	if need := binary.MaxVarintLen64 + size; cap(l.buf) < need {
+		l.buf = make([]byte, need)
+	}
+	buf := l.buf[:cap(l.buf)]
+	n := binary.PutUvarint(buf, uint64(size))
+	if _, err := protoutil.MarshalToWithoutFuzzing(event, buf[n:n+size]); err != nil {
+		return err
+	}
+	if _, err := l.w.Write(buf[:n+size]); err != nil {
+		return err
+	}
+	if l.policy == SyncAlways || (l.policy == SyncOnCheckpoint && event.Checkpoint != nil) {
+		return l.Sync()
+	}
+	return nil
+}
+
+// Sync flushes all appended events and syncs them to disk.
+func (l *FileEventLog) Sync() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Close flushes all appended events and closes the log.
+func (l *FileEventLog) Close() error {
+	if err := l.w.Flush(); err != nil {
+		_ = l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// ReplayEventLog reads the events in the event log provided by r and calls fn
+// with each event that a registration over the provided span with the given
+// start timestamp would have observed. Checkpoints and range deletions are
+// constrained to the span. A partially written event at the end of the log, as
+// may be left behind by a crash, is ignored. The entire log is read, however
+// far startTS is past its first events.
+func ReplayEventLog(
+	r io.Reader,
+	span roachpb.Span,
+	startTS hlc.Timestamp,
+	fn func(*roachpb.RangeFeedEvent) error,
+) error {
+	br := bufio.NewReader(r)
+	var buf []byte
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if uint64(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(br, buf); err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var event roachpb.RangeFeedEvent
+		if err := protoutil.Unmarshal(buf, &event); err != nil {
+			return errors.Wrap(err, "decoding rangefeed event log entry")
+		}
+		switch t := event.GetValue().(type) {
+		case *roachpb.RangeFeedValue:
+			if !span.ContainsKey(t.Key) || !startTS.Less(t.Value.Timestamp) {
+				continue
+			}
+		case *roachpb.RangeFeedDeleteRange:
+			if !t.Span.Overlaps(span) || !startTS.Less(t.Timestamp) {
+				continue
+			}
+			t.Span = constrainSpan(t.Span, span)
+		case *roachpb.RangeFeedSSTable:
+			if !t.Span.Overlaps(span) || !startTS.Less(t.WriteTS) {
+				continue
+			}
+			t.Span = constrainSpan(t.Span, span)
+		case *roachpb.RangeFeedCheckpoint:
+			if !t.Span.Overlaps(span) || !startTS.Less(t.ResolvedTS) {
+				continue
+			}
+			t.Span = constrainSpan(t.Span, span)
+		default:
+			return errors.Errorf("unexpected RangeFeedEvent variant in event log: %v", t)
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+}
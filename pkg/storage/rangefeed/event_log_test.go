@@ -0,0 +1,97 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package rangefeed
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileEventLog(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "events")
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	value := func(key string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(roachpb.Key(key), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(wall)})
+	}
+	checkpoint := func(span roachpb.Span, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span, ts(wall))
+	}
+	deleteRange := func(key, endKey string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedDeleteRange(roachpb.Span{Key: roachpb.Key(key), EndKey: roachpb.Key(endKey)}, ts(wall))
+	}
+	spanAZ := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")}
+	events := []*roachpb.RangeFeedEvent{
+		value("b", 1),
+		value("m", 2),
+		checkpoint(spanAZ, 2),
+		value("c", 3),
+		deleteRange("f", "p", 3),
+		value("n", 4),
+		checkpoint(spanAZ, 4),
+	}
+
+	// Append the events over two openings of the log, with different sync
+	// policies.
+	l, err := OpenFileEventLog(path, SyncOnCheckpoint)
+	require.NoError(t, err)
+	for _, e := range events[:3] {
+		require.NoError(t, l.Append(e))
+	}
+	require.NoError(t, l.Close())
+	l, err = OpenFileEventLog(path, SyncAlways)
+	require.NoError(t, err)
+	for _, e := range events[3:] {
+		require.NoError(t, l.Append(e))
+	}
+	require.NoError(t, l.Close())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	replay := func(data []byte, span roachpb.Span, startTS hlc.Timestamp) []*roachpb.RangeFeedEvent {
+		var res []*roachpb.RangeFeedEvent
+		require.NoError(t, ReplayEventLog(bytes.NewReader(data), span, startTS,
+			func(e *roachpb.RangeFeedEvent) error {
+				res = append(res, e)
+				return nil
+			}))
+		return res
+	}
+
+	// Replay the entire log.
+	require.Equal(t, events, replay(data, spanAZ, hlc.Timestamp{}))
+
+	// Replay the log for a narrower span and a later start timestamp.
+	spanAH := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("h")}
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{value("c", 3), deleteRange("f", "h", 3), checkpoint(spanAH, 4)},
+		replay(data, spanAH, ts(2)),
+	)
+
+	// A partially written event at the end of the log is ignored.
+	require.Equal(t, events[:6], replay(data[:len(data)-3], spanAZ, hlc.Timestamp{}))
+
+	// Corrupted entries are reported.
+	err = ReplayEventLog(bytes.NewReader([]byte{0x02, 0xff, 0xff}), spanAZ, hlc.Timestamp{},
+		func(*roachpb.RangeFeedEvent) error { return nil })
+	require.Error(t, err)
+}
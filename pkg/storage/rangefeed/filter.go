@@ -31,10 +31,16 @@ func newFilterFromRegistry(reg *registry) *Filter {
 	}
 	reg.tree.Do(func(i interval.Interface) (done bool) {
 		r := i.(*registration)
-		if r.withDiff {
-			f.needPrevVals.Add(r.Range())
+		if r.checkpointsOnly {
+			// Checkpoints don't carry values.
+			return false
+		}
+		for _, s := range r.keySpans() {
+			if r.withDiff {
+				f.needPrevVals.Add(s.AsRange())
+			}
+			f.needVals.Add(s.AsRange())
 		}
-		f.needVals.Add(r.Range())
 		return false
 	})
 	return f
@@ -0,0 +1,134 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package rangefeed
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/pkg/errors"
+)
+
+// The field numbers and wire types needed to walk the encoding of a
+// storagepb.LogicalOpLog without decoding it.
+const (
+	// logicalOpLogOpsField is the field number of LogicalOpLog.ops.
+	logicalOpLogOpsField = 1
+	// writeValueOpField is the field number of MVCCLogicalOp.write_value.
+	writeValueOpField = 1
+	// writeValueOpKeyField is the field number of MVCCWriteValueOp.key.
+	writeValueOpKeyField = 1
+
+	wireTypeVarint = 0
+	wireType64     = 1
+	wireTypeBytes  = 2
+	wireType32     = 5
+)
+
+var errMalformedLogicalOpLog = errors.New("malformed logical op log")
+
+// decodeLogicalOps decodes the logical operations in buf, which holds the
+// encoding of a storagepb.LogicalOpLog. MVCCWriteValueOps, whose only effect
+// on a Processor is the value they publish, are skipped without being decoded
+// if wantKey returns false for their key; the number of skipped operations is
+// returned. All other operations are decoded, since they may affect the
+// resolved timestamp.
+func decodeLogicalOps(
+	buf []byte, wantKey func(roachpb.Key) bool,
+) (ops []enginepb.MVCCLogicalOp, skipped int, _ error) {
+	for len(buf) > 0 {
+		num, typ, op, rest, err := nextField(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		buf = rest
+		if num != logicalOpLogOpsField || typ != wireTypeBytes {
+			// Ignore unknown fields, like the generated code does.
+			continue
+		}
+		key, ok, err := writeValueOpKey(op)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok && !wantKey(key) {
+			skipped++
+			continue
+		}
+		ops = append(ops, enginepb.MVCCLogicalOp{})
+		if err := protoutil.Unmarshal(op, &ops[len(ops)-1]); err != nil {
+			return nil, 0, errors.Wrap(err, "decoding logical op")
+		}
+	}
+	return ops, skipped, nil
+}
+
+// writeValueOpKey returns the key of the operation, and true, if op is the
+// encoding of an MVCCLogicalOp that holds an MVCCWriteValueOp. The key aliases
+// op.
+func writeValueOpKey(op []byte) (roachpb.Key, bool, error) {
+	if len(op) == 0 {
+		return nil, false, nil
+	}
+	num, typ, val, _, err := nextField(op)
+	if err != nil || num != writeValueOpField || typ != wireTypeBytes {
+		return nil, false, err
+	}
+	for len(val) > 0 {
+		num, typ, field, rest, err := nextField(val)
+		if err != nil {
+			return nil, false, err
+		}
+		if num == writeValueOpKeyField && typ == wireTypeBytes {
+			return roachpb.Key(field), true, nil
+		}
+		val = rest
+	}
+	return nil, true, nil
+}
+
+// nextField decodes the tag of the protobuf field at the start of buf. It
+// returns the field's number and wire type, its payload if it is
+// length-delimited, and the remainder of buf following the field.
+func nextField(buf []byte) (num, typ int, val, rest []byte, _ error) {
+	tag, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, 0, nil, nil, errMalformedLogicalOpLog
+	}
+	buf = buf[n:]
+	num, typ = int(tag>>3), int(tag&7)
+	switch typ {
+	case wireTypeVarint:
+		if _, n = binary.Uvarint(buf); n <= 0 {
+			return 0, 0, nil, nil, errMalformedLogicalOpLog
+		}
+		return num, typ, nil, buf[n:], nil
+	case wireType64, wireType32:
+		size := 8
+		if typ == wireType32 {
+			size = 4
+		}
+		if len(buf) < size {
+			return 0, 0, nil, nil, errMalformedLogicalOpLog
+		}
+		return num, typ, nil, buf[size:], nil
+	case wireTypeBytes:
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || l > uint64(len(buf)-n) {
+			return 0, 0, nil, nil, errMalformedLogicalOpLog
+		}
+		end := n + int(l)
+		return num, typ, buf[n:end], buf[end:], nil
+	default:
+		return 0, 0, nil, nil, errMalformedLogicalOpLog
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package rangefeed
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeLogicalOps(t *testing.T, ops ...enginepb.MVCCLogicalOp) []byte {
+	t.Helper()
+	buf, err := protoutil.Marshal(&storagepb.LogicalOpLog{Ops: ops})
+	require.NoError(t, err)
+	return buf
+}
+
+func TestDecodeLogicalOps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ts := hlc.Timestamp{WallTime: 5}
+	txnID := uuid.MakeV4()
+	ops := []enginepb.MVCCLogicalOp{
+		writeValueOpWithKV(roachpb.Key("a"), ts, []byte("val1")),
+		writeIntentOpWithKey(txnID, roachpb.Key("b"), ts),
+		writeValueOpWithKV(roachpb.Key("c"), ts, []byte("val2")),
+		commitIntentOpWithKV(txnID, roachpb.Key("b"), ts, []byte("val3")),
+		writeValueOpWithKV(roachpb.Key("d"), ts, nil),
+	}
+	buf := encodeLogicalOps(t, ops...)
+
+	// All operations are decoded if all keys are wanted.
+	dec, skipped, err := decodeLogicalOps(buf, func(roachpb.Key) bool { return true })
+	require.NoError(t, err)
+	require.Zero(t, skipped)
+	require.Equal(t, ops, dec)
+
+	// Only the value writes to unwanted keys are skipped.
+	var checked []string
+	dec, skipped, err = decodeLogicalOps(buf, func(key roachpb.Key) bool {
+		checked = append(checked, string(key))
+		return key.Equal(roachpb.Key("c"))
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, skipped)
+	require.Equal(t, []enginepb.MVCCLogicalOp{ops[1], ops[2], ops[3]}, dec)
+	require.Equal(t, []string{"a", "c", "d"}, checked)
+
+	// An empty buffer holds no operations.
+	dec, skipped, err = decodeLogicalOps(nil, func(roachpb.Key) bool { return true })
+	require.NoError(t, err)
+	require.Zero(t, skipped)
+	require.Nil(t, dec)
+
+	// Truncated buffers are rejected.
+	for i := 1; i < len(buf); i++ {
+		if _, _, err := decodeLogicalOps(buf[:i], func(roachpb.Key) bool { return false }); err != nil {
+			continue
+		}
+		// The truncation may fall between operations.
+		prefix, _, err := decodeLogicalOps(buf[:i], func(roachpb.Key) bool { return true })
+		require.NoError(t, err)
+		require.Equal(t, i, len(encodeLogicalOps(t, prefix...)), "truncated at %d", i)
+	}
+}
@@ -13,6 +13,7 @@ package rangefeed
 import (
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil/singleflight"
@@ -25,13 +26,107 @@ var (
 		Measurement: "Nanoseconds",
 		Unit:        metric.Unit_NANOSECONDS,
 	}
+	metaRangeFeedRegistrations = metric.Metadata{
+		Name:        "kv.rangefeed.registrations",
+		Help:        "Number of active RangeFeed registrations",
+		Measurement: "Registrations",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedUnresolvedIntents = metric.Metadata{
+		Name:        "kv.rangefeed.unresolved_intents",
+		Help:        "Number of unresolved intents tracked by RangeFeed processors",
+		Measurement: "Intents",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedLogicalOps = metric.Metadata{
+		Name:        "kv.rangefeed.logical_ops",
+		Help:        "Number of logical operations consumed by RangeFeed processors",
+		Measurement: "Operations",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedEventsPublished = metric.Metadata{
+		Name:        "kv.rangefeed.events_published",
+		Help:        "Number of value and checkpoint events published by RangeFeed processors",
+		Measurement: "Events",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedResolvedTSLagNanos = metric.Metadata{
+		Name:        "kv.rangefeed.resolved_ts_lag_nanos",
+		Help:        "Sum over RangeFeed processors of the lag of the resolved timestamp behind the closed timestamp",
+		Measurement: "Nanoseconds",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaRangeFeedClosedTSRegressions = metric.Metadata{
+		Name:        "kv.rangefeed.closed_ts_regressions",
+		Help:        "Number of closed timestamps provided to RangeFeed processors in strict mode that regressed below a previous one",
+		Measurement: "Closed Timestamps",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedDroppedEvents = metric.Metadata{
+		Name:        "kv.rangefeed.dropped_events",
+		Help:        "Number of events that RangeFeed registrations could not buffer because their buffer was exceeded, causing them to be disconnected",
+		Measurement: "Events",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedDroppedBytes = metric.Metadata{
+		Name:        "kv.rangefeed.dropped_bytes",
+		Help:        "Estimated size of the events that RangeFeed registrations could not buffer because their buffer was exceeded",
+		Measurement: "Bytes",
+		Unit:        metric.Unit_BYTES,
+	}
+	metaRangeFeedForcedTxnPushes = metric.Metadata{
+		Name:        "kv.rangefeed.forced_txn_pushes",
+		Help:        "Number of out-of-band transaction pushes triggered by RangeFeed processors because an intent exceeded the maximum intent age",
+		Measurement: "Pushes",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedShedIntentTxns = metric.Metadata{
+		Name:        "kv.rangefeed.shed_intent_txns",
+		Help:        "Number of transactions shed from the unresolved intent queues of RangeFeed processors because the queue exceeded its maximum size, holding back the resolved timestamp",
+		Measurement: "Transactions",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRangeFeedValuesBelowCheckpoint = metric.Metadata{
+		Name:        "kv.rangefeed.values_below_checkpoint",
+		Help:        "Number of committed values published by RangeFeed processors at or below the resolved timestamp of a checkpoint they had already published, which only the transactions excluded from the resolved timestamp can produce",
+		Measurement: "Events",
+		Unit:        metric.Unit_COUNT,
+	}
 )
 
 // Metrics are for production monitoring of RangeFeeds.
 type Metrics struct {
 	RangeFeedCatchupScanNanos *metric.Counter
+	RangeFeedLogicalOps       *metric.Counter
+	RangeFeedEventsPublished  *metric.Counter
+	// RangeFeedDroppedEvents and RangeFeedDroppedBytes count the events, and
+	// their encoded size, that registrations dropped because their buffer
+	// was exceeded. A registration that drops events is disconnected with a
+	// REASON_SLOW_CONSUMER error once it has sent its buffered events.
+	RangeFeedDroppedEvents *metric.Counter
+	RangeFeedDroppedBytes  *metric.Counter
+	// RangeFeedClosedTSRegressions is only maintained by Processors with
+	// Config.StrictClosedTS set.
+	RangeFeedClosedTSRegressions *metric.Counter
+	// RangeFeedForcedTxnPushes is only maintained by Processors with
+	// Config.MaxIntentAge set.
+	RangeFeedForcedTxnPushes *metric.Counter
+	// RangeFeedShedIntentTxns is only maintained by Processors with
+	// Config.MaxIntentQueueSize set.
+	RangeFeedShedIntentTxns *metric.Counter
+	// RangeFeedValuesBelowCheckpoint only counts the values of transactions
+	// excluded with Processor.ExcludeTxns.
+	RangeFeedValuesBelowCheckpoint *metric.Counter
+
+	// The gauges are shared by all of the Processors on a store. Each
+	// Processor adds its own value to them, and withdraws it when it stops.
+	RangeFeedRegistrations      *metric.Gauge
+	RangeFeedUnresolvedIntents  *metric.Gauge
+	RangeFeedResolvedTSLagNanos *metric.Gauge
 
 	RangeFeedSlowClosedTimestampLogN  log.EveryN
+	RangeFeedClosedTSRegressionLogN   log.EveryN
+	RangeFeedShedIntentTxnsLogN       log.EveryN
 	RangeFeedSlowClosedTimestampNudge singleflight.Group
 	// RangeFeedSlowClosedTimestampNudgeSem bounds the amount of work that can be
 	// spun up on behalf of the RangeFeed nudger. We don't expect to hit this
@@ -47,7 +142,50 @@ func (*Metrics) MetricStruct() {}
 func NewMetrics() *Metrics {
 	return &Metrics{
 		RangeFeedCatchupScanNanos:            metric.NewCounter(metaRangeFeedCatchupScanNanos),
+		RangeFeedLogicalOps:                  metric.NewCounter(metaRangeFeedLogicalOps),
+		RangeFeedEventsPublished:             metric.NewCounter(metaRangeFeedEventsPublished),
+		RangeFeedDroppedEvents:               metric.NewCounter(metaRangeFeedDroppedEvents),
+		RangeFeedDroppedBytes:                metric.NewCounter(metaRangeFeedDroppedBytes),
+		RangeFeedRegistrations:               metric.NewGauge(metaRangeFeedRegistrations),
+		RangeFeedUnresolvedIntents:           metric.NewGauge(metaRangeFeedUnresolvedIntents),
+		RangeFeedResolvedTSLagNanos:          metric.NewGauge(metaRangeFeedResolvedTSLagNanos),
+		RangeFeedClosedTSRegressions:         metric.NewCounter(metaRangeFeedClosedTSRegressions),
+		RangeFeedForcedTxnPushes:             metric.NewCounter(metaRangeFeedForcedTxnPushes),
+		RangeFeedShedIntentTxns:              metric.NewCounter(metaRangeFeedShedIntentTxns),
+		RangeFeedValuesBelowCheckpoint:       metric.NewCounter(metaRangeFeedValuesBelowCheckpoint),
 		RangeFeedSlowClosedTimestampLogN:     log.Every(5 * time.Second),
+		RangeFeedClosedTSRegressionLogN:      log.Every(10 * time.Second),
+		RangeFeedShedIntentTxnsLogN:          log.Every(10 * time.Second),
 		RangeFeedSlowClosedTimestampNudgeSem: make(chan struct{}, 1024),
 	}
 }
+
+// ProcessorMetrics is a snapshot of the counters maintained by a single
+// Processor. See Processor.MetricsSnapshot.
+type ProcessorMetrics struct {
+	// LogicalOps is the number of logical operations consumed.
+	LogicalOps int64
+	// ValuesPublished is the number of value events published to the
+	// registrations.
+	ValuesPublished int64
+	// CheckpointsPublished is the number of checkpoint events published to the
+	// registrations.
+	CheckpointsPublished int64
+	// TimerFirings is the number of times that the txn push ticker or the
+	// checkpoint timer was serviced.
+	TimerFirings int64
+	// LateTimerFirings is the number of TimerFirings that were serviced more
+	// than Config.TimerLatenessThreshold after the timer fired. Only
+	// maintained if the threshold is set.
+	LateTimerFirings int64
+	// MaxTimerLateness is the longest delay between a timer firing and the
+	// Processor servicing it.
+	MaxTimerLateness time.Duration
+	// QueueDepth is the number of events waiting in the Processor's input
+	// channel when the snapshot was taken.
+	QueueDepth int
+	// OldestIntentTS is the timestamp of the oldest unresolved intent holding
+	// back the Processor's resolved timestamp, or its closed timestamp if
+	// there is none. See Processor.OldestIntentTS.
+	OldestIntentTS hlc.Timestamp
+}
@@ -13,6 +13,9 @@ package rangefeed
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
@@ -21,6 +24,11 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -36,6 +44,23 @@ const (
 	defaultCheckStreamsInterval = 1 * time.Second
 )
 
+// newErrRegistrationSpanMismatch creates an error that is returned to
+// subscribers if the span of their registration does not overlap the span of
+// the Processor.
+func newErrRegistrationSpanMismatch() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_SPAN_MISMATCH),
+	)
+}
+
+// closedC is a closed channel, used to enable a case in a select statement
+// that should always be ready.
+var closedC = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
 // newErrBufferCapacityExceeded creates an error that is returned to subscribers
 // if the rangefeed processor is not able to keep up with the flow of incoming
 // events and is forced to drop events in order to not block.
@@ -45,6 +70,74 @@ func newErrBufferCapacityExceeded() *roachpb.Error {
 	)
 }
 
+// newErrStalenessExceeded creates an error that is returned to subscribers if
+// an event sits in their registration's output buffer for longer than the
+// maximum buffered event age.
+func newErrStalenessExceeded() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_STALENESS_EXCEEDED),
+	)
+}
+
+// newErrResolvedTSBehind creates an error that is returned to subscribers if
+// the resolved timestamp is below the minimum required by their registration.
+func newErrResolvedTSBehind() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_RESOLVED_TS_BEHIND),
+	)
+}
+
+// newErrSpanNarrowedToEmpty creates an error that is returned to subscribers
+// if the span of their registration is narrowed to an empty span.
+func newErrSpanNarrowedToEmpty() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_SPAN_NARROWED_TO_EMPTY),
+	)
+}
+
+// newErrStreamCanceled creates an error that is returned to subscribers if the
+// context of their registration or of its stream is canceled.
+func newErrStreamCanceled() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_STREAM_CANCELED),
+	)
+}
+
+// newErrProcessorStopped creates an error that is returned to subscribers if
+// the Processor stops before their registration can be served.
+func newErrProcessorStopped() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_PROCESSOR_STOPPED),
+	)
+}
+
+// newErrRateLimitBacklog creates an error that is returned to subscribers if
+// the value events of their registration are rate limited for longer than the
+// maximum delay of its rate limit.
+func newErrRateLimitBacklog() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_RATE_LIMIT_BACKLOG),
+	)
+}
+
+// newErrIntentQueueOverflow creates an error that is returned to subscribers
+// if the Processor stops because its intent queue exceeded MaxIntentQueueSize,
+// which leaves it unable to track the intents of the shed transactions.
+func newErrIntentQueueOverflow() *roachpb.Error {
+	return roachpb.NewError(
+		roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_LOGICAL_OPS_MISSING),
+	)
+}
+
+// newErrDataGarbageCollected creates an error that is returned to subscribers
+// if the GC threshold of the range advances past the resolved timestamp of
+// their registration, or if they attempt to resume from below it, so that the
+// versions they would need to resume may have been garbage collected.
+// Subscribers must re-register with a start time at or above the threshold.
+func newErrDataGarbageCollected(threshold hlc.Timestamp) *roachpb.Error {
+	return roachpb.NewError(roachpb.NewDataGarbageCollectedError(threshold))
+}
+
 // Config encompasses the configuration required to create a Processor.
 type Config struct {
 	log.AmbientContext
@@ -59,20 +152,242 @@ type Config struct {
 	// PushTxnsAge specifies the age at which a Processor will begin to consider
 	// a transaction old enough to push.
 	PushTxnsAge time.Duration
+	// PushTxnsJitter, if set, randomizes the interval between transaction
+	// pushes within [(1-PushTxnsJitter) * PushTxnsInterval, (1+PushTxnsJitter)
+	// * PushTxnsInterval], so that the Processors of many ranges don't push
+	// their old transactions in lockstep. Must be in the range [0, 1]. Ignored
+	// if PushTxnsInterval is 0.
+	PushTxnsJitter float64
+	// MaxIntentAge, if set, is the age, according to Clock, beyond which the
+	// oldest transaction in the unresolvedIntentQueue is pushed immediately
+	// rather than at the next PushTxnsInterval, because a single old intent
+	// can hold back the resolved timestamp indefinitely. The age is checked
+	// each time the Processor goroutine handles an event, a request or a
+	// timer, which happens at least every CheckStreamsInterval. Each
+	// transaction is forced to be pushed at most once at a given timestamp;
+	// if it remains the oldest, it is pushed again at the regular interval.
+	// Requires a TxnPusher. 0 to disable.
+	MaxIntentAge time.Duration
+	// JitterRand is the source of randomness for PushTxnsJitter. It is only
+	// used by the Processor goroutine, so it must not be shared between
+	// Processors. If nil, a source seeded with the current time is used.
+	JitterRand *rand.Rand
 
 	// EventChanCap specifies the capacity to give to the Processor's input
 	// channel.
 	EventChanCap int
+	// MaxEventChanCap, if greater than EventChanCap, lets the capacity of the
+	// Processor's input channel grow adaptively up to MaxEventChanCap events.
+	// When the Processor observes that the channel is full, it moves the
+	// events waiting in it to an overflow buffer, without reordering them, so
+	// that bursts do not block writers. The buffer is released once it
+	// drains. 0 to disable.
+	MaxEventChanCap int
 	// EventChanTimeout specifies the maximum duration that methods will
 	// wait to send on the Processor's input channel before giving up and
 	// shutting down the Processor. 0 for no timeout.
 	EventChanTimeout time.Duration
 
+	// MaxBufferedEventAge specifies the default maximum duration that an event
+	// may sit in a registration's output buffer before it is sent to the
+	// registration's stream. Registrations whose consumers fall further behind
+	// than this are disconnected with a REASON_STALENESS_EXCEEDED error. Can be
+	// overridden for individual registrations using RegistrationOptions. 0 for
+	// no limit.
+	MaxBufferedEventAge time.Duration
+
+	// RegistrationMemBudget bounds the memory, in bytes, used by the events
+	// buffered for each registration that its stream has not yet consumed.
+	// A registration whose buffered events would exceed the budget is
+	// disconnected immediately with a REASON_BUFFER_CAPACITY_EXCEEDED error,
+	// without affecting the Processor's other registrations. 0 for no limit.
+	RegistrationMemBudget int64
+
 	// CheckStreamsInterval specifies interval at which a Processor will check
-	// all streams to make sure they have not been canceled.
+	// all registrations to make sure their contexts have not been canceled
+	// and their streams are still alive.
 	CheckStreamsInterval time.Duration
 
-	// Metrics is for production monitoring of RangeFeeds.
+	// StreamLiveness decides whether the stream of each registration is still
+	// alive when the Processor checks its registrations. Registrations whose
+	// stream is not alive are disconnected. Defaults to considering a stream
+	// alive until its context is canceled.
+	StreamLiveness StreamLiveness
+
+	// MaxEgressBytesPerSec, if set, limits the rate at which the Processor's
+	// registrations send bytes to their streams, in aggregate. Delivery is
+	// paced to stay within the limit. If a registration's buffer overflows as
+	// a result, the registration that has sent the most bytes is disconnected
+	// with a REASON_SLOW_CONSUMER error, in addition to the overflowing
+	// registration. 0 for no limit.
+	MaxEgressBytesPerSec int64
+
+	// MaxEventsPerBatch, if set, bounds the number of value events that the
+	// Processor publishes to registrations in a single iteration of its event
+	// loop. The events produced by a larger batch of logical operations are
+	// published in chunks over multiple iterations, allowing timer work to be
+	// interleaved with them. The resolved timestamp is still updated from the
+	// entire batch at once, and any checkpoint that this produces is published
+	// after the last of the batch's events. 0 for no limit.
+	MaxEventsPerBatch int
+
+	// MaxBatchSize, if greater than 1, combines the value events published to
+	// each registration by a single batch of logical operations into
+	// RangeFeedBatch events carrying up to MaxBatchSize values, amortizing the
+	// per-event overhead of the registrations' streams. Any other event, such
+	// as a checkpoint, is published only after the values that precede it, so
+	// the guarantees provided by checkpoints are unaffected. Registrations
+	// with a ValueEncoder receive values individually. 0 to publish each value
+	// as its own event.
+	MaxBatchSize int
+
+	// TransformWorkers, if set, bounds the number of registrations that may
+	// run their per-event transforms, such as a ValueEncoder, concurrently.
+	// Transforms run on each registration's output loop, so they never block
+	// the Processor goroutine, and the events of a single registration are
+	// transformed in order. 0 for no limit.
+	TransformWorkers int
+
+	// CatchUpScanConcurrency, if set, bounds the number of registrations that
+	// may run their catch-up scans concurrently, so that many registrations
+	// arriving at once do not overwhelm the engine with concurrent reads.
+	// Registrations beyond the limit wait for a running scan to finish before
+	// starting their own; a registration that is disconnected while waiting
+	// or scanning gives up its place. 0 for no limit.
+	CatchUpScanConcurrency int
+
+	// CheckpointInterval, if set, coalesces checkpoints such that at most one
+	// is published to registrations per interval. Resolved timestamp updates
+	// that occur within an interval are combined into a single checkpoint
+	// carrying the latest resolved timestamp, published when the interval
+	// elapses. 0 to publish a checkpoint on every resolved timestamp update.
+	// Like MinCheckpointCadence, the interval is measured using Clock.
+	CheckpointInterval time.Duration
+	// MinCheckpointCadence, if set, guarantees that a checkpoint is published
+	// to registrations at least once per cadence, re-publishing the latest
+	// resolved timestamp if it has not advanced. Must not be smaller than
+	// CheckpointInterval. Setting both to the same value results in
+	// checkpoints being published at a fixed cadence.
+	MinCheckpointCadence time.Duration
+	// CoalesceCheckpoints instructs each registration to replace a checkpoint
+	// that is still waiting in its buffer with the next checkpoint published
+	// to it, if no other event was published in between. Registrations whose
+	// streams fall behind then receive only the latest of a run of
+	// consecutive checkpoints. Values are never coalesced or reordered.
+	CoalesceCheckpoints bool
+	// TimerLatenessThreshold, if set, is the delay between a timer firing and
+	// the Processor goroutine servicing it, for the txn push ticker and the
+	// checkpoint timer, above which the timer is considered late. Late timers
+	// are counted in ProcessorMetrics. After a late timer, the Processor
+	// services timers ahead of other work until a timer is serviced within the
+	// threshold again. 0 to service timers in no particular order.
+	TimerLatenessThreshold time.Duration
+
+	// EmitCausalTokens instructs the Processor to assign a causal ordering
+	// token to each RangeFeedValue event that it publishes to registrations.
+	// A registration's tokens are monotonically non-decreasing and derived
+	// from the HLC timestamps of its values, such that applying its values in
+	// token order yields a causally consistent state across keys. Tokens are
+	// only delivered to streams that implement CausalStream and are not
+	// assigned to events emitted during catch-up scans.
+	EmitCausalTokens bool
+
+	// WithDiff instructs the Processor to treat every registration as if it
+	// had been registered with withDiff. The Processor's Filter then requests
+	// previous values for all registered spans, and the PrevValue fields of
+	// the RangeFeedValue events published to registrations are not stripped.
+	WithDiff bool
+
+	// StrictClosedTS instructs the Processor to report closed timestamps
+	// provided to ForwardClosedTS that regress below a closed timestamp that
+	// it was provided previously, which indicates a bug in the closed
+	// timestamp subsystem. Each regression increments the
+	// kv.rangefeed.closed_ts_regressions metric and is logged as a warning,
+	// rate-limited across the store. The regressing closed timestamp is
+	// ignored either way.
+	StrictClosedTS bool
+
+	// DisableResolvedTimestamps turns the Processor into a firehose of values
+	// for consumers that order events themselves. The Processor does not
+	// track intents or closed timestamps, so it has no resolved timestamp: it
+	// runs no initialization scan over the provided rtsIter, never pushes
+	// transactions, ignores ForwardClosedTS, and never publishes checkpoints,
+	// including the initial checkpoint of each registration and the final
+	// checkpoint of draining registrations. Since the values published to a
+	// registration are then never known to be complete up to any timestamp,
+	// registrations that request a historical start time, by running a
+	// catch-up scan or resuming from a timestamp, and registrations that
+	// require a minimum resolved timestamp are rejected.
+	DisableResolvedTimestamps bool
+
+	// MaxIntentQueueSize, if set, bounds the number of transactions with
+	// unresolved intents that the Processor tracks to compute its resolved
+	// timestamp. When the bound is exceeded, the oldest transactions are shed
+	// from the queue rather than continuing to allocate memory for it, and
+	// the RangeFeedShedIntentTxns metric is incremented. Since the intents of
+	// shed transactions are no longer tracked and are never pushed, the
+	// resolved timestamp could not advance past them again, so the Processor
+	// then stops with a retryable REASON_LOGICAL_OPS_MISSING error. Until it
+	// has stopped, the resolved timestamp is held below the oldest shed
+	// transaction. Subscribers re-register with a new Processor, which
+	// rebuilds the queue from its initial scan. 0 for no limit.
+	MaxIntentQueueSize int
+
+	// RejectIntentOps puts the Processor in a validation mode for read-only
+	// rangefeeds, such as those served by follower replicas, whose logical
+	// ops are expected to never include intent writes because intents are
+	// resolved before the data arrives. Receiving an MVCCWriteIntentOp or
+	// MVCCUpdateIntentOp is then treated as a programming error: the batch of
+	// ops is not consumed, and the Processor is stopped, disconnecting all
+	// registrations with an error that describes the offending op.
+	RejectIntentOps bool
+
+	// OnIntentQueueTxnAdded, if set, is called on the Processor goroutine when
+	// a transaction is added to the queue of transactions with unresolved
+	// intents that hold back the resolved timestamp. It is provided the
+	// transaction's ID and timestamp. Must be cheap and non-blocking.
+	OnIntentQueueTxnAdded func(txnID uuid.UUID, ts hlc.Timestamp)
+	// OnIntentQueueTxnRemoved, if set, is called on the Processor goroutine
+	// when a transaction is removed from the queue of transactions with
+	// unresolved intents, either because all of its intents were resolved or
+	// because it was found to be aborted. It is provided the transaction's ID
+	// and its timestamp at the time of removal. Must be cheap and non-blocking.
+	OnIntentQueueTxnRemoved func(txnID uuid.UUID, ts hlc.Timestamp)
+
+	// OnStopped, if set, is called exactly once after the Processor has fully
+	// stopped, meaning that all of its registrations have been disconnected
+	// and its goroutine has exited. It is provided the error that the
+	// Processor was stopped with, which is nil if it was stopped cleanly.
+	OnStopped func(*roachpb.Error)
+
+	// OnResolvedTSAdvance, if set, is called on the Processor goroutine each
+	// time the resolved timestamp advances, with its previous and new values.
+	// cause is the logical operation that allowed the resolved timestamp to
+	// advance, or nil if it advanced due to the closed timestamp moving
+	// forward or the resolved timestamp being initialized. The cause must not
+	// be retained after the call returns. It is called before the checkpoint
+	// carrying the new resolved timestamp is published, so bookkeeping
+	// maintained by the callback is never behind what registrations observe.
+	// Intended for debugging stalls in resolved timestamp progress and for
+	// range-level bookkeeping. Must be cheap and non-blocking.
+	OnResolvedTSAdvance func(from, to hlc.Timestamp, cause *enginepb.MVCCLogicalOp)
+
+	// GCThreshold, if set, returns the GC threshold of the range. It is used
+	// to reject registrations that resume from a timestamp below it. See
+	// RegistrationOptions.ResumeFrom. It is called on the goroutine that
+	// registers, never on the Processor goroutine.
+	GCThreshold func() hlc.Timestamp
+
+	// EventLog, if set, is a write-ahead log that every value and checkpoint
+	// event, including the final checkpoints of draining registrations, is
+	// appended to before it is delivered to registrations. If an append
+	// fails, the event is not delivered and the Processor stops with the
+	// error, since any later event would leave a gap in the log.
+	EventLog EventLog
+
+	// Metrics is for production monitoring of RangeFeeds. It is usually
+	// shared by all of the Processors on a store. If nil, the Processor
+	// creates its own.
 	Metrics *Metrics
 }
 
@@ -86,6 +401,9 @@ func (sc *Config) SetDefaults() {
 		if sc.PushTxnsAge != 0 {
 			panic("nil TxnPusher with non-zero PushTxnsAge")
 		}
+		if sc.MaxIntentAge != 0 {
+			panic("nil TxnPusher with non-zero MaxIntentAge")
+		}
 	} else {
 		if sc.PushTxnsInterval == 0 {
 			sc.PushTxnsInterval = defaultPushTxnsInterval
@@ -94,11 +412,141 @@ func (sc *Config) SetDefaults() {
 			sc.PushTxnsAge = defaultPushTxnsAge
 		}
 	}
+	if sc.PushTxnsJitter < 0 || sc.PushTxnsJitter > 1 {
+		panic("PushTxnsJitter not in the range [0, 1]")
+	}
+	if sc.PushTxnsJitter > 0 && sc.PushTxnsInterval > 0 && sc.JitterRand == nil {
+		sc.JitterRand = rand.New(rand.NewSource(timeutil.Now().UnixNano()))
+	}
 	if sc.CheckStreamsInterval == 0 {
 		sc.CheckStreamsInterval = defaultCheckStreamsInterval
 	}
+	if sc.StreamLiveness == nil {
+		sc.StreamLiveness = contextStreamLiveness{}
+	}
+	if sc.Metrics == nil {
+		sc.Metrics = NewMetrics()
+	}
+	if sc.MinCheckpointCadence != 0 && sc.CheckpointInterval > sc.MinCheckpointCadence {
+		panic("CheckpointInterval larger than MinCheckpointCadence")
+	}
+}
+
+// RegistrationOptions configures optional behavior of an individual
+// registration. The zero value of RegistrationOptions results in the default
+// behavior.
+type RegistrationOptions struct {
+	// MaxBufferedEventAge overrides Config.MaxBufferedEventAge for the
+	// registration, if non-zero.
+	MaxBufferedEventAge time.Duration
+	// ReverseBatchOrder instructs the Processor to deliver the value events
+	// produced by each call to ConsumeLogicalOps to the registration in
+	// descending timestamp order. Values are never reordered across
+	// checkpoints, so the ordering guarantees provided by checkpoints are
+	// unaffected.
+	ReverseBatchOrder bool
+	// OmitCheckpointSpans instructs the Processor to publish only the first
+	// checkpoint to the registration with its span. Subsequent checkpoints
+	// carry an empty span and only the new resolved timestamp, and consumers
+	// are expected to associate them with the span of the first checkpoint.
+	// A new registration receives the full span again.
+	OmitCheckpointSpans bool
+	// ValueEncoder, if set, encodes each RangeFeedValue event published to
+	// the registration into a payload that is sent to its stream using
+	// EncodedStream.SendEncoded, in place of the event itself. The stream must
+	// implement EncodedStream. Other events are sent unmodified. If nil,
+	// values are sent as RangeFeedValue events.
+	ValueEncoder ValueEncoder
+	// EmitSplitEvents instructs the Processor to end the registration with a
+	// RangeFeedSplit event, rather than an error, when the range is split at a
+	// key below the end of the registration's span. The registration flushes
+	// its buffered events, followed by the RangeFeedSplit event, and is then
+	// disconnected without an error. The consumer is expected to register for
+	// the portion of its span at and above the split key against the new
+	// range.
+	EmitSplitEvents bool
+	// MinResolvedTS, if set, is the minimum resolved timestamp that the
+	// Processor must have reached for the registration to be accepted. If the
+	// resolved timestamp is below it, the registration is rejected and its
+	// error channel is immediately provided a RangeFeedRetryError with reason
+	// REASON_RESOLVED_TS_BEHIND. Consumers that reconnect after processing
+	// events up to some timestamp can use it to detect a Processor that is
+	// unexpectedly behind.
+	MinResolvedTS hlc.Timestamp
+	// CatchupIterConstructor, if set and no catch-up iterator is provided,
+	// is called by the Processor goroutine to construct the registration's
+	// catch-up iterator when it accepts the registration. Because the
+	// Processor goroutine consumes logical operations only after they have
+	// been applied, the iterator observes exactly the values that precede the
+	// registration's live events, without the caller having to construct it
+	// in the same critical section as the call to RegisterWithOptions. The
+	// catch-up scan itself runs on the registration's output loop, so it does
+	// not block other registrations. Must be cheap and non-blocking.
+	CatchupIterConstructor func() engine.SimpleIterator
+	// KeyPredicate, if set, restricts the RangeFeedValue events published to
+	// the registration, including those of its catch-up scan, to the keys for
+	// which it returns true. Checkpoints are published regardless, so the
+	// registration's resolved timestamp continues to advance. It is called on
+	// the Processor goroutine and must be cheap and non-blocking.
+	KeyPredicate func(roachpb.Key) bool
+	// Priority orders the registration relative to the Processor's other
+	// registrations. Each event is published to the buffers of overlapping
+	// registrations in descending order of priority, so that the consumers
+	// of higher-priority registrations are woken before those of
+	// lower-priority ones when the Processor is under load. Priority only
+	// affects when a registration receives events, never which events it
+	// receives. Registrations with the same priority, including the default
+	// of 0, are published to in key order.
+	Priority int
+	// ReportBufferedEvents instructs the Processor to report, in each
+	// checkpoint published to the registration, the number of events that
+	// were buffered for the registration ahead of the checkpoint and not yet
+	// sent to its stream. This lets a consumer detect that it is falling
+	// behind before its buffer overflows. The field is left zero otherwise.
+	ReportBufferedEvents bool
+	// MarkCatchUpComplete instructs the Processor to set CatchUpComplete on
+	// the first checkpoint published to the registration, which is sent once
+	// its catch-up scan, if any, has completed. Its resolved timestamp is the
+	// timestamp at which live streaming began: the values that follow it are
+	// all live and above it. For registrations over multiple spans, the first
+	// checkpoint of each span is marked.
+	MarkCatchUpComplete bool
+	// MaxValuesPerSec, if positive, limits the rate at which the live value
+	// events published to the registration are sent to its stream, for
+	// consumers with a throughput cap. Values are smoothed by a token bucket
+	// with a burst of MaxValuesPerSec, rounded up, and wait in the
+	// registration's buffer until they fit within the rate. Other events,
+	// including checkpoints, are not limited, though they are still sent in
+	// order after the values buffered ahead of them. The values of the
+	// catch-up scan are not limited.
+	MaxValuesPerSec float64
+	// MaxRateLimitDelay is the maximum duration for which the registration's
+	// values may be continuously held back by MaxValuesPerSec before the
+	// registration is disconnected with a RangeFeedRetryError with reason
+	// REASON_RATE_LIMIT_BACKLOG, rather than values being dropped. Defaults to
+	// defaultMaxRateLimitDelay if zero. Ignored unless MaxValuesPerSec is set.
+	MaxRateLimitDelay time.Duration
+	// CheckpointsOnly instructs the Processor to publish only checkpoints to
+	// the registration, for consumers that track the resolved timestamp but
+	// never look at the data. No RangeFeedValue, RangeFeedDeleteRange or
+	// RangeFeedSSTable events are published to it, it runs no catch-up scan,
+	// and it does not require the producer of logical operations to populate
+	// values. Every checkpoint is still published.
+	CheckpointsOnly bool
+	// ResumeFrom, if set, is the resolved timestamp of the last checkpoint
+	// that the consumer received before it was disconnected. The registration
+	// resumes from it: its catch-up scan and live events only deliver versions
+	// strictly newer than the later of ResumeFrom and the registration's
+	// start timestamp. If ResumeFrom is below the range's GC threshold, as
+	// reported by Config.GCThreshold, versions that the consumer has not seen
+	// may have been garbage collected, so the registration is rejected and its
+	// error channel is immediately provided a DataGarbageCollectedError.
+	ResumeFrom hlc.Timestamp
 }
 
+// defaultMaxRateLimitDelay is the default RegistrationOptions.MaxRateLimitDelay.
+const defaultMaxRateLimitDelay = 10 * time.Second
+
 // Processor manages a set of rangefeed registrations and handles the routing of
 // logical updates to these registrations. While routing logical updates to
 // rangefeed registrations, the processor performs two important tasks:
@@ -116,19 +564,136 @@ type Processor struct {
 	lenResC    chan int
 	filterReqC chan struct{}
 	filterResC chan *Filter
+	statsReqC  chan struct{}
+	statsResC  chan RegistryStats
+	regsReqC   chan struct{}
+	regsResC   chan []RegistrationInfo
+	intsReqC   chan struct{}
+	intsResC   chan []IntentInfo
+	rtsReqC    chan struct{}
+	rtsResC    chan hlc.Timestamp
+	drainReqC  chan Stream
+	drainResC  chan bool
+	drainAllC  chan struct{}
+	flushReqC  chan struct{}
+	flushResC  chan []<-chan struct{}
+	spanReqC   chan spanUpdate
+	spanResC   chan bool
 	eventC     chan event
 	stopC      chan *roachpb.Error
 	stoppedC   chan struct{}
+
+	// drain records whether Drain has been called, after which logical
+	// operations are no longer accepted. Senders of logical operations hold
+	// the read lock until their event is enqueued, so once Drain has set
+	// draining, all operations that were accepted are in eventC.
+	drain struct {
+		syncutil.RWMutex
+		draining bool
+	}
+
+	// checkpoint tracks the publication of checkpoints when they are coalesced
+	// or published at a minimum cadence. last is the physical time of Clock at
+	// which the last checkpoint was published. Accessed only by the Processor
+	// goroutine.
+	checkpoint struct {
+		timer   *timeutil.Timer
+		last    time.Time
+		pending bool
+	}
+
+	// emit holds the value events of a batch of logical operations that have
+	// not yet been published to registrations because the batch exceeded
+	// MaxEventsPerBatch. While any remain, new events and registrations are
+	// not accepted so that they cannot be reordered with them. checkpoint is
+	// set if a checkpoint was deferred until the events are published.
+	// Accessed only by the Processor goroutine.
+	emit struct {
+		events     []*roachpb.RangeFeedEvent
+		checkpoint bool
+	}
+
+	// overflow holds the events moved out of eventC when it was observed to
+	// be full, in the order in which they were sent. While any remain, they
+	// are consumed ahead of the events in eventC. Accessed only by the
+	// Processor goroutine. See Config.MaxEventChanCap.
+	overflow []event
+
+	// covered holds the union of the spans of all current registrations. It
+	// is recomputed by the Processor goroutine whenever the set of
+	// registrations changes, as identified by regVersion.
+	covered struct {
+		syncutil.RWMutex
+		spans []roachpb.Span
+	}
+	regVersion int64
+
+	// resolved holds the resolved timestamp most recently published to
+	// registrations. It is updated by the Processor goroutine and read by
+	// IsResolved.
+	resolved struct {
+		syncutil.RWMutex
+		ts hlc.Timestamp
+	}
+
+	// metrics holds the Processor's counters. They are updated by the
+	// Processor goroutine and read by MetricsSnapshot. QueueDepth is not
+	// maintained.
+	metrics struct {
+		syncutil.Mutex
+		ProcessorMetrics
+		// oldestIntentTS is the value of rts.OldestIntentTS as of the last
+		// update of the gauges, or empty if rts is not initialized.
+		oldestIntentTS hlc.Timestamp
+	}
+
+	// gauges holds the values that the Processor has added to the gauges in
+	// Metrics. Only accessed by the Processor goroutine.
+	gauges struct {
+		registrations, unresolvedIntents, resolvedTSLagNanos int64
+	}
+
+	// forcedPush identifies the transaction, at its timestamp, that was last
+	// pushed because it exceeded MaxIntentAge. Only accessed by the Processor
+	// goroutine.
+	forcedPush struct {
+		txnID uuid.UUID
+		ts    hlc.Timestamp
+	}
+
+	// egress is shared by all registrations to enforce MaxEgressBytesPerSec.
+	// nil if the egress is not limited.
+	egress *rate.Limiter
+
+	// timersLate is set when the last timer serviced by the Processor goroutine
+	// exceeded TimerLatenessThreshold. Only accessed by the Processor goroutine.
+	timersLate bool
+
+	// transformSem is shared by all registrations to enforce TransformWorkers.
+	// nil if the transforms are not bounded.
+	transformSem chan struct{}
+	// catchUpScanSem is shared by all registrations to enforce
+	// CatchUpScanConcurrency. nil if the catch-up scans are not bounded.
+	catchUpScanSem chan struct{}
 }
 
 // event is a union of different event types that the Processor goroutine needs
 // to be informed of. It is used so that all events can be sent over the same
 // channel, which is necessary to prevent reordering.
 type event struct {
-	ops     []enginepb.MVCCLogicalOp
+	ops []enginepb.MVCCLogicalOp
+	// rawOps holds the encoding of a storagepb.LogicalOpLog. See
+	// ConsumeLogicalOpsRaw.
+	rawOps  []byte
 	ct      hlc.Timestamp
 	initRTS bool
-	syncC   chan struct{}
+	// gcThreshold is the new GC threshold of the range. See
+	// ForwardGCThreshold.
+	gcThreshold hlc.Timestamp
+	// excludeTxns holds transactions whose intents must no longer hold back
+	// the resolved timestamp. See ExcludeTxns.
+	excludeTxns []uuid.UUID
+	syncC       chan struct{}
 	// This setting is used in conjunction with syncC in tests in order to ensure
 	// that all registrations have fully finished outputting their buffers. This
 	// has to be done by the processor in order to avoid race conditions with the
@@ -141,7 +706,7 @@ type event struct {
 func NewProcessor(cfg Config) *Processor {
 	cfg.SetDefaults()
 	cfg.AmbientContext.AddLogTag("rangefeed", nil)
-	return &Processor{
+	p := &Processor{
 		Config: cfg,
 		reg:    makeRegistry(),
 		rts:    makeResolvedTimestamp(),
@@ -152,10 +717,38 @@ func NewProcessor(cfg Config) *Processor {
 		lenResC:    make(chan int),
 		filterReqC: make(chan struct{}),
 		filterResC: make(chan *Filter),
+		statsReqC:  make(chan struct{}),
+		statsResC:  make(chan RegistryStats),
+		regsReqC:   make(chan struct{}),
+		regsResC:   make(chan []RegistrationInfo),
+		intsReqC:   make(chan struct{}),
+		intsResC:   make(chan []IntentInfo),
+		rtsReqC:    make(chan struct{}),
+		rtsResC:    make(chan hlc.Timestamp),
+		drainReqC:  make(chan Stream),
+		drainResC:  make(chan bool),
+		drainAllC:  make(chan struct{}, 1),
+		flushReqC:  make(chan struct{}),
+		flushResC:  make(chan []<-chan struct{}),
+		spanReqC:   make(chan spanUpdate),
+		spanResC:   make(chan bool),
 		eventC:     make(chan event, cfg.EventChanCap),
 		stopC:      make(chan *roachpb.Error, 1),
 		stoppedC:   make(chan struct{}),
 	}
+	if cfg.MaxEgressBytesPerSec > 0 {
+		p.egress = rate.NewLimiter(rate.Limit(cfg.MaxEgressBytesPerSec), int(cfg.MaxEgressBytesPerSec))
+	}
+	if cfg.TransformWorkers > 0 {
+		p.transformSem = make(chan struct{}, cfg.TransformWorkers)
+	}
+	if cfg.CatchUpScanConcurrency > 0 {
+		p.catchUpScanSem = make(chan struct{}, cfg.CatchUpScanConcurrency)
+	}
+	p.rts.maxIntentQueueSize = cfg.MaxIntentQueueSize
+	p.rts.intentQ.onTxnAdded = cfg.OnIntentQueueTxnAdded
+	p.rts.intentQ.onTxnRemoved = cfg.OnIntentQueueTxnRemoved
+	return p
 }
 
 // Start launches a goroutine to process rangefeed events and send them to
@@ -170,13 +763,27 @@ func NewProcessor(cfg Config) *Processor {
 func (p *Processor) Start(stopper *stop.Stopper, rtsIter engine.SimpleIterator) {
 	ctx := p.AnnotateCtx(context.Background())
 	stopper.RunWorker(ctx, func(ctx context.Context) {
+		var stopErr *roachpb.Error
+		if p.OnStopped != nil {
+			// Registered first so that it runs after all other teardown.
+			defer func() { p.OnStopped(stopErr) }()
+		}
 		defer close(p.stoppedC)
+		// Withdraw the Processor's contribution to the gauges once all
+		// registrations have been disconnected.
+		defer p.clearGauges()
+		// All registrations are disconnected when the processor stops.
+		defer p.updateCoveredSpans()
 		ctx, cancelOutputLoops := context.WithCancel(ctx)
 		defer cancelOutputLoops()
 
 		// Launch an async task to scan over the resolved timestamp iterator and
 		// initialize the unresolvedIntentQueue. Ignore error if quiescing.
-		if rtsIter != nil {
+		if p.DisableResolvedTimestamps {
+			if rtsIter != nil {
+				rtsIter.Close()
+			}
+		} else if rtsIter != nil {
 			initScan := newInitResolvedTSScan(p, rtsIter)
 			err := stopper.RunAsyncTask(ctx, "rangefeed: init resolved ts", initScan.Run)
 			if err != nil {
@@ -188,27 +795,224 @@ func (p *Processor) Start(stopper *stop.Stopper, rtsIter engine.SimpleIterator)
 
 		// txnPushTicker periodically pushes the transaction record of all
 		// unresolved intents that are above a certain age, helping to ensure
-		// that the resolved timestamp continues to make progress.
+		// that the resolved timestamp continues to make progress. If the push
+		// interval is jittered, txnPushTimer is used in its place and re-armed
+		// with a new interval each time it fires.
 		var txnPushTicker *time.Ticker
-		var txnPushTickerC <-chan time.Time
+		var txnPushTimer *time.Timer
+		var txnPushC, txnPushTickerC <-chan time.Time
 		var txnPushAttemptC chan struct{}
 		if p.PushTxnsInterval > 0 {
-			txnPushTicker = time.NewTicker(p.PushTxnsInterval)
-			txnPushTickerC = txnPushTicker.C
-			defer txnPushTicker.Stop()
+			if p.PushTxnsJitter > 0 {
+				txnPushTimer = time.NewTimer(p.nextPushTxnsInterval())
+				txnPushC = txnPushTimer.C
+				defer txnPushTimer.Stop()
+			} else {
+				txnPushTicker = time.NewTicker(p.PushTxnsInterval)
+				txnPushC = txnPushTicker.C
+				defer txnPushTicker.Stop()
+			}
+			txnPushTickerC = txnPushC
+		}
+
+		// checkStreamsTicker periodically disconnects the registrations whose
+		// context has been canceled or whose stream is no longer alive.
+		checkStreamsTicker := time.NewTicker(p.CheckStreamsInterval)
+		defer checkStreamsTicker.Stop()
+
+		// checkpoint.timer fires when a coalesced checkpoint is due or when no
+		// checkpoint has been published for MinCheckpointCadence. It is only
+		// armed if either option is configured.
+		p.checkpoint.timer = timeutil.NewTimer()
+		defer p.checkpoint.timer.Stop()
+		if p.MinCheckpointCadence > 0 && !p.DisableResolvedTimestamps {
+			p.checkpoint.last = p.Clock.PhysicalTime()
+			p.resetCheckpointTimer()
+		}
+
+		// pushTxns pushes the transaction record of all unresolved intents that
+		// are above the provided age.
+		pushTxns := func(age time.Duration) {
+			now := p.Clock.Now()
+			before := now.Add(-age.Nanoseconds(), 0)
+			oldTxns := p.rts.intentQ.Before(before)
+
+			if len(oldTxns) > 0 {
+				toPush := make([]enginepb.TxnMeta, len(oldTxns))
+				for i, txn := range oldTxns {
+					toPush[i] = txn.asTxnMeta()
+				}
+
+				// Set the ticker channel to nil so that it can't trigger a
+				// second concurrent push. Create a push attempt response
+				// channel that is closed when the push attempt completes.
+				txnPushTickerC = nil
+				txnPushAttemptC = make(chan struct{})
+
+				// Launch an async transaction push attempt that pushes the
+				// timestamp of all transactions beneath the push offset.
+				// Ignore error if quiescing.
+				attempt := newTxnPushAttempt(p, toPush, now, txnPushAttemptC)
+				err := stopper.RunAsyncTask(ctx, "rangefeed: pushing old txns", attempt.Run)
+				if err != nil {
+					attempt.Cancel()
+				}
+			}
+		}
+
+		// pushOldTxns pushes the transaction record of all unresolved intents that
+		// are above PushTxnsAge. tick is the time at which txnPushTicker fired.
+		pushOldTxns := func(tick time.Time) {
+			p.observeTimer(tick)
+			if txnPushTimer != nil {
+				// The timer's channel has been drained, so it can be re-armed.
+				txnPushTimer.Reset(p.nextPushTxnsInterval())
+			}
+			// Don't perform transaction push attempts until the resolved
+			// timestamp has been initialized.
+			if !p.rts.IsInit() {
+				return
+			}
+			pushTxns(p.PushTxnsAge)
+		}
+
+		// maybeForcePush pushes the transaction record of all unresolved
+		// intents that are above MaxIntentAge, or PushTxnsAge if smaller, out
+		// of band if the oldest transaction has exceeded MaxIntentAge and has
+		// not already been forced to be pushed at its current timestamp.
+		maybeForcePush := func() {
+			if p.MaxIntentAge == 0 || txnPushAttemptC != nil || !p.rts.IsInit() {
+				return
+			}
+			oldest := p.rts.intentQ.Oldest()
+			if oldest == nil ||
+				(oldest.txnID == p.forcedPush.txnID && oldest.timestamp == p.forcedPush.ts) {
+				return
+			}
+			age := time.Duration(p.Clock.Now().WallTime - oldest.timestamp.WallTime)
+			if age <= p.MaxIntentAge {
+				return
+			}
+			p.forcedPush.txnID, p.forcedPush.ts = oldest.txnID, oldest.timestamp
+			p.Config.Metrics.RangeFeedForcedTxnPushes.Inc(1)
+			if p.PushTxnsAge < p.MaxIntentAge {
+				pushTxns(p.PushTxnsAge)
+			} else {
+				pushTxns(p.MaxIntentAge)
+			}
+		}
+
+		// checkpoint publishes a coalesced checkpoint or upholds the minimum
+		// checkpoint cadence. fired is the time at which checkpoint.timer
+		// fired.
+		checkpoint := func(fired time.Time) {
+			p.observeTimer(fired)
+			p.checkpoint.timer.Read = true
+			if p.checkpointDue() {
+				p.publishCheckpoint(ctx)
+			} else {
+				p.resetCheckpointTimer()
+			}
 		}
 
 		for {
+			maybeForcePush()
+
+			// Service timers ahead of other work while they are running late.
+			if p.timersLate {
+				select {
+				case tick := <-txnPushTickerC:
+					pushOldTxns(tick)
+					p.updateCoveredSpans()
+					continue
+				case fired := <-p.checkpoint.timer.C:
+					checkpoint(fired)
+					p.updateCoveredSpans()
+					continue
+				default:
+				}
+			}
+
+			// Hold back new events, registrations, drain requests and span
+			// updates while the events of a split batch are still being
+			// published, and publish the next chunk of them when there is no
+			// other work.
+			eventC, regC, drainReqC, drainAllC, spanReqC, emitC :=
+				p.eventC, p.regC, p.drainReqC, p.drainAllC, p.spanReqC, (<-chan struct{})(nil)
+			// Consume overflowed events ahead of new ones, and only accept new
+			// events while there is room to overflow them.
+			var overflowC <-chan struct{}
+			if len(p.overflow) > 0 {
+				overflowC = closedC
+				if len(p.overflow) >= p.MaxEventChanCap-p.EventChanCap {
+					eventC = nil
+				}
+				// Overflowed events must be published before draining.
+				drainAllC = nil
+			}
+			if len(p.emit.events) > 0 {
+				eventC, regC, drainReqC, drainAllC, spanReqC, emitC = nil, nil, nil, nil, nil, closedC
+				overflowC = nil
+			}
+
 			select {
 
 			// Handle new registrations.
-			case r := <-p.regC:
+			case r := <-regC:
+				// Reject the registration if its span does not overlap the
+				// Processor's span.
+				if !p.Span.AsRawSpanWithNoLocals().Overlaps(r.span) {
+					p.rejectRegistration(&r, newErrRegistrationSpanMismatch())
+					continue
+				}
 				if !p.Span.AsRawSpanWithNoLocals().Contains(r.span) {
 					log.Fatalf(ctx, "registration %s not in Processor's key range %v", r, p.Span)
 				}
 
+				// Reject the registration if its context has already been
+				// canceled.
+				if r.ctx.Err() != nil {
+					p.rejectRegistration(&r, newErrStreamCanceled())
+					continue
+				}
+
+				// Reject the registration if it resumes from below the GC
+				// threshold, as it could miss versions that have been garbage
+				// collected.
+				if r.resumeFrom.Less(r.gcThreshold) {
+					p.rejectRegistration(&r, newErrDataGarbageCollected(r.gcThreshold))
+					continue
+				}
+
+				// Reject the registration if it depends on a resolved timestamp,
+				// which is not tracked.
+				if p.DisableResolvedTimestamps && (r.catchupIter != nil ||
+					r.catchupIterConstructor != nil || !r.resumeFrom.IsEmpty() ||
+					!r.minResolvedTS.IsEmpty()) {
+					p.rejectRegistration(&r, roachpb.NewErrorf(
+						"rangefeed over %s without resolved timestamps does not support "+
+							"catch-up scans, resumption or a minimum resolved timestamp", p.Span,
+					))
+					continue
+				}
+
+				// Reject the registration if the resolved timestamp has not
+				// reached the minimum that it requires.
+				if p.rts.Get().Less(r.minResolvedTS) {
+					p.rejectRegistration(&r, newErrResolvedTSBehind())
+					continue
+				}
+
+				// Construct the catch-up iterator, if requested, now that no
+				// more events can be published to the registration before it
+				// is added to the registry.
+				if r.catchupIterConstructor != nil {
+					r.catchupIter = r.catchupIterConstructor()
+				}
+
 				// Add the new registration to the registry.
 				p.reg.Register(&r)
+				p.updateCoveredSpans()
 
 				// Publish an updated filter that includes the new registration.
 				p.filterResC <- p.reg.NewFilter()
@@ -216,7 +1020,11 @@ func (p *Processor) Start(stopper *stop.Stopper, rtsIter engine.SimpleIterator)
 				// Immediately publish a checkpoint event to the registry. This will be
 				// the first event published to this registration after its initial
 				// catch-up scan completes.
-				r.publish(p.newCheckpointEvent())
+				if !p.DisableResolvedTimestamps {
+					initCheckpoint := p.newCheckpointEvent()
+					initCheckpoint.Checkpoint.CatchUpComplete = r.markCatchUpComplete
+					r.publish(initCheckpoint)
+				}
 
 				// Run an output loop for the registry.
 				runOutputLoop := func(ctx context.Context) {
@@ -230,7 +1038,7 @@ func (p *Processor) Start(stopper *stop.Stopper, rtsIter engine.SimpleIterator)
 					if r.catchupIter != nil {
 						r.catchupIter.Close() // clean up
 					}
-					r.disconnect(roachpb.NewError(err))
+					r.disconnect(newErrProcessorStopped())
 					p.reg.Unregister(&r)
 				}
 
@@ -248,66 +1056,122 @@ func (p *Processor) Start(stopper *stop.Stopper, rtsIter engine.SimpleIterator)
 			case <-p.filterReqC:
 				p.filterResC <- p.reg.NewFilter()
 
-			// Transform and route events.
-			case e := <-p.eventC:
-				p.consumeEvent(ctx, e)
+			// Respond to requests for a snapshot of the registry's structure.
+			case <-p.statsReqC:
+				p.statsResC <- p.reg.Stats()
 
-			// Check whether any unresolved intents need a push.
-			case <-txnPushTickerC:
-				// Don't perform transaction push attempts until the resolved
-				// timestamp has been initialized.
-				if !p.rts.IsInit() {
-					continue
-				}
+			// Respond to requests for a description of each registration.
+			case <-p.regsReqC:
+				p.regsResC <- p.reg.Registrations()
 
-				now := p.Clock.Now()
-				before := now.Add(-p.PushTxnsAge.Nanoseconds(), 0)
-				oldTxns := p.rts.intentQ.Before(before)
+			// Respond to requests for the contents of the unresolved intent
+			// queue.
+			case <-p.intsReqC:
+				p.intsResC <- p.rts.intentQ.Snapshot()
 
-				if len(oldTxns) > 0 {
-					toPush := make([]enginepb.TxnMeta, len(oldTxns))
-					for i, txn := range oldTxns {
-						toPush[i] = txn.asTxnMeta()
-					}
+			// Respond to requests for the current resolved timestamp.
+			case <-p.rtsReqC:
+				p.rtsResC <- p.rts.Get()
 
-					// Set the ticker channel to nil so that it can't trigger a
-					// second concurrent push. Create a push attempt response
-					// channel that is closed when the push attempt completes.
-					txnPushTickerC = nil
-					txnPushAttemptC = make(chan struct{})
-
-					// Launch an async transaction push attempt that pushes the
-					// timestamp of all transactions beneath the push offset.
-					// Ignore error if quiescing.
-					pushTxns := newTxnPushAttempt(p, toPush, now, txnPushAttemptC)
-					err := stopper.RunAsyncTask(ctx, "rangefeed: pushing old txns", pushTxns.Run)
-					if err != nil {
-						pushTxns.Cancel()
-					}
+			// Drain individual registrations upon request. Each registration
+			// is unregistered once its output loop has flushed its buffer.
+			case stream := <-drainReqC:
+				p.drainResC <- p.reg.Drain(stream, p.newFinalCheckpointEvent(ctx))
+
+			// Respond to flush requests with a channel for each registration
+			// that is closed once it has sent its buffered events.
+			case <-p.flushReqC:
+				p.flushResC <- p.reg.Flushed()
+
+			// Narrow the span of individual registrations upon request.
+			case u := <-spanReqC:
+				p.spanResC <- p.reg.UpdateSpan(u.stream, u.span)
+
+			// Transform and route events.
+			case e := <-eventC:
+				if p.MaxEventChanCap > p.EventChanCap {
+					e = p.overflowEvents(e)
 				}
+				p.consumeEvent(ctx, e)
+
+			// Transform and route the next overflowed event.
+			case <-overflowC:
+				p.consumeEvent(ctx, p.popOverflow())
+
+			// Publish the next chunk of events from a split batch.
+			case <-emitC:
+				p.emitPending(ctx)
+
+			// Check whether any unresolved intents need a push.
+			case tick := <-txnPushTickerC:
+				pushOldTxns(tick)
 
 			// Update the resolved timestamp based on the push attempt.
 			case <-txnPushAttemptC:
 				// Reset the ticker channel so that it can trigger push attempts
 				// again. Set the push attempt channel back to nil.
-				txnPushTickerC = txnPushTicker.C
+				txnPushTickerC = txnPushC
 				txnPushAttemptC = nil
 
+			// Publish coalesced checkpoints and uphold the minimum checkpoint
+			// cadence.
+			case fired := <-p.checkpoint.timer.C:
+				checkpoint(fired)
+
+			// Disconnect registrations whose context has been canceled or
+			// whose stream is no longer alive.
+			case <-checkStreamsTicker.C:
+				p.reg.CheckStreams(p.StreamLiveness)
+
+			// Drain all registrations and exit when signaled. Each registration
+			// flushes its buffered events, followed by a final checkpoint,
+			// before it is disconnected without an error.
+			case <-drainAllC:
+				// Consume the events that were enqueued after Drain synchronized
+				// with the event loop, so that they are published ahead of the
+				// final checkpoint. No overflowed events or events of a split
+				// batch are pending, or drainAllC would not have been selected.
+				for len(p.eventC) > 0 {
+					p.consumeEvent(ctx, <-p.eventC)
+					for len(p.emit.events) > 0 {
+						p.emitPending(ctx)
+					}
+				}
+				p.reg.DrainAll(p.newFinalCheckpointEvent(ctx))
+				p.stopRegistrations(stopper, nil)
+				return
+
 			// Close registrations and exit when signaled.
 			case pErr := <-p.stopC:
-				p.reg.DisconnectWithErr(all, pErr)
+				p.stopRegistrations(stopper, pErr)
+				stopErr = pErr
 				return
 
 			// Exit on stopper.
 			case <-stopper.ShouldQuiesce():
 				pErr := roachpb.NewError(&roachpb.NodeUnavailableError{})
 				p.reg.DisconnectWithErr(all, pErr)
+				stopErr = pErr
 				return
 			}
+
+			// Registrations may have been removed while handling the case.
+			p.updateCoveredSpans()
+			p.updateGauges()
 		}
 	})
 }
 
+// nextPushTxnsInterval returns the interval until the next transaction push,
+// randomized according to PushTxnsJitter.
+func (p *Processor) nextPushTxnsInterval() time.Duration {
+	if p.PushTxnsJitter == 0 || p.PushTxnsInterval == 0 {
+		return p.PushTxnsInterval
+	}
+	f := 1 - p.PushTxnsJitter + 2*p.PushTxnsJitter*p.JitterRand.Float64()
+	return time.Duration(float64(p.PushTxnsInterval) * f)
+}
+
 // Stop shuts down the processor and closes all registrations. Safe to call on
 // nil Processor. It is not valid to restart a processor after it has been
 // stopped.
@@ -328,6 +1192,67 @@ func (p *Processor) StopWithErr(pErr *roachpb.Error) {
 	p.sendStop(pErr)
 }
 
+// Drain gracefully shuts down the processor. The processor stops accepting
+// logical operations, and all events that it has already accepted are flushed
+// to every registration's stream, followed by a final checkpoint, after which
+// each registration's error channel is sent a nil error. Drain returns once
+// the processor has stopped, or with the context's error if it is canceled
+// first, in which case the processor continues to drain in the background.
+// Safe to call on nil Processor. It is not valid to restart a processor after
+// it has been drained.
+func (p *Processor) Drain(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	// Stop accepting logical operations, then flush any remaining events
+	// before draining.
+	p.drain.Lock()
+	p.drain.draining = true
+	p.drain.Unlock()
+	p.syncEventC()
+	select {
+	case p.drainAllC <- struct{}{}:
+		// drainAllC has non-zero capacity so this should not block unless
+		// multiple callers attempt to drain the Processor concurrently.
+	case <-p.stoppedC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-p.stoppedC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rejectRegistration rejects a registration that was received by the event
+// loop but will not be added to the registry. Its catch-up iterator is closed,
+// it is disconnected with the provided error, and the unchanged filter is
+// published to the goroutine waiting on its registration.
+func (p *Processor) rejectRegistration(r *registration, pErr *roachpb.Error) {
+	if r.catchupIter != nil {
+		r.catchupIter.Close() // clean up
+	}
+	r.disconnect(pErr)
+	p.filterResC <- p.reg.NewFilter()
+}
+
+// stopWithErr stops the Processor with the provided error from within its
+// event loop. The registrations are disconnected right away, so that none
+// observes the events of later ops, while the Processor itself stops on the
+// next iteration of the event loop. Unlike sendStop, it never blocks.
+func (p *Processor) stopWithErr(ctx context.Context, pErr *roachpb.Error) {
+	log.Errorf(ctx, "%s", pErr)
+	p.reg.DisconnectWithErr(all, pErr)
+	select {
+	case p.stopC <- pErr:
+	default:
+		// The Processor is already stopping.
+	}
+}
+
 func (p *Processor) sendStop(pErr *roachpb.Error) {
 	select {
 	case p.stopC <- pErr:
@@ -340,6 +1265,10 @@ func (p *Processor) sendStop(pErr *roachpb.Error) {
 
 // Register registers the stream over the specified span of keys.
 //
+// The span is clipped to the processor's span. If it does not overlap the
+// processor's span at all, the registration is rejected and the channel is
+// provided a REASON_SPAN_MISMATCH error.
+//
 // The registration will not observe any events that were consumed before this
 // method was called. It is undefined whether the registration will observe
 // events that are consumed concurrently with this call. The channel will be
@@ -348,6 +1277,10 @@ func (p *Processor) sendStop(pErr *roachpb.Error) {
 // The optionally provided "catch-up" iterator is used to read changes from the
 // engine which occurred after the provided start timestamp.
 //
+// The registration is disconnected when the provided context is canceled, at
+// which point the channel is provided a REASON_STREAM_CANCELED error. The Processor
+// checks for canceled contexts every CheckStreamsInterval.
+//
 // If the method returns false, the processor will have been stopped, so calling
 // Stop is not necessary. If the method returns true, it will also return an
 // updated operation filter that includes the operations required by the new
@@ -355,22 +1288,146 @@ func (p *Processor) sendStop(pErr *roachpb.Error) {
 //
 // NOT safe to call on nil Processor.
 func (p *Processor) Register(
+	ctx context.Context,
+	span roachpb.RSpan,
+	startTS hlc.Timestamp,
+	catchupIter engine.SimpleIterator,
+	withDiff bool,
+	stream Stream,
+	errC chan<- *roachpb.Error,
+) (bool, *Filter) {
+	return p.RegisterWithOptions(
+		ctx, span, startTS, catchupIter, withDiff, stream, errC, RegistrationOptions{},
+	)
+}
+
+// RegisterWithOptions is like Register, but it allows the behavior of the
+// registration to be customized using the provided RegistrationOptions.
+//
+// NOT safe to call on nil Processor.
+func (p *Processor) RegisterWithOptions(
+	ctx context.Context,
 	span roachpb.RSpan,
 	startTS hlc.Timestamp,
 	catchupIter engine.SimpleIterator,
 	withDiff bool,
 	stream Stream,
 	errC chan<- *roachpb.Error,
+	opts RegistrationOptions,
+) (bool, *Filter) {
+	return p.RegisterSpans(
+		ctx, []roachpb.RSpan{span}, startTS, catchupIter, withDiff, stream, errC, opts,
+	)
+}
+
+// RegisterSpans is like RegisterWithOptions, but it registers the stream over
+// multiple spans of keys, which need not be contiguous. The stream receives
+// the values for keys within any of the spans. Checkpoints are published to
+// the stream separately for each of the spans, such that together they report
+// the union of the spans, and range deletions are similarly constrained to
+// each span. The catch-up iterator, if provided, must cover the smallest span
+// that contains all of the spans; keys outside of the spans are skipped.
+// OmitCheckpointSpans is not supported for registrations over multiple
+// disjoint spans.
+//
+// NOT safe to call on nil Processor.
+func (p *Processor) RegisterSpans(
+	ctx context.Context,
+	spans []roachpb.RSpan,
+	startTS hlc.Timestamp,
+	catchupIter engine.SimpleIterator,
+	withDiff bool,
+	stream Stream,
+	errC chan<- *roachpb.Error,
+	opts RegistrationOptions,
 ) (bool, *Filter) {
 	// Synchronize the event channel so that this registration doesn't see any
 	// events that were consumed before this registration was called. Instead,
 	// it should see these events during its catch up scan.
 	p.syncEventC()
 
+	if opts.ValueEncoder != nil {
+		if _, ok := stream.(EncodedStream); !ok {
+			panic(fmt.Sprintf("stream %T with ValueEncoder does not implement EncodedStream", stream))
+		}
+	}
+	if len(spans) == 0 {
+		panic("registration without spans")
+	}
+	// Spans that extend beyond the Processor's span are clipped to it, and
+	// spans that do not overlap it are dropped. If no span overlaps it, the
+	// registration is rejected by the Processor goroutine.
+	procSpan := p.Span.AsRawSpanWithNoLocals()
+	rawSpans := make([]roachpb.Span, 0, len(spans))
+	for _, span := range spans {
+		if s := span.AsRawSpanWithNoLocals(); s.Overlaps(procSpan) {
+			rawSpans = append(rawSpans, constrainSpan(s, procSpan))
+		}
+	}
+	if len(rawSpans) == 0 {
+		rawSpans = append(rawSpans, spans[0].AsRawSpanWithNoLocals())
+	}
+	rawSpans, _ = roachpb.MergeSpans(rawSpans)
+	if len(rawSpans) > 1 && opts.OmitCheckpointSpans {
+		panic("OmitCheckpointSpans not supported for registrations over multiple spans")
+	}
+	span := roachpb.Span{Key: rawSpans[0].Key, EndKey: rawSpans[len(rawSpans)-1].EndKey}
+
 	r := newRegistration(
-		span.AsRawSpanWithNoLocals(), startTS, catchupIter, withDiff,
-		p.Config.EventChanCap, p.Metrics, stream, errC,
+		span, startTS, catchupIter, withDiff || p.WithDiff,
+		p.Config.EventChanCap, p.Config.Metrics, stream, errC,
 	)
+	if len(rawSpans) > 1 {
+		r.spans = rawSpans
+	}
+	r.ctx = ctx
+	r.withCausalTokens = p.EmitCausalTokens
+	r.coalesceCheckpoints = p.CoalesceCheckpoints
+	r.maxBufferedEventAge = p.MaxBufferedEventAge
+	r.memBudget = p.RegistrationMemBudget
+	if opts.MaxBufferedEventAge != 0 {
+		r.maxBufferedEventAge = opts.MaxBufferedEventAge
+	}
+	r.reverseBatchOrder = opts.ReverseBatchOrder
+	if opts.ValueEncoder == nil {
+		r.maxBatchSize = p.MaxBatchSize
+	}
+	r.omitCheckpointSpans = opts.OmitCheckpointSpans
+	r.valueEncoder = opts.ValueEncoder
+	r.emitSplitEvents = opts.EmitSplitEvents
+	r.minResolvedTS = opts.MinResolvedTS
+	r.keyPredicate = opts.KeyPredicate
+	r.priority = opts.Priority
+	r.reportBufferedEvents = opts.ReportBufferedEvents
+	r.markCatchUpComplete = opts.MarkCatchUpComplete
+	if opts.MaxValuesPerSec > 0 {
+		burst := int(math.Ceil(opts.MaxValuesPerSec))
+		r.valueLimiter = rate.NewLimiter(rate.Limit(opts.MaxValuesPerSec), burst)
+		r.maxRateLimitDelay = opts.MaxRateLimitDelay
+		if r.maxRateLimitDelay == 0 {
+			r.maxRateLimitDelay = defaultMaxRateLimitDelay
+		}
+	}
+	r.checkpointsOnly = opts.CheckpointsOnly
+	if !opts.ResumeFrom.IsEmpty() {
+		r.resumeFrom = opts.ResumeFrom
+		r.catchupTimestamp.Forward(opts.ResumeFrom)
+		if p.GCThreshold != nil {
+			r.gcThreshold = p.GCThreshold()
+		}
+	}
+	if r.checkpointsOnly {
+		// The catch-up scan would only produce values.
+		if catchupIter != nil {
+			catchupIter.Close()
+			r.catchupIter = nil
+		}
+	} else if catchupIter == nil {
+		r.catchupIterConstructor = opts.CatchupIterConstructor
+	}
+	r.egress = p.egress
+	r.transformSem = p.transformSem
+	r.catchUpScanSem = p.catchUpScanSem
 	select {
 	case p.regC <- r:
 		// Wait for response.
@@ -413,66 +1470,508 @@ func (p *Processor) Filter() *Filter {
 	}
 }
 
-// ConsumeLogicalOps informs the rangefeed processor of the set of logical
-// operations. It returns false if consuming the operations hit a timeout, as
-// specified by the EventChanTimeout configuration. If the method returns false,
-// the processor will have been stopped, so calling Stop is not necessary. Safe
-// to call on nil Processor.
-func (p *Processor) ConsumeLogicalOps(ops ...enginepb.MVCCLogicalOp) bool {
+// spanUpdate is a request to narrow the span of the registrations that are
+// sending events on a stream. See UpdateRegistrationSpan.
+type spanUpdate struct {
+	stream Stream
+	span   roachpb.Span
+}
+
+// UpdateRegistrationSpan narrows the span of the registrations that are
+// sending events on the provided stream to the intersection of their span and
+// the provided span. The registrations observe the events within their
+// narrowed span that are consumed after this method is called. If the
+// intersection is empty, the registrations are gracefully disconnected: all
+// events that have been buffered for them are flushed to the stream, after
+// which their error channel is sent a RangeFeedRetryError with reason
+// REASON_SPAN_NARROWED_TO_EMPTY. Returns false if no such registration was
+// found or if the processor has been stopped already. Safe to call on nil
+// Processor.
+func (p *Processor) UpdateRegistrationSpan(stream Stream, span roachpb.RSpan) bool {
 	if p == nil {
-		return true
+		return false
 	}
-	if len(ops) == 0 {
-		return true
+
+	// Flush the event channel so that the registrations observe all events
+	// that were consumed before this method was called over their full span.
+	p.syncEventC()
+
+	// Ask the processor goroutine.
+	select {
+	case p.spanReqC <- spanUpdate{stream: stream, span: span.AsRawSpanWithNoLocals()}:
+		// Wait for response.
+		return <-p.spanResC
+	case <-p.stoppedC:
+		return false
 	}
-	return p.sendEvent(event{ops: ops}, p.EventChanTimeout)
 }
 
-// ForwardClosedTS indicates that the closed timestamp that serves as the basis
-// for the rangefeed processor's resolved timestamp has advanced. It returns
-// false if forwarding the closed timestamp hit a timeout, as specified by the
-// EventChanTimeout configuration. If the method returns false, the processor
-// will have been stopped, so calling Stop is not necessary.  Safe to call on
-// nil Processor.
-func (p *Processor) ForwardClosedTS(closedTS hlc.Timestamp) bool {
+// DrainRegistration gracefully disconnects the registration that is sending
+// events on the provided stream without stopping the processor. All events
+// that have been buffered for the registration are flushed to the stream,
+// followed by a final checkpoint, after which the registration's error channel
+// is sent a nil error. Other registrations are not affected. Returns false if
+// no such registration was found or if the processor has been stopped already.
+// Safe to call on nil Processor.
+func (p *Processor) DrainRegistration(stream Stream) bool {
 	if p == nil {
-		return true
+		return false
 	}
-	if closedTS == (hlc.Timestamp{}) {
-		return true
+
+	// Flush the event channel so that the registration observes all events
+	// that were consumed before this method was called.
+	p.syncEventC()
+
+	// Ask the processor goroutine.
+	select {
+	case p.drainReqC <- stream:
+		// Wait for response.
+		return <-p.drainResC
+	case <-p.stoppedC:
+		return false
 	}
-	return p.sendEvent(event{ct: closedTS}, p.EventChanTimeout)
 }
 
-// sendEvent informs the Processor of a new event. If a timeout is specified,
-// the method will wait for no longer than that duration before giving up,
-// shutting down the Processor, and returning false. 0 for no timeout.
-func (p *Processor) sendEvent(e event, timeout time.Duration) bool {
-	if timeout == 0 {
-		select {
-		case p.eventC <- e:
-		case <-p.stoppedC:
-			// Already stopped. Do nothing.
-		}
-	} else {
-		select {
-		case p.eventC <- e:
-		case <-p.stoppedC:
+// Flush blocks until the events of all logical operations consumed before it
+// was called have been sent to the streams of all registrations, along with
+// any other events that were buffered for them. Registrations that are
+// disconnected in the meantime, including because the processor stops, are
+// not waited for. If the context is canceled first, its error is returned.
+// Safe to call on nil Processor.
+func (p *Processor) Flush(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	// Flush the event channel so that the events of all logical operations
+	// consumed before this method was called are buffered for the
+	// registrations.
+	syncC := make(chan struct{})
+	select {
+	case p.eventC <- event{syncC: syncC}:
+	case <-p.stoppedC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-syncC:
+	case <-p.stoppedC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Ask the processor goroutine.
+	var flushed []<-chan struct{}
+	select {
+	case p.flushReqC <- struct{}{}:
+		flushed = <-p.flushResC
+	case <-p.stoppedC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, c := range flushed {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// RegistryStats returns a snapshot of the structure of the processor's
+// registry. It is intended for debugging only. Returns an empty snapshot if the
+// processor has been stopped already. Safe to call on nil Processor.
+func (p *Processor) RegistryStats() RegistryStats {
+	if p == nil {
+		return RegistryStats{}
+	}
+
+	// Ask the processor goroutine.
+	select {
+	case p.statsReqC <- struct{}{}:
+		// Wait for response.
+		return <-p.statsResC
+	case <-p.stoppedC:
+		return RegistryStats{}
+	}
+}
+
+// Registrations returns a description of each of the processor's current
+// registrations, sorted by span. It is intended for debugging only. Returns
+// nil if the processor has been stopped already. Safe to call on nil
+// Processor.
+func (p *Processor) Registrations() []RegistrationInfo {
+	if p == nil {
+		return nil
+	}
+
+	// Ask the processor goroutine.
+	select {
+	case p.regsReqC <- struct{}{}:
+		// Wait for response.
+		return <-p.regsResC
+	case <-p.stoppedC:
+		return nil
+	}
+}
+
+// IntentQueueSnapshot returns a point-in-time description of each transaction
+// with unresolved intents that holds back the processor's resolved timestamp,
+// ordered by timestamp. It is intended for debugging stuck resolved
+// timestamps. Returns an empty slice if no transactions are being tracked and
+// nil if the processor has been stopped already. Safe to call on nil
+// Processor.
+func (p *Processor) IntentQueueSnapshot() []IntentInfo {
+	if p == nil {
+		return nil
+	}
+
+	// Ask the processor goroutine.
+	select {
+	case p.intsReqC <- struct{}{}:
+		// Wait for response.
+		return <-p.intsResC
+	case <-p.stoppedC:
+		return nil
+	}
+}
+
+// OldestIntentTS returns the timestamp of the oldest unresolved intent that
+// holds back the processor's resolved timestamp, or its current closed
+// timestamp if there is no such intent. It does not synchronize with the
+// processor goroutine, which updates the value after handling each event, so
+// it is cheap to call concurrently with the consumption of logical ops.
+// Returns the zero timestamp if the processor has not yet initialized its
+// resolved timestamp. Safe to call on nil Processor.
+func (p *Processor) OldestIntentTS() hlc.Timestamp {
+	if p == nil {
+		return hlc.Timestamp{}
+	}
+	p.metrics.Lock()
+	defer p.metrics.Unlock()
+	return p.metrics.oldestIntentTS
+}
+
+// ResolvedTS returns the processor's current resolved timestamp, which may be
+// ahead of the resolved timestamp of the last checkpoint published to its
+// registrations. It does not force a checkpoint. Returns the zero timestamp if
+// the processor has not yet initialized its resolved timestamp or has been
+// stopped already. Safe to call on nil Processor.
+func (p *Processor) ResolvedTS() hlc.Timestamp {
+	if p == nil {
+		return hlc.Timestamp{}
+	}
+
+	// Ask the processor goroutine.
+	select {
+	case p.rtsReqC <- struct{}{}:
+		// Wait for response.
+		return <-p.rtsResC
+	case <-p.stoppedC:
+		return hlc.Timestamp{}
+	}
+}
+
+// CoveredSpans returns the union of the spans of the processor's current
+// registrations, as a sorted slice of non-overlapping spans. Operations on
+// keys outside of these spans are of no interest to any registration. It does
+// not synchronize with the processor goroutine and is cheap to call
+// frequently. The returned slice must not be modified. Safe to call on nil
+// Processor.
+func (p *Processor) CoveredSpans() []roachpb.Span {
+	if p == nil {
+		return nil
+	}
+	p.covered.RLock()
+	defer p.covered.RUnlock()
+	return p.covered.spans
+}
+
+// IsResolved returns whether the resolved timestamp published to the
+// processor's registrations has reached or passed the provided timestamp, in
+// which case all values at or below it have already been published. It does
+// not synchronize with the processor goroutine. Safe to call on nil Processor.
+func (p *Processor) IsResolved(ts hlc.Timestamp) bool {
+	if p == nil {
+		return false
+	}
+	p.resolved.RLock()
+	defer p.resolved.RUnlock()
+	return !p.resolved.ts.Less(ts)
+}
+
+// MetricsSnapshot returns a snapshot of the processor's counters. The counters
+// in the snapshot are consistent with one another. It does not synchronize
+// with the processor goroutine. Safe to call on nil Processor.
+func (p *Processor) MetricsSnapshot() ProcessorMetrics {
+	if p == nil {
+		return ProcessorMetrics{}
+	}
+	p.metrics.Lock()
+	defer p.metrics.Unlock()
+	m := p.metrics.ProcessorMetrics
+	m.QueueDepth = len(p.eventC)
+	m.OldestIntentTS = p.metrics.oldestIntentTS
+	return m
+}
+
+// observeTimer records the lateness of a timer that fired at the provided time
+// and is being serviced by the Processor goroutine.
+func (p *Processor) observeTimer(fired time.Time) {
+	lateness := timeutil.Since(fired)
+	late := p.TimerLatenessThreshold > 0 && lateness > p.TimerLatenessThreshold
+	p.timersLate = late
+	p.metrics.Lock()
+	defer p.metrics.Unlock()
+	p.metrics.TimerFirings++
+	if late {
+		p.metrics.LateTimerFirings++
+	}
+	if lateness > p.metrics.MaxTimerLateness {
+		p.metrics.MaxTimerLateness = lateness
+	}
+}
+
+// Metrics returns the live metrics that the Processor maintains. They are
+// usually shared with the other Processors on the store.
+func (p *Processor) Metrics() *Metrics {
+	return p.Config.Metrics
+}
+
+// updateGauges brings the Processor's contribution to the gauges in Metrics
+// up to date.
+func (p *Processor) updateGauges() {
+	var lag int64
+	var oldestIntentTS hlc.Timestamp
+	if p.rts.IsInit() {
+		lag = p.rts.closedTS.WallTime - p.rts.Get().WallTime
+		oldestIntentTS = p.rts.OldestIntentTS()
+	}
+	p.setGauges(int64(p.reg.Len()), int64(p.rts.intentQ.Len()), lag)
+	p.metrics.Lock()
+	p.metrics.oldestIntentTS = oldestIntentTS
+	p.metrics.Unlock()
+}
+
+// clearGauges withdraws the Processor's contribution to the gauges in
+// Metrics.
+func (p *Processor) clearGauges() {
+	p.setGauges(0, 0, 0)
+}
+
+func (p *Processor) setGauges(registrations, unresolvedIntents, resolvedTSLagNanos int64) {
+	m := p.Config.Metrics
+	m.RangeFeedRegistrations.Inc(registrations - p.gauges.registrations)
+	m.RangeFeedUnresolvedIntents.Inc(unresolvedIntents - p.gauges.unresolvedIntents)
+	m.RangeFeedResolvedTSLagNanos.Inc(resolvedTSLagNanos - p.gauges.resolvedTSLagNanos)
+	p.gauges.registrations = registrations
+	p.gauges.unresolvedIntents = unresolvedIntents
+	p.gauges.resolvedTSLagNanos = resolvedTSLagNanos
+}
+
+// ResetMetrics is provided for testing and resets the processor's counters to
+// zero. Safe to call on nil Processor.
+func (p *Processor) ResetMetrics() {
+	if p == nil {
+		return
+	}
+	p.metrics.Lock()
+	defer p.metrics.Unlock()
+	p.metrics.ProcessorMetrics = ProcessorMetrics{}
+}
+
+// updateCoveredSpans recomputes the spans returned by CoveredSpans if the set
+// of registrations has changed since they were last computed.
+func (p *Processor) updateCoveredSpans() {
+	version := p.reg.added + p.reg.removed + p.reg.updated
+	if version == p.regVersion {
+		return
+	}
+	p.regVersion = version
+	spans := p.reg.CoveredSpans()
+	p.covered.Lock()
+	p.covered.spans = spans
+	p.covered.Unlock()
+}
+
+// ConsumeLogicalOps informs the rangefeed processor of the set of logical
+// operations. It returns false if consuming the operations hit a timeout, as
+// specified by the EventChanTimeout configuration, or if the processor is
+// draining, in which case the operations are dropped. If the method returns
+// false, the processor will have been stopped or is stopping, so calling Stop
+// is not necessary. Safe to call on nil Processor.
+func (p *Processor) ConsumeLogicalOps(ops ...enginepb.MVCCLogicalOp) bool {
+	if p == nil {
+		return true
+	}
+	if len(ops) == 0 {
+		return true
+	}
+	_, timedOut, draining := p.trySendOps(event{ops: ops})
+	return !timedOut && !draining
+}
+
+// ConsumeLogicalOpsRaw is like ConsumeLogicalOps, but it accepts the encoding
+// of a storagepb.LogicalOpLog holding the operations. The operations are
+// decoded lazily by the processor goroutine, and MVCCWriteValueOps whose key
+// is not within the span of any registration are skipped without ever being
+// decoded, saving the allocations of their values. The buffer must not be
+// modified after the call. If the buffer is malformed, none of its operations
+// are consumed and the processor is stopped with an error. Safe to call on nil
+// Processor.
+func (p *Processor) ConsumeLogicalOpsRaw(buf []byte) bool {
+	if p == nil {
+		return true
+	}
+	if len(buf) == 0 {
+		return true
+	}
+	_, timedOut, draining := p.trySendOps(event{rawOps: buf})
+	return !timedOut && !draining
+}
+
+// ConsumeLogicalOpsReturn is like ConsumeLogicalOps, but it returns whether
+// the operations were enqueued on the rangefeed processor's input channel. It
+// returns false if the processor had already stopped or is draining, in which
+// case the operations are dropped, or if consuming the operations hit a
+// timeout, in which case the processor will have been stopped. Safe to call on
+// nil Processor.
+func (p *Processor) ConsumeLogicalOpsReturn(ops ...enginepb.MVCCLogicalOp) bool {
+	if p == nil {
+		return true
+	}
+	if len(ops) == 0 {
+		return true
+	}
+	// Check for a stopped processor up front. Otherwise, the operations could
+	// still be enqueued on the input channel if it has capacity.
+	select {
+	case <-p.stoppedC:
+		return false
+	default:
+	}
+	sent, _, _ := p.trySendOps(event{ops: ops})
+	return sent
+}
+
+// ForwardClosedTS indicates that the closed timestamp that serves as the basis
+// for the rangefeed processor's resolved timestamp has advanced. It returns
+// false if forwarding the closed timestamp hit a timeout, as specified by the
+// EventChanTimeout configuration. If the method returns false, the processor
+// will have been stopped, so calling Stop is not necessary.  Safe to call on
+// nil Processor.
+func (p *Processor) ForwardClosedTS(closedTS hlc.Timestamp) bool {
+	if p == nil {
+		return true
+	}
+	if closedTS == (hlc.Timestamp{}) || p.DisableResolvedTimestamps {
+		return true
+	}
+	return p.sendEvent(event{ct: closedTS}, p.EventChanTimeout)
+}
+
+// ForwardGCThreshold informs the rangefeed processor that the GC threshold of
+// its range has advanced. Registrations whose resolved timestamp, as of the
+// last checkpoint published to them, is below the threshold can no longer be
+// resumed without missing versions, so they are disconnected with a
+// DataGarbageCollectedError that carries the threshold. Registrations that
+// have not been published a checkpoint are not affected. It returns false if
+// forwarding the GC threshold hit a timeout, as specified by the
+// EventChanTimeout configuration, in which case the processor will have been
+// stopped. Safe to call on nil Processor.
+func (p *Processor) ForwardGCThreshold(threshold hlc.Timestamp) bool {
+	if p == nil {
+		return true
+	}
+	if threshold.IsEmpty() {
+		return true
+	}
+	return p.sendEvent(event{gcThreshold: threshold}, p.EventChanTimeout)
+}
+
+// ExcludeTxns informs the rangefeed processor that the intents of the provided
+// transactions must not hold back its resolved timestamp. It is intended for
+// transactions that are known to commit far in the future, such as those of
+// bulk jobs, which would otherwise delay the checkpoints seen by
+// latency-sensitive consumers. The values of the transactions' intents are
+// still published when they are committed, but possibly at timestamps below
+// the resolved timestamp of checkpoints that were published before them, so
+// consumers must be prepared to receive such values. Such values are counted
+// by the RangeFeedValuesBelowCheckpoint metric. An exclusion is forgotten once
+// its transaction is aborted or all of its intents known to the processor are
+// resolved; intents that the transaction writes after that hold back the
+// resolved timestamp again.
+//
+// The method returns false if excluding the transactions hit a timeout, in
+// which case the processor will have been stopped. Safe to call on nil
+// Processor.
+func (p *Processor) ExcludeTxns(txnIDs ...uuid.UUID) bool {
+	if p == nil {
+		return true
+	}
+	if len(txnIDs) == 0 {
+		return true
+	}
+	return p.sendEvent(event{excludeTxns: txnIDs}, p.EventChanTimeout)
+}
+
+// sendEvent informs the Processor of a new event. If a timeout is specified,
+// the method will wait for no longer than that duration before giving up,
+// shutting down the Processor, and returning false. 0 for no timeout.
+func (p *Processor) sendEvent(e event, timeout time.Duration) bool {
+	_, timedOut := p.trySendEvent(e, timeout)
+	return !timedOut
+}
+
+// trySendEvent is like sendEvent, but it also returns whether the event was
+// sent on the Processor's input channel, which it is not if the Processor has
+// already stopped or if the timeout is hit.
+func (p *Processor) trySendEvent(e event, timeout time.Duration) (sent, timedOut bool) {
+	if timeout == 0 {
+		select {
+		case p.eventC <- e:
+		case <-p.stoppedC:
+			// Already stopped. Do nothing.
+			return false, false
+		}
+	} else {
+		select {
+		case p.eventC <- e:
+		case <-p.stoppedC:
 			// Already stopped. Do nothing.
+			return false, false
 		default:
 			select {
 			case p.eventC <- e:
 			case <-p.stoppedC:
 				// Already stopped. Do nothing.
+				return false, false
 			case <-time.After(timeout):
 				// Sending on the eventC channel would have blocked.
 				// Instead, tear down the processor and return immediately.
 				p.sendStop(newErrBufferCapacityExceeded())
-				return false
+				return false, true
 			}
 		}
 	}
-	return true
+	return true, false
+}
+
+// trySendOps is like trySendEvent for an event carrying logical operations,
+// using the EventChanTimeout. It also returns whether the Processor is
+// draining, in which case the event is not sent. See Drain.
+func (p *Processor) trySendOps(e event) (sent, timedOut, draining bool) {
+	p.drain.RLock()
+	defer p.drain.RUnlock()
+	if p.drain.draining {
+		return false, false, true
+	}
+	sent, timedOut = p.trySendEvent(e, p.EventChanTimeout)
+	return sent, timedOut, false
 }
 
 // setResolvedTSInitialized informs the Processor that its resolved timestamp has
@@ -503,11 +2002,23 @@ func (p *Processor) consumeEvent(ctx context.Context, e event) {
 	switch {
 	case len(e.ops) > 0:
 		p.consumeLogicalOps(ctx, e.ops)
+	case len(e.rawOps) > 0:
+		p.consumeLogicalOpsRaw(ctx, e.rawOps)
 	case e.ct != hlc.Timestamp{}:
 		p.forwardClosedTS(ctx, e.ct)
 	case e.initRTS:
 		p.initResolvedTS(ctx)
+	case !e.gcThreshold.IsEmpty():
+		p.reg.DisconnectBelowGCThreshold(e.gcThreshold)
+	case len(e.excludeTxns) > 0:
+		p.excludeTxns(ctx, e.excludeTxns)
 	case e.syncC != nil:
+		// Publish any checkpoint that has become due according to Clock, so
+		// that the checkpoint cadence can be controlled deterministically in
+		// tests using a manual clock.
+		if p.checkpointDue() {
+			p.publishCheckpoint(ctx)
+		}
 		if e.testRegCatchupSpan.Valid() {
 			if err := p.reg.waitForCaughtUp(e.testRegCatchupSpan); err != nil {
 				log.Errorf(
@@ -524,12 +2035,22 @@ func (p *Processor) consumeEvent(ctx context.Context, e event) {
 }
 
 func (p *Processor) consumeLogicalOps(ctx context.Context, ops []enginepb.MVCCLogicalOp) {
+	p.metrics.Lock()
+	p.metrics.LogicalOps += int64(len(ops))
+	p.metrics.Unlock()
+	p.Config.Metrics.RangeFeedLogicalOps.Inc(int64(len(ops)))
+	defer p.updateGauges()
+	if p.RejectIntentOps && p.rejectIntentOps(ctx, ops) {
+		return
+	}
+	defer p.noteShedTxns(ctx, p.rts.shedTxns)
+
 	for _, op := range ops {
 		// Publish RangeFeedValue updates, if necessary.
 		switch t := op.GetValue().(type) {
 		case *enginepb.MVCCWriteValueOp:
 			// Publish the new value directly.
-			p.publishValue(ctx, t.Key, t.Timestamp, t.Value, t.PrevValue)
+			p.publishValue(ctx, t.Key, t.Timestamp, t.Value, t.PrevValue, t.Deleted)
 
 		case *enginepb.MVCCWriteIntentOp:
 			// No updates to publish.
@@ -538,8 +2059,12 @@ func (p *Processor) consumeLogicalOps(ctx context.Context, ops []enginepb.MVCCLo
 			// No updates to publish.
 
 		case *enginepb.MVCCCommitIntentOp:
-			// Publish the newly committed value.
-			p.publishValue(ctx, t.Key, t.Timestamp, t.Value, t.PrevValue)
+			// Publish the newly committed value. Only the values of excluded
+			// transactions can be committed below a published checkpoint.
+			if p.IsResolved(t.Timestamp) {
+				p.Config.Metrics.RangeFeedValuesBelowCheckpoint.Inc(1)
+			}
+			p.publishValue(ctx, t.Key, t.Timestamp, t.Value, t.PrevValue, t.Deleted)
 
 		case *enginepb.MVCCAbortIntentOp:
 			// No updates to publish.
@@ -547,32 +2072,236 @@ func (p *Processor) consumeLogicalOps(ctx context.Context, ops []enginepb.MVCCLo
 		case *enginepb.MVCCAbortTxnOp:
 			// No updates to publish.
 
+		case *enginepb.MVCCSplitOp:
+			// Publish a split to the registrations clipped by it.
+			p.publishSplit(ctx, t.SplitKey)
+
+		case *enginepb.MVCCDeleteRangeOp:
+			// Publish the deletion of the span.
+			p.publishDeleteRange(ctx, t.StartKey, t.EndKey, t.Timestamp)
+
+		case *enginepb.MVCCIngestSSTableOp:
+			// Publish the ingested SSTable.
+			p.publishSSTable(ctx, t.Data, t.StartKey, t.EndKey, t.Timestamp)
+
 		default:
 			panic(fmt.Sprintf("unknown logical op %T", t))
 		}
 
+		if p.DisableResolvedTimestamps {
+			continue
+		}
+
 		// Determine whether the operation caused the resolved timestamp to
 		// move forward. If so, publish a RangeFeedCheckpoint notification.
+		from := p.rts.Get()
 		if p.rts.ConsumeLogicalOp(op) {
-			p.publishCheckpoint(ctx)
+			p.resolvedTSAdvanced(ctx, from, &op)
 		}
 	}
+
+	if p.MaxEventsPerBatch > 0 {
+		// Publish the first chunk of the batch's events. The rest are
+		// published by subsequent iterations of the event loop.
+		p.emitPending(ctx)
+		return
+	}
+
+	// Deliver the batch's values to registrations that receive them in
+	// reverse timestamp order.
+	p.reg.FlushBatches()
+}
+
+// rejectIntentOps stops the Processor if the logical ops include an intent
+// write, which a Processor configured with RejectIntentOps must never receive.
+// Returns whether the ops were rejected.
+func (p *Processor) rejectIntentOps(ctx context.Context, ops []enginepb.MVCCLogicalOp) bool {
+	for _, op := range ops {
+		var txnID uuid.UUID
+		switch t := op.GetValue().(type) {
+		case *enginepb.MVCCWriteIntentOp:
+			txnID = t.TxnID
+		case *enginepb.MVCCUpdateIntentOp:
+			txnID = t.TxnID
+		default:
+			continue
+		}
+		pErr := roachpb.NewErrorf(
+			"read-only rangefeed over %s received unexpected intent op %T for txn %s; "+
+				"the ops of intents must not be fed to a read-only rangefeed",
+			p.Span, op.GetValue(), txnID,
+		)
+		// Stop the Processor rather than letting the op corrupt its resolved
+		// timestamp.
+		p.stopWithErr(ctx, pErr)
+		return true
+	}
+	return false
+}
+
+// consumeLogicalOpsRaw decodes the logical operations in buf, skipping those
+// that only write values that no registration is interested in, and consumes
+// the rest.
+func (p *Processor) consumeLogicalOpsRaw(ctx context.Context, buf []byte) {
+	ops, skipped, err := decodeLogicalOps(buf, p.coversKey)
+	if err != nil {
+		p.stopWithErr(ctx, roachpb.NewErrorf(
+			"rangefeed over %s received undecodable logical ops: %v", p.Span, err,
+		))
+		return
+	}
+	if skipped > 0 {
+		p.metrics.Lock()
+		p.metrics.LogicalOps += int64(skipped)
+		p.metrics.Unlock()
+		p.Config.Metrics.RangeFeedLogicalOps.Inc(int64(skipped))
+	}
+	if len(ops) > 0 {
+		p.consumeLogicalOps(ctx, ops)
+	}
+}
+
+// coversKey returns whether the key is within the span of any registration.
+// It reads the covered spans without synchronization, so it must only be
+// called on the Processor goroutine, which is the only one that updates them.
+func (p *Processor) coversKey(key roachpb.Key) bool {
+	spans := p.covered.spans
+	i := sort.Search(len(spans), func(i int) bool {
+		return key.Compare(spans[i].EndKey) < 0
+	})
+	return i < len(spans) && key.Compare(spans[i].Key) >= 0
+}
+
+// noteShedTxns records the transactions shed from the intent queue because
+// it exceeded MaxIntentQueueSize since the provided count was observed, and
+// stops the Processor if any were. See Config.MaxIntentQueueSize.
+func (p *Processor) noteShedTxns(ctx context.Context, before int64) {
+	shed := p.rts.shedTxns - before
+	if shed == 0 {
+		return
+	}
+	m := p.Config.Metrics
+	m.RangeFeedShedIntentTxns.Inc(shed)
+	if m.RangeFeedShedIntentTxnsLogN.ShouldLog() {
+		log.Warningf(ctx, "intent queue exceeded %d transactions, shed %d; "+
+			"resolved timestamp held below %s", p.MaxIntentQueueSize, shed, p.rts.overflowTS)
+	}
+	p.stopWithErr(ctx, newErrIntentQueueOverflow())
+}
+
+// overflowEvents is called with each event received from eventC when the
+// capacity of eventC can grow adaptively, and returns the event to consume
+// next. If eventC was full or earlier events have overflowed, the event and
+// those waiting in eventC are moved to the overflow buffer, in order, up to
+// MaxEventChanCap-EventChanCap events, unblocking writers.
+func (p *Processor) overflowEvents(e event) event {
+	if len(p.overflow) == 0 && len(p.eventC) < cap(p.eventC)-1 {
+		return e
+	}
+	p.overflow = append(p.overflow, e)
+	for len(p.overflow) < p.MaxEventChanCap-p.EventChanCap {
+		select {
+		case e := <-p.eventC:
+			p.overflow = append(p.overflow, e)
+			continue
+		default:
+		}
+		break
+	}
+	return p.popOverflow()
+}
+
+// popOverflow removes and returns the oldest event in the overflow buffer.
+// The buffer is released once it drains, shrinking it back down while the
+// Processor is idle.
+func (p *Processor) popOverflow() event {
+	e := p.overflow[0]
+	p.overflow[0] = event{}
+	p.overflow = p.overflow[1:]
+	if len(p.overflow) == 0 {
+		p.overflow = nil
+	}
+	return e
+}
+
+// emitPending publishes up to MaxEventsPerBatch of the value events held back
+// from the last batch of logical operations. Once all have been published, it
+// publishes any checkpoint that was deferred until then.
+func (p *Processor) emitPending(ctx context.Context) {
+	events := p.emit.events
+	n := len(events)
+	if n > p.MaxEventsPerBatch {
+		n = p.MaxEventsPerBatch
+	}
+	for i, event := range events[:n] {
+		p.publishValueEvent(ctx, event)
+		events[i] = nil // for GC
+	}
+	if p.emit.events = events[n:]; len(p.emit.events) > 0 {
+		return
+	}
+	p.emit.events = nil
+
+	p.reg.FlushBatches()
+	if p.emit.checkpoint {
+		p.emit.checkpoint = false
+		p.publishCheckpoint(ctx)
+	}
 }
 
 func (p *Processor) forwardClosedTS(ctx context.Context, newClosedTS hlc.Timestamp) {
+	defer p.updateGauges()
+	if p.StrictClosedTS && newClosedTS.Less(p.rts.closedTS) {
+		m := p.Config.Metrics
+		m.RangeFeedClosedTSRegressions.Inc(1)
+		if m.RangeFeedClosedTSRegressionLogN.ShouldLog() {
+			log.Warningf(ctx, "closed timestamp regressed from %s to %s", p.rts.closedTS, newClosedTS)
+		}
+	}
+	from := p.rts.Get()
 	if p.rts.ForwardClosedTS(newClosedTS) {
-		p.publishCheckpoint(ctx)
+		p.resolvedTSAdvanced(ctx, from, nil /* cause */)
+	}
+}
+
+func (p *Processor) excludeTxns(ctx context.Context, txnIDs []uuid.UUID) {
+	defer p.updateGauges()
+	from := p.rts.Get()
+	advanced := false
+	for _, txnID := range txnIDs {
+		if p.rts.ExcludeTxn(txnID) {
+			advanced = true
+		}
+	}
+	if advanced {
+		p.resolvedTSAdvanced(ctx, from, nil /* cause */)
 	}
 }
 
 func (p *Processor) initResolvedTS(ctx context.Context) {
+	from := p.rts.Get()
 	if p.rts.Init() {
-		p.publishCheckpoint(ctx)
+		p.resolvedTSAdvanced(ctx, from, nil /* cause */)
 	}
 }
 
+// resolvedTSAdvanced is called when the resolved timestamp advances from the
+// provided timestamp, optionally due to the provided logical operation.
+func (p *Processor) resolvedTSAdvanced(
+	ctx context.Context, from hlc.Timestamp, cause *enginepb.MVCCLogicalOp,
+) {
+	if p.OnResolvedTSAdvance != nil {
+		p.OnResolvedTSAdvance(from, p.rts.Get(), cause)
+	}
+	p.publishCheckpoint(ctx)
+}
+
 func (p *Processor) publishValue(
-	ctx context.Context, key roachpb.Key, timestamp hlc.Timestamp, value, prevValue []byte,
+	ctx context.Context,
+	key roachpb.Key,
+	timestamp hlc.Timestamp,
+	value, prevValue []byte,
+	deleted bool,
 ) {
 	if !p.Span.ContainsKey(roachpb.RKey(key)) {
 		log.Fatalf(ctx, "key %v not in Processor's key range %v", key, p.Span)
@@ -582,24 +2311,230 @@ func (p *Processor) publishValue(
 	if prevValue != nil {
 		prevVal.RawBytes = prevValue
 	}
+	val := roachpb.Value{
+		RawBytes:  value,
+		Timestamp: timestamp,
+	}
 	var event roachpb.RangeFeedEvent
 	event.MustSetValue(&roachpb.RangeFeedValue{
-		Key: key,
-		Value: roachpb.Value{
-			RawBytes:  value,
-			Timestamp: timestamp,
-		},
-		PrevValue: prevVal,
+		Key:        key,
+		Value:      val,
+		PrevValue:  prevVal,
+		IsDeletion: deleted,
+	})
+	if p.MaxEventsPerBatch > 0 {
+		// Published by emitPending.
+		p.emit.events = append(p.emit.events, &event)
+		return
+	}
+	p.publishValueEvent(ctx, &event)
+}
+
+func (p *Processor) publishValueEvent(ctx context.Context, event *roachpb.RangeFeedEvent) {
+	if !p.appendToEventLog(ctx, event) {
+		return
+	}
+	if t := event.DeleteRange; t != nil {
+		p.reg.PublishToOverlapping(t.Span, event)
+		p.Config.Metrics.RangeFeedEventsPublished.Inc(1)
+		return
+	}
+	if t := event.SST; t != nil {
+		p.reg.PublishToOverlapping(t.Span, event)
+		p.Config.Metrics.RangeFeedEventsPublished.Inc(1)
+		return
+	}
+	p.reg.PublishToOverlapping(roachpb.Span{Key: event.Val.Key}, event)
+	p.metrics.Lock()
+	p.metrics.ValuesPublished++
+	p.metrics.Unlock()
+	p.Config.Metrics.RangeFeedEventsPublished.Inc(1)
+}
+
+// publishDeleteRange publishes a RangeFeedDeleteRange event to the
+// registrations that overlap the deleted span. It is ordered with respect to
+// the value events of the batch like a value event would be.
+func (p *Processor) publishDeleteRange(
+	ctx context.Context, startKey, endKey roachpb.Key, timestamp hlc.Timestamp,
+) {
+	span := roachpb.Span{Key: startKey, EndKey: endKey}
+	if !p.Span.AsRawSpanWithNoLocals().Contains(span) {
+		log.Fatalf(ctx, "span %v not in Processor's key range %v", span, p.Span)
+	}
+
+	var event roachpb.RangeFeedEvent
+	event.MustSetValue(&roachpb.RangeFeedDeleteRange{
+		Span:      span,
+		Timestamp: timestamp,
+	})
+	if p.MaxEventsPerBatch > 0 {
+		// Published by emitPending.
+		p.emit.events = append(p.emit.events, &event)
+		return
+	}
+	p.publishValueEvent(ctx, &event)
+}
+
+// publishSSTable publishes a RangeFeedSSTable event carrying the data of an
+// ingested SSTable to the registrations that overlap its span. Like a range
+// deletion, it is ordered with respect to the value events of the batch.
+func (p *Processor) publishSSTable(
+	ctx context.Context, data []byte, startKey, endKey roachpb.Key, writeTS hlc.Timestamp,
+) {
+	span := roachpb.Span{Key: startKey, EndKey: endKey}
+	if !p.Span.AsRawSpanWithNoLocals().Contains(span) {
+		log.Fatalf(ctx, "span %v not in Processor's key range %v", span, p.Span)
+	}
+
+	var event roachpb.RangeFeedEvent
+	event.MustSetValue(&roachpb.RangeFeedSSTable{
+		Data:    data,
+		Span:    span,
+		WriteTS: writeTS,
+	})
+	if p.MaxEventsPerBatch > 0 {
+		// Published by emitPending.
+		p.emit.events = append(p.emit.events, &event)
+		return
+	}
+	p.publishValueEvent(ctx, &event)
+}
+
+// publishSplit publishes a RangeFeedSplit event to the registrations that
+// opted into split events and whose span extends beyond the split key, and
+// begins draining them. The value events of the current batch are published
+// first, so that the split is the final event the registrations receive.
+func (p *Processor) publishSplit(ctx context.Context, splitKey roachpb.Key) {
+	for len(p.emit.events) > 0 {
+		p.emitPending(ctx)
+	}
+	p.reg.FlushBatches()
+
+	var event roachpb.RangeFeedEvent
+	event.MustSetValue(&roachpb.RangeFeedSplit{SplitKey: splitKey})
+	p.reg.DrainSplit(splitKey, &event)
+}
+
+// stopRegistrations disconnects all registrations with the provided error,
+// except for those that are draining, which are given the chance to flush
+// their remaining events. It returns once all draining registrations have
+// been disconnected or the stopper begins quiescing.
+func (p *Processor) stopRegistrations(stopper *stop.Stopper, pErr *roachpb.Error) {
+	p.reg.forOverlappingRegs(all, func(r *registration) (bool, *roachpb.Error) {
+		return !r.isDraining(), pErr
 	})
-	p.reg.PublishToOverlapping(roachpb.Span{Key: key}, &event)
+	for p.reg.Len() > 0 {
+		select {
+		case r := <-p.unregC:
+			p.reg.Unregister(r)
+		case <-stopper.ShouldQuiesce():
+			p.reg.DisconnectWithErr(all, roachpb.NewError(&roachpb.NodeUnavailableError{}))
+		}
+	}
 }
 
 func (p *Processor) publishCheckpoint(ctx context.Context) {
 	// TODO(nvanbenschoten): persist resolvedTimestamp. Give Processor a client.DB.
-	// TODO(nvanbenschoten): rate limit these? send them periodically?
+	if p.DisableResolvedTimestamps {
+		return
+	}
+
+	if len(p.emit.events) > 0 {
+		// The checkpoint must not overtake the values that are yet to be
+		// published. It is published by emitPending once they have been.
+		p.emit.checkpoint = true
+		return
+	}
+
+	if p.CheckpointInterval > 0 && p.sinceCheckpoint() < p.CheckpointInterval {
+		// Coalesce with the checkpoint already published in the current
+		// interval. The latest resolved timestamp will be published once the
+		// interval elapses.
+		if !p.checkpoint.pending {
+			p.checkpoint.pending = true
+			p.resetCheckpointTimer()
+		}
+		return
+	}
+
+	event := p.newCheckpointEvent()
+	if p.appendToEventLog(ctx, event) {
+		p.reg.PublishToOverlapping(all, event)
+		p.resolved.Lock()
+		p.resolved.ts = event.Checkpoint.ResolvedTS
+		p.resolved.Unlock()
+		p.metrics.Lock()
+		p.metrics.CheckpointsPublished++
+		p.metrics.Unlock()
+		p.Config.Metrics.RangeFeedEventsPublished.Inc(1)
+	}
+
+	p.checkpoint.last = p.Clock.PhysicalTime()
+	p.checkpoint.pending = false
+	p.resetCheckpointTimer()
+}
+
+// appendToEventLog appends the event to the Processor's EventLog, if one is
+// configured. Returns false if the event could not be appended, in which case
+// it must not be delivered and the Processor is stopping.
+func (p *Processor) appendToEventLog(ctx context.Context, event *roachpb.RangeFeedEvent) bool {
+	if p.EventLog == nil {
+		return true
+	}
+	if err := p.EventLog.Append(event); err != nil {
+		p.stopWithErr(ctx, roachpb.NewError(errors.Wrap(err, "appending to rangefeed event log")))
+		return false
+	}
+	return true
+}
 
+// resetCheckpointTimer arms the checkpoint timer to fire when the next
+// checkpoint is due, either because a coalesced checkpoint is pending or
+// because the minimum checkpoint cadence is configured.
+func (p *Processor) resetCheckpointTimer() {
+	var d time.Duration
+	switch {
+	case p.checkpoint.pending:
+		d = p.CheckpointInterval
+	case p.MinCheckpointCadence > 0:
+		d = p.MinCheckpointCadence
+	default:
+		return
+	}
+	if p.checkpoint.timer == nil {
+		return
+	}
+	p.checkpoint.timer.Reset(d - p.sinceCheckpoint())
+}
+
+// sinceCheckpoint returns the time elapsed on Clock since the last checkpoint
+// was published.
+func (p *Processor) sinceCheckpoint() time.Duration {
+	return p.Clock.PhysicalTime().Sub(p.checkpoint.last)
+}
+
+// checkpointDue returns whether a coalesced checkpoint is due to be published,
+// or whether one must be published to uphold the minimum checkpoint cadence.
+func (p *Processor) checkpointDue() bool {
+	since := p.sinceCheckpoint()
+	if p.checkpoint.pending {
+		return since >= p.CheckpointInterval
+	}
+	return p.MinCheckpointCadence > 0 && since >= p.MinCheckpointCadence
+}
+
+// newFinalCheckpointEvent returns the checkpoint that draining registrations
+// publish before they are disconnected, after appending it to the EventLog.
+// Returns nil if checkpoints are disabled or the append failed.
+func (p *Processor) newFinalCheckpointEvent(ctx context.Context) *roachpb.RangeFeedEvent {
+	if p.DisableResolvedTimestamps {
+		return nil
+	}
 	event := p.newCheckpointEvent()
-	p.reg.PublishToOverlapping(all, event)
+	if !p.appendToEventLog(ctx, event) {
+		return nil
+	}
+	return event
 }
 
 func (p *Processor) newCheckpointEvent() *roachpb.RangeFeedEvent {
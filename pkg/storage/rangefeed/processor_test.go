@@ -14,6 +14,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math/rand"
+	"reflect"
 	"runtime"
 	"sort"
 	"sync"
@@ -28,6 +30,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/stretchr/testify/require"
@@ -104,6 +107,31 @@ func abortTxnOp(txnID uuid.UUID) enginepb.MVCCLogicalOp {
 	})
 }
 
+func splitOp(key roachpb.Key) enginepb.MVCCLogicalOp {
+	return makeLogicalOp(&enginepb.MVCCSplitOp{
+		SplitKey: key,
+	})
+}
+
+func deleteRangeOp(startKey, endKey roachpb.Key, ts hlc.Timestamp) enginepb.MVCCLogicalOp {
+	return makeLogicalOp(&enginepb.MVCCDeleteRangeOp{
+		StartKey:  startKey,
+		EndKey:    endKey,
+		Timestamp: ts,
+	})
+}
+
+func ingestSSTableOp(
+	data []byte, startKey, endKey roachpb.Key, ts hlc.Timestamp,
+) enginepb.MVCCLogicalOp {
+	return makeLogicalOp(&enginepb.MVCCIngestSSTableOp{
+		Data:      data,
+		StartKey:  startKey,
+		EndKey:    endKey,
+		Timestamp: ts,
+	})
+}
+
 func makeRangeFeedEvent(val interface{}) *roachpb.RangeFeedEvent {
 	var event roachpb.RangeFeedEvent
 	event.MustSetValue(val)
@@ -129,6 +157,21 @@ func rangeFeedCheckpoint(span roachpb.Span, ts hlc.Timestamp) *roachpb.RangeFeed
 	})
 }
 
+func rangeFeedDeleteRange(span roachpb.Span, ts hlc.Timestamp) *roachpb.RangeFeedEvent {
+	return makeRangeFeedEvent(&roachpb.RangeFeedDeleteRange{
+		Span:      span,
+		Timestamp: ts,
+	})
+}
+
+func rangeFeedSSTable(data []byte, span roachpb.Span, ts hlc.Timestamp) *roachpb.RangeFeedEvent {
+	return makeRangeFeedEvent(&roachpb.RangeFeedSSTable{
+		Data:    data,
+		Span:    span,
+		WriteTS: ts,
+	})
+}
+
 const testProcessorEventCCap = 16
 
 func newTestProcessorWithTxnPusher(
@@ -189,7 +232,7 @@ func TestProcessorBasic(t *testing.T) {
 	r1Stream := newTestStream()
 	r1ErrC := make(chan *roachpb.Error, 1)
 	r1OK, r1Filter := p.Register(
-		roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
 		hlc.Timestamp{WallTime: 1},
 		nil,   /* catchUpIter */
 		false, /* withDiff */
@@ -313,7 +356,7 @@ func TestProcessorBasic(t *testing.T) {
 	r2Stream := newTestStream()
 	r2ErrC := make(chan *roachpb.Error, 1)
 	r2OK, r1And2Filter := p.Register(
-		roachpb.RSpan{Key: roachpb.RKey("c"), EndKey: roachpb.RKey("z")},
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("c"), EndKey: roachpb.RKey("z")},
 		hlc.Timestamp{WallTime: 1},
 		nil,  /* catchUpIter */
 		true, /* withDiff */
@@ -398,7 +441,7 @@ func TestProcessorBasic(t *testing.T) {
 	r3Stream := newTestStream()
 	r3ErrC := make(chan *roachpb.Error, 1)
 	r3OK, _ := p.Register(
-		roachpb.RSpan{Key: roachpb.RKey("c"), EndKey: roachpb.RKey("z")},
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("c"), EndKey: roachpb.RKey("z")},
 		hlc.Timestamp{WallTime: 1},
 		nil,   /* catchUpIter */
 		false, /* withDiff */
@@ -414,17 +457,23 @@ func TestNilProcessor(t *testing.T) {
 
 	// All of the following should be no-ops.
 	require.Equal(t, 0, p.Len())
+	require.Equal(t, RegistryStats{}, p.RegistryStats())
+	require.Nil(t, p.Registrations())
+	require.Equal(t, hlc.Timestamp{}, p.ResolvedTS())
+	require.False(t, p.DrainRegistration(nil))
 	require.NotPanics(t, func() { p.Stop() })
 	require.NotPanics(t, func() { p.StopWithErr(nil) })
 	require.NotPanics(t, func() { p.ConsumeLogicalOps() })
 	require.NotPanics(t, func() { p.ConsumeLogicalOps(make([]enginepb.MVCCLogicalOp, 5)...) })
+	require.True(t, p.ConsumeLogicalOpsReturn(make([]enginepb.MVCCLogicalOp, 5)...))
+	require.NotPanics(t, func() { p.ExcludeTxns(uuid.MakeV4()) })
 	require.NotPanics(t, func() { p.ForwardClosedTS(hlc.Timestamp{}) })
 	require.NotPanics(t, func() { p.ForwardClosedTS(hlc.Timestamp{WallTime: 1}) })
 
 	// The following should panic because they are not safe
 	// to call on a nil Processor.
 	require.Panics(t, func() { p.Start(stop.NewStopper(), nil) })
-	require.Panics(t, func() { p.Register(roachpb.RSpan{}, hlc.Timestamp{}, nil, false, nil, nil) })
+	require.Panics(t, func() { p.Register(context.Background(), roachpb.RSpan{}, hlc.Timestamp{}, nil, false, nil, nil) })
 }
 
 func TestProcessorSlowConsumer(t *testing.T) {
@@ -439,7 +488,7 @@ func TestProcessorSlowConsumer(t *testing.T) {
 	r1Stream := newTestStream()
 	r1ErrC := make(chan *roachpb.Error, 1)
 	p.Register(
-		roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
 		hlc.Timestamp{WallTime: 1},
 		nil,   /* catchUpIter */
 		false, /* withDiff */
@@ -449,7 +498,7 @@ func TestProcessorSlowConsumer(t *testing.T) {
 	r2Stream := newTestStream()
 	r2ErrC := make(chan *roachpb.Error, 1)
 	p.Register(
-		roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
 		hlc.Timestamp{WallTime: 1},
 		nil,   /* catchUpIter */
 		false, /* withDiff */
@@ -569,7 +618,7 @@ func TestProcessorInitializeResolvedTimestamp(t *testing.T) {
 	// Add a registration.
 	r1Stream := newTestStream()
 	p.Register(
-		roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
 		hlc.Timestamp{WallTime: 1},
 		nil,   /* catchUpIter */
 		false, /* withDiff */
@@ -810,19 +859,24 @@ func TestProcessorConcurrentStop(t *testing.T) {
 		p, stopper := newTestProcessor(nil /* rtsIter */)
 
 		var wg sync.WaitGroup
-		wg.Add(6)
+		wg.Add(7)
 		go func() {
 			defer wg.Done()
 			runtime.Gosched()
 			s := newTestStream()
 			errC := make(chan<- *roachpb.Error, 1)
-			p.Register(p.Span, hlc.Timestamp{}, nil, false, s, errC)
+			p.Register(context.Background(), p.Span, hlc.Timestamp{}, nil, false, s, errC)
 		}()
 		go func() {
 			defer wg.Done()
 			runtime.Gosched()
 			p.Len()
 		}()
+		go func() {
+			defer wg.Done()
+			runtime.Gosched()
+			p.Registrations()
+		}()
 		go func() {
 			defer wg.Done()
 			runtime.Gosched()
@@ -885,7 +939,7 @@ func TestProcessorRegistrationObservesOnlyNewEvents(t *testing.T) {
 			s := newTestStream()
 			regs[s] = firstIdx
 			errC := make(chan *roachpb.Error, 1)
-			p.Register(p.Span, hlc.Timestamp{}, nil, false, s, errC)
+			p.Register(context.Background(), p.Span, hlc.Timestamp{}, nil, false, s, errC)
 			regDone <- struct{}{}
 		}
 	}()
@@ -905,11 +959,2897 @@ func TestProcessorRegistrationObservesOnlyNewEvents(t *testing.T) {
 	}
 }
 
-// syncEventAndRegistrations waits for all previously sent events to be
-// processed *and* for all registration output loops to fully process their own
-// internal buffers.
-func (p *Processor) syncEventAndRegistrations() {
-	p.syncEventAndRegistrationSpan(all)
+// TestProcessorDrainRegistration tests that a single registration can be
+// drained without affecting the processor or its other registrations.
+func TestProcessorDrainRegistration(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	r1Stream, r2Stream := newTestStream(), newTestStream()
+	r1ErrC, r2ErrC := make(chan *roachpb.Error, 1), make(chan *roachpb.Error, 1)
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, r1Stream, r1ErrC)
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, r2Stream, r2ErrC)
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("c"), hlc.Timestamp{WallTime: 6}, []byte("val")),
+	)
+
+	checkpoint := func(ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{WallTime: ts})
+	}
+	value := rangeFeedValue(
+		roachpb.Key("c"),
+		roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 6}},
+	)
+
+	// Drain the first registration. It should receive all buffered events
+	// followed by a final checkpoint before being disconnected without error.
+	require.True(t, p.DrainRegistration(r1Stream))
+	require.Nil(t, <-r1ErrC)
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{checkpoint(0), checkpoint(5), value, checkpoint(5)},
+		r1Stream.Events(),
+	)
+	testutils.SucceedsSoon(t, func() error {
+		if n := p.Len(); n != 1 {
+			return fmt.Errorf("expected 1 registration, found %d", n)
+		}
+		return nil
+	})
+	require.False(t, p.DrainRegistration(r1Stream))
+
+	// The second registration should be unaffected.
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 7})
+	p.syncEventAndRegistrations()
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{checkpoint(0), checkpoint(5), value, checkpoint(7)},
+		r2Stream.Events(),
+	)
+	require.Len(t, r2ErrC, 0)
+	require.Len(t, r1Stream.Events(), 0)
+}
+
+// TestProcessorCheckpointCadence tests that checkpoints are coalesced to at
+// most one per CheckpointInterval and published at least once per
+// MinCheckpointCadence, as measured by the processor's clock.
+func TestProcessorCheckpointCadence(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	checkpoint := func(ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{WallTime: ts})
+	}
+	realClock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	newProcessor := func(clock *hlc.Clock, interval, cadence time.Duration) (*Processor, *stop.Stopper) {
+		stopper := stop.NewStopper()
+		p := NewProcessor(Config{
+			AmbientContext:       log.AmbientContext{Tracer: tracing.NewTracer()},
+			Clock:                clock,
+			Span:                 span,
+			EventChanCap:         testProcessorEventCCap,
+			CheckStreamsInterval: 10 * time.Millisecond,
+			CheckpointInterval:   interval,
+			MinCheckpointCadence: cadence,
+		})
+		p.Start(stopper, nil /* rtsIter */)
+		return p, stopper
+	}
+
+	t.Run("coalesce", func(t *testing.T) {
+		p, stopper := newProcessor(realClock, 250*time.Millisecond, 0)
+		defer stopper.Stop(context.Background())
+
+		stream := newTestStream()
+		p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, make(chan *roachpb.Error, 1))
+
+		// The first resolved timestamp update is published immediately. The
+		// following updates are coalesced into a single checkpoint carrying the
+		// latest resolved timestamp.
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 6})
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 7})
+		p.syncEventAndRegistrations()
+		require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(0), checkpoint(5)}, stream.Events())
+
+		var events []*roachpb.RangeFeedEvent
+		testutils.SucceedsSoon(t, func() error {
+			events = append(events, stream.Events()...)
+			if len(events) == 0 {
+				return fmt.Errorf("coalesced checkpoint not published")
+			}
+			return nil
+		})
+		require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(7)}, events)
+	})
+
+	t.Run("min-cadence", func(t *testing.T) {
+		p, stopper := newProcessor(realClock, 10*time.Millisecond, 10*time.Millisecond)
+		defer stopper.Stop(context.Background())
+
+		stream := newTestStream()
+		p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, make(chan *roachpb.Error, 1))
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+
+		// Without further resolved timestamp updates, the latest resolved
+		// timestamp is re-published at the minimum cadence.
+		var published int
+		testutils.SucceedsSoon(t, func() error {
+			for _, e := range stream.Events() {
+				require.NotNil(t, e.Checkpoint)
+				if e.Checkpoint.ResolvedTS == (hlc.Timestamp{WallTime: 5}) {
+					published++
+				}
+			}
+			if published < 3 {
+				return fmt.Errorf("expected at least 3 checkpoints, found %d", published)
+			}
+			return nil
+		})
+	})
+
+	t.Run("manual-clock", func(t *testing.T) {
+		manual := hlc.NewManualClock(1)
+		p, stopper := newProcessor(
+			hlc.NewClock(manual.UnixNano, time.Nanosecond), time.Second, 2*time.Second,
+		)
+		defer stopper.Stop(context.Background())
+
+		stream := newTestStream()
+		p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, make(chan *roachpb.Error, 1))
+
+		// No time has passed on the clock since the processor started, so the
+		// resolved timestamp updates are coalesced.
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 7})
+		p.syncEventAndRegistrations()
+		require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(0)}, stream.Events())
+
+		// The coalesced checkpoint is published once the interval has passed on
+		// the clock.
+		manual.Increment(time.Second.Nanoseconds())
+		p.syncEventAndRegistrations()
+		require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(7)}, stream.Events())
+
+		// On an idle range, the resolved timestamp is re-published at the
+		// minimum cadence.
+		manual.Increment(time.Second.Nanoseconds())
+		p.syncEventAndRegistrations()
+		require.Empty(t, stream.Events())
+		manual.Increment(time.Second.Nanoseconds())
+		p.syncEventAndRegistrations()
+		require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(7)}, stream.Events())
+	})
+}
+
+// TestProcessorReverseBatchOrder tests that registrations can opt into
+// receiving the values of each batch of logical ops in descending timestamp
+// order.
+func TestProcessorReverseBatchOrder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	fwdStream, revStream := newTestStream(), newTestStream()
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, fwdStream, make(chan *roachpb.Error, 1))
+	p.RegisterWithOptions(
+		context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, revStream, make(chan *roachpb.Error, 1),
+		RegistrationOptions{ReverseBatchOrder: true},
+	)
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	value := func(key string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(
+			roachpb.Key(key), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(wall)},
+		)
+	}
+	checkpoint := func(wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(wall))
+	}
+
+	// Values are only reordered within a single batch.
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("b"), ts(2), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("c"), ts(4), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("d"), ts(3), []byte("val")),
+	)
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("e"), ts(5), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("f"), ts(6), []byte("val")),
+	)
+	p.syncEventAndRegistrations()
+
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{
+			checkpoint(0), value("b", 2), value("c", 4), value("d", 3), value("e", 5), value("f", 6),
+		},
+		fwdStream.Events(),
+	)
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{
+			checkpoint(0), value("c", 4), value("d", 3), value("b", 2), value("f", 6), value("e", 5),
+		},
+		revStream.Events(),
+	)
+}
+
+// TestProcessorOnStopped tests that the OnStopped callback is invoked exactly
+// once after the Processor fully stops, with the error it was stopped with.
+func TestProcessorOnStopped(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	boom := roachpb.NewErrorf("boom")
+	testCases := []struct {
+		name string
+		stop func(*Processor, *stop.Stopper)
+		exp  *roachpb.Error
+	}{
+		{
+			name: "clean",
+			stop: func(p *Processor, _ *stop.Stopper) { p.Stop() },
+		},
+		{
+			name: "error",
+			stop: func(p *Processor, _ *stop.Stopper) { p.StopWithErr(boom) },
+			exp:  boom,
+		},
+		{
+			name: "quiesce",
+			stop: func(_ *Processor, s *stop.Stopper) { s.Stop(context.Background()) },
+			exp:  roachpb.NewError(&roachpb.NodeUnavailableError{}),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stopper := stop.NewStopper()
+			defer stopper.Stop(context.Background())
+
+			var p *Processor
+			stoppedC := make(chan *roachpb.Error, 2)
+			p = NewProcessor(Config{
+				AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+				Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+				Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+				EventChanCap:   testProcessorEventCCap,
+				OnStopped: func(pErr *roachpb.Error) {
+					// The Processor's goroutine must have exited.
+					select {
+					case <-p.stoppedC:
+					default:
+						t.Errorf("OnStopped called before Processor stopped")
+					}
+					stoppedC <- pErr
+				},
+			})
+			p.Start(stopper, nil /* rtsIter */)
+
+			errC := make(chan *roachpb.Error, 1)
+			p.Register(context.Background(), p.Span, hlc.Timestamp{}, nil, false, newTestStream(), errC)
+
+			tc.stop(p, stopper)
+			require.Equal(t, tc.exp, <-stoppedC)
+			require.Equal(t, tc.exp, <-errC)
+
+			// Stopping again does not call OnStopped a second time.
+			p.Stop()
+			require.Len(t, stoppedC, 0)
+		})
+	}
+}
+
+// TestProcessorOmitCheckpointSpans tests that registrations can opt into
+// receiving checkpoints without spans after the first checkpoint.
+func TestProcessorOmitCheckpointSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	fullStream, omitStream := newTestStream(), newTestStream()
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, fullStream, make(chan *roachpb.Error, 1))
+	p.RegisterWithOptions(
+		context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, omitStream, make(chan *roachpb.Error, 1),
+		RegistrationOptions{OmitCheckpointSpans: true},
+	)
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 7})
+	p.syncEventAndRegistrations()
+
+	checkpoint := func(span roachpb.Span, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span, hlc.Timestamp{WallTime: wall})
+	}
+	fullSpan := span.AsRawSpanWithNoLocals()
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{
+			checkpoint(fullSpan, 0), checkpoint(fullSpan, 5), checkpoint(fullSpan, 7),
+		},
+		fullStream.Events(),
+	)
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{
+			checkpoint(fullSpan, 0), checkpoint(roachpb.Span{}, 5), checkpoint(roachpb.Span{}, 7),
+		},
+		omitStream.Events(),
+	)
+}
+
+type testEventLog struct {
+	mu     sync.Mutex
+	events []*roachpb.RangeFeedEvent
+	err    error
+}
+
+func (l *testEventLog) Append(event *roachpb.RangeFeedEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	l.events = append(l.events, event)
+	return nil
+}
+
+func (l *testEventLog) setErr(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+}
+
+// TestProcessorEventLog tests that events are appended to the Processor's
+// EventLog before they are delivered, including the final checkpoints of
+// draining registrations, and that the Processor stops without delivering an
+// event if its append fails.
+func TestProcessorEventLog(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	eventLog := &testEventLog{}
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	p := NewProcessor(Config{
+		AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:           span,
+		EventChanCap:   testProcessorEventCCap,
+		EventLog:       eventLog,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	stream := newTestStream()
+	errC := make(chan *roachpb.Error, 1)
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, errC)
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("c"), hlc.Timestamp{WallTime: 6}, []byte("val")),
+	)
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 7})
+	p.syncEventAndRegistrations()
+
+	value := rangeFeedValue(
+		roachpb.Key("c"), roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 6}},
+	)
+	initCheckpoint := rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{})
+	checkpoint := rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{WallTime: 7})
+	require.Equal(t, []*roachpb.RangeFeedEvent{initCheckpoint, value, checkpoint}, eventLog.events)
+	require.Equal(t, []*roachpb.RangeFeedEvent{initCheckpoint, value, checkpoint}, stream.Events())
+
+	// The final checkpoint of a draining registration is logged.
+	drained := newTestStream()
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, drained, make(chan *roachpb.Error, 1))
+	p.syncEventAndRegistrations()
+	logged := len(eventLog.events)
+	require.True(t, p.DrainRegistration(drained))
+	require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint}, eventLog.events[logged:])
+
+	// Events that cannot be logged are not delivered, and the Processor stops,
+	// so that the log has no gaps.
+	eventLog.setErr(fmt.Errorf("disk full"))
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("d"), hlc.Timestamp{WallTime: 8}, []byte("val")),
+	)
+	pErr := <-errC
+	require.Regexp(t, "disk full", pErr.GoError())
+	require.Len(t, stream.Events(), 0)
+	<-p.stoppedC
+}
+
+// TestProcessorCoveredSpans tests that the union of the spans of all
+// registrations is maintained as registrations come and go.
+func TestProcessorCoveredSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	require.Nil(t, p.CoveredSpans())
+
+	rspan := func(start, end string) roachpb.RSpan {
+		return roachpb.RSpan{Key: roachpb.RKey(start), EndKey: roachpb.RKey(end)}
+	}
+	span := func(start, end string) roachpb.Span {
+		return rspan(start, end).AsRawSpanWithNoLocals()
+	}
+	register := func(sp roachpb.RSpan) *testStream {
+		s := newTestStream()
+		p.Register(context.Background(), sp, hlc.Timestamp{}, nil, false, s, make(chan *roachpb.Error, 1))
+		return s
+	}
+	register(rspan("a", "c"))
+	sBD := register(rspan("b", "d"))
+	register(rspan("f", "h"))
+	require.Equal(t, []roachpb.Span{span("a", "d"), span("f", "h")}, p.CoveredSpans())
+
+	// Removing a registration shrinks the covered spans.
+	require.True(t, p.DrainRegistration(sBD))
+	testutils.SucceedsSoon(t, func() error {
+		if exp, act := []roachpb.Span{span("a", "c"), span("f", "h")}, p.CoveredSpans(); !reflect.DeepEqual(exp, act) {
+			return fmt.Errorf("expected covered spans %v, found %v", exp, act)
+		}
+		return nil
+	})
+
+	// Stopping the processor disconnects all registrations.
+	p.Stop()
+	<-p.stoppedC
+	require.Nil(t, p.CoveredSpans())
+
+	var nilP *Processor
+	require.Nil(t, nilP.CoveredSpans())
+}
+
+func TestProcessorOnResolvedTSAdvance(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	type advance struct {
+		from, to hlc.Timestamp
+		cause    *enginepb.MVCCLogicalOp
+	}
+	var mu sync.Mutex
+	var advances []advance
+	p := NewProcessor(Config{
+		AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:   testProcessorEventCCap,
+		OnResolvedTSAdvance: func(from, to hlc.Timestamp, cause *enginepb.MVCCLogicalOp) {
+			a := advance{from: from, to: to}
+			if cause != nil {
+				causeCopy := *cause
+				a.cause = &causeCopy
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			advances = append(advances, a)
+		},
+	})
+	p.Start(stopper, nil)
+	defer p.Stop()
+
+	txn1 := uuid.MakeV4()
+	intentTS := hlc.Timestamp{WallTime: 10}
+	closedTS := hlc.Timestamp{WallTime: 20}
+
+	// The intent holds the resolved timestamp back when the closed timestamp
+	// is forwarded past it.
+	p.ConsumeLogicalOps(writeIntentOp(txn1, intentTS))
+	p.ForwardClosedTS(closedTS)
+	// Resolving the intent allows the resolved timestamp to catch up to the
+	// closed timestamp.
+	commitOp := commitIntentOp(txn1, intentTS)
+	p.ConsumeLogicalOps(commitOp)
+	p.syncEventC()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []advance{
+		{from: hlc.Timestamp{}, to: intentTS.Prev()},
+		{from: intentTS.Prev(), to: closedTS, cause: &commitOp},
+	}, advances)
+}
+
+// TestProcessorOnResolvedTSAdvanceBeforeCheckpoint tests that the resolved
+// timestamp advance callback is invoked before the checkpoint carrying the new
+// resolved timestamp is published.
+func TestProcessorOnResolvedTSAdvanceBeforeCheckpoint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	var p *Processor
+	var mu sync.Mutex
+	var advanced []hlc.Timestamp
+	var publishedEarly bool
+	p = NewProcessor(Config{
+		AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:   testProcessorEventCCap,
+		OnResolvedTSAdvance: func(from, to hlc.Timestamp, _ *enginepb.MVCCLogicalOp) {
+			mu.Lock()
+			defer mu.Unlock()
+			advanced = append(advanced, to)
+			publishedEarly = publishedEarly || p.IsResolved(to)
+		},
+	})
+	p.Start(stopper, nil)
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	stream := newTestStream()
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, stream, make(chan *roachpb.Error, 1))
+	require.True(t, ok)
+
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 10})
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 20})
+	p.syncEventAndRegistrations()
+	require.True(t, p.IsResolved(hlc.Timestamp{WallTime: 20}))
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{}),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{WallTime: 10}),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{WallTime: 20}),
+	}, stream.Events())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []hlc.Timestamp{{WallTime: 10}, {WallTime: 20}}, advanced)
+	// The checkpoints had not been published when the callback was invoked.
+	require.False(t, publishedEarly)
+}
+
+// TestProcessorMaxEventsPerBatch tests that a batch of logical operations that
+// exceeds MaxEventsPerBatch is published in full before the checkpoint that it
+// produces.
+func TestProcessorMaxEventsPerBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	p := NewProcessor(Config{
+		AmbientContext:    log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:             hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:              span,
+		EventChanCap:      testProcessorEventCCap,
+		MaxEventsPerBatch: 2,
+	})
+	p.Start(stopper, nil)
+	defer p.Stop()
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	value := func(key string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(
+			roachpb.Key(key), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(wall)},
+		)
+	}
+	checkpoint := func(rts hlc.Timestamp) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), rts)
+	}
+
+	// Hold the resolved timestamp back with an intent.
+	txn1 := uuid.MakeV4()
+	p.ConsumeLogicalOps(writeIntentOp(txn1, ts(3)))
+	p.ForwardClosedTS(ts(10))
+
+	stream := newTestStream()
+	p.Register(context.Background(), span, ts(1), nil, false, stream, make(chan *roachpb.Error, 1))
+
+	// Committing the intent in the middle of the batch advances the resolved
+	// timestamp, but the checkpoint is only published after all of the
+	// batch's values.
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("b"), ts(4), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("c"), ts(5), []byte("val")),
+		commitIntentOpWithKV(txn1, roachpb.Key("d"), ts(3), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("e"), ts(6), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("f"), ts(7), []byte("val")),
+	)
+	p.syncEventAndRegistrations()
+
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{
+			checkpoint(ts(3).Prev()),
+			value("b", 4), value("c", 5), value("d", 3), value("e", 6), value("f", 7),
+			checkpoint(ts(10)),
+		},
+		stream.Events(),
+	)
+}
+
+// TestProcessorMaxBatchSize tests that the values published to a registration
+// by a batch of logical operations are combined into RangeFeedBatch events,
+// and that a checkpoint is only published after the values that precede it.
+func TestProcessorMaxBatchSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	p := NewProcessor(Config{
+		AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:           span,
+		EventChanCap:   testProcessorEventCCap,
+		MaxBatchSize:   2,
+	})
+	p.Start(stopper, nil)
+	defer p.Stop()
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	value := func(key string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(
+			roachpb.Key(key), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(wall)},
+		)
+	}
+	batch := func(values ...*roachpb.RangeFeedEvent) *roachpb.RangeFeedEvent {
+		var b roachpb.RangeFeedBatch
+		for _, v := range values {
+			b.Values = append(b.Values, *v.Val)
+		}
+		var event roachpb.RangeFeedEvent
+		event.MustSetValue(&b)
+		return &event
+	}
+	checkpoint := func(rts hlc.Timestamp) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), rts)
+	}
+
+	// Hold the resolved timestamp back with an intent.
+	txn1 := uuid.MakeV4()
+	p.ConsumeLogicalOps(writeIntentOp(txn1, ts(3)))
+	p.ForwardClosedTS(ts(10))
+
+	stream := newTestStream()
+	p.Register(context.Background(), span, ts(1), nil, false, stream, make(chan *roachpb.Error, 1))
+
+	// Committing the intent in the middle of the batch advances the resolved
+	// timestamp, which flushes the values that precede it.
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("b"), ts(4), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("c"), ts(5), []byte("val")),
+		commitIntentOpWithKV(txn1, roachpb.Key("d"), ts(3), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("e"), ts(6), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("f"), ts(7), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("g"), ts(8), []byte("val")),
+	)
+	p.syncEventAndRegistrations()
+
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{
+			checkpoint(ts(3).Prev()),
+			batch(value("b", 4), value("c", 5)), value("d", 3),
+			checkpoint(ts(10)),
+			batch(value("e", 6), value("f", 7)), value("g", 8),
+		},
+		stream.Events(),
+	)
+}
+
+func TestProcessorIsResolved(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+
+	// Hold the resolved timestamp back with an intent.
+	txn1 := uuid.MakeV4()
+	p.ConsumeLogicalOps(writeIntentOp(txn1, ts(3)))
+	p.ForwardClosedTS(ts(10))
+	p.syncEventC()
+	require.True(t, p.IsResolved(ts(2)))
+	require.False(t, p.IsResolved(ts(3)))
+	require.False(t, p.IsResolved(ts(10)))
+
+	// Resolve the intent.
+	p.ConsumeLogicalOps(commitIntentOp(txn1, ts(3)))
+	p.syncEventC()
+	require.True(t, p.IsResolved(ts(3)))
+	require.True(t, p.IsResolved(ts(10)))
+	require.False(t, p.IsResolved(ts(11)))
+
+	var nilP *Processor
+	require.False(t, nilP.IsResolved(ts(1)))
+}
+
+// TestProcessorMinResolvedTS tests that registrations that require a minimum
+// resolved timestamp are rejected if the processor has not reached it.
+func TestProcessorMinResolvedTS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 10})
+	register := func(minTS int64) (*testStream, chan *roachpb.Error) {
+		stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+		ok, _ := p.RegisterWithOptions(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, errC,
+			RegistrationOptions{MinResolvedTS: hlc.Timestamp{WallTime: minTS}})
+		require.True(t, ok)
+		return stream, errC
+	}
+
+	// The resolved timestamp is behind the registration's minimum.
+	behindStream, behindErrC := register(11)
+	require.Equal(t, newErrResolvedTSBehind(), <-behindErrC)
+	require.Equal(t, 0, p.Len())
+	require.Len(t, behindStream.Events(), 0)
+
+	// The resolved timestamp has reached the registration's minimum.
+	stream, errC := register(10)
+	p.syncEventAndRegistrations()
+	require.Equal(t, 1, p.Len())
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{rangeFeedCheckpoint(
+			span.AsRawSpanWithNoLocals(), hlc.Timestamp{WallTime: 10},
+		)},
+		stream.Events(),
+	)
+	require.Len(t, errC, 0)
+}
+
+// TestProcessorUpdateRegistrationSpan tests that the span of a registration
+// can be narrowed and that a registration whose span is narrowed to nothing is
+// gracefully disconnected with a typed error.
+func TestProcessorUpdateRegistrationSpan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	rspan := func(key, endKey string) roachpb.RSpan {
+		return roachpb.RSpan{Key: roachpb.RKey(key), EndKey: roachpb.RKey(endKey)}
+	}
+	value := func(key string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(
+			roachpb.Key(key), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(wall)},
+		)
+	}
+	checkpoint := func(span roachpb.RSpan, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(wall))
+	}
+
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(context.Background(), rspan("a", "m"), ts(1), nil, false, stream, errC)
+	p.ForwardClosedTS(ts(5))
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("c"), ts(6), []byte("val")))
+	require.False(t, p.UpdateRegistrationSpan(newTestStream(), rspan("d", "f")))
+
+	// Narrow the registration. Values outside of its new span are no longer
+	// published to it.
+	require.True(t, p.UpdateRegistrationSpan(stream, rspan("d", "z")))
+	require.Equal(t, []roachpb.Span{rspan("d", "m").AsRawSpanWithNoLocals()}, p.CoveredSpans())
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("c"), ts(7), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("e"), ts(8), []byte("val")),
+	)
+	p.ForwardClosedTS(ts(10))
+	p.syncEventAndRegistrations()
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{
+			checkpoint(rspan("a", "m"), 0), checkpoint(rspan("a", "m"), 5), value("c", 6),
+			value("e", 8), checkpoint(rspan("d", "m"), 10),
+		},
+		stream.Events(),
+	)
+
+	// Narrow the registration to nothing. It flushes its buffered events
+	// before being disconnected.
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("e"), ts(11), []byte("val")))
+	require.True(t, p.UpdateRegistrationSpan(stream, rspan("x", "z")))
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("e"), ts(12), []byte("val")))
+	pErr := <-errC
+	retryErr, ok := pErr.GetDetail().(*roachpb.RangeFeedRetryError)
+	require.True(t, ok, "unexpected error %v", pErr)
+	require.Equal(t, roachpb.RangeFeedRetryError_REASON_SPAN_NARROWED_TO_EMPTY, retryErr.Reason)
+	require.Equal(t, []*roachpb.RangeFeedEvent{value("e", 11)}, stream.Events())
+	testutils.SucceedsSoon(t, func() error {
+		if n := p.Len(); n != 0 {
+			return fmt.Errorf("expected 0 registrations, found %d", n)
+		}
+		return nil
+	})
+}
+
+// TestProcessorValuesAboveResolvedTS tests that the processor never delivers a
+// value at or below the resolved timestamp of a checkpoint that it has already
+// delivered, as intents are written, pushed, and resolved around closed
+// timestamp updates.
+func TestProcessorValuesAboveResolvedTS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	r1Stream, r2Stream := newResolvedTSCheckingStream(), newResolvedTSCheckingStream()
+	p.Register(context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
+		ts(1), nil, false, r1Stream, make(chan *roachpb.Error, 1))
+	p.Register(context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		ts(1), nil, false, r2Stream, make(chan *roachpb.Error, 1))
+
+	txn1, txn2 := uuid.MakeV4(), uuid.MakeV4()
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("b"), ts(2), []byte("val")),
+		writeIntentOpWithKey(txn1, roachpb.Key("c"), ts(4)),
+		writeIntentOpWithKey(txn2, roachpb.Key("n"), ts(6)),
+	)
+	p.ForwardClosedTS(ts(10))
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("d"), ts(11), []byte("val")),
+		updateIntentOp(txn1, ts(12)),
+		commitIntentOpWithKV(txn2, roachpb.Key("n"), ts(6), []byte("val")),
+	)
+	p.ForwardClosedTS(ts(15))
+	p.ConsumeLogicalOps(
+		commitIntentOpWithKV(txn1, roachpb.Key("c"), ts(12), []byte("val")),
+		writeValueOpWithKV(roachpb.Key("e"), ts(16), []byte("val")),
+	)
+	p.ForwardClosedTS(ts(20))
+	p.syncEventAndRegistrations()
+	require.NotEmpty(t, r1Stream.Events())
+	requireNoViolations(t, r1Stream, r2Stream)
+}
+
+// TestProcessorTimerLateness tests that the processor records the lateness of
+// its timers and continues to service them while they are running late.
+func TestProcessorTimerLateness(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	newProcessor := func(threshold time.Duration) (*Processor, *stop.Stopper) {
+		stopper := stop.NewStopper()
+		p := NewProcessor(Config{
+			AmbientContext:         log.AmbientContext{Tracer: tracing.NewTracer()},
+			Clock:                  hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+			Span:                   span,
+			EventChanCap:           testProcessorEventCCap,
+			CheckStreamsInterval:   10 * time.Millisecond,
+			MinCheckpointCadence:   5 * time.Millisecond,
+			TimerLatenessThreshold: threshold,
+		})
+		p.Start(stopper, nil /* rtsIter */)
+		return p, stopper
+	}
+
+	t.Run("late", func(t *testing.T) {
+		// Every timer is serviced more than a nanosecond after it fires, so
+		// the processor prioritizes its timers throughout.
+		p, stopper := newProcessor(time.Nanosecond)
+		defer stopper.Stop(context.Background())
+
+		stream := newTestStream()
+		p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, make(chan *roachpb.Error, 1))
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+		testutils.SucceedsSoon(t, func() error {
+			if m := p.MetricsSnapshot(); m.TimerFirings < 3 {
+				return fmt.Errorf("expected at least 3 timer firings, found %d", m.TimerFirings)
+			}
+			return nil
+		})
+		m := p.MetricsSnapshot()
+		require.Equal(t, m.TimerFirings, m.LateTimerFirings)
+		require.True(t, m.MaxTimerLateness > 0)
+		p.syncEventAndRegistrations()
+		require.True(t, len(stream.Events()) > 2)
+	})
+
+	t.Run("on time", func(t *testing.T) {
+		p, stopper := newProcessor(time.Hour)
+		defer stopper.Stop(context.Background())
+
+		testutils.SucceedsSoon(t, func() error {
+			if m := p.MetricsSnapshot(); m.TimerFirings < 3 {
+				return fmt.Errorf("expected at least 3 timer firings, found %d", m.TimerFirings)
+			}
+			return nil
+		})
+		require.Zero(t, p.MetricsSnapshot().LateTimerFirings)
+	})
+}
+
+// TestProcessorWithDiff tests that a processor configured with WithDiff
+// treats registrations that did not request previous values as if they had.
+func TestProcessorWithDiff(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	p := NewProcessor(Config{
+		AmbientContext:       log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:                hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:                 span,
+		EventChanCap:         testProcessorEventCCap,
+		CheckStreamsInterval: 10 * time.Millisecond,
+		WithDiff:             true,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	stream := newTestStream()
+	ok, filter := p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false /* withDiff */, stream, make(chan *roachpb.Error, 1))
+	require.True(t, ok)
+	require.True(t, filter.NeedPrevVal(roachpb.Span{Key: roachpb.Key("b")}))
+	p.syncEventAndRegistrations()
+	stream.Events() // discard the initial checkpoint
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	p.ConsumeLogicalOps(
+		makeLogicalOp(&enginepb.MVCCWriteValueOp{
+			Key: roachpb.Key("b"), Timestamp: ts(5), Value: []byte("val"),
+		}),
+		makeLogicalOp(&enginepb.MVCCWriteValueOp{
+			Key: roachpb.Key("b"), Timestamp: ts(6), Value: []byte("val2"), PrevValue: []byte("val"),
+		}),
+	)
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedValueWithPrev(
+			roachpb.Key("b"),
+			roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(5)},
+			roachpb.Value{},
+		),
+		rangeFeedValueWithPrev(
+			roachpb.Key("b"),
+			roachpb.Value{RawBytes: []byte("val2"), Timestamp: ts(6)},
+			roachpb.Value{RawBytes: []byte("val")},
+		),
+	}, stream.Events())
+}
+
+// TestProcessorDeleteRange tests that range deletions are published to the
+// overlapping registrations, constrained to the registrations' spans.
+func TestProcessorDeleteRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	rspan := func(key, endKey string) roachpb.RSpan {
+		return roachpb.RSpan{Key: roachpb.RKey(key), EndKey: roachpb.RKey(endKey)}
+	}
+	register := func(sp roachpb.RSpan, startTS hlc.Timestamp) *testStream {
+		stream := newTestStream()
+		ok, _ := p.Register(context.Background(), sp, startTS, nil, false, stream, make(chan *roachpb.Error, 1))
+		require.True(t, ok)
+		return stream
+	}
+	r1Stream := register(rspan("a", "m"), ts(1))
+	r2Stream := register(rspan("f", "z"), ts(1))
+	r3Stream := register(rspan("x", "z"), ts(1))
+	r4Stream := register(rspan("a", "z"), ts(6))
+	p.syncEventAndRegistrations()
+	for _, s := range []*testStream{r1Stream, r2Stream, r3Stream, r4Stream} {
+		s.Events() // discard the initial checkpoints
+	}
+
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("g"), ts(4), []byte("val")),
+		deleteRangeOp(roachpb.Key("d"), roachpb.Key("h"), ts(5)),
+	)
+	p.syncEventAndRegistrations()
+	val := rangeFeedValue(
+		roachpb.Key("g"), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(4)},
+	)
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		val, rangeFeedDeleteRange(rspan("d", "h").AsRawSpanWithNoLocals(), ts(5)),
+	}, r1Stream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		val, rangeFeedDeleteRange(rspan("f", "h").AsRawSpanWithNoLocals(), ts(5)),
+	}, r2Stream.Events())
+	require.Nil(t, r3Stream.Events())
+	// Deletions at or below a registration's start timestamp are not published
+	// to it.
+	require.Nil(t, r4Stream.Events())
+}
+
+// TestProcessorDeletionValues tests that deletion tombstones are published as
+// deletions, distinctly from writes of empty values.
+func TestProcessorDeletionValues(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	stream := newTestStream()
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, make(chan *roachpb.Error, 1))
+	require.True(t, ok)
+	p.syncEventAndRegistrations()
+	stream.Events() // discard the initial checkpoint
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	emptyVal := roachpb.MakeValueFromBytes(nil).RawBytes
+	txnID := uuid.MakeV4()
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("b"), ts(5), emptyVal),
+		makeLogicalOp(&enginepb.MVCCWriteValueOp{
+			Key:       roachpb.Key("c"),
+			Timestamp: ts(6),
+			Value:     []byte{},
+			Deleted:   true,
+		}),
+		writeIntentOpWithKey(txnID, roachpb.Key("d"), ts(7)),
+		makeLogicalOp(&enginepb.MVCCCommitIntentOp{
+			TxnID:     txnID,
+			Key:       roachpb.Key("d"),
+			Timestamp: ts(7),
+			Value:     []byte{},
+			Deleted:   true,
+		}),
+	)
+	p.syncEventAndRegistrations()
+
+	events := stream.Events()
+	require.Len(t, events, 3)
+	for i, exp := range []struct {
+		key        string
+		isDeletion bool
+	}{
+		{"b", false},
+		{"c", true},
+		{"d", true},
+	} {
+		require.Equal(t, roachpb.Key(exp.key), events[i].Val.Key)
+		require.Equal(t, exp.isDeletion, events[i].Val.IsDeletion, "key %s", exp.key)
+	}
+}
+
+// TestProcessorSSTable tests that ingested SSTables are published to the
+// registrations that overlap them with their span clipped to each registration,
+// and that the resolved timestamp does not advance past the ingestion until the
+// SSTable has been published.
+func TestProcessorSSTable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	rspan := func(key, endKey string) roachpb.RSpan {
+		return roachpb.RSpan{Key: roachpb.RKey(key), EndKey: roachpb.RKey(endKey)}
+	}
+	register := func(sp roachpb.RSpan, startTS hlc.Timestamp) *testStream {
+		stream := newTestStream()
+		ok, _ := p.Register(context.Background(), sp, startTS, nil, false, stream, make(chan *roachpb.Error, 1))
+		require.True(t, ok)
+		return stream
+	}
+	r1Stream := register(rspan("a", "m"), ts(1))
+	r2Stream := register(rspan("f", "z"), ts(1))
+	r3Stream := register(rspan("x", "z"), ts(1))
+	r4Stream := register(rspan("a", "z"), ts(6))
+	p.syncEventAndRegistrations()
+	for _, s := range []*testStream{r1Stream, r2Stream, r3Stream, r4Stream} {
+		s.Events() // discard the initial checkpoints
+	}
+
+	data := []byte("sst")
+	p.ConsumeLogicalOps(ingestSSTableOp(data, roachpb.Key("d"), roachpb.Key("h"), ts(5)))
+	p.ForwardClosedTS(ts(7))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedSSTable(data, rspan("d", "h").AsRawSpanWithNoLocals(), ts(5)),
+		rangeFeedCheckpoint(rspan("a", "m").AsRawSpanWithNoLocals(), ts(7)),
+	}, r1Stream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedSSTable(data, rspan("f", "h").AsRawSpanWithNoLocals(), ts(5)),
+		rangeFeedCheckpoint(rspan("f", "z").AsRawSpanWithNoLocals(), ts(7)),
+	}, r2Stream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(rspan("x", "z").AsRawSpanWithNoLocals(), ts(7)),
+	}, r3Stream.Events())
+	// SSTables ingested at or below a registration's start timestamp are not
+	// published to it.
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(rspan("a", "z").AsRawSpanWithNoLocals(), ts(7)),
+	}, r4Stream.Events())
+}
+
+// TestProcessorRegisterContextCanceled tests that registrations are
+// disconnected with a REASON_STREAM_CANCELED error once their context is
+// canceled, and that registrations with a canceled context are rejected.
+func TestProcessorRegisterContextCanceled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	ctx, cancel := context.WithCancel(context.Background())
+	r1ErrC := make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(ctx, span, hlc.Timestamp{}, nil, false, newTestStream(), r1ErrC)
+	require.True(t, ok)
+	r2ErrC := make(chan *roachpb.Error, 1)
+	ok, _ = p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, newTestStream(), r2ErrC)
+	require.True(t, ok)
+	require.Equal(t, 2, p.Len())
+
+	// Canceling the context disconnects only its registration.
+	cancel()
+	pErr := <-r1ErrC
+	require.Regexp(t, "REASON_STREAM_CANCELED", pErr.GoError())
+	testutils.SucceedsSoon(t, func() error {
+		if l := p.Len(); l != 1 {
+			return fmt.Errorf("expected 1 registration, found %d", l)
+		}
+		return nil
+	})
+	select {
+	case pErr := <-r2ErrC:
+		t.Fatalf("unexpected disconnection of registration with live context: %v", pErr)
+	default:
+	}
+
+	// A registration whose context is already canceled is rejected.
+	r3ErrC := make(chan *roachpb.Error, 1)
+	ok, _ = p.Register(ctx, span, hlc.Timestamp{}, nil, false, newTestStream(), r3ErrC)
+	require.True(t, ok)
+	pErr = <-r3ErrC
+	require.Regexp(t, "REASON_STREAM_CANCELED", pErr.GoError())
+	require.Equal(t, 1, p.Len())
+}
+
+// testStreamLiveness is a StreamLiveness that considers a stream dead once it
+// has been marked as such.
+type testStreamLiveness struct {
+	mu struct {
+		syncutil.Mutex
+		dead map[Stream]bool
+	}
+}
+
+func (l *testStreamLiveness) CheckStream(s Stream) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mu.dead[s] {
+		return fmt.Errorf("missed heartbeat")
+	}
+	return nil
+}
+
+func (l *testStreamLiveness) markDead(s Stream) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mu.dead[s] = true
+}
+
+// TestProcessorStreamLiveness tests that the Processor disconnects the
+// registrations whose stream is no longer alive according to the configured
+// StreamLiveness.
+func TestProcessorStreamLiveness(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	liveness := &testStreamLiveness{}
+	liveness.mu.dead = make(map[Stream]bool)
+	p := NewProcessor(Config{
+		AmbientContext:       log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:                hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:                 roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:         testProcessorEventCCap,
+		CheckStreamsInterval: 10 * time.Millisecond,
+		StreamLiveness:       liveness,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	r1Stream, r1ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, r1Stream, r1ErrC)
+	require.True(t, ok)
+	r2Stream, r2ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ = p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, r2Stream, r2ErrC)
+	require.True(t, ok)
+
+	liveness.markDead(r1Stream)
+	pErr := <-r1ErrC
+	require.Regexp(t, "missed heartbeat", pErr.GoError())
+	testutils.SucceedsSoon(t, func() error {
+		if l := p.Len(); l != 1 {
+			return fmt.Errorf("expected 1 registration, found %d", l)
+		}
+		return nil
+	})
+	select {
+	case pErr := <-r2ErrC:
+		t.Fatalf("unexpected disconnection of registration with live stream: %v", pErr)
+	default:
+	}
+}
+
+// TestProcessorRejectIntentOps tests that a processor configured to reject
+// intent ops consumes other ops as usual, but stops and disconnects all
+// registrations when it receives an intent op.
+func TestProcessorRejectIntentOps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	p := NewProcessor(Config{
+		AmbientContext:  log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:           hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:            roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:    testProcessorEventCCap,
+		RejectIntentOps: true,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	r1Stream, r1ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, r1Stream, r1ErrC)
+	require.True(t, ok)
+
+	// Values are published as usual.
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("b"), hlc.Timestamp{WallTime: 5}, []byte("val")))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{}),
+		rangeFeedValue(roachpb.Key("b"), roachpb.Value{
+			RawBytes:  []byte("val"),
+			Timestamp: hlc.Timestamp{WallTime: 5},
+		}),
+	}, r1Stream.Events())
+
+	// An intent op stops the processor.
+	txnID := uuid.MakeV4()
+	p.ConsumeLogicalOps(writeIntentOp(txnID, hlc.Timestamp{WallTime: 10}))
+	pErr := <-r1ErrC
+	require.Regexp(t, "read-only rangefeed .* received unexpected intent op", pErr.GoError())
+	require.Regexp(t, txnID.String(), pErr.GoError())
+	<-p.stoppedC
+	require.Equal(t, 0, p.Len())
+}
+
+// TestProcessorIntentQueueOverflow tests that a processor whose intent queue
+// exceeds MaxIntentQueueSize stops with a retryable error, and that the
+// resolved timestamp of a processor restarted in its place advances past the
+// transactions that were shed.
+func TestProcessorIntentQueueOverflow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	cfg := Config{
+		AmbientContext:     log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:              hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:               roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:       testProcessorEventCCap,
+		MaxIntentQueueSize: 2,
+	}
+	p := NewProcessor(cfg)
+	p.Start(stopper, nil /* rtsIter */)
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	r1Stream, r1ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, r1Stream, r1ErrC)
+	require.True(t, ok)
+	p.ForwardClosedTS(ts(5))
+	p.syncEventC()
+	require.Equal(t, ts(5), p.rts.Get())
+
+	// Overflowing the queue sheds the oldest transaction and stops the
+	// processor.
+	txn1, txn2, txn3 := uuid.MakeV4(), uuid.MakeV4(), uuid.MakeV4()
+	p.ConsumeLogicalOps(
+		writeIntentOpWithKey(txn1, roachpb.Key("b"), ts(10)),
+		writeIntentOpWithKey(txn2, roachpb.Key("c"), ts(12)),
+		writeIntentOpWithKey(txn3, roachpb.Key("d"), ts(8)),
+	)
+	require.Equal(t, newErrIntentQueueOverflow().GoError(), (<-r1ErrC).GoError())
+	<-p.stoppedC
+	require.Equal(t, int64(1), p.Config.Metrics.RangeFeedShedIntentTxns.Count())
+
+	// The shed transaction commits. A processor started in place of the
+	// stopped one finds the intents of the other transactions in its initial
+	// scan, and its resolved timestamp advances once they are resolved.
+	rtsIter := newTestIterator([]engine.MVCCKeyValue{
+		makeIntent("b", txn1, "txnKey1", 10),
+		makeProvisionalKV("b", "txnKey1", 10),
+		makeIntent("c", txn2, "txnKey2", 12),
+		makeProvisionalKV("c", "txnKey2", 12),
+	})
+	p = NewProcessor(cfg)
+	p.Start(stopper, rtsIter)
+	r2Stream, r2ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ = p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, r2Stream, r2ErrC)
+	require.True(t, ok)
+	<-rtsIter.done
+	p.ForwardClosedTS(ts(20))
+	p.syncEventC()
+	require.True(t, p.rts.IsInit())
+	require.Equal(t, ts(9), p.rts.Get())
+
+	p.ConsumeLogicalOps(
+		commitIntentOp(txn1, ts(10)),
+		commitIntentOp(txn2, ts(12)),
+	)
+	p.syncEventC()
+	require.Equal(t, ts(20), p.rts.Get())
+	require.Zero(t, p.Config.Metrics.RangeFeedShedIntentTxns.Count())
+}
+
+// TestProcessorCatchupIterConstructor tests that the catch-up iterator of a
+// registration can be constructed by the processor when it accepts the
+// registration, and that the registration receives the catch-up scan's values
+// before its first checkpoint and any live values.
+func TestProcessorCatchupIterConstructor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	p.ForwardClosedTS(ts(20))
+
+	var constructed int
+	stream := newTestStream()
+	opts := RegistrationOptions{
+		CatchupIterConstructor: func() engine.SimpleIterator {
+			constructed++
+			return newTestIterator([]engine.MVCCKeyValue{
+				makeKV("b", "val1", 10),
+				makeKV("b", "val0", 4),
+				makeKV("c", "val2", 11),
+			})
+		},
+	}
+	ok, _ := p.RegisterWithOptions(
+		context.Background(), span, ts(5), nil /* catchupIter */, false /* withDiff */, stream, make(chan *roachpb.Error, 1), opts,
+	)
+	require.True(t, ok)
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("d"), ts(21), []byte("val3")))
+	p.syncEventAndRegistrations()
+	require.Equal(t, 1, constructed)
+
+	value := func(key, val string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(roachpb.Key(key), roachpb.Value{RawBytes: []byte(val), Timestamp: ts(wall)})
+	}
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		value("b", "val1", 10),
+		value("c", "val2", 11),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(20)),
+		value("d", "val3", 21),
+	}, stream.Events())
+}
+
+// TestProcessorMarkCatchUpComplete tests that registrations can opt into having
+// the first checkpoint after their catch-up scan marked, and that the marker is
+// never coalesced with a later checkpoint.
+func TestProcessorMarkCatchUpComplete(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	rawSpan := span.AsRawSpanWithNoLocals()
+	p.ForwardClosedTS(ts(20))
+
+	register := func(opts RegistrationOptions) *testStream {
+		stream := newTestStream()
+		catchupIter := newTestIterator([]engine.MVCCKeyValue{makeKV("b", "val1", 10)})
+		ok, _ := p.RegisterWithOptions(
+			context.Background(), span, ts(5), catchupIter, false /* withDiff */, stream,
+			make(chan *roachpb.Error, 1), opts,
+		)
+		require.True(t, ok)
+		return stream
+	}
+	markStream := register(RegistrationOptions{MarkCatchUpComplete: true})
+	plainStream := register(RegistrationOptions{})
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("d"), ts(21), []byte("val2")))
+	p.ForwardClosedTS(ts(25))
+	p.syncEventAndRegistrations()
+
+	value := func(key, val string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(roachpb.Key(key), roachpb.Value{RawBytes: []byte(val), Timestamp: ts(wall)})
+	}
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		value("b", "val1", 10),
+		makeRangeFeedEvent(&roachpb.RangeFeedCheckpoint{
+			Span: rawSpan, ResolvedTS: ts(20), CatchUpComplete: true,
+		}),
+		value("d", "val2", 21),
+		rangeFeedCheckpoint(rawSpan, ts(25)),
+	}, markStream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		value("b", "val1", 10),
+		rangeFeedCheckpoint(rawSpan, ts(20)),
+		value("d", "val2", 21),
+		rangeFeedCheckpoint(rawSpan, ts(25)),
+	}, plainStream.Events())
+
+	// The marker is not superseded by a checkpoint published before it is
+	// sent to the stream.
+	reg := newTestRegistration(rawSpan, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.coalesceCheckpoints = true
+	marker := makeRangeFeedEvent(&roachpb.RangeFeedCheckpoint{
+		Span: rawSpan, ResolvedTS: ts(20), CatchUpComplete: true,
+	})
+	reg.publish(marker)
+	reg.publish(rangeFeedCheckpoint(rawSpan, ts(25)))
+	go reg.runOutputLoop(context.Background())
+	require.NoError(t, reg.waitForCaughtUp())
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{marker, rangeFeedCheckpoint(rawSpan, ts(25))},
+		reg.stream.Events(),
+	)
+	reg.disconnect(nil)
+	<-reg.errC
+}
+
+// TestProcessorOverflowEvents tests that events waiting in a full input
+// channel are moved to the overflow buffer in order, up to the maximum
+// capacity, and that the buffer is released once it drains.
+func TestProcessorOverflowEvents(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := NewProcessor(Config{
+		AmbientContext:  log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:           hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:            roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:    2,
+		MaxEventChanCap: 5,
+	})
+	ct := func(wall int64) event { return event{ct: hlc.Timestamp{WallTime: wall}} }
+
+	// Events are not overflowed while the channel has room.
+	require.Equal(t, ct(1), p.overflowEvents(ct(1)))
+	require.Nil(t, p.overflow)
+
+	// Once the channel is observed to be full, the received event and those
+	// waiting in the channel are overflowed, up to the maximum capacity.
+	p.eventC <- ct(3)
+	p.eventC <- ct(4)
+	require.Equal(t, ct(2), p.overflowEvents(ct(2)))
+	require.Equal(t, []event{ct(3), ct(4)}, p.overflow)
+
+	// Once the buffer is at capacity, events remain in the channel.
+	p.eventC <- ct(6)
+	p.eventC <- ct(7)
+	require.Equal(t, ct(3), p.overflowEvents(ct(5)))
+	require.Equal(t, []event{ct(4), ct(5)}, p.overflow)
+	require.Equal(t, 2, len(p.eventC))
+
+	// Events are consumed in order, and the buffer is released once empty.
+	for _, exp := range []event{ct(4), ct(5)} {
+		require.Equal(t, exp, p.popOverflow())
+	}
+	require.Nil(t, p.overflow)
+}
+
+// TestProcessorAdaptiveEventChanCap tests that a Processor whose input channel
+// grows adaptively neither drops nor reorders events.
+func TestProcessorAdaptiveEventChanCap(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	p := NewProcessor(Config{
+		AmbientContext:       log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:                hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:                 roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:         1,
+		MaxEventChanCap:      16,
+		CheckStreamsInterval: 10 * time.Millisecond,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	stream := newTestStream()
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, stream, make(chan *roachpb.Error, 1))
+	require.True(t, ok)
+	p.syncEventAndRegistrations()
+	stream.Events() // discard the initial checkpoint
+
+	const n = 200
+	var exp []*roachpb.RangeFeedEvent
+	for i := 1; i <= n; i++ {
+		ts := hlc.Timestamp{WallTime: int64(i)}
+		val := []byte(fmt.Sprintf("val%d", i))
+		require.True(t, p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("b"), ts, val)))
+		exp = append(exp, rangeFeedValue(roachpb.Key("b"), roachpb.Value{RawBytes: val, Timestamp: ts}))
+	}
+	p.syncEventAndRegistrations()
+	require.Equal(t, 0, len(p.eventC))
+	require.Equal(t, exp, stream.Events())
+}
+
+// TestProcessorStepEventC tests that an unstarted processor can be stepped
+// through its events one at a time, observing the events published by each.
+func TestProcessorStepEventC(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := NewProcessor(Config{
+		AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:   testProcessorEventCCap,
+	})
+	spanAZ := p.Span.AsRawSpanWithNoLocals()
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+
+	txn1 := uuid.MakeV4()
+	p.setResolvedTSInitialized()
+	p.ConsumeLogicalOps(writeIntentOp(txn1, ts(10)))
+	p.ConsumeLogicalOps(writeValueOp(ts(5)))
+	p.ForwardClosedTS(ts(20))
+	p.ConsumeLogicalOps(commitIntentOp(txn1, ts(10)))
+
+	// Initializing the resolved timestamp publishes nothing.
+	published, ok := p.StepEventC()
+	require.True(t, ok)
+	require.Nil(t, published)
+	require.True(t, p.rts.IsInit())
+
+	// The intent is tracked, but not published.
+	published, ok = p.StepEventC()
+	require.True(t, ok)
+	require.Nil(t, published)
+	require.Equal(t, 1, p.rts.intentQ.Len())
+
+	published, ok = p.StepEventC()
+	require.True(t, ok)
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedValue(roachpb.Key("a"), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(5)}),
+	}, published)
+
+	// The closed timestamp is held back by the intent.
+	published, ok = p.StepEventC()
+	require.True(t, ok)
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(spanAZ, ts(10).FloorPrev()),
+	}, published)
+
+	// Committing the intent releases it.
+	published, ok = p.StepEventC()
+	require.True(t, ok)
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedValue(roachpb.Key("a"), roachpb.Value{Timestamp: ts(10)}),
+		rangeFeedCheckpoint(spanAZ, ts(20)),
+	}, published)
+	require.Equal(t, 0, p.rts.intentQ.Len())
+
+	// No events remain, and the capturing registrations are gone.
+	_, ok = p.StepEventC()
+	require.False(t, ok)
+	require.Equal(t, 0, p.reg.Len())
+	require.Equal(t, int64(0), p.reg.Stats().Added)
+}
+
+// TestProcessorDisableResolvedTimestamps tests that a Processor without
+// resolved timestamps publishes only values and rejects registrations that
+// depend on a resolved timestamp.
+func TestProcessorDisableResolvedTimestamps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	txnID := uuid.MakeV4()
+	rtsIter := newTestIterator([]engine.MVCCKeyValue{
+		makeIntent("a", txnID, "txnKey", 2),
+		makeProvisionalKV("a", "txnKey", 2),
+	})
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	p := NewProcessor(Config{
+		AmbientContext:            log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:                     hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:                      span,
+		EventChanCap:              testProcessorEventCCap,
+		CheckStreamsInterval:      10 * time.Millisecond,
+		DisableResolvedTimestamps: true,
+	})
+	p.Start(stopper, rtsIter)
+	require.True(t, rtsIter.closed)
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+
+	// Registrations that depend on a resolved timestamp are rejected.
+	for _, tc := range []struct {
+		name        string
+		catchupIter bool
+		opts        RegistrationOptions
+	}{
+		{name: "catch-up", catchupIter: true},
+		{name: "resume", opts: RegistrationOptions{ResumeFrom: ts(3)}},
+		{name: "min resolved ts", opts: RegistrationOptions{MinResolvedTS: ts(3)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var catchupIter *testIterator
+			var iter engine.SimpleIterator
+			if tc.catchupIter {
+				catchupIter = newTestIterator([]engine.MVCCKeyValue{makeKV("b", "val", 2)})
+				iter = catchupIter
+			}
+			errC := make(chan *roachpb.Error, 1)
+			ok, _ := p.RegisterWithOptions(
+				context.Background(), span, ts(1), iter, false /* withDiff */, newTestStream(), errC, tc.opts,
+			)
+			require.True(t, ok)
+			pErr := <-errC
+			require.Contains(t, pErr.String(), "without resolved timestamps")
+			if catchupIter != nil {
+				require.True(t, catchupIter.closed)
+			}
+		})
+	}
+
+	// Live registrations receive values, but no checkpoints.
+	stream := newTestStream()
+	errC := make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(context.Background(), span, ts(1), nil, false, stream, errC)
+	require.True(t, ok)
+	p.ConsumeLogicalOps(
+		writeIntentOpWithKey(txnID, roachpb.Key("b"), ts(5)),
+		writeValueOpWithKV(roachpb.Key("c"), ts(6), []byte("val")),
+	)
+	require.True(t, p.ForwardClosedTS(ts(10)))
+	p.ConsumeLogicalOps(
+		commitIntentOpWithKV(txnID, roachpb.Key("b"), ts(5), []byte("val2")),
+	)
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedValue(roachpb.Key("c"), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(6)}),
+		rangeFeedValue(roachpb.Key("b"), roachpb.Value{RawBytes: []byte("val2"), Timestamp: ts(5)}),
+	}, stream.Events())
+	require.Equal(t, 0, p.rts.intentQ.Len())
+	require.Equal(t, hlc.Timestamp{}, p.ResolvedTS())
+
+	// Draining registrations are not sent a final checkpoint.
+	require.True(t, p.DrainRegistration(stream))
+	require.Nil(t, <-errC)
+	require.Nil(t, stream.Events())
+}
+
+// TestProcessorCheckpointsOnly tests that registrations that opt out of data
+// events receive only checkpoints, and don't require values to be populated.
+func TestProcessorCheckpointsOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	keySpan := span.AsRawSpanWithNoLocals()
+
+	stream := newTestStream()
+	catchupIter := newTestIterator([]engine.MVCCKeyValue{
+		makeKV("b", "val1", 2),
+	})
+	opts := RegistrationOptions{CheckpointsOnly: true}
+	ok, filter := p.RegisterWithOptions(
+		context.Background(), span, ts(1), catchupIter, false /* withDiff */, stream, make(chan *roachpb.Error, 1), opts,
+	)
+	require.True(t, ok)
+	require.True(t, catchupIter.closed)
+	require.False(t, filter.NeedVal(keySpan))
+
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("b"), ts(4), []byte("val2")))
+	p.ForwardClosedTS(ts(5))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(keySpan, hlc.Timestamp{}),
+		rangeFeedCheckpoint(keySpan, ts(5)),
+	}, stream.Events())
+
+	// A registration that wants values receives them alongside.
+	allStream := newTestStream()
+	ok, filter = p.Register(
+		context.Background(), span, ts(1), nil /* catchupIter */, false /* withDiff */, allStream, make(chan *roachpb.Error, 1),
+	)
+	require.True(t, ok)
+	require.True(t, filter.NeedVal(keySpan))
+
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("c"), ts(6), []byte("val3")),
+		deleteRangeOp(roachpb.Key("c"), roachpb.Key("d"), ts(7)),
+	)
+	p.ForwardClosedTS(ts(10))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(keySpan, hlc.Timestamp{}),
+		rangeFeedCheckpoint(keySpan, ts(5)),
+		rangeFeedCheckpoint(keySpan, ts(10)),
+	}, stream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(keySpan, ts(5)),
+		rangeFeedValue(roachpb.Key("c"), roachpb.Value{RawBytes: []byte("val3"), Timestamp: ts(6)}),
+		rangeFeedDeleteRange(roachpb.Span{Key: roachpb.Key("c"), EndKey: roachpb.Key("d")}, ts(7)),
+		rangeFeedCheckpoint(keySpan, ts(10)),
+	}, allStream.Events())
+}
+
+// TestProcessorMaxIntentAge tests that the processor pushes the transaction of
+// an intent that exceeds the maximum intent age out of band, once.
+func TestProcessorMaxIntentAge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	pushedC := make(chan []enginepb.TxnMeta, 10)
+	var tp testTxnPusher
+	tp.mockPushTxns(func(txns []enginepb.TxnMeta, ts hlc.Timestamp) ([]roachpb.Transaction, error) {
+		pushedC <- txns
+		// The push does not succeed.
+		protos := make([]roachpb.Transaction, len(txns))
+		for i, txn := range txns {
+			protos[i] = roachpb.Transaction{TxnMeta: txn, Status: roachpb.PENDING}
+		}
+		return protos, nil
+	})
+	tp.mockCleanupTxnIntentsAsync(func([]roachpb.Transaction) error { return nil })
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	manual := hlc.NewManualClock(10 * time.Second.Nanoseconds())
+	metrics := NewMetrics()
+	p := NewProcessor(Config{
+		AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:          hlc.NewClock(manual.UnixNano, time.Nanosecond),
+		Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		TxnPusher:      &tp,
+		// Regular pushes never happen during the test.
+		PushTxnsInterval: time.Hour,
+		PushTxnsAge:      time.Hour,
+		MaxIntentAge:     time.Second,
+		EventChanCap:     testProcessorEventCCap,
+		Metrics:          metrics,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	oldTxn := enginepb.TxnMeta{
+		ID: uuid.MakeV4(), Key: keyA,
+		WriteTimestamp: hlc.Timestamp{WallTime: time.Second.Nanoseconds()},
+		MinTimestamp:   hlc.Timestamp{WallTime: time.Second.Nanoseconds()},
+	}
+	newTxnTS := hlc.Timestamp{WallTime: 9500 * time.Millisecond.Nanoseconds()}
+	p.ConsumeLogicalOps(
+		writeIntentOpWithDetails(oldTxn.ID, oldTxn.Key, oldTxn.MinTimestamp, oldTxn.WriteTimestamp),
+		writeIntentOpWithDetails(uuid.MakeV4(), keyB, newTxnTS, newTxnTS),
+	)
+
+	// Only the old transaction is pushed.
+	require.Equal(t, []enginepb.TxnMeta{oldTxn}, <-pushedC)
+	require.Equal(t, int64(1), metrics.RangeFeedForcedTxnPushes.Count())
+
+	// The old transaction remains the oldest, but is not forced to be pushed
+	// again.
+	for i := 0; i < 10; i++ {
+		p.syncEventC()
+	}
+	require.Len(t, pushedC, 0)
+	require.Equal(t, int64(1), metrics.RangeFeedForcedTxnPushes.Count())
+}
+
+// TestProcessorResumeFrom tests that registrations resuming from a timestamp
+// only receive versions above it, and are rejected if it is below the GC
+// threshold.
+func TestProcessorResumeFrom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	p := NewProcessor(Config{
+		AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:   testProcessorEventCCap,
+		GCThreshold:    func() hlc.Timestamp { return ts(10) },
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	value := func(key, val string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(roachpb.Key(key), roachpb.Value{RawBytes: []byte(val), Timestamp: ts(wall)})
+	}
+
+	// Resuming from below the GC threshold is rejected.
+	catchupIter := newTestIterator([]engine.MVCCKeyValue{makeKV("b", "val1", 12)})
+	errC := make(chan *roachpb.Error, 1)
+	ok, _ := p.RegisterWithOptions(
+		context.Background(), span, ts(1), catchupIter, false /* withDiff */, newTestStream(), errC,
+		RegistrationOptions{ResumeFrom: ts(5)},
+	)
+	require.True(t, ok)
+	require.Equal(t, roachpb.NewDataGarbageCollectedError(ts(10)), (<-errC).GetDetail())
+	require.True(t, catchupIter.closed)
+	require.Equal(t, 0, p.Len())
+
+	// Resuming from above the GC threshold only delivers newer versions.
+	stream := newTestStream()
+	catchupIter = newTestIterator([]engine.MVCCKeyValue{
+		makeKV("b", "val4", 18),
+		makeKV("b", "val3", 15),
+		makeKV("b", "val2", 12),
+	})
+	ok, _ = p.RegisterWithOptions(
+		context.Background(), span, ts(1), catchupIter, false /* withDiff */, stream, make(chan *roachpb.Error, 1),
+		RegistrationOptions{ResumeFrom: ts(15)},
+	)
+	require.True(t, ok)
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("c"), ts(14), []byte("val5")),
+		writeValueOpWithKV(roachpb.Key("c"), ts(21), []byte("val6")),
+	)
+	p.ForwardClosedTS(ts(25))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		value("b", "val4", 18),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{}),
+		value("c", "val6", 21),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(25)),
+	}, stream.Events())
+}
+
+// TestProcessorCatchUpScanConcurrency tests that registrations beyond the
+// catch-up scan concurrency limit wait for a running scan to finish, and that
+// registrations that are canceled give up their place.
+func TestProcessorCatchUpScanConcurrency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	p := NewProcessor(Config{
+		AmbientContext:         log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:                  hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:                   roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:           testProcessorEventCCap,
+		CheckStreamsInterval:   10 * time.Millisecond,
+		CatchUpScanConcurrency: 1,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	register := func(ctx context.Context, iter *testIterator) (*testStream, chan *roachpb.Error) {
+		stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+		ok, _ := p.Register(ctx, span, hlc.Timestamp{WallTime: 1}, iter, false, stream, errC)
+		require.True(t, ok)
+		return stream, errC
+	}
+
+	// The first registration's catch-up scan blocks, holding the only slot.
+	iter1 := newTestIterator([]engine.MVCCKeyValue{makeKV("b", "val1", 2)})
+	iter1.block = make(chan struct{})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	_, r1ErrC := register(ctx1, iter1)
+	testutils.SucceedsSoon(t, func() error {
+		if len(p.catchUpScanSem) != 1 {
+			return fmt.Errorf("catch-up scan not started")
+		}
+		return nil
+	})
+
+	// The catch-up scans of the next registrations wait for the slot.
+	iter2 := newTestIterator([]engine.MVCCKeyValue{makeKV("c", "val2", 3)})
+	r2Stream, r2ErrC := register(context.Background(), iter2)
+	iter3 := newTestIterator([]engine.MVCCKeyValue{makeKV("d", "val3", 4)})
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	defer cancel3()
+	_, r3ErrC := register(ctx3, iter3)
+	p.syncEventC()
+	require.Nil(t, r2Stream.Events())
+
+	// A registration that is canceled while waiting closes its iterator
+	// without scanning.
+	cancel3()
+	require.NotNil(t, <-r3ErrC)
+	<-iter3.done
+	require.Equal(t, -1, iter3.cur)
+
+	// A registration that is canceled mid-scan gives up its slot, letting the
+	// waiting catch-up scan run.
+	cancel1()
+	require.NotNil(t, <-r1ErrC)
+	close(iter1.block)
+	<-iter1.done
+	<-iter2.done
+	require.NoError(t, p.Flush(context.Background()))
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedValue(roachpb.Key("c"), roachpb.Value{RawBytes: []byte("val2"), Timestamp: hlc.Timestamp{WallTime: 3}}),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{}),
+	}, r2Stream.Events())
+	select {
+	case pErr := <-r2ErrC:
+		t.Fatalf("unexpected error: %v", pErr)
+	default:
+	}
+}
+
+// TestProcessorOldestIntentTS tests that OldestIntentTS reports the timestamp
+// of the oldest unresolved intent, or the closed timestamp if there is none.
+func TestProcessorOldestIntentTS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	requireOldestIntentTS := func(exp hlc.Timestamp) {
+		t.Helper()
+		p.syncEventC()
+		require.Equal(t, exp, p.OldestIntentTS())
+		require.Equal(t, exp, p.MetricsSnapshot().OldestIntentTS)
+	}
+
+	// Without intents, the closed timestamp is reported.
+	require.True(t, p.ForwardClosedTS(ts(5)))
+	requireOldestIntentTS(ts(5))
+
+	// The oldest intent is reported, even once the closed timestamp passes it.
+	txn1, txn2 := uuid.MakeV4(), uuid.MakeV4()
+	p.ConsumeLogicalOps(writeIntentOp(txn1, ts(10)))
+	requireOldestIntentTS(ts(10))
+	p.ConsumeLogicalOps(writeIntentOp(txn2, ts(7)))
+	requireOldestIntentTS(ts(7))
+	require.True(t, p.ForwardClosedTS(ts(20)))
+	requireOldestIntentTS(ts(7))
+
+	// Resolving the intents moves it forward.
+	p.ConsumeLogicalOps(commitIntentOp(txn2, ts(7)))
+	requireOldestIntentTS(ts(10))
+	p.ConsumeLogicalOps(commitIntentOp(txn1, ts(10)))
+	requireOldestIntentTS(ts(20))
+
+	var nilP *Processor
+	require.Equal(t, hlc.Timestamp{}, nilP.OldestIntentTS())
+}
+
+// TestProcessorForwardGCThreshold tests that registrations are disconnected
+// once the GC threshold advances past their resolved timestamp.
+func TestProcessorForwardGCThreshold(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	require.True(t, p.ForwardClosedTS(ts(10)))
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(context.Background(), span, ts(1), nil, false, stream, errC)
+	require.True(t, ok)
+
+	// An intent holds back the resolved timestamp published to the
+	// registration.
+	p.ConsumeLogicalOps(writeIntentOp(uuid.MakeV4(), ts(15)))
+	require.True(t, p.ForwardClosedTS(ts(30)))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(10)),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(14)),
+	}, stream.Events())
+
+	// GC thresholds at or below the registration's resolved timestamp do not
+	// affect it.
+	require.True(t, p.ForwardGCThreshold(ts(12)))
+	require.True(t, p.ForwardGCThreshold(ts(14)))
+	p.syncEventC()
+	require.Equal(t, 1, p.Len())
+	select {
+	case pErr := <-errC:
+		t.Fatalf("unexpected error: %v", pErr)
+	default:
+	}
+
+	// Once the GC threshold passes it, the registration is disconnected with
+	// an error carrying the threshold.
+	require.True(t, p.ForwardGCThreshold(ts(20)))
+	pErr := <-errC
+	require.Equal(t, roachpb.NewDataGarbageCollectedError(ts(20)), pErr.GetDetail())
+
+	var nilP *Processor
+	require.True(t, nilP.ForwardGCThreshold(ts(20)))
+}
+
+// TestProcessorConsumeLogicalOpsRaw tests that encoded logical ops are
+// consumed like decoded ones, skipping the values that no registration is
+// interested in.
+func TestProcessorConsumeLogicalOpsRaw(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(context.Background(), span, ts(1), nil, false, stream, errC)
+	require.True(t, ok)
+	p.syncEventAndRegistrations()
+	stream.Events()
+	p.ResetMetrics()
+
+	// The value outside of the registration's span is skipped, but the
+	// intent outside of it still holds back the resolved timestamp.
+	txnID := uuid.MakeV4()
+	require.True(t, p.ConsumeLogicalOpsRaw(encodeLogicalOps(t,
+		writeValueOpWithKV(roachpb.Key("b"), ts(5), []byte("val1")),
+		writeValueOpWithKV(roachpb.Key("x"), ts(6), []byte("val2")),
+		writeIntentOpWithKey(txnID, roachpb.Key("y"), ts(7)),
+	)))
+	require.True(t, p.ForwardClosedTS(ts(10)))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedValue(roachpb.Key("b"), roachpb.Value{RawBytes: []byte("val1"), Timestamp: ts(5)}),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(6)),
+	}, stream.Events())
+	require.Equal(t, int64(3), p.MetricsSnapshot().LogicalOps)
+	require.Equal(t, []IntentInfo{{TxnID: txnID, Timestamp: ts(7)}}, p.IntentQueueSnapshot())
+
+	// A malformed buffer stops the processor without consuming any of its
+	// ops.
+	buf := encodeLogicalOps(t, writeValueOpWithKV(roachpb.Key("c"), ts(11), []byte("val3")))
+	require.True(t, p.ConsumeLogicalOpsRaw(buf[:len(buf)-1]))
+	pErr := <-errC
+	require.Contains(t, pErr.String(), "undecodable logical ops")
+	require.Nil(t, stream.Events())
+
+	var nilP *Processor
+	require.True(t, nilP.ConsumeLogicalOpsRaw(buf))
+}
+
+// TestProcessorFlush tests that Flush waits for the buffered events of all
+// registrations to be sent to their streams.
+func TestProcessorFlush(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	r1Stream, r2Stream := newTestStream(), newTestStream()
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, r1Stream, make(chan *roachpb.Error, 1))
+	require.True(t, ok)
+	ok, _ = p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, r2Stream, make(chan *roachpb.Error, 1))
+	require.True(t, ok)
+	require.NoError(t, p.Flush(context.Background()))
+	require.Len(t, r1Stream.Events(), 1)
+	require.Len(t, r2Stream.Events(), 1)
+
+	// Block one of the streams. Flush waits for it until its context is
+	// canceled.
+	unblock := r1Stream.BlockSend()
+	ts := hlc.Timestamp{WallTime: 5}
+	p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("b"), ts, []byte("val")))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, p.Flush(ctx))
+
+	// Once the stream is unblocked, Flush returns after all of the buffered
+	// events have been sent to both streams.
+	unblock()
+	require.NoError(t, p.Flush(context.Background()))
+	value := rangeFeedValue(roachpb.Key("b"), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts})
+	require.Equal(t, []*roachpb.RangeFeedEvent{value}, r1Stream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{value}, r2Stream.Events())
+
+	// Flush returns immediately once the processor is stopped.
+	p.Stop()
+	require.NoError(t, p.Flush(context.Background()))
+	var nilP *Processor
+	require.NoError(t, nilP.Flush(context.Background()))
+}
+
+// TestProcessorDroppedEvents tests that the events dropped by an overloaded
+// registration are counted in the processor's metrics.
+func TestProcessorDroppedEvents(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, stream, errC)
+	require.True(t, ok)
+	p.syncEventAndRegistrations()
+	require.Equal(t, int64(0), p.Metrics().RangeFeedDroppedEvents.Count())
+	require.Equal(t, int64(0), p.Metrics().RangeFeedDroppedBytes.Count())
+
+	// Block the stream and publish more events than the registration can
+	// buffer. At most one event is held by the blocked output loop.
+	unblock := stream.BlockSend()
+	for i := 0; i < testProcessorEventCCap+3; i++ {
+		ts := hlc.Timestamp{WallTime: int64(i + 1)}
+		p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("b"), ts, []byte("val")))
+		p.syncEventC()
+	}
+	require.True(t, p.Metrics().RangeFeedDroppedEvents.Count() >= 2)
+	require.True(t, p.Metrics().RangeFeedDroppedBytes.Count() > 0)
+
+	// The registration is disconnected once it has sent its buffered events.
+	unblock()
+	require.Equal(t, newErrBufferCapacityExceeded().GoError(), (<-errC).GoError())
+}
+
+// TestProcessorKeyPredicate tests that registrations with a key predicate only
+// receive the values whose keys it accepts, while still receiving checkpoints.
+func TestProcessorKeyPredicate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	value := func(key, val string, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(roachpb.Key(key), roachpb.Value{RawBytes: []byte(val), Timestamp: ts(wall)})
+	}
+
+	stream := newTestStream()
+	catchupIter := newTestIterator([]engine.MVCCKeyValue{
+		makeKV("b", "val1", 2),
+		makeKV("c", "val2", 3),
+	})
+	opts := RegistrationOptions{
+		KeyPredicate: func(key roachpb.Key) bool { return bytes.HasPrefix(key, []byte("b")) },
+	}
+	ok, _ := p.RegisterWithOptions(
+		context.Background(), span, ts(1), catchupIter, false /* withDiff */, stream, make(chan *roachpb.Error, 1), opts,
+	)
+	require.True(t, ok)
+	allStream := newTestStream()
+	p.Register(context.Background(), span, ts(1), nil /* catchupIter */, false /* withDiff */, allStream, make(chan *roachpb.Error, 1))
+
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("ba"), ts(4), []byte("val3")),
+		writeValueOpWithKV(roachpb.Key("c"), ts(5), []byte("val4")),
+	)
+	p.ForwardClosedTS(ts(10))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		value("b", "val1", 2),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{}),
+		value("ba", "val3", 4),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(10)),
+	}, stream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{}),
+		value("ba", "val3", 4),
+		value("c", "val4", 5),
+		rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), ts(10)),
+	}, allStream.Events())
+}
+
+// TestProcessorRegistrationMemBudget tests that a registration whose stream
+// stops consuming events is disconnected once its buffered events exceed the
+// memory budget, without affecting the other registrations.
+func TestProcessorRegistrationMemBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	p := NewProcessor(Config{
+		AmbientContext:        log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:                 hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:                  span,
+		EventChanCap:          testProcessorEventCCap,
+		RegistrationMemBudget: 1024,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	r1Stream, r1ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, r1Stream, r1ErrC)
+	r2Stream, r2ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, r2Stream, r2ErrC)
+	p.syncEventAndRegistrations()
+
+	// Block the first stream. Each value takes up more than half of the
+	// budget, so the first registration exceeds it by the third value at the
+	// latest, even if its output loop has dequeued the first one.
+	unblock := r1Stream.BlockSend()
+	defer unblock()
+	val := make([]byte, 600)
+	for i := 0; i < 3; i++ {
+		p.ConsumeLogicalOps(
+			writeValueOpWithKV(roachpb.Key("k"), hlc.Timestamp{WallTime: int64(i + 2)}, val),
+		)
+	}
+	require.Equal(t, newErrBufferCapacityExceeded().GoError(), (<-r1ErrC).GoError())
+
+	p.syncEventAndRegistrationSpan(span.AsRawSpanWithNoLocals())
+	// The initial checkpoint and all three values.
+	require.Len(t, r2Stream.Events(), 4)
+	require.Equal(t, 1, p.Len())
+	select {
+	case pErr := <-r2ErrC:
+		t.Fatalf("unexpected disconnection of the second registration: %v", pErr)
+	default:
+	}
+}
+
+// TestProcessorRegistrations tests that the processor describes the span,
+// catch-up timestamp, resolved timestamp and buffered events of each of its
+// registrations.
+func TestProcessorRegistrations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	spAM := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("m")}
+	spCZ := roachpb.Span{Key: roachpb.Key("c"), EndKey: roachpb.Key("z")}
+	r1Stream, r2Stream := newTestStream(), newTestStream()
+	p.Register(
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("c"), EndKey: roachpb.RKey("z")},
+		hlc.Timestamp{WallTime: 3},
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		r2Stream,
+		make(chan *roachpb.Error, 1),
+	)
+	p.Register(
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
+		hlc.Timestamp{WallTime: 1},
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		r1Stream,
+		make(chan *roachpb.Error, 1),
+	)
+	p.syncEventAndRegistrations()
+	require.Equal(t, []RegistrationInfo{
+		{Span: spAM, CatchupTimestamp: hlc.Timestamp{WallTime: 1}},
+		{Span: spCZ, CatchupTimestamp: hlc.Timestamp{WallTime: 3}},
+	}, p.Registrations())
+
+	// Block the second registration's stream. Its events remain buffered.
+	unblock := r2Stream.BlockSend()
+	defer func() {
+		if unblock != nil {
+			unblock()
+		}
+	}()
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("d"), hlc.Timestamp{WallTime: 6}, []byte("val")),
+		writeValueOpWithKV(roachpb.Key("n"), hlc.Timestamp{WallTime: 7}, []byte("val")),
+	)
+	p.syncEventC()
+	testutils.SucceedsSoon(t, func() error {
+		exp := []RegistrationInfo{
+			{
+				Span:             spAM,
+				CatchupTimestamp: hlc.Timestamp{WallTime: 1},
+				ResolvedTS:       hlc.Timestamp{WallTime: 5},
+			},
+			{
+				Span:             spCZ,
+				CatchupTimestamp: hlc.Timestamp{WallTime: 3},
+				ResolvedTS:       hlc.Timestamp{WallTime: 5},
+				BufferedEvents:   3,
+			},
+		}
+		if act := p.Registrations(); !reflect.DeepEqual(exp, act) {
+			return fmt.Errorf("expected %+v, found %+v", exp, act)
+		}
+		return nil
+	})
+
+	unblock()
+	unblock = nil
+	p.Stop()
+	<-p.stoppedC
+	require.Nil(t, p.Registrations())
+}
+
+// TestProcessorIntentQueueSnapshot tests that the processor reports the
+// transactions with unresolved intents that hold back its resolved timestamp,
+// ordered by timestamp.
+func TestProcessorIntentQueueSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+
+	require.Equal(t, []IntentInfo{}, p.IntentQueueSnapshot())
+
+	txn1, txn2 := uuid.MakeV4(), uuid.MakeV4()
+	p.ConsumeLogicalOps(
+		writeIntentOp(txn1, hlc.Timestamp{WallTime: 10}),
+		writeIntentOp(txn2, hlc.Timestamp{WallTime: 5}),
+		writeIntentOp(txn1, hlc.Timestamp{WallTime: 10}),
+	)
+	p.syncEventC()
+	require.Equal(t, []IntentInfo{
+		{TxnID: txn2, Timestamp: hlc.Timestamp{WallTime: 5}},
+		{TxnID: txn1, Timestamp: hlc.Timestamp{WallTime: 10}},
+	}, p.IntentQueueSnapshot())
+
+	// Moving a transaction's intents reorders the snapshot.
+	p.ConsumeLogicalOps(updateIntentOp(txn2, hlc.Timestamp{WallTime: 15}))
+	p.syncEventC()
+	require.Equal(t, []IntentInfo{
+		{TxnID: txn1, Timestamp: hlc.Timestamp{WallTime: 10}},
+		{TxnID: txn2, Timestamp: hlc.Timestamp{WallTime: 15}},
+	}, p.IntentQueueSnapshot())
+
+	// Resolving all of a transaction's intents removes it from the snapshot.
+	p.ConsumeLogicalOps(
+		commitIntentOp(txn1, hlc.Timestamp{WallTime: 10}),
+		commitIntentOp(txn1, hlc.Timestamp{WallTime: 10}),
+		abortIntentOp(txn2),
+	)
+	p.syncEventC()
+	require.Equal(t, []IntentInfo{}, p.IntentQueueSnapshot())
+
+	// The snapshot is nil once the processor is stopped.
+	stopper.Stop(context.Background())
+	require.Nil(t, p.IntentQueueSnapshot())
+}
+
+// TestProcessorDrain tests that draining a processor flushes the events
+// buffered for each registration, followed by a final checkpoint, before the
+// registrations are disconnected without an error.
+func TestProcessorDrain(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	spAM := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("m")}
+	spMZ := roachpb.Span{Key: roachpb.Key("m"), EndKey: roachpb.Key("z")}
+	r1Stream, r1ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")},
+		hlc.Timestamp{WallTime: 1},
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		r1Stream,
+		r1ErrC,
+	)
+	r2Stream, r2ErrC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("m"), EndKey: roachpb.RKey("z")},
+		hlc.Timestamp{WallTime: 1},
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		r2Stream,
+		r2ErrC,
+	)
+	p.syncEventAndRegistrations()
+
+	// Block the first stream so that its events are still buffered when the
+	// processor begins draining.
+	unblock := r1Stream.BlockSend()
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("b"), hlc.Timestamp{WallTime: 6}, []byte("val")),
+		writeValueOpWithKV(roachpb.Key("n"), hlc.Timestamp{WallTime: 7}, []byte("val")),
+	)
+	drainErrC := make(chan error, 1)
+	go func() { drainErrC <- p.Drain(context.Background()) }()
+	require.Nil(t, <-r2ErrC)
+	unblock()
+	require.NoError(t, <-drainErrC)
+	require.Nil(t, <-r1ErrC)
+
+	value := func(key string, ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(
+			roachpb.Key(key),
+			roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: ts}},
+		)
+	}
+	checkpoint := func(span roachpb.Span, ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span, hlc.Timestamp{WallTime: ts})
+	}
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		checkpoint(spAM, 0), checkpoint(spAM, 5), value("b", 6), checkpoint(spAM, 5),
+	}, r1Stream.Events())
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		checkpoint(spMZ, 0), checkpoint(spMZ, 5), value("n", 7), checkpoint(spMZ, 5),
+	}, r2Stream.Events())
+
+	// The processor no longer accepts logical operations.
+	require.False(t, p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("c"), hlc.Timestamp{WallTime: 8}, []byte("val")),
+	))
+
+	// The processor has stopped, so draining it again is a no-op.
+	require.Equal(t, 0, p.Len())
+	require.NoError(t, p.Drain(context.Background()))
+
+	var nilP *Processor
+	require.NoError(t, nilP.Drain(context.Background()))
+}
+
+// TestProcessorDrainConcurrentOps tests that every logical operation accepted
+// by a draining Processor, whose input channel overflows, is published ahead
+// of the final checkpoint, and that operations are rejected once it drains.
+func TestProcessorDrainConcurrentOps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	p := NewProcessor(Config{
+		AmbientContext:  log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:           hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		Span:            roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		EventChanCap:    1,
+		MaxEventChanCap: 16,
+	})
+	p.Start(stopper, nil /* rtsIter */)
+
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	span := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	ok, _ := p.Register(context.Background(), span, hlc.Timestamp{}, nil, false, stream, errC)
+	require.True(t, ok)
+	p.syncEventAndRegistrations()
+	stream.Events() // discard the initial checkpoint
+
+	// Consume operations until the processor rejects them.
+	expC := make(chan []*roachpb.RangeFeedEvent, 1)
+	go func() {
+		var exp []*roachpb.RangeFeedEvent
+		for i := 1; ; i++ {
+			ts := hlc.Timestamp{WallTime: int64(i)}
+			val := []byte(fmt.Sprintf("val%d", i))
+			if !p.ConsumeLogicalOps(writeValueOpWithKV(roachpb.Key("b"), ts, val)) {
+				break
+			}
+			exp = append(exp, rangeFeedValue(roachpb.Key("b"), roachpb.Value{RawBytes: val, Timestamp: ts}))
+		}
+		expC <- exp
+	}()
+	time.Sleep(time.Millisecond)
+	require.NoError(t, p.Drain(context.Background()))
+	require.Nil(t, <-errC)
+
+	exp := append(<-expC, rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{}))
+	require.Equal(t, exp, stream.Events())
+}
+
+// TestProcessorRegisterSpans tests that a registration over multiple disjoint
+// spans receives only the values within its spans, and checkpoints and range
+// deletions constrained to each of its spans.
+func TestProcessorRegisterSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	spAC := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("c")}
+	spFH := roachpb.Span{Key: roachpb.Key("f"), EndKey: roachpb.Key("h")}
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, filter := p.RegisterSpans(
+		context.Background(), []roachpb.RSpan{
+			{Key: roachpb.RKey("f"), EndKey: roachpb.RKey("h")},
+			{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("c")},
+		},
+		hlc.Timestamp{WallTime: 1},
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		stream,
+		errC,
+		RegistrationOptions{},
+	)
+	require.True(t, ok)
+	require.True(t, filter.NeedVal(roachpb.Span{Key: roachpb.Key("b")}))
+	require.False(t, filter.NeedVal(roachpb.Span{Key: roachpb.Key("d")}))
+	require.True(t, filter.NeedVal(roachpb.Span{Key: roachpb.Key("g")}))
+	require.Equal(t, []roachpb.Span{spAC, spFH}, p.CoveredSpans())
+
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("b"), hlc.Timestamp{WallTime: 6}, []byte("val")),
+		writeValueOpWithKV(roachpb.Key("d"), hlc.Timestamp{WallTime: 7}, []byte("val")),
+		writeValueOpWithKV(roachpb.Key("g"), hlc.Timestamp{WallTime: 8}, []byte("val")),
+		deleteRangeOp(roachpb.Key("b"), roachpb.Key("g"), hlc.Timestamp{WallTime: 9}),
+		deleteRangeOp(roachpb.Key("d"), roachpb.Key("e"), hlc.Timestamp{WallTime: 9}),
+	)
+	p.syncEventAndRegistrations()
+
+	value := func(key string, ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(
+			roachpb.Key(key),
+			roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: ts}},
+		)
+	}
+	require.Equal(t, []*roachpb.RangeFeedEvent{
+		rangeFeedCheckpoint(spAC, hlc.Timestamp{}),
+		rangeFeedCheckpoint(spFH, hlc.Timestamp{}),
+		rangeFeedCheckpoint(spAC, hlc.Timestamp{WallTime: 5}),
+		rangeFeedCheckpoint(spFH, hlc.Timestamp{WallTime: 5}),
+		value("b", 6),
+		value("g", 8),
+		rangeFeedDeleteRange(
+			roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")}, hlc.Timestamp{WallTime: 9},
+		),
+		rangeFeedDeleteRange(
+			roachpb.Span{Key: roachpb.Key("f"), EndKey: roachpb.Key("g")}, hlc.Timestamp{WallTime: 9},
+		),
+	}, stream.Events())
+}
+
+// TestProcessorPushTxnsJitter tests that the interval between transaction
+// pushes is randomized within the jitter fraction using the configured source
+// of randomness, and that the jitter is ignored without a push interval.
+func TestProcessorPushTxnsJitter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	newProcessor := func(interval time.Duration, jitter float64, rnd *rand.Rand) *Processor {
+		cfg := Config{
+			AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+			Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+			Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+			PushTxnsJitter: jitter,
+			JitterRand:     rnd,
+		}
+		if interval > 0 {
+			cfg.TxnPusher = &testTxnPusher{}
+			cfg.PushTxnsInterval = interval
+		}
+		return NewProcessor(cfg)
+	}
+
+	p := newProcessor(0, 0.5, nil)
+	require.Nil(t, p.JitterRand)
+	require.Zero(t, p.nextPushTxnsInterval())
+
+	p = newProcessor(time.Second, 0, nil)
+	require.Equal(t, time.Second, p.nextPushTxnsInterval())
+
+	// Processors seeded identically produce the same intervals.
+	p1 := newProcessor(time.Second, 0.5, rand.New(rand.NewSource(1)))
+	p2 := newProcessor(time.Second, 0.5, rand.New(rand.NewSource(1)))
+	distinct := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		d := p1.nextPushTxnsInterval()
+		require.Equal(t, d, p2.nextPushTxnsInterval())
+		require.True(t, d >= 500*time.Millisecond && d <= 1500*time.Millisecond, "interval %s", d)
+		distinct[d] = struct{}{}
+	}
+	require.True(t, len(distinct) > 1)
+
+	// A source of randomness is provided if none is configured.
+	require.NotNil(t, newProcessor(time.Second, 0.5, nil).JitterRand)
+	require.Panics(t, func() { newProcessor(time.Second, 1.5, nil) })
+}
+
+// TestProcessorRegistrationSpanMismatch tests that a registration whose span
+// does not overlap the processor's span is rejected, while one whose span
+// partially overlaps it is clipped to the processor's span.
+func TestProcessorRegistrationSpanMismatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	// The processor's span is [a, z).
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	ok, _ := p.Register(
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("z"), EndKey: roachpb.RKey("zz")},
+		hlc.Timestamp{WallTime: 1},
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		stream,
+		errC,
+	)
+	require.True(t, ok)
+	pErr := <-errC
+	retryErr, ok := pErr.GetDetail().(*roachpb.RangeFeedRetryError)
+	require.True(t, ok, "unexpected error %v", pErr)
+	require.Equal(t, roachpb.RangeFeedRetryError_REASON_SPAN_MISMATCH, retryErr.Reason)
+	require.Equal(t, 0, p.Len())
+
+	stream, errC = newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("x"), EndKey: roachpb.RKey("zz")},
+		hlc.Timestamp{WallTime: 1},
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		stream,
+		errC,
+	)
+	p.syncEventAndRegistrations()
+	require.Equal(t, 1, p.Len())
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{rangeFeedCheckpoint(
+			roachpb.Span{Key: roachpb.Key("x"), EndKey: roachpb.Key("z")}, hlc.Timestamp{},
+		)},
+		stream.Events(),
+	)
+}
+
+// TestProcessorConsumeLogicalOpsReturn tests that ConsumeLogicalOpsReturn
+// reports whether the operations were accepted by the processor.
+func TestProcessorConsumeLogicalOpsReturn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(context.Background(), p.Span, hlc.Timestamp{WallTime: 1}, nil, false, stream, errC)
+	require.True(t, p.ConsumeLogicalOpsReturn())
+	require.True(t, p.ConsumeLogicalOpsReturn(
+		writeValueOpWithKV(roachpb.Key("k"), hlc.Timestamp{WallTime: 2}, []byte("val")),
+	))
+	p.syncEventAndRegistrations()
+	require.Len(t, stream.Events(), 2)
+
+	p.Stop()
+	<-p.stoppedC
+	require.False(t, p.ConsumeLogicalOpsReturn(
+		writeValueOpWithKV(roachpb.Key("k"), hlc.Timestamp{WallTime: 3}, []byte("val")),
+	))
+	// ConsumeLogicalOps does not report operations dropped by a stopped
+	// processor.
+	require.True(t, p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("k"), hlc.Timestamp{WallTime: 3}, []byte("val")),
+	))
+}
+
+// TestProcessorResolvedTS tests that the processor reports its current
+// resolved timestamp, without publishing a checkpoint.
+func TestProcessorResolvedTS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+	require.Equal(t, hlc.Timestamp{}, p.ResolvedTS())
+
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(context.Background(), p.Span, hlc.Timestamp{WallTime: 1}, nil, false, stream, errC)
+	p.syncEventAndRegistrations()
+
+	// An unresolved intent holds the resolved timestamp below the closed
+	// timestamp.
+	txn := uuid.MakeV4()
+	p.ConsumeLogicalOps(writeIntentOp(txn, hlc.Timestamp{WallTime: 10}))
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 20})
+	p.syncEventAndRegistrations()
+	require.Equal(t, hlc.Timestamp{WallTime: 10}.Prev(), p.ResolvedTS())
+
+	// Aborting the transaction releases the resolved timestamp.
+	p.ConsumeLogicalOps(abortTxnOp(txn))
+	p.syncEventAndRegistrations()
+	require.Equal(t, hlc.Timestamp{WallTime: 20}, p.ResolvedTS())
+
+	p.Stop()
+	<-p.stoppedC
+	require.Equal(t, hlc.Timestamp{}, p.ResolvedTS())
+}
+
+// TestProcessorStrictClosedTS tests that a processor in strict mode counts
+// closed timestamps that regress, and that they are ignored either way.
+func TestProcessorStrictClosedTS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testutils.RunTrueAndFalse(t, "strict", func(t *testing.T, strict bool) {
+		stopper := stop.NewStopper()
+		defer stopper.Stop(context.Background())
+
+		p := NewProcessor(Config{
+			AmbientContext: log.AmbientContext{Tracer: tracing.NewTracer()},
+			Clock:          hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+			Span:           roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+			EventChanCap:   testProcessorEventCCap,
+			StrictClosedTS: strict,
+		})
+		p.Start(stopper, nil)
+		defer p.Stop()
+		regressions := p.Metrics().RangeFeedClosedTSRegressions
+
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 10})
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 10})
+		p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+		p.syncEventAndRegistrations()
+		require.Equal(t, hlc.Timestamp{WallTime: 10}, p.ResolvedTS())
+		if strict {
+			require.Equal(t, int64(1), regressions.Count())
+		} else {
+			require.Equal(t, int64(0), regressions.Count())
+		}
+	})
+}
+
+// TestProcessorExcludeTxns tests that the intents of excluded transactions do
+// not hold back the resolved timestamp, while their committed values are still
+// published.
+func TestProcessorExcludeTxns(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	checkpoint := func(rts hlc.Timestamp) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(p.Span.AsRawSpanWithNoLocals(), rts)
+	}
+
+	// Hold the resolved timestamp back with an intent.
+	txn1 := uuid.MakeV4()
+	p.ConsumeLogicalOps(writeIntentOp(txn1, ts(10)))
+	p.ForwardClosedTS(ts(20))
+
+	stream := newTestStream()
+	p.Register(context.Background(), p.Span, ts(1), nil, false, stream, make(chan *roachpb.Error, 1))
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(ts(10).Prev())}, stream.Events())
+
+	// Excluding the transaction releases the resolved timestamp.
+	p.ExcludeTxns(txn1)
+	p.syncEventAndRegistrations()
+	require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(ts(20))}, stream.Events())
+	require.Equal(t, 0, p.rts.intentQ.Len())
+
+	// The transaction's committed value is still published.
+	p.ConsumeLogicalOps(
+		commitIntentOpWithKV(txn1, roachpb.Key("k"), ts(10), []byte("val")),
+	)
+	p.syncEventAndRegistrations()
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{rangeFeedValue(
+			roachpb.Key("k"), roachpb.Value{RawBytes: []byte("val"), Timestamp: ts(10)},
+		)},
+		stream.Events(),
+	)
+	require.Equal(t, ts(20), p.ResolvedTS())
+	// The value was published below the checkpoint, and the transaction is
+	// forgotten since that was its last intent.
+	require.Equal(t, int64(1), p.Config.Metrics.RangeFeedValuesBelowCheckpoint.Count())
+	require.False(t, p.rts.isExcluded(txn1))
+}
+
+// TestProcessorMetricsSnapshot tests that the processor's counters can be
+// inspected and reset between the phases of a test.
+func TestProcessorMetricsSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	p.syncEventC()
+	p.ResetMetrics()
+	require.Equal(t, ProcessorMetrics{}, p.MetricsSnapshot())
+
+	p.ConsumeLogicalOps(writeValueOp(ts(6)), writeValueOp(ts(7)))
+	p.ForwardClosedTS(ts(10))
+	p.syncEventC()
+	require.Equal(t, ProcessorMetrics{
+		LogicalOps:           2,
+		ValuesPublished:      2,
+		CheckpointsPublished: 1,
+	}, p.MetricsSnapshot())
+
+	p.ResetMetrics()
+	require.Equal(t, ProcessorMetrics{}, p.MetricsSnapshot())
+
+	p.ConsumeLogicalOps(writeIntentOp(uuid.MakeV4(), ts(12)))
+	p.ForwardClosedTS(ts(15))
+	p.syncEventC()
+	require.Equal(t, ProcessorMetrics{
+		LogicalOps:           1,
+		CheckpointsPublished: 1,
+	}, p.MetricsSnapshot())
+
+	var nilP *Processor
+	require.Equal(t, ProcessorMetrics{}, nilP.MetricsSnapshot())
+	require.NotPanics(t, func() { nilP.ResetMetrics() })
+}
+
+// TestProcessorMetrics tests that the processor maintains the counters and
+// gauges in its Metrics and withdraws its gauge values when it stops.
+func TestProcessorMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	m := p.Metrics()
+	require.NotNil(t, m)
+	p.syncEventC()
+	logicalOps, eventsPublished := m.RangeFeedLogicalOps.Count(), m.RangeFeedEventsPublished.Count()
+
+	stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+	p.Register(
+		context.Background(), roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("z")},
+		ts(1),
+		nil,   /* catchUpIter */
+		false, /* withDiff */
+		stream,
+		errC,
+	)
+	p.ConsumeLogicalOps(writeValueOp(ts(6)), writeIntentOp(uuid.MakeV4(), ts(8)))
+	p.ForwardClosedTS(ts(10))
+	p.syncEventAndRegistrations()
+
+	require.Equal(t, logicalOps+2, m.RangeFeedLogicalOps.Count())
+	// One value and one checkpoint.
+	require.Equal(t, eventsPublished+2, m.RangeFeedEventsPublished.Count())
+	require.Equal(t, int64(1), m.RangeFeedRegistrations.Value())
+	require.Equal(t, int64(1), m.RangeFeedUnresolvedIntents.Value())
+	// The resolved timestamp is held back just below the intent at 8.
+	require.Equal(t, int64(3), m.RangeFeedResolvedTSLagNanos.Value())
+
+	p.Stop()
+	<-errC
+	<-p.stoppedC
+	require.Zero(t, m.RangeFeedRegistrations.Value())
+	require.Zero(t, m.RangeFeedUnresolvedIntents.Value())
+	require.Zero(t, m.RangeFeedResolvedTSLagNanos.Value())
+}
+
+// TestProcessorSplitEvents tests that registrations that opt into split
+// events and are clipped by a split receive a final RangeFeedSplit event and
+// are disconnected without an error when the processor is stopped, while all
+// other registrations are disconnected with the processor's error.
+func TestProcessorSplitEvents(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p, stopper := newTestProcessor(nil /* rtsIter */)
+	defer stopper.Stop(context.Background())
+
+	wideSpan := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("m")}
+	narrowSpan := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("c")}
+	register := func(span roachpb.RSpan, emitSplitEvents bool) (*testStream, chan *roachpb.Error) {
+		stream, errC := newTestStream(), make(chan *roachpb.Error, 1)
+		p.RegisterWithOptions(context.Background(), span, hlc.Timestamp{WallTime: 1}, nil, false, stream, errC,
+			RegistrationOptions{EmitSplitEvents: emitSplitEvents})
+		return stream, errC
+	}
+	// r1 opts into split events and is clipped by the split.
+	r1Stream, r1ErrC := register(wideSpan, true)
+	// r2 is clipped by the split but does not opt into split events.
+	r2Stream, r2ErrC := register(wideSpan, false)
+	// r3 opts into split events but is not clipped by the split.
+	r3Stream, r3ErrC := register(narrowSpan, true)
+
+	p.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	p.ConsumeLogicalOps(
+		writeValueOpWithKV(roachpb.Key("d"), hlc.Timestamp{WallTime: 6}, []byte("val")),
+		splitOp(roachpb.Key("g")),
+	)
+	p.syncEventAndRegistrations()
+	pErr := roachpb.NewErrorf("split")
+	p.StopWithErr(pErr)
+
+	checkpoint := func(span roachpb.RSpan, ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(span.AsRawSpanWithNoLocals(), hlc.Timestamp{WallTime: ts})
+	}
+	value := rangeFeedValue(
+		roachpb.Key("d"),
+		roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 6}},
+	)
+	split := makeRangeFeedEvent(&roachpb.RangeFeedSplit{SplitKey: roachpb.Key("g")})
+
+	require.Nil(t, <-r1ErrC)
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{checkpoint(wideSpan, 0), checkpoint(wideSpan, 5), value, split},
+		r1Stream.Events(),
+	)
+	require.Equal(t, pErr, <-r2ErrC)
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{checkpoint(wideSpan, 0), checkpoint(wideSpan, 5), value},
+		r2Stream.Events(),
+	)
+	require.Equal(t, pErr, <-r3ErrC)
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{checkpoint(narrowSpan, 0), checkpoint(narrowSpan, 5)},
+		r3Stream.Events(),
+	)
+}
+
+// syncEventAndRegistrations waits for all previously sent events to be
+// processed *and* for all registration output loops to fully process their own
+// internal buffers.
+func (p *Processor) syncEventAndRegistrations() {
+	p.syncEventAndRegistrationSpan(all)
+}
+
+// stepCaptureBufSize is the buffer size of the registration that captures the
+// events published by StepEventC.
+const stepCaptureBufSize = 1024
+
+// StepEventC processes exactly one event queued in eventC, on the calling
+// goroutine, and returns the events that it published. It returns false if no
+// event is queued. It must only be used on a Processor that has not been
+// started, and so runs no goroutines of its own, which lets tests single-step
+// through the events sent to the Processor and assert its intermediate state
+// in between. Value events held back by MaxEventsPerBatch are not emitted.
+func (p *Processor) StepEventC() ([]*roachpb.RangeFeedEvent, bool) {
+	var e event
+	select {
+	case e = <-p.eventC:
+	default:
+		return nil, false
+	}
+
+	// Capture the published events with a registration over the entire
+	// keyspace for the duration of the step. It is not counted in the
+	// registry's stats.
+	capture := newRegistration(
+		all, hlc.Timestamp{}, nil /* catchupIter */, p.WithDiff,
+		stepCaptureBufSize, p.Config.Metrics, newTestStream(), make(chan *roachpb.Error, 1),
+	)
+	added, removed := p.reg.added, p.reg.removed
+	p.reg.Register(&capture)
+	p.consumeEvent(context.Background(), e)
+	p.reg.Unregister(&capture)
+	p.reg.added, p.reg.removed = added, removed
+	if capture.mu.overflowed {
+		panic("too many events published in a single step")
+	}
+
+	var published []*roachpb.RangeFeedEvent
+	for len(capture.buf) > 0 {
+		published = append(published, (<-capture.buf).event)
+	}
+	return published, true
 }
 
 // syncEventAndRegistrations waits for all previously sent events to be
@@ -14,7 +14,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
@@ -29,6 +32,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 )
 
 // Stream is a object capable of transmitting RangeFeedEvents.
@@ -40,6 +44,78 @@ type Stream interface {
 	Send(*roachpb.RangeFeedEvent) error
 }
 
+// CausalStream is a Stream that is also capable of transmitting the causal
+// ordering token of RangeFeedValue events. See Config.EmitCausalTokens.
+type CausalStream interface {
+	Stream
+	// SendWithCausalToken is like Send, but it also provides the causal
+	// ordering token assigned to the event.
+	SendWithCausalToken(*roachpb.RangeFeedEvent, hlc.Timestamp) error
+}
+
+// ValueEncoder transforms RangeFeedValue events into the payload that is sent
+// to a registration's stream, allowing consumers to receive values in their
+// own wire format. See RegistrationOptions.ValueEncoder.
+type ValueEncoder interface {
+	// EncodeValue encodes the value. It is called on the registration's
+	// output loop goroutine and must not retain the value.
+	EncodeValue(*roachpb.RangeFeedValue) ([]byte, error)
+}
+
+// EncodedStream is a Stream that is also capable of transmitting values
+// encoded by a ValueEncoder.
+type EncodedStream interface {
+	Stream
+	// SendEncoded is like Send, but it sends the payload produced by the
+	// registration's ValueEncoder in place of a RangeFeedValue event.
+	SendEncoded([]byte) error
+}
+
+// StreamLiveness decides whether the stream of a registration is still alive.
+// Every CheckStreamsInterval, the Processor disconnects the registrations whose
+// stream is no longer alive. See Config.StreamLiveness.
+type StreamLiveness interface {
+	// CheckStream returns nil if the stream is alive. Otherwise, it returns
+	// the error that the registration is disconnected with.
+	CheckStream(Stream) error
+}
+
+// contextStreamLiveness is the default StreamLiveness, which considers a
+// stream alive until its context is canceled.
+type contextStreamLiveness struct{}
+
+// CheckStream implements the StreamLiveness interface.
+func (contextStreamLiveness) CheckStream(s Stream) error {
+	if s.Context().Err() != nil {
+		return newErrStreamCanceled().GoError()
+	}
+	return nil
+}
+
+// bufferedEvent is an event held in a registration's output buffer.
+type bufferedEvent struct {
+	event *roachpb.RangeFeedEvent
+	// causalToken is the causal ordering token assigned to the event. Empty if
+	// causal tokens are not being emitted or if the event is not a value.
+	causalToken hlc.Timestamp
+	// enqueued is the time at which the event was added to the buffer. Only
+	// set if the registration has a maximum buffered event age.
+	enqueued time.Time
+	// size is the memory accounted to the event in the registration's memory
+	// budget. Only set if the registration has a memory budget.
+	size int64
+	// coalesced, if set, holds the checkpoint that the event has been
+	// replaced with while it was waiting in the buffer. Only set for
+	// checkpoints published to registrations that coalesce checkpoints.
+	coalesced *coalescedCheckpoint
+}
+
+// coalescedCheckpoint holds the latest of a run of consecutive checkpoints
+// published to a registration. It is protected by the registration's mutex.
+type coalescedCheckpoint struct {
+	event *roachpb.RangeFeedEvent
+}
+
 // registration is an instance of a rangefeed subscriber who has
 // registered to receive updates for a specific range of keys.
 // Updates are delivered to its stream until one of the following
@@ -57,16 +133,119 @@ type registration struct {
 	catchupTimestamp hlc.Timestamp
 	catchupIter      engine.SimpleIterator
 	withDiff         bool
-	metrics          *Metrics
+	withCausalTokens bool
+	// spans, if set, holds the disjoint spans of a registration over multiple
+	// spans, sorted by key. span is then the smallest span that contains all
+	// of them, and only events for keys within spans are published.
+	spans []roachpb.Span
+	// catchupIterConstructor, if set, constructs catchupIter when the
+	// registration is accepted by the Processor.
+	catchupIterConstructor func() engine.SimpleIterator
+	// maxBufferedEventAge is the maximum duration that an event may sit in the
+	// buffer before the registration is considered stale. 0 for no limit.
+	maxBufferedEventAge time.Duration
+	// reverseBatchOrder instructs the registration to receive the value events
+	// published in a single batch in descending timestamp order. See
+	// registry.FlushBatches.
+	reverseBatchOrder bool
+	// maxBatchSize, if greater than 1, instructs the registration to receive
+	// the value events published in a single batch in RangeFeedBatch events
+	// of up to maxBatchSize values. See registry.FlushBatches.
+	maxBatchSize int
+	// omitCheckpointSpans instructs the registration to omit the span from all
+	// checkpoints after the first, which the consumer is expected to cache.
+	omitCheckpointSpans bool
+	// coalesceCheckpoints instructs the registration to replace a checkpoint
+	// at the tail of its buffer with the next checkpoint published to it.
+	coalesceCheckpoints bool
+	// valueEncoder, if set, encodes the value events sent to the stream, which
+	// must be an EncodedStream.
+	valueEncoder ValueEncoder
+	// transformSem, if set, is the semaphore shared by all of the Processor's
+	// registrations that bounds the number of concurrent transforms.
+	transformSem chan struct{}
+	// catchUpScanSem, if set, is the semaphore shared by all of the
+	// Processor's registrations that bounds the number of concurrent catch-up
+	// scans.
+	catchUpScanSem chan struct{}
+	// emitSplitEvents instructs the registration to drain with a final
+	// RangeFeedSplit event when the range is split within its span. See
+	// registry.DrainSplit.
+	emitSplitEvents bool
+	// minResolvedTS is the minimum resolved timestamp that the Processor must
+	// have reached for the registration to be accepted.
+	minResolvedTS hlc.Timestamp
+	// keyPredicate, if set, filters the value events published to the
+	// registration by key.
+	keyPredicate func(roachpb.Key) bool
+	// priority orders the registration relative to the others in its registry
+	// when events are published.
+	priority int
+	// reportBufferedEvents instructs the registration to populate the
+	// BufferedEvents field of the checkpoints published to it.
+	reportBufferedEvents bool
+	// markCatchUpComplete instructs the Processor to mark the first
+	// checkpoint published to the registration as CatchUpComplete.
+	markCatchUpComplete bool
+	// checkpointsOnly instructs the registration to receive only checkpoints
+	// and none of the data events.
+	checkpointsOnly bool
+	// resumeFrom is the timestamp that the registration resumes from, and
+	// gcThreshold is the GC threshold of the range when it registered. The
+	// registration is rejected if resumeFrom is below gcThreshold.
+	resumeFrom, gcThreshold hlc.Timestamp
+	// egress, if set, is the limiter shared by all of the Processor's
+	// registrations that paces the bytes sent to their streams.
+	egress *rate.Limiter
+	// valueLimiter, if set, limits the rate at which the live value events of
+	// the registration are sent to its stream. See waitValueLimit.
+	valueLimiter *rate.Limiter
+	// maxRateLimitDelay is the maximum duration for which valueLimiter may
+	// continuously hold back values before the registration is disconnected.
+	maxRateLimitDelay time.Duration
+	metrics           *Metrics
+	// memBudget, if positive, bounds the memory used by the events in buf.
+	memBudget int64
 
 	// Output.
 	stream Stream
 	errC   chan<- *roachpb.Error
+	// ctx is the context provided to Register. The registration is
+	// disconnected with a REASON_STREAM_CANCELED error once it is canceled.
+	ctx context.Context
 
 	// Internal.
 	id   int64
 	keys interval.Range
-	buf  chan *roachpb.RangeFeedEvent
+	buf  chan bufferedEvent
+	// causalToken is the causal ordering token assigned to the most recent
+	// value event published to the registration. Only accessed by the
+	// Processor goroutine.
+	causalToken hlc.Timestamp
+	// batch holds the value events published to a registration with
+	// reverseBatchOrder or maxBatchSize set that have not yet been flushed.
+	// Only accessed by the Processor goroutine.
+	batch []*roachpb.RangeFeedEvent
+	// resolvedTS is the resolved timestamp of the most recent checkpoint
+	// added to the registration's buffer. Only accessed by the Processor
+	// goroutine.
+	resolvedTS hlc.Timestamp
+	// checkpointSpanSent is set once a checkpoint carrying the registration's
+	// span has been published to the registration. Only accessed by the
+	// Processor goroutine.
+	checkpointSpanSent bool
+	// egressBytes is the number of bytes sent to the stream by the output
+	// loop. Accessed atomically.
+	egressBytes int64
+	// egressSamples are the two most recent samples of egressBytes, taken
+	// when the registration is registered and each time the streams are
+	// checked. The egress rate since the older sample is the registration's
+	// recent egress rate. Only accessed by the Processor goroutine.
+	egressSamples [2]egressSample
+	// rateLimitedSince is the time at which valueLimiter began to
+	// continuously hold back values, or zero if the last value was sent
+	// without waiting. Only accessed by the output loop.
+	rateLimitedSince time.Time
 
 	mu struct {
 		sync.Locker
@@ -74,9 +253,28 @@ type registration struct {
 		// This will cause the registration to exit with an error once the buffer
 		// has been emptied.
 		overflowed bool
+		// True if the buffer overflowed because the registration's memory
+		// budget was exceeded.
+		overBudget bool
+		// memUsed is the memory used by the events in buf. Only maintained
+		// if the registration has a memory budget.
+		memUsed int64
+		// lastCheckpoint is the checkpoint at the tail of buf, if any. Only
+		// maintained if the registration coalesces checkpoints.
+		lastCheckpoint *coalescedCheckpoint
+		// True if this registration is draining. This will cause the
+		// registration to exit with drainErr, which is usually nil, once the
+		// buffer has been emptied.
+		draining bool
+		drainErr *roachpb.Error
 		// Boolean indicating if all events have been output to stream. Used only
 		// for testing.
 		caughtUp bool
+		// published is the number of events added to buf, and sent is the
+		// number of them that the output loop has sent to the stream. Each of
+		// flushWaiters is notified once sent reaches its count. See flushed.
+		published, sent int64
+		flushWaiters    []flushWaiter
 		// Management of the output loop goroutine, used to ensure proper teardown.
 		outputLoopCancelFn func()
 		disconnected       bool
@@ -101,7 +299,8 @@ func newRegistration(
 		metrics:          metrics,
 		stream:           stream,
 		errC:             errC,
-		buf:              make(chan *roachpb.RangeFeedEvent, bufferSz),
+		ctx:              context.Background(),
+		buf:              make(chan bufferedEvent, bufferSz),
 	}
 	r.mu.Locker = &syncutil.Mutex{}
 	r.mu.caughtUp = true
@@ -112,26 +311,231 @@ func newRegistration(
 // registration. If the output buffer is full, the overflowed flag is set,
 // indicating that live events were lost and a catchup scan should be initiated.
 // If overflowed is already set, events are ignored and not written to the
-// buffer.
-func (r *registration) publish(event *roachpb.RangeFeedEvent) {
-	r.validateEvent(event)
-	event = r.maybeStripEvent(event)
+// buffer. Returns whether the event caused the buffer to overflow.
+func (r *registration) publish(event *roachpb.RangeFeedEvent) bool {
+	if r.spans != nil {
+		overflowed := false
+		for _, e := range r.splitBySpans(event) {
+			if r.publishOne(e) {
+				overflowed = true
+			}
+		}
+		return overflowed
+	}
+	return r.publishOne(event)
+}
+
+// publishOne publishes a single event to the output buffer. See publish.
+func (r *registration) publishOne(event *roachpb.RangeFeedEvent) bool {
+	e := r.makeBufferedEvent(event)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bufferLocked(e)
+}
+
+// splitBySpans splits a checkpoint, range deletion or SSTable published to a
+// registration over multiple spans into one event for each of its spans that
+// the event overlaps, constrained to that span. Together, the checkpoints
+// report the union of the registration's spans. Other events are returned
+// as is.
+func (r *registration) splitBySpans(event *roachpb.RangeFeedEvent) []*roachpb.RangeFeedEvent {
+	var span roachpb.Span
+	switch t := event.GetValue().(type) {
+	case *roachpb.RangeFeedCheckpoint:
+		span = t.Span
+	case *roachpb.RangeFeedDeleteRange:
+		span = t.Span
+	case *roachpb.RangeFeedSSTable:
+		span = t.Span
+	default:
+		return []*roachpb.RangeFeedEvent{event}
+	}
+	var events []*roachpb.RangeFeedEvent
+	for _, s := range r.spans {
+		if !s.Overlaps(span) {
+			continue
+		}
+		e := event.ShallowCopy()
+		switch t := e.GetValue().(type) {
+		case *roachpb.RangeFeedCheckpoint:
+			t.Span = constrainSpan(t.Span, s)
+		case *roachpb.RangeFeedDeleteRange:
+			t.Span = constrainSpan(t.Span, s)
+		case *roachpb.RangeFeedSSTable:
+			t.Span = constrainSpan(t.Span, s)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// drain publishes a final event, if not nil, to the registration and marks it
+// as draining. Once the output loop has flushed all buffered events, including
+// the final event, the registration is disconnected without an error. Events published
+// after the registration begins draining are ignored.
+func (r *registration) drain(final *roachpb.RangeFeedEvent) {
+	var finals []*roachpb.RangeFeedEvent
+	if final != nil {
+		finals = []*roachpb.RangeFeedEvent{final}
+		if r.spans != nil {
+			finals = r.splitBySpans(final)
+		}
+	}
+	es := make([]bufferedEvent, len(finals))
+	for i, final := range finals {
+		es[i] = r.makeBufferedEvent(final)
+	}
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	for _, e := range es {
+		r.bufferLocked(e)
+	}
+	r.mu.draining = true
+}
+
+// drainWithErr marks the registration as draining without publishing a final
+// event. Once the output loop has flushed all buffered events, the
+// registration is disconnected with the provided error.
+func (r *registration) drainWithErr(pErr *roachpb.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.draining = true
+	r.mu.drainErr = pErr
+}
+
+// egressSample records the egressBytes of a registration at a point in time.
+type egressSample struct {
+	bytes int64
+	at    time.Time
+}
+
+// sampleEgress records the number of bytes sent to the stream so far,
+// replacing the older of the registration's egress samples.
+func (r *registration) sampleEgress(now time.Time) {
+	r.egressSamples[0] = r.egressSamples[1]
+	r.egressSamples[1] = egressSample{bytes: atomic.LoadInt64(&r.egressBytes), at: now}
+}
+
+// recentEgressRate returns the number of bytes per second sent to the stream
+// since the older of the registration's egress samples.
+func (r *registration) recentEgressRate(now time.Time) float64 {
+	s := r.egressSamples[0]
+	elapsed := now.Sub(s.at)
+	if elapsed < time.Millisecond {
+		elapsed = time.Millisecond
+	}
+	return float64(atomic.LoadInt64(&r.egressBytes)-s.bytes) / elapsed.Seconds()
+}
+
+// isDisconnected returns whether the registration has been disconnected.
+func (r *registration) isDisconnected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.disconnected
+}
+
+// isDraining returns whether the registration is draining.
+func (r *registration) isDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.draining
+}
+
+// makeBufferedEvent prepares an event to be added to the output buffer.
+func (r *registration) makeBufferedEvent(event *roachpb.RangeFeedEvent) bufferedEvent {
+	r.validateEvent(event)
+	e := bufferedEvent{event: r.maybeStripEvent(event)}
+	if r.withCausalTokens {
+		switch t := event.GetValue().(type) {
+		case *roachpb.RangeFeedValue:
+			// The token is the maximum timestamp of all values published to
+			// the registration so far. Values are published in the order that
+			// they were applied, so ordering events by their token respects
+			// causality across keys.
+			r.causalToken.Forward(t.Value.Timestamp)
+			e.causalToken = r.causalToken
+		case *roachpb.RangeFeedBatch:
+			for i := range t.Values {
+				r.causalToken.Forward(t.Values[i].Value.Timestamp)
+			}
+			e.causalToken = r.causalToken
+		}
+	}
+	if r.maxBufferedEventAge > 0 {
+		e.enqueued = timeutil.Now()
+	}
+	if r.memBudget > 0 {
+		e.size = int64(e.event.Size())
+	}
+	return e
+}
+
+// bufferLocked adds the event to the output buffer. See publish.
+func (r *registration) bufferLocked(e bufferedEvent) (overflowed bool) {
+	if r.mu.draining {
+		return false
+	}
 	if r.mu.overflowed {
-		return
+		r.recordDropped(e)
+		return false
+	}
+	if c := r.mu.lastCheckpoint; c != nil && e.event.Checkpoint != nil &&
+		!c.event.Checkpoint.CatchUpComplete &&
+		c.event.Checkpoint.Span.EqualValue(e.event.Checkpoint.Span) {
+		// The previous checkpoint has not been sent to the stream yet and is
+		// superseded by this one, so send this one in its place. A checkpoint
+		// that marks the end of the catch-up scan is never superseded.
+		c.event = e.event
+		r.resolvedTS.Forward(e.event.Checkpoint.ResolvedTS)
+		return false
+	}
+	if r.memBudget > 0 && r.mu.memUsed+e.size > r.memBudget {
+		r.mu.overflowed = true
+		r.mu.overBudget = true
+		r.recordDropped(e)
+		return true
+	}
+	var last *coalescedCheckpoint
+	if r.coalesceCheckpoints && e.event.Checkpoint != nil {
+		last = &coalescedCheckpoint{event: e.event}
+		e.coalesced = last
 	}
 	select {
-	case r.buf <- event:
+	case r.buf <- e:
 		r.mu.caughtUp = false
+		r.mu.published++
+		r.mu.memUsed += e.size
+		r.mu.lastCheckpoint = last
+		if c := e.event.Checkpoint; c != nil {
+			r.resolvedTS.Forward(c.ResolvedTS)
+		}
+		return false
 	default:
 		// Buffer exceeded and we are dropping this event. Registration will need
 		// a catch-up scan.
 		r.mu.overflowed = true
+		r.recordDropped(e)
+		return true
 	}
 }
 
+// recordDropped records that the event was dropped because the registration's
+// buffer was exceeded.
+func (r *registration) recordDropped(e bufferedEvent) {
+	r.metrics.RangeFeedDroppedEvents.Inc(1)
+	r.metrics.RangeFeedDroppedBytes.Inc(int64(e.event.Size()))
+}
+
+// exceededMemBudget returns whether the registration's buffer overflowed
+// because its memory budget was exceeded.
+func (r *registration) exceededMemBudget() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.overBudget
+}
+
 // validateEvent checks that the event contains enough information for the
 // registation.
 func (r *registration) validateEvent(event *roachpb.RangeFeedEvent) {
@@ -146,10 +550,38 @@ func (r *registration) validateEvent(event *roachpb.RangeFeedEvent) {
 		if t.Value.Timestamp.IsEmpty() {
 			panic(fmt.Sprintf("unexpected empty RangeFeedValue.Value.Timestamp: %v", t))
 		}
+		if t.IsDeletion && t.Value.IsPresent() {
+			panic(fmt.Sprintf("unexpected value on deleted RangeFeedValue: %v", t))
+		}
 	case *roachpb.RangeFeedCheckpoint:
 		if t.Span.Key == nil {
 			panic(fmt.Sprintf("unexpected empty RangeFeedCheckpoint.Span.Key: %v", t))
 		}
+	case *roachpb.RangeFeedSplit:
+		if t.SplitKey == nil {
+			panic(fmt.Sprintf("unexpected empty RangeFeedSplit.SplitKey: %v", t))
+		}
+	case *roachpb.RangeFeedDeleteRange:
+		if t.Span.Key == nil {
+			panic(fmt.Sprintf("unexpected empty RangeFeedDeleteRange.Span.Key: %v", t))
+		}
+		if t.Timestamp.IsEmpty() {
+			panic(fmt.Sprintf("unexpected empty RangeFeedDeleteRange.Timestamp: %v", t))
+		}
+	case *roachpb.RangeFeedSSTable:
+		if len(t.Data) == 0 {
+			panic(fmt.Sprintf("unexpected empty RangeFeedSSTable.Data: %v", t))
+		}
+		if t.Span.Key == nil {
+			panic(fmt.Sprintf("unexpected empty RangeFeedSSTable.Span.Key: %v", t))
+		}
+		if t.WriteTS.IsEmpty() {
+			panic(fmt.Sprintf("unexpected empty RangeFeedSSTable.WriteTS: %v", t))
+		}
+	case *roachpb.RangeFeedBatch:
+		if len(t.Values) == 0 {
+			panic(fmt.Sprintf("unexpected empty RangeFeedBatch.Values: %v", t))
+		}
 	default:
 		panic(fmt.Sprintf("unexpected RangeFeedEvent variant: %v", t))
 	}
@@ -181,6 +613,19 @@ func (r *registration) maybeStripEvent(event *roachpb.RangeFeedEvent) *roachpb.R
 			t.PrevValue = roachpb.Value{}
 		}
 	case *roachpb.RangeFeedCheckpoint:
+		if r.omitCheckpointSpans && r.checkpointSpanSent {
+			// The consumer has cached the registration's span from the first
+			// checkpoint, so only the resolved timestamp needs to be sent.
+			t = copyOnWrite().(*roachpb.RangeFeedCheckpoint)
+			t.Span = roachpb.Span{}
+			break
+		}
+		r.checkpointSpanSent = true
+		if r.spans != nil {
+			// The checkpoint was already constrained to one of the
+			// registration's spans by splitBySpans.
+			break
+		}
 		if !t.Span.EqualValue(r.span) {
 			// Checkpoint events are always created spanning the entire Range.
 			// However, a registration might not be listening on updates over
@@ -196,12 +641,74 @@ func (r *registration) maybeStripEvent(event *roachpb.RangeFeedEvent) *roachpb.R
 			t = copyOnWrite().(*roachpb.RangeFeedCheckpoint)
 			t.Span = r.span
 		}
+	case *roachpb.RangeFeedSplit:
+		// Split events are only published to the registrations they apply to.
+	case *roachpb.RangeFeedDeleteRange:
+		if !r.span.Contains(t.Span) {
+			// Like point values outside of its span, the registration must not
+			// observe the deletion of keys outside of its span, so constrain
+			// the deleted span to the part that overlaps the registration.
+			t = copyOnWrite().(*roachpb.RangeFeedDeleteRange)
+			t.Span = constrainSpan(t.Span, r.span)
+		}
+	case *roachpb.RangeFeedSSTable:
+		if !r.span.Contains(t.Span) {
+			// The SSTable's data is not filtered, but its span is constrained
+			// to the part that overlaps the registration so that consumers
+			// know which of its keys they are responsible for.
+			t = copyOnWrite().(*roachpb.RangeFeedSSTable)
+			t.Span = constrainSpan(t.Span, r.span)
+		}
+	case *roachpb.RangeFeedBatch:
+		// The values of a batch are validated and stripped individually when
+		// it is assembled by makeBatchEvent.
 	default:
 		panic(fmt.Sprintf("unexpected RangeFeedEvent variant: %v", t))
 	}
+	if r.reportBufferedEvents && ret.Checkpoint != nil {
+		// Report how many events are queued ahead of the checkpoint, so that
+		// the consumer can tell that it is falling behind before its buffer
+		// overflows.
+		t := copyOnWrite().(*roachpb.RangeFeedCheckpoint)
+		t.BufferedEvents = int64(len(r.buf))
+	}
 	return ret
 }
 
+// wantsKey returns whether the registration's key predicate, if any, accepts
+// the key.
+func (r *registration) wantsKey(key roachpb.Key) bool {
+	if r.spans != nil {
+		i := sort.Search(len(r.spans), func(i int) bool {
+			return key.Compare(r.spans[i].EndKey) < 0
+		})
+		if i == len(r.spans) || key.Compare(r.spans[i].Key) < 0 {
+			return false
+		}
+	}
+	return r.keyPredicate == nil || r.keyPredicate(key)
+}
+
+// keySpans returns the spans of keys that the registration is interested in.
+func (r *registration) keySpans() []roachpb.Span {
+	if r.spans != nil {
+		return r.spans
+	}
+	return []roachpb.Span{r.span}
+}
+
+// constrainSpan returns the part of span s that overlaps span to. The spans
+// must overlap.
+func constrainSpan(s, to roachpb.Span) roachpb.Span {
+	if s.Key.Compare(to.Key) < 0 {
+		s.Key = to.Key
+	}
+	if s.EndKey.Compare(to.EndKey) > 0 {
+		s.EndKey = to.EndKey
+	}
+	return s
+}
+
 // disconnect cancels the output loop context for the registration and passes an
 // error to the output error stream for the registration. This also sets the
 // disconnected flag on the registration, preventing it from being disconnected
@@ -215,9 +722,49 @@ func (r *registration) disconnect(pErr *roachpb.Error) {
 		}
 		r.mu.disconnected = true
 		r.errC <- pErr
+		for _, w := range r.mu.flushWaiters {
+			close(w.c)
+		}
+		r.mu.flushWaiters = nil
 	}
 }
 
+// flushWaiter is notified, by closing c, once the output loop of a
+// registration has sent the first n events published to it.
+type flushWaiter struct {
+	n int64
+	c chan struct{}
+}
+
+// flushed returns a channel that is closed once the output loop has sent all
+// of the events that are currently buffered to the stream, or once the
+// registration is disconnected.
+func (r *registration) flushed() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := make(chan struct{})
+	if r.mu.disconnected || r.mu.sent >= r.mu.published {
+		close(c)
+		return c
+	}
+	r.mu.flushWaiters = append(r.mu.flushWaiters, flushWaiter{n: r.mu.published, c: c})
+	return c
+}
+
+// notifyFlushWaitersLocked notifies the flush waiters whose events have all
+// been sent. r.mu must be held.
+func (r *registration) notifyFlushWaitersLocked() {
+	waiters := r.mu.flushWaiters[:0]
+	for _, w := range r.mu.flushWaiters {
+		if r.mu.sent >= w.n {
+			close(w.c)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	r.mu.flushWaiters = waiters
+}
+
 // outputLoop is the operational loop for a single registration. The behavior
 // is as thus:
 //
@@ -229,11 +776,12 @@ func (r *registration) disconnect(pErr *roachpb.Error) {
 //
 // The loop exits with any error encountered, if the provided context is
 // canceled, or when the buffer has overflowed and all pre-overflow entries
-// have been emitted.
+// have been emitted. It exits without an error when the registration is
+// draining and all buffered entries have been emitted.
 func (r *registration) outputLoop(ctx context.Context) error {
 	// If the registration has a catch-up scan,
 	if r.catchupIter != nil {
-		if err := r.runCatchupScan(); err != nil {
+		if err := r.runCatchupScan(ctx); err != nil {
 			err = errors.Wrap(err, "catch-up scan failed")
 			log.Error(ctx, err)
 			return err
@@ -241,29 +789,162 @@ func (r *registration) outputLoop(ctx context.Context) error {
 	}
 
 	// Normal buffered output loop.
+	var sent bool
 	for {
-		overflowed := false
+		overflowed, drained := false, false
+		var drainErr *roachpb.Error
 		r.mu.Lock()
+		if sent {
+			sent = false
+			r.mu.sent++
+			if len(r.mu.flushWaiters) > 0 {
+				r.notifyFlushWaitersLocked()
+			}
+		}
 		if len(r.buf) == 0 {
 			overflowed = r.mu.overflowed
+			drained, drainErr = r.mu.draining, r.mu.drainErr
 			r.mu.caughtUp = true
 		}
 		r.mu.Unlock()
 		if overflowed {
 			return newErrBufferCapacityExceeded().GoError()
 		}
+		if drained {
+			return drainErr.GoError()
+		}
 
 		select {
 		case nextEvent := <-r.buf:
-			if err := r.stream.Send(nextEvent); err != nil {
+			if nextEvent.size > 0 || nextEvent.coalesced != nil {
+				r.mu.Lock()
+				r.mu.memUsed -= nextEvent.size
+				if c := nextEvent.coalesced; c != nil {
+					nextEvent.event = c.event
+					if r.mu.lastCheckpoint == c {
+						r.mu.lastCheckpoint = nil
+					}
+				}
+				r.mu.Unlock()
+			}
+			if r.maxBufferedEventAge > 0 &&
+				timeutil.Since(nextEvent.enqueued) > r.maxBufferedEventAge {
+				return newErrStalenessExceeded().GoError()
+			}
+			if err := r.waitValueLimit(ctx, nextEvent.event); err != nil {
+				return err
+			}
+			if err := r.send(ctx, nextEvent); err != nil {
 				return err
 			}
+			sent = true
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-r.stream.Context().Done():
-			return r.stream.Context().Err()
+			return newErrStreamCanceled().GoError()
+		}
+	}
+}
+
+// waitValueLimit waits until the value events in the event fit within the
+// registration's value rate limit, if it has one. Other events are not
+// limited. If the limit has continuously held back values for longer than the
+// registration's maximum rate limit delay, it returns a REASON_RATE_LIMIT_BACKLOG
+// error instead of waiting.
+func (r *registration) waitValueLimit(ctx context.Context, event *roachpb.RangeFeedEvent) error {
+	if r.valueLimiter == nil {
+		return nil
+	}
+	var n int
+	switch t := event.GetValue().(type) {
+	case *roachpb.RangeFeedValue:
+		n = 1
+	case *roachpb.RangeFeedBatch:
+		n = len(t.Values)
+	default:
+		return nil
+	}
+	// Batches larger than the limiter's burst are allowed through once the
+	// full burst is available.
+	if n > r.valueLimiter.Burst() {
+		n = r.valueLimiter.Burst()
+	}
+	now := timeutil.Now()
+	res := r.valueLimiter.ReserveN(now, n)
+	delay := res.DelayFrom(now)
+	if delay == 0 {
+		r.rateLimitedSince = time.Time{}
+		return nil
+	}
+	if r.rateLimitedSince.IsZero() {
+		r.rateLimitedSince = now
+	}
+	if now.Add(delay).Sub(r.rateLimitedSince) > r.maxRateLimitDelay {
+		res.CancelAt(now)
+		return newErrRateLimitBacklog().GoError()
+	}
+	t := timeutil.NewTimer()
+	defer t.Stop()
+	t.Reset(delay)
+	select {
+	case <-t.C:
+		t.Read = true
+		return nil
+	case <-ctx.Done():
+		res.CancelAt(timeutil.Now())
+		return ctx.Err()
+	}
+}
+
+// send transmits the buffered event on the registration's stream, along with
+// its causal ordering token if it has one and the stream can accept it. Values
+// are encoded first if the registration has a ValueEncoder. If the Processor
+// limits its egress, send waits until the event fits within the limit.
+func (r *registration) send(ctx context.Context, e bufferedEvent) error {
+	size := e.event.Size()
+	if r.egress != nil {
+		// Events larger than the limiter's burst are allowed through once the
+		// full burst is available.
+		n := size
+		if n > r.egress.Burst() {
+			n = r.egress.Burst()
+		}
+		if err := r.egress.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&r.egressBytes, int64(size))
+	if r.valueEncoder != nil {
+		if t, ok := e.event.GetValue().(*roachpb.RangeFeedValue); ok {
+			payload, err := r.encodeValue(ctx, t)
+			if err != nil {
+				return errors.Wrap(err, "encoding rangefeed value")
+			}
+			return r.stream.(EncodedStream).SendEncoded(payload)
+		}
+	}
+	if !e.causalToken.IsEmpty() {
+		if cs, ok := r.stream.(CausalStream); ok {
+			return cs.SendWithCausalToken(e.event, e.causalToken)
 		}
 	}
+	return r.stream.Send(e.event)
+}
+
+// encodeValue encodes the value event using the registration's ValueEncoder,
+// first waiting for a slot in transformSem if the transforms are bounded.
+func (r *registration) encodeValue(
+	ctx context.Context, v *roachpb.RangeFeedValue,
+) ([]byte, error) {
+	if r.transformSem != nil {
+		select {
+		case r.transformSem <- struct{}{}:
+			defer func() { <-r.transformSem }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return r.valueEncoder.EncodeValue(v)
 }
 
 func (r *registration) runOutputLoop(ctx context.Context) {
@@ -277,11 +958,22 @@ func (r *registration) runOutputLoop(ctx context.Context) {
 // runCatchupScan starts a catchup scan which will output entries for all
 // recorded changes in the replica that are newer than the catchupTimestamp.
 // This uses the iterator provided when the registration was originally created;
-// after the scan completes, the iterator will be closed.
-func (r *registration) runCatchupScan() error {
+// after the scan completes, the iterator will be closed. If catch-up scans are
+// bounded, it first waits for a slot in catchUpScanSem.
+func (r *registration) runCatchupScan(ctx context.Context) error {
 	if r.catchupIter == nil {
 		return nil
 	}
+	if r.catchUpScanSem != nil {
+		select {
+		case r.catchUpScanSem <- struct{}{}:
+			defer func() { <-r.catchUpScanSem }()
+		case <-ctx.Done():
+			r.catchupIter.Close()
+			r.catchupIter = nil
+			return ctx.Err()
+		}
+	}
 	start := timeutil.Now()
 	defer func() {
 		r.catchupIter.Close()
@@ -311,7 +1003,10 @@ func (r *registration) runCatchupScan() error {
 	outputEvents := func() error {
 		for i := len(reorderBuf) - 1; i >= 0; i-- {
 			e := reorderBuf[i]
-			if err := r.stream.Send(&e); err != nil {
+			if !r.wantsKey(e.Val.Key) {
+				continue
+			}
+			if err := r.send(ctx, bufferedEvent{event: &e}); err != nil {
 				return err
 			}
 		}
@@ -325,6 +1020,11 @@ func (r *registration) runCatchupScan() error {
 	var meta enginepb.MVCCMetadata
 	r.catchupIter.SeekGE(startKey)
 	for {
+		// Stop scanning once the registration is disconnected, so that it
+		// does not hold back other catch-up scans.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if ok, err := r.catchupIter.Valid(); err != nil {
 			return err
 		} else if !ok || !r.catchupIter.UnsafeKey().Less(endKey) {
@@ -393,13 +1093,18 @@ func (r *registration) runCatchupScan() error {
 			// Move to the next version of this key.
 			r.catchupIter.Next()
 
+			v := roachpb.Value{
+				RawBytes:  val,
+				Timestamp: ts,
+			}
 			var event roachpb.RangeFeedEvent
 			event.MustSetValue(&roachpb.RangeFeedValue{
-				Key: key,
-				Value: roachpb.Value{
-					RawBytes:  val,
-					Timestamp: ts,
-				},
+				Key:   key,
+				Value: v,
+				// Committed versions have no metadata of their own. The engine
+				// stores a deletion as a version without a value, while inline
+				// values are cleared rather than deleted.
+				IsDeletion: !ts.IsEmpty() && len(val) == 0,
 			})
 			reorderBuf = append(reorderBuf, event)
 		}
@@ -427,6 +1132,21 @@ func (r registration) String() string {
 type registry struct {
 	tree    interval.Tree // *registration items
 	idAlloc int64
+	// added and removed count the registrations added to and removed from the
+	// tree over the registry's lifetime. updated counts the updates to the
+	// spans of registrations in the tree.
+	added, removed, updated int64
+	// batched contains the registrations with a non-empty batch of value
+	// events awaiting a call to FlushBatches.
+	batched []*registration
+	// prioritized counts the registrations in the tree with a non-zero
+	// priority. While it is zero, registrations are visited in key order
+	// without first being collected and sorted.
+	prioritized int
+	// checkpointsOnly counts the registrations in the tree that receive only
+	// checkpoints. While it equals the number of registrations, data events
+	// are not published at all.
+	checkpointsOnly int
 }
 
 func makeRegistry() registry {
@@ -440,6 +1160,159 @@ func (reg *registry) Len() int {
 	return reg.tree.Len()
 }
 
+// RegistryStats is a snapshot of the structure of a registry's interval tree.
+// It is intended for diagnosing pathological registration patterns that slow
+// down the overlap checks performed when routing events.
+type RegistryStats struct {
+	// Registrations is the number of registrations in the tree.
+	Registrations int
+	// DistinctSpans is the number of distinct spans among the registrations.
+	DistinctSpans int
+	// MaxOverlap is the largest number of registrations whose spans overlap a
+	// single key. An event published to that key must be routed to each of
+	// these registrations.
+	MaxOverlap int
+	// TreeDepth is the depth of the interval tree and TreeNodes is the number
+	// of nodes in it. A depth far above log2(TreeNodes) indicates an
+	// unbalanced tree.
+	TreeDepth, TreeNodes int
+	// Added and Removed are the number of registrations added to and removed
+	// from the registry over its lifetime. Their rate of change reflects the
+	// churn of the registration set; a high rate indicates consumers that
+	// repeatedly disconnect and reconnect.
+	Added, Removed int64
+	// Spans holds the span of each registration, sorted by start key and then
+	// by end key.
+	Spans []roachpb.Span
+}
+
+// String implements the fmt.Stringer interface.
+func (s RegistryStats) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf,
+		"registrations=%d distinct_spans=%d max_overlap=%d tree_depth=%d tree_nodes=%d added=%d removed=%d",
+		s.Registrations, s.DistinctSpans, s.MaxOverlap, s.TreeDepth, s.TreeNodes, s.Added, s.Removed)
+	for _, sp := range s.Spans {
+		fmt.Fprintf(&buf, "\n  %s", sp)
+	}
+	return buf.String()
+}
+
+// RegistrationInfo describes a single registration. It is intended for
+// debugging only.
+type RegistrationInfo struct {
+	// Span is the key span of the registration.
+	Span roachpb.Span
+	// CatchupTimestamp is the timestamp that the registration started at.
+	// Only values above it are published to the registration.
+	CatchupTimestamp hlc.Timestamp
+	// ResolvedTS is the resolved timestamp of the most recent checkpoint
+	// published to the registration. It may not have been sent to the
+	// registration's stream yet.
+	ResolvedTS hlc.Timestamp
+	// BufferedEvents is the number of events published to the registration
+	// that are waiting to be sent to its stream.
+	BufferedEvents int
+}
+
+// Registrations returns a description of each registration, sorted by span
+// and then by catch-up timestamp.
+func (reg *registry) Registrations() []RegistrationInfo {
+	var infos []RegistrationInfo
+	reg.tree.Do(func(i interval.Interface) (done bool) {
+		r := i.(*registration)
+		infos = append(infos, RegistrationInfo{
+			Span:             r.span,
+			CatchupTimestamp: r.catchupTimestamp,
+			ResolvedTS:       r.resolvedTS,
+			BufferedEvents:   len(r.buf),
+		})
+		return false
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		if c := infos[i].Span.Key.Compare(infos[j].Span.Key); c != 0 {
+			return c < 0
+		}
+		if c := infos[i].Span.EndKey.Compare(infos[j].Span.EndKey); c != 0 {
+			return c < 0
+		}
+		return infos[i].CatchupTimestamp.Less(infos[j].CatchupTimestamp)
+	})
+	return infos
+}
+
+// CoveredSpans returns the union of the spans of all registrations, as a
+// sorted slice of non-overlapping spans.
+func (reg *registry) CoveredSpans() []roachpb.Span {
+	if reg.tree.Len() == 0 {
+		return nil
+	}
+	spans := make([]roachpb.Span, 0, reg.tree.Len())
+	reg.tree.Do(func(i interval.Interface) (done bool) {
+		spans = append(spans, i.(*registration).keySpans()...)
+		return false
+	})
+	spans, _ = roachpb.MergeSpans(spans)
+	return spans
+}
+
+// Stats returns a snapshot of the structure of the registry.
+func (reg *registry) Stats() RegistryStats {
+	stats := RegistryStats{
+		Registrations: reg.tree.Len(),
+		Added:         reg.added,
+		Removed:       reg.removed,
+	}
+	stats.TreeDepth, stats.TreeNodes = reg.tree.Shape()
+	type boundary struct {
+		key   roachpb.Key
+		delta int
+	}
+	var bounds []boundary
+	reg.tree.Do(func(i interval.Interface) (done bool) {
+		r := i.(*registration)
+		stats.Spans = append(stats.Spans, r.span)
+		// Point registrations cover the single key [Key, Key.Next()).
+		endKey := r.span.EndKey
+		if len(endKey) == 0 {
+			endKey = r.span.Key.Next()
+		}
+		bounds = append(bounds,
+			boundary{key: r.span.Key, delta: +1},
+			boundary{key: endKey, delta: -1},
+		)
+		return false
+	})
+	sort.Slice(stats.Spans, func(i, j int) bool {
+		if c := stats.Spans[i].Key.Compare(stats.Spans[j].Key); c != 0 {
+			return c < 0
+		}
+		return stats.Spans[i].EndKey.Compare(stats.Spans[j].EndKey) < 0
+	})
+	for i, sp := range stats.Spans {
+		if i == 0 || !stats.Spans[i-1].EqualValue(sp) {
+			stats.DistinctSpans++
+		}
+	}
+
+	// Sweep over the span boundaries to determine the maximum overlap. Span
+	// end keys are exclusive, so ends sort before starts at the same key.
+	sort.Slice(bounds, func(i, j int) bool {
+		if c := bounds[i].key.Compare(bounds[j].key); c != 0 {
+			return c < 0
+		}
+		return bounds[i].delta < bounds[j].delta
+	})
+	cur := 0
+	for _, b := range bounds {
+		cur += b.delta
+		if cur > stats.MaxOverlap {
+			stats.MaxOverlap = cur
+		}
+	}
+	return stats
+}
+
 // NewFilter returns a operation filter reflecting the registrations
 // in the registry.
 func (reg *registry) NewFilter() *Filter {
@@ -450,9 +1323,18 @@ func (reg *registry) NewFilter() *Filter {
 func (reg *registry) Register(r *registration) {
 	r.id = reg.nextID()
 	r.keys = r.span.AsRange()
+	r.sampleEgress(timeutil.Now())
+	r.egressSamples[0] = r.egressSamples[1]
 	if err := reg.tree.Insert(r, false /* fast */); err != nil {
 		panic(err)
 	}
+	reg.added++
+	if r.priority != 0 {
+		reg.prioritized++
+	}
+	if r.checkpointsOnly {
+		reg.checkpointsOnly++
+	}
 }
 
 func (reg *registry) nextID() int64 {
@@ -466,11 +1348,20 @@ func (reg *registry) PublishToOverlapping(span roachpb.Span, event *roachpb.Rang
 	// Determine the earliest starting timestamp that a registration
 	// can have while still needing to hear about this event.
 	var minTS hlc.Timestamp
+	data := true
 	switch t := event.GetValue().(type) {
 	case *roachpb.RangeFeedValue:
 		// Only publish values to registrations with starting
 		// timestamps equal to or greater than the value's timestamp.
 		minTS = t.Value.Timestamp
+	case *roachpb.RangeFeedDeleteRange:
+		// Only publish range deletions to registrations with starting
+		// timestamps equal to or greater than the deletion's timestamp.
+		minTS = t.Timestamp
+	case *roachpb.RangeFeedSSTable:
+		// Only publish SSTables to registrations with starting timestamps
+		// equal to or greater than the ingestion timestamp.
+		minTS = t.WriteTS
 	case *roachpb.RangeFeedCheckpoint:
 		// Always publish checkpoint notifications, regardless of a registration's
 		// starting timestamp.
@@ -478,27 +1369,290 @@ func (reg *registry) PublishToOverlapping(span roachpb.Span, event *roachpb.Rang
 		// TODO(dan): It's unclear if this is the right contract, it's certainly
 		// surprising. Revisit this once RangeFeed has more users.
 		minTS = hlc.MaxTimestamp
+		data = false
 	default:
 		panic(fmt.Sprintf("unexpected RangeFeedEvent variant: %v", t))
 	}
+	if data && reg.checkpointsOnly == reg.tree.Len() {
+		// No registration is interested in data events, so don't bother
+		// searching for overlapping registrations.
+		return
+	}
 
+	shed := false
 	reg.forOverlappingRegs(span, func(r *registration) (bool, *roachpb.Error) {
+		if data && r.checkpointsOnly {
+			return false, nil
+		}
 		// Don't publish events if they are equal to or less
-		// than the registration's starting timestamp.
+		// than the registration's starting timestamp, or values
+		// that the registration filters out.
+		if val := event.Val; val != nil && !r.wantsKey(val.Key) {
+			return false, nil
+		}
 		if r.catchupTimestamp.Less(minTS) {
-			r.publish(event)
+			if r.batchesValues() {
+				if _, ok := event.GetValue().(*roachpb.RangeFeedValue); ok {
+					if len(r.batch) == 0 {
+						reg.batched = append(reg.batched, r)
+					}
+					r.batch = append(r.batch, event)
+					return false, nil
+				}
+				// Never reorder values across other events.
+				if r.flushBatch() {
+					if r.exceededMemBudget() {
+						return true, newErrBufferCapacityExceeded()
+					}
+					shed = shed || r.egress != nil
+				}
+			}
+			if r.publish(event) {
+				if r.exceededMemBudget() {
+					return true, newErrBufferCapacityExceeded()
+				}
+				shed = shed || r.egress != nil
+			}
 		}
 		return false, nil
 	})
+	if shed {
+		reg.shedLargestConsumer()
+	}
+}
+
+// FlushBatches publishes the value events held back by registrations that
+// receive batches in reverse timestamp order. It must be called at the end of
+// each batch of published events.
+func (reg *registry) FlushBatches() {
+	if reg.prioritized > 0 {
+		sortByPriority(reg.batched)
+	}
+	shed := false
+	for _, r := range reg.batched {
+		if r.flushBatch() {
+			if r.exceededMemBudget() {
+				r.disconnect(newErrBufferCapacityExceeded())
+				reg.Unregister(r)
+				continue
+			}
+			shed = shed || r.egress != nil
+		}
+	}
+	reg.batched = reg.batched[:0]
+	if shed {
+		reg.shedLargestConsumer()
+	}
+}
+
+// shedLargestConsumer disconnects the connected registration with the highest
+// recent egress rate. It is called when a registration overflows while the
+// Processor's egress is limited, so that the consumers that currently take
+// the largest share of the limit are disconnected before those that take
+// less. The overflowing registration is disconnected regardless, once it has
+// flushed its buffer.
+func (reg *registry) shedLargestConsumer() {
+	now := timeutil.Now()
+	var largest *registration
+	var largestRate float64
+	reg.tree.Do(func(i interval.Interface) (done bool) {
+		r := i.(*registration)
+		if r.isDisconnected() {
+			return false
+		}
+		if rate := r.recentEgressRate(now); largest == nil || rate > largestRate {
+			largest, largestRate = r, rate
+		}
+		return false
+	})
+	if largest == nil {
+		return
+	}
+	largest.disconnect(newErrBufferCapacityExceeded())
+	reg.Unregister(largest)
+}
+
+// batchesValues returns whether the value events published to the
+// registration are held back in its batch until FlushBatches is called.
+func (r *registration) batchesValues() bool {
+	return r.reverseBatchOrder || r.maxBatchSize > 1
+}
+
+// flushBatch publishes the registration's batch of value events, in descending
+// timestamp order if reverseBatchOrder is set and combined into RangeFeedBatch
+// events of up to maxBatchSize values if it is greater than 1. Returns whether
+// any of them caused the buffer to overflow.
+func (r *registration) flushBatch() (overflowed bool) {
+	if len(r.batch) == 0 {
+		return false
+	}
+	if r.reverseBatchOrder {
+		sort.SliceStable(r.batch, func(i, j int) bool {
+			return r.batch[j].Val.Value.Timestamp.Less(r.batch[i].Val.Value.Timestamp)
+		})
+	}
+	size := 1
+	if r.maxBatchSize > 1 {
+		size = r.maxBatchSize
+	}
+	for events := r.batch; len(events) > 0; {
+		n := size
+		if n > len(events) {
+			n = len(events)
+		}
+		if r.publish(r.makeBatchEvent(events[:n])) {
+			overflowed = true
+		}
+		events = events[n:]
+	}
+	r.batch = r.batch[:0]
+	return overflowed
+}
+
+// makeBatchEvent combines the value events into a single RangeFeedBatch
+// event, after validating and stripping each of them for the registration. A
+// single value event is returned as is.
+func (r *registration) makeBatchEvent(events []*roachpb.RangeFeedEvent) *roachpb.RangeFeedEvent {
+	if len(events) == 1 {
+		return events[0]
+	}
+	values := make([]roachpb.RangeFeedValue, len(events))
+	for i, event := range events {
+		r.validateEvent(event)
+		values[i] = *r.maybeStripEvent(event).Val
+	}
+	var event roachpb.RangeFeedEvent
+	event.MustSetValue(&roachpb.RangeFeedBatch{Values: values})
+	return &event
 }
 
 // Unregister removes a registration from the registry. It is assumed that the
 // registration has already been disconnected, this is intended only to clean
 // up the registry.
 func (reg *registry) Unregister(r *registration) {
+	// The registration may already have been removed when it was disconnected.
+	before := reg.tree.Len()
 	if err := reg.tree.Delete(r, false /* fast */); err != nil {
 		panic(err)
 	}
+	if before != reg.tree.Len() {
+		if r.priority != 0 {
+			reg.prioritized--
+		}
+		if r.checkpointsOnly {
+			reg.checkpointsOnly--
+		}
+	}
+	reg.removed += int64(before - reg.tree.Len())
+	reg.dropBatch(r)
+}
+
+// dropBatch discards the batch of value events held back by a registration
+// that is removed from the registry, and removes the registration from
+// batched, so that FlushBatches does not publish to it.
+func (reg *registry) dropBatch(r *registration) {
+	if len(r.batch) > 0 {
+		for i, b := range reg.batched {
+			if b == r {
+				reg.batched = append(reg.batched[:i], reg.batched[i+1:]...)
+				break
+			}
+		}
+	}
+	r.batch = nil
+}
+
+// Drain begins draining all registrations that are sending events on the
+// provided stream. See registration.drain. Returns whether any registrations
+// were found.
+func (reg *registry) Drain(stream Stream, final *roachpb.RangeFeedEvent) bool {
+	found := false
+	reg.tree.Do(func(i interval.Interface) (done bool) {
+		if r := i.(*registration); r.stream == stream {
+			r.drain(final)
+			found = true
+		}
+		return false
+	})
+	return found
+}
+
+// DrainAll begins draining all registrations, using the provided event as
+// their final event. See registration.drain.
+func (reg *registry) DrainAll(final *roachpb.RangeFeedEvent) {
+	reg.forOverlappingRegs(all, func(r *registration) (bool, *roachpb.Error) {
+		r.drain(final)
+		return false, nil
+	})
+}
+
+// DrainSplit begins draining all registrations that opted into split events
+// and whose span extends beyond the provided split key, using the provided
+// RangeFeedSplit event as their final event. See registration.drain.
+func (reg *registry) DrainSplit(splitKey roachpb.Key, final *roachpb.RangeFeedEvent) {
+	span := roachpb.Span{Key: splitKey, EndKey: roachpb.KeyMax}
+	reg.forOverlappingRegs(span, func(r *registration) (bool, *roachpb.Error) {
+		if r.emitSplitEvents {
+			r.drain(final)
+		}
+		return false, nil
+	})
+}
+
+// UpdateSpan narrows the span of all registrations that are sending events on
+// the provided stream to the intersection of their span and the provided span.
+// Registrations whose span is narrowed to an empty span begin draining and are
+// disconnected with an error once they have flushed their buffered events.
+// Returns whether any registrations were found.
+func (reg *registry) UpdateSpan(stream Stream, span roachpb.Span) bool {
+	var regs []*registration
+	reg.tree.Do(func(i interval.Interface) (done bool) {
+		if r := i.(*registration); r.stream == stream {
+			regs = append(regs, r)
+		}
+		return false
+	})
+	for _, r := range regs {
+		narrowed := r.span
+		if narrowed.Key.Compare(span.Key) < 0 {
+			narrowed.Key = span.Key
+		}
+		if narrowed.EndKey.Compare(span.EndKey) > 0 {
+			narrowed.EndKey = span.EndKey
+		}
+		if r.spans != nil && narrowed.Key.Compare(narrowed.EndKey) < 0 {
+			var spans []roachpb.Span
+			for _, s := range r.spans {
+				if s.Overlaps(narrowed) {
+					spans = append(spans, constrainSpan(s, narrowed))
+				}
+			}
+			if len(spans) == 0 {
+				narrowed = roachpb.Span{}
+			} else {
+				narrowed.Key, narrowed.EndKey = spans[0].Key, spans[len(spans)-1].EndKey
+				r.spans = spans
+			}
+		}
+		if narrowed.Key.Compare(narrowed.EndKey) >= 0 {
+			// The registration is removed from the registry once its output
+			// loop exits.
+			r.drainWithErr(newErrSpanNarrowedToEmpty())
+			continue
+		}
+		if err := reg.tree.Delete(r, false /* fast */); err != nil {
+			panic(err)
+		}
+		r.span = narrowed
+		r.keys = r.span.AsRange()
+		// Checkpoints carry the narrowed span until it has been sent.
+		r.checkpointSpanSent = false
+		if err := reg.tree.Insert(r, false /* fast */); err != nil {
+			panic(err)
+		}
+		reg.updated++
+	}
+	return len(regs) > 0
 }
 
 // Disconnect disconnects all registrations that overlap the specified span with
@@ -507,6 +1661,36 @@ func (reg *registry) Disconnect(span roachpb.Span) {
 	reg.DisconnectWithErr(span, nil /* pErr */)
 }
 
+// CheckStreams disconnects all registrations whose context has been canceled,
+// with a REASON_STREAM_CANCELED error, or whose stream is no longer alive
+// according to the provided StreamLiveness, with the error it returns.
+func (reg *registry) CheckStreams(liveness StreamLiveness) {
+	now := timeutil.Now()
+	reg.forOverlappingRegs(all, func(r *registration) (bool, *roachpb.Error) {
+		r.sampleEgress(now)
+		if r.ctx.Err() != nil {
+			return true, newErrStreamCanceled()
+		}
+		if err := liveness.CheckStream(r.stream); err != nil {
+			return true, roachpb.NewError(err)
+		}
+		return false, nil
+	})
+}
+
+// DisconnectBelowGCThreshold disconnects the registrations whose resolved
+// timestamp is below the provided GC threshold with an error carrying the
+// threshold. Registrations that have not been published a checkpoint are not
+// affected.
+func (reg *registry) DisconnectBelowGCThreshold(threshold hlc.Timestamp) {
+	reg.forOverlappingRegs(all, func(r *registration) (bool, *roachpb.Error) {
+		if r.resolvedTS.IsEmpty() || !r.resolvedTS.Less(threshold) {
+			return false, nil
+		}
+		return true, newErrDataGarbageCollected(threshold)
+	})
+}
+
 // DisconnectWithErr disconnects all registrations that overlap the specified
 // span with the provided error.
 func (reg *registry) DisconnectWithErr(span roachpb.Span, pErr *roachpb.Error) {
@@ -518,10 +1702,19 @@ func (reg *registry) DisconnectWithErr(span roachpb.Span, pErr *roachpb.Error) {
 // all is a span that overlaps with all registrations.
 var all = roachpb.Span{Key: roachpb.KeyMin, EndKey: roachpb.KeyMax}
 
+// sortByPriority sorts the registrations in descending order of priority,
+// preserving the relative order of registrations with the same priority.
+func sortByPriority(regs []*registration) {
+	sort.SliceStable(regs, func(i, j int) bool {
+		return regs[i].priority > regs[j].priority
+	})
+}
+
 // forOverlappingRegs calls the provided function on each registration that
-// overlaps the span. If the function returns true for a given registration
-// then that registration is unregistered and the error returned by the
-// function is send on its corresponding error channel.
+// overlaps the span, in descending order of priority and then in key order.
+// If the function returns true for a given registration then that
+// registration is unregistered and the error returned by the function is send
+// on its corresponding error channel.
 func (reg *registry) forOverlappingRegs(
 	span roachpb.Span, fn func(*registration) (disconnect bool, pErr *roachpb.Error),
 ) {
@@ -535,12 +1728,37 @@ func (reg *registry) forOverlappingRegs(
 		}
 		return false
 	}
-	if span.EqualValue(all) {
-		reg.tree.Do(matchFn)
+	do := func(fn interval.Operation) {
+		if span.EqualValue(all) {
+			reg.tree.Do(fn)
+		} else {
+			reg.tree.DoMatching(fn, span.AsRange())
+		}
+	}
+	if reg.prioritized > 0 {
+		var regs []*registration
+		do(func(i interval.Interface) (done bool) {
+			regs = append(regs, i.(*registration))
+			return false
+		})
+		sortByPriority(regs)
+		for _, r := range regs {
+			matchFn(r)
+		}
 	} else {
-		reg.tree.DoMatching(matchFn, span.AsRange())
+		do(matchFn)
 	}
 
+	for _, i := range toDelete {
+		r := i.(*registration)
+		if r.priority != 0 {
+			reg.prioritized--
+		}
+		if r.checkpointsOnly {
+			reg.checkpointsOnly--
+		}
+		reg.dropBatch(r)
+	}
 	if len(toDelete) == reg.tree.Len() {
 		reg.tree.Clear()
 	} else if len(toDelete) == 1 {
@@ -555,6 +1773,7 @@ func (reg *registry) forOverlappingRegs(
 		}
 		reg.tree.AdjustRanges()
 	}
+	reg.removed += int64(len(toDelete))
 }
 
 // Wait for this registration to completely process its internal buffer.
@@ -576,6 +1795,18 @@ func (r *registration) waitForCaughtUp() error {
 	return errors.Errorf("registration %v failed to empty in time", r.Range())
 }
 
+// Flushed returns a channel for each registration that is closed once the
+// registration has sent all of the events that are currently buffered for it
+// to its stream, or once it is disconnected. See registration.flushed.
+func (reg *registry) Flushed() []<-chan struct{} {
+	var flushed []<-chan struct{}
+	reg.forOverlappingRegs(all, func(r *registration) (bool, *roachpb.Error) {
+		flushed = append(flushed, r.flushed())
+		return false, nil
+	})
+	return flushed
+}
+
 // waitForCaughtUp waits for all registrations overlapping the given span to
 // completely process their internal buffers.
 func (reg *registry) waitForCaughtUp(span roachpb.Span) error {
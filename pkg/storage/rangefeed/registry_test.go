@@ -13,7 +13,9 @@ package rangefeed
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "github.com/cockroachdb/cockroach/pkg/keys" // hook up pretty printer
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
@@ -21,8 +23,10 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -42,8 +46,10 @@ type testStream struct {
 	ctxDone func()
 	mu      struct {
 		syncutil.Mutex
-		sendErr error
-		events  []*roachpb.RangeFeedEvent
+		sendErr  error
+		events   []*roachpb.RangeFeedEvent
+		tokens   []hlc.Timestamp
+		payloads [][]byte
 	}
 }
 
@@ -70,6 +76,42 @@ func (s *testStream) Send(e *roachpb.RangeFeedEvent) error {
 	return nil
 }
 
+func (s *testStream) SendWithCausalToken(e *roachpb.RangeFeedEvent, token hlc.Timestamp) error {
+	if err := s.Send(e); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.tokens = append(s.mu.tokens, token)
+	return nil
+}
+
+func (s *testStream) CausalTokens() []hlc.Timestamp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := s.mu.tokens
+	s.mu.tokens = nil
+	return tokens
+}
+
+func (s *testStream) SendEncoded(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.sendErr != nil {
+		return s.mu.sendErr
+	}
+	s.mu.payloads = append(s.mu.payloads, payload)
+	return nil
+}
+
+func (s *testStream) Payloads() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payloads := s.mu.payloads
+	s.mu.payloads = nil
+	return payloads
+}
+
 func (s *testStream) SetSendErr(err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -89,6 +131,80 @@ func (s *testStream) BlockSend() func() {
 	return s.mu.Unlock
 }
 
+// resolvedTSCheckingStream is a testStream that checks the core rangefeed
+// ordering invariant on each event sent to it: once a checkpoint has resolved
+// a span up to some timestamp, no value at or below that timestamp is ever
+// delivered for a key in that span. Violations are recorded rather than
+// failing immediately, since Send is called from output loop goroutines. See
+// requireNoViolations.
+type resolvedTSCheckingStream struct {
+	*testStream
+	check struct {
+		syncutil.Mutex
+		// lastSpan is the span of the most recent checkpoint that had one, used
+		// for checkpoints whose span was omitted.
+		lastSpan    roachpb.Span
+		checkpoints []roachpb.RangeFeedCheckpoint
+		violations  []string
+	}
+}
+
+func newResolvedTSCheckingStream() *resolvedTSCheckingStream {
+	return &resolvedTSCheckingStream{testStream: newTestStream()}
+}
+
+func (s *resolvedTSCheckingStream) Send(e *roachpb.RangeFeedEvent) error {
+	s.checkEvent(e)
+	return s.testStream.Send(e)
+}
+
+func (s *resolvedTSCheckingStream) SendWithCausalToken(
+	e *roachpb.RangeFeedEvent, token hlc.Timestamp,
+) error {
+	s.checkEvent(e)
+	return s.testStream.SendWithCausalToken(e, token)
+}
+
+func (s *resolvedTSCheckingStream) checkEvent(e *roachpb.RangeFeedEvent) {
+	s.check.Lock()
+	defer s.check.Unlock()
+	switch t := e.GetValue().(type) {
+	case *roachpb.RangeFeedValue:
+		for _, c := range s.check.checkpoints {
+			if c.Span.ContainsKey(t.Key) && !c.ResolvedTS.Less(t.Value.Timestamp) {
+				s.check.violations = append(s.check.violations, fmt.Sprintf(
+					"value %s@%s delivered after checkpoint %s@%s",
+					t.Key, t.Value.Timestamp, c.Span, c.ResolvedTS))
+				break
+			}
+		}
+	case *roachpb.RangeFeedCheckpoint:
+		c := *t
+		if len(c.Span.Key) == 0 {
+			c.Span = s.check.lastSpan
+		} else {
+			s.check.lastSpan = c.Span
+		}
+		s.check.checkpoints = append(s.check.checkpoints, c)
+	}
+}
+
+// Violations returns a description of each event that violated the invariant.
+func (s *resolvedTSCheckingStream) Violations() []string {
+	s.check.Lock()
+	defer s.check.Unlock()
+	return s.check.violations
+}
+
+// requireNoViolations fails the test if any of the streams delivered a value
+// at or below the resolved timestamp of an earlier checkpoint.
+func requireNoViolations(t *testing.T, streams ...*resolvedTSCheckingStream) {
+	t.Helper()
+	for _, s := range streams {
+		require.Empty(t, s.Violations())
+	}
+}
+
 type testRegistration struct {
 	registration
 	stream *testStream
@@ -203,7 +319,243 @@ func TestRegistrationBasic(t *testing.T) {
 	go streamCancelReg.runOutputLoop(context.Background())
 	require.NoError(t, streamCancelReg.waitForCaughtUp())
 	err = <-streamCancelReg.errC
-	require.Equal(t, streamCancelReg.stream.Context().Err().Error(), err.GoError().Error())
+	require.Equal(t, newErrStreamCanceled(), err)
+}
+
+// TestRegistrationCoalesceCheckpoints tests that a registration that coalesces
+// checkpoints replaces a checkpoint waiting at the tail of its buffer with the
+// next checkpoint, without coalescing or reordering values.
+func TestRegistrationCoalesceCheckpoints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	checkpoint := func(ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedCheckpoint(spAB, hlc.Timestamp{WallTime: ts})
+	}
+	val := rangeFeedValue(keyA, roachpb.Value{
+		RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 3},
+	})
+
+	reg := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.coalesceCheckpoints = true
+	for _, ev := range []*roachpb.RangeFeedEvent{
+		checkpoint(1), checkpoint(2), val, checkpoint(3), checkpoint(4), checkpoint(5),
+	} {
+		require.False(t, reg.publish(ev))
+	}
+	require.Equal(t, 3, len(reg.buf))
+	require.Equal(t, hlc.Timestamp{WallTime: 5}, reg.resolvedTS)
+
+	go reg.runOutputLoop(context.Background())
+	require.NoError(t, reg.waitForCaughtUp())
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{checkpoint(2), val, checkpoint(5)},
+		reg.stream.Events(),
+	)
+
+	// A checkpoint published after the previous one was sent is not
+	// coalesced with it.
+	reg.publish(checkpoint(6))
+	require.NoError(t, reg.waitForCaughtUp())
+	require.Equal(t, []*roachpb.RangeFeedEvent{checkpoint(6)}, reg.stream.Events())
+	reg.disconnect(nil)
+	<-reg.errC
+}
+
+func TestRegistrationCausalTokens(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ev := func(key roachpb.Key, ts int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(key, roachpb.Value{
+			RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: ts},
+		})
+	}
+	evs := []*roachpb.RangeFeedEvent{
+		ev(keyA, 5),
+		ev(keyB, 3),
+		rangeFeedCheckpoint(spAC, hlc.Timestamp{WallTime: 4}),
+		ev(keyA, 7),
+		ev(keyB, 6),
+	}
+
+	r := newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	r.withCausalTokens = true
+	for _, e := range evs {
+		r.publish(e)
+	}
+	go r.runOutputLoop(context.Background())
+	require.NoError(t, r.waitForCaughtUp())
+	require.Equal(t, evs, r.Events())
+	// Checkpoints are not assigned tokens, and the tokens of values never
+	// regress.
+	require.Equal(t, []hlc.Timestamp{
+		{WallTime: 5}, {WallTime: 5}, {WallTime: 7}, {WallTime: 7},
+	}, r.stream.CausalTokens())
+	r.disconnect(nil)
+	<-r.errC
+
+	// Without causal tokens, no tokens are delivered.
+	r = newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	for _, e := range evs {
+		r.publish(e)
+	}
+	go r.runOutputLoop(context.Background())
+	require.NoError(t, r.waitForCaughtUp())
+	require.Equal(t, evs, r.Events())
+	require.Nil(t, r.stream.CausalTokens())
+	r.disconnect(nil)
+	<-r.errC
+}
+
+type testValueEncoder struct {
+	err error
+}
+
+func (e testValueEncoder) EncodeValue(v *roachpb.RangeFeedValue) ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return []byte(fmt.Sprintf("%s@%d", string(v.Key), v.Value.Timestamp.WallTime)), nil
+}
+
+func TestRegistrationValueEncoder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	val := roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 1}}
+	ev1 := rangeFeedValue(keyA, val)
+	ev2 := rangeFeedCheckpoint(spAC, hlc.Timestamp{WallTime: 2})
+	ev3 := rangeFeedValue(keyB, val)
+
+	// Values are sent as encoded payloads, other events are sent unmodified.
+	r := newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	r.valueEncoder = testValueEncoder{}
+	r.publish(ev1)
+	r.publish(ev2)
+	r.publish(ev3)
+	go r.runOutputLoop(context.Background())
+	require.NoError(t, r.waitForCaughtUp())
+	require.Equal(t, []*roachpb.RangeFeedEvent{ev2}, r.Events())
+	require.Equal(t, [][]byte{[]byte("a@1"), []byte("b@1")}, r.stream.Payloads())
+	r.disconnect(nil)
+	<-r.errC
+
+	// An encoding error disconnects the registration.
+	r = newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	r.valueEncoder = testValueEncoder{err: fmt.Errorf("boom")}
+	r.publish(ev1)
+	go r.runOutputLoop(context.Background())
+	pErr := <-r.errC
+	require.Regexp(t, "encoding rangefeed value: boom", pErr.GoError())
+	require.Nil(t, r.stream.Payloads())
+}
+
+// concurrencyTrackingEncoder is a ValueEncoder that records the maximum number
+// of concurrent calls to EncodeValue across all encoders sharing its counters.
+type concurrencyTrackingEncoder struct {
+	cur, max *int32
+}
+
+func (e concurrencyTrackingEncoder) EncodeValue(v *roachpb.RangeFeedValue) ([]byte, error) {
+	n := atomic.AddInt32(e.cur, 1)
+	defer atomic.AddInt32(e.cur, -1)
+	for {
+		m := atomic.LoadInt32(e.max)
+		if n <= m || atomic.CompareAndSwapInt32(e.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return testValueEncoder{}.EncodeValue(v)
+}
+
+func TestRegistrationTransformSem(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var cur, max int32
+	enc := concurrencyTrackingEncoder{cur: &cur, max: &max}
+	sem := make(chan struct{}, 1)
+
+	// Registrations sharing a semaphore of size 1 never run their transforms
+	// concurrently, and each registration's values remain in order.
+	const numRegs, numEvents = 4, 10
+	var regs []*testRegistration
+	var expPayloads [][]byte
+	for i := 0; i < numEvents; i++ {
+		ts := hlc.Timestamp{WallTime: int64(i + 1)}
+		expPayloads = append(expPayloads, []byte(fmt.Sprintf("a@%d", ts.WallTime)))
+	}
+	for i := 0; i < numRegs; i++ {
+		r := newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+		r.valueEncoder = enc
+		r.transformSem = sem
+		for j := 0; j < numEvents; j++ {
+			val := roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: int64(j + 1)}}
+			r.publish(rangeFeedValue(keyA, val))
+		}
+		regs = append(regs, r)
+	}
+	for _, r := range regs {
+		go r.runOutputLoop(context.Background())
+	}
+	for _, r := range regs {
+		require.NoError(t, r.waitForCaughtUp())
+		require.Equal(t, expPayloads, r.stream.Payloads())
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&max))
+	for _, r := range regs {
+		r.disconnect(nil)
+		<-r.errC
+	}
+}
+
+func TestResolvedTSCheckingStream(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	val := func(key roachpb.Key, wall int64) *roachpb.RangeFeedEvent {
+		return rangeFeedValue(key, roachpb.Value{Timestamp: hlc.Timestamp{WallTime: wall}})
+	}
+	s := newResolvedTSCheckingStream()
+	require.NoError(t, s.Send(val(keyA, 1)))
+	require.NoError(t, s.Send(rangeFeedCheckpoint(spAB, hlc.Timestamp{WallTime: 5})))
+	require.NoError(t, s.Send(val(keyA, 6)))
+	require.NoError(t, s.Send(val(keyB, 3)))
+	requireNoViolations(t, s)
+
+	// Values at or below the resolved timestamp of a checkpoint over their key
+	// are flagged, including for checkpoints whose span was omitted.
+	require.NoError(t, s.Send(val(keyA, 5)))
+	require.NoError(t, s.Send(rangeFeedCheckpoint(roachpb.Span{}, hlc.Timestamp{WallTime: 8})))
+	require.NoError(t, s.SendWithCausalToken(val(keyA, 7), hlc.Timestamp{}))
+	require.Len(t, s.Violations(), 2)
+	require.Regexp(t, `value "a"@0.000000005,0 delivered after checkpoint`, s.Violations()[0])
+	require.Len(t, s.Events(), 7)
+}
+
+func TestRegistrationMaxBufferedEventAge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ev := rangeFeedValue(keyA, roachpb.Value{
+		RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 1},
+	})
+
+	// An event that sits in the buffer for too long disconnects the
+	// registration.
+	staleReg := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	staleReg.maxBufferedEventAge = time.Millisecond
+	staleReg.publish(ev)
+	time.Sleep(10 * time.Millisecond)
+	go staleReg.runOutputLoop(context.Background())
+	require.Equal(t, newErrStalenessExceeded(), <-staleReg.errC)
+	require.Nil(t, staleReg.Events())
+
+	// An event that is consumed promptly is sent.
+	promptReg := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	promptReg.maxBufferedEventAge = time.Hour
+	promptReg.publish(ev)
+	go promptReg.runOutputLoop(context.Background())
+	require.NoError(t, promptReg.waitForCaughtUp())
+	require.Equal(t, []*roachpb.RangeFeedEvent{ev}, promptReg.Events())
+	promptReg.disconnect(nil)
+	<-promptReg.errC
 }
 
 func TestRegistrationCatchUpScan(t *testing.T) {
@@ -253,7 +605,7 @@ func TestRegistrationCatchUpScan(t *testing.T) {
 	}, hlc.Timestamp{WallTime: 4}, iter, true /* withDiff */)
 
 	require.Zero(t, r.metrics.RangeFeedCatchupScanNanos.Count())
-	require.NoError(t, r.runCatchupScan())
+	require.NoError(t, r.runCatchupScan(context.Background()))
 	require.True(t, iter.closed)
 	require.NotZero(t, r.metrics.RangeFeedCatchupScanNanos.Count())
 
@@ -310,6 +662,40 @@ func TestRegistrationCatchUpScan(t *testing.T) {
 	require.Equal(t, expEvents, r.Events())
 }
 
+func TestRegistrationCatchUpScanDeletions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Catch-up scans publish deletion tombstones as deletions, distinctly from
+	// writes of empty values.
+	emptyVal := string(roachpb.MakeValueFromBytes(nil).RawBytes)
+	iter := newTestIterator([]engine.MVCCKeyValue{
+		makeKV("a", "", 12),
+		makeKV("a", "valA1", 10),
+		makeKV("b", emptyVal, 11),
+	})
+	r := newTestRegistration(roachpb.Span{
+		Key:    roachpb.Key("a"),
+		EndKey: roachpb.Key("z"),
+	}, hlc.Timestamp{WallTime: 4}, iter, false /* withDiff */)
+	require.NoError(t, r.runCatchupScan(context.Background()))
+
+	events := r.stream.Events()
+	require.Len(t, events, 3)
+	for i, exp := range []struct {
+		key        string
+		ts         int64
+		isDeletion bool
+	}{
+		{"a", 10, false},
+		{"a", 12, true},
+		{"b", 11, false},
+	} {
+		require.Equal(t, roachpb.Key(exp.key), events[i].Val.Key)
+		require.Equal(t, hlc.Timestamp{WallTime: exp.ts}, events[i].Val.Value.Timestamp)
+		require.Equal(t, exp.isDeletion, events[i].Val.IsDeletion, "key %s", exp.key)
+	}
+}
+
 func TestRegistryBasic(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -569,3 +955,293 @@ func TestRegistrationString(t *testing.T) {
 		require.Equal(t, tc.exp, tc.r.String())
 	}
 }
+
+func TestRegistryStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	reg := makeRegistry()
+	require.Equal(t, RegistryStats{}, reg.Stats())
+
+	rAB := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rAC := newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rAC2 := newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rBC := newTestRegistration(spBC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rCD := newTestRegistration(spCD, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.Register(&rAB.registration)
+	reg.Register(&rAC.registration)
+	reg.Register(&rAC2.registration)
+	reg.Register(&rBC.registration)
+	reg.Register(&rCD.registration)
+
+	stats := reg.Stats()
+	require.Equal(t, 5, stats.Registrations)
+	require.Equal(t, 4, stats.DistinctSpans)
+	// Keys in [b, c) are covered by rAC, rAC2, and rBC. The end key of rBC is
+	// exclusive, so it does not overlap with rCD.
+	require.Equal(t, 3, stats.MaxOverlap)
+	require.Equal(t, []roachpb.Span{spAB, spAC, spAC, spBC, spCD}, stats.Spans)
+	require.True(t, stats.TreeDepth >= 1 && stats.TreeDepth <= stats.TreeNodes,
+		"depth=%d nodes=%d", stats.TreeDepth, stats.TreeNodes)
+
+	reg.Unregister(&rAC2.registration)
+	require.Equal(t, 2, reg.Stats().MaxOverlap)
+}
+
+func TestRegistryStatsPointSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	spB := roachpb.Span{Key: keyB}
+	spC := roachpb.Span{Key: keyC}
+	reg := makeRegistry()
+	rAC := newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rBC := newTestRegistration(spBC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rB := newTestRegistration(spB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rB2 := newTestRegistration(spB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rC := newTestRegistration(spC, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.Register(&rAC.registration)
+	reg.Register(&rBC.registration)
+	reg.Register(&rB.registration)
+	reg.Register(&rB2.registration)
+	reg.Register(&rC.registration)
+
+	// Key b is covered by rAC, rBC, and both point registrations. The point
+	// registration at c only overlaps keys at or above the end keys of rAC and
+	// rBC.
+	stats := reg.Stats()
+	require.Equal(t, 5, stats.Registrations)
+	require.Equal(t, 4, stats.DistinctSpans)
+	require.Equal(t, 4, stats.MaxOverlap)
+	require.Equal(t, []roachpb.Span{spAC, spB, spB, spBC, spC}, stats.Spans)
+
+	reg.Unregister(&rB2.registration)
+	reg.Unregister(&rAC.registration)
+	require.Equal(t, 2, reg.Stats().MaxOverlap)
+}
+
+func TestRegistryStatsChurn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	reg := makeRegistry()
+	rAB := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rBC := newTestRegistration(spBC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rCD := newTestRegistration(spCD, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.Register(&rAB.registration)
+	reg.Register(&rBC.registration)
+	reg.Register(&rCD.registration)
+	stats := reg.Stats()
+	require.Equal(t, int64(3), stats.Added)
+	require.Equal(t, int64(0), stats.Removed)
+
+	// Registrations removed by a disconnect are counted once, even when they
+	// are subsequently unregistered.
+	reg.DisconnectWithErr(spAB, nil)
+	reg.Unregister(&rAB.registration)
+	reg.Unregister(&rBC.registration)
+	stats = reg.Stats()
+	require.Equal(t, 1, stats.Registrations)
+	require.Equal(t, int64(3), stats.Added)
+	require.Equal(t, int64(2), stats.Removed)
+	require.Equal(t, "registrations=1 distinct_spans=1 max_overlap=1 tree_depth=1 tree_nodes=1 added=3 removed=2\n  "+spCD.String(), stats.String())
+
+	// Reconnecting counts as a new addition.
+	rAB = newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.Register(&rAB.registration)
+	require.Equal(t, int64(4), reg.Stats().Added)
+}
+
+func TestRegistryShedLargestConsumer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	egress := rate.NewLimiter(rate.Limit(1<<20), 1<<20)
+	reg := makeRegistry()
+	rAC := newTestRegistration(spAC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rAB := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rXY := newTestRegistration(spXY, hlc.Timestamp{}, nil, false /* withDiff */)
+	rCD := newTestRegistration(spCD, hlc.Timestamp{}, nil, false /* withDiff */)
+	for _, r := range []*testRegistration{rAC, rAB, rXY, rCD} {
+		r.egress = egress
+		reg.Register(&r.registration)
+	}
+	// rXY has sent the most bytes, but rAC has the highest recent egress rate
+	// of the connected registrations. rCD has the highest rate of all, but it
+	// is already disconnected.
+	sampled := timeutil.Now().Add(-time.Second)
+	rAC.egressBytes, rAB.egressBytes, rXY.egressBytes, rCD.egressBytes = 100, 10, 1000, 10000
+	rAC.egressSamples[0] = egressSample{bytes: 0, at: sampled}
+	rAB.egressSamples[0] = egressSample{bytes: 0, at: sampled}
+	rXY.egressSamples[0] = egressSample{bytes: 990, at: sampled}
+	rCD.egressSamples[0] = egressSample{bytes: 0, at: sampled}
+	rCD.disconnect(roachpb.NewErrorf("disconnected"))
+
+	// Fill up the buffers of the registrations over a. Their output loops are
+	// not running.
+	ev := rangeFeedValue(keyA, roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 1}})
+	for i := 0; i < cap(rAB.buf); i++ {
+		reg.PublishToOverlapping(spAB, ev)
+	}
+	require.Nil(t, rAC.Err())
+	require.Equal(t, 4, reg.Len())
+
+	// Overflowing them disconnects the connected registration with the highest
+	// recent egress rate.
+	reg.PublishToOverlapping(spAB, ev)
+	require.Equal(t, newErrBufferCapacityExceeded(), rAC.Err())
+	require.Equal(t, 3, reg.Len())
+	require.Nil(t, rAB.Err())
+	require.Nil(t, rXY.Err())
+	require.Equal(t, roachpb.NewErrorf("disconnected"), rCD.Err())
+
+	// Without an egress limit, overflows don't shed other registrations.
+	reg = makeRegistry()
+	rAB = newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rXY = newTestRegistration(spXY, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.Register(&rAB.registration)
+	reg.Register(&rXY.registration)
+	for i := 0; i <= cap(rAB.buf); i++ {
+		reg.PublishToOverlapping(spAB, ev)
+	}
+	require.Nil(t, rXY.Err())
+	require.Equal(t, 2, reg.Len())
+}
+
+// TestRegistryDisconnectDropsBatch tests that disconnecting a registration
+// that holds back a batch of value events discards the batch, so that it is
+// not published when the batches are flushed.
+func TestRegistryDisconnectDropsBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	reg := makeRegistry()
+	rAB := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rCD := newTestRegistration(spCD, hlc.Timestamp{}, nil, false /* withDiff */)
+	rAB.reverseBatchOrder, rCD.reverseBatchOrder = true, true
+	reg.Register(&rAB.registration)
+	reg.Register(&rCD.registration)
+
+	evA := rangeFeedValue(keyA, roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 1}})
+	evC := rangeFeedValue(keyC, roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 1}})
+	reg.PublishToOverlapping(spAB, evA)
+	reg.PublishToOverlapping(spCD, evC)
+	require.Len(t, reg.batched, 2)
+
+	reg.DisconnectWithErr(spAB, roachpb.NewErrorf("disconnected"))
+	require.Nil(t, rAB.batch)
+	require.Equal(t, []*registration{&rCD.registration}, reg.batched)
+
+	reg.FlushBatches()
+	require.Len(t, rAB.buf, 0)
+	require.Len(t, rCD.buf, 1)
+}
+
+func TestRegistryPriority(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	reg := makeRegistry()
+	rAB := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	rBC := newTestRegistration(spBC, hlc.Timestamp{}, nil, false /* withDiff */)
+	rCD := newTestRegistration(spCD, hlc.Timestamp{}, nil, false /* withDiff */)
+	rBC.priority, rCD.priority = 2, 1
+	for _, r := range []*testRegistration{rAB, rBC, rCD} {
+		reg.Register(&r.registration)
+	}
+	require.Equal(t, 2, reg.prioritized)
+
+	visited := func() []*registration {
+		var regs []*registration
+		reg.forOverlappingRegs(all, func(r *registration) (bool, *roachpb.Error) {
+			regs = append(regs, r)
+			return false, nil
+		})
+		return regs
+	}
+	require.Equal(t,
+		[]*registration{&rBC.registration, &rCD.registration, &rAB.registration}, visited(),
+	)
+
+	// Every registration receives the event, regardless of its priority.
+	ev := rangeFeedCheckpoint(all, hlc.Timestamp{WallTime: 1})
+	reg.PublishToOverlapping(all, ev)
+	for _, r := range []*testRegistration{rAB, rBC, rCD} {
+		require.Equal(t, 1, len(r.buf))
+	}
+
+	// Once the prioritized registrations are removed, the remaining ones are
+	// visited in key order.
+	reg.Unregister(&rBC.registration)
+	reg.forOverlappingRegs(spCD, func(*registration) (bool, *roachpb.Error) {
+		return true, nil
+	})
+	require.Equal(t, 0, reg.prioritized)
+	require.Equal(t, []*registration{&rAB.registration}, visited())
+}
+
+// TestRegistrationReportBufferedEvents tests that checkpoints report the number
+// of events buffered ahead of them for registrations that request it.
+func TestRegistrationReportBufferedEvents(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	val := rangeFeedValue(keyA, roachpb.Value{
+		RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 1},
+	})
+	checkpoint := rangeFeedCheckpoint(spAB, hlc.Timestamp{WallTime: 2})
+	withCount := func(n int64) *roachpb.RangeFeedEvent {
+		return makeRangeFeedEvent(&roachpb.RangeFeedCheckpoint{
+			Span: spAB, ResolvedTS: hlc.Timestamp{WallTime: 2}, BufferedEvents: n,
+		})
+	}
+
+	reg := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	reg.reportBufferedEvents = true
+	other := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	for _, r := range []*testRegistration{reg, other} {
+		r.publish(checkpoint)
+		r.publish(val)
+		r.publish(val)
+		r.publish(checkpoint)
+		go r.runOutputLoop(context.Background())
+		require.NoError(t, r.waitForCaughtUp())
+	}
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{withCount(0), val, val, withCount(2)},
+		reg.stream.Events(),
+	)
+	// Registrations that do not request it are unaffected, and the published
+	// event is not modified.
+	require.Equal(t,
+		[]*roachpb.RangeFeedEvent{checkpoint, val, val, checkpoint},
+		other.stream.Events(),
+	)
+	require.Zero(t, checkpoint.Checkpoint.BufferedEvents)
+	for _, r := range []*testRegistration{reg, other} {
+		r.disconnect(nil)
+		<-r.errC
+	}
+}
+
+func TestRegistrationWaitValueLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	r := newTestRegistration(spAB, hlc.Timestamp{}, nil, false /* withDiff */)
+	r.valueLimiter = rate.NewLimiter(rate.Limit(10), 1)
+	r.maxRateLimitDelay = 50 * time.Millisecond
+	val := rangeFeedValue(keyA, roachpb.Value{RawBytes: []byte("val"), Timestamp: hlc.Timestamp{WallTime: 1}})
+	checkpoint := rangeFeedCheckpoint(spAB, hlc.Timestamp{WallTime: 1})
+
+	// The first value fits within the burst.
+	require.NoError(t, r.waitValueLimit(ctx, val))
+	require.True(t, r.rateLimitedSince.IsZero())
+
+	// Checkpoints are never limited.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, r.waitValueLimit(ctx, checkpoint))
+	}
+
+	// The next value would be held back for longer than the maximum delay.
+	err := r.waitValueLimit(ctx, val)
+	require.Equal(t, newErrRateLimitBacklog().GoError(), err)
+
+	// With a larger maximum delay, the value waits for the limiter instead.
+	r.maxRateLimitDelay = time.Minute
+	require.NoError(t, r.waitValueLimit(ctx, val))
+	require.False(t, r.rateLimitedSince.IsZero())
+}
@@ -14,6 +14,7 @@ import (
 	"bytes"
 	"container/heap"
 	"fmt"
+	"sort"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
@@ -79,6 +80,20 @@ type resolvedTimestamp struct {
 	closedTS   hlc.Timestamp
 	resolvedTS hlc.Timestamp
 	intentQ    unresolvedIntentQueue
+	// excludedTxns holds the transactions whose intents do not hold back the
+	// resolved timestamp, along with the number of their intents that are
+	// known to be unresolved. See ExcludeTxn.
+	excludedTxns map[uuid.UUID]int
+
+	// maxIntentQueueSize, if positive, is the maximum number of transactions
+	// tracked in intentQ. See shedOverflow.
+	maxIntentQueueSize int
+	// overflowTS is the lowest timestamp of any transaction that was shed
+	// from intentQ, or empty if none was. The transactions' intents are no
+	// longer tracked, so the resolved timestamp can not advance to it.
+	overflowTS hlc.Timestamp
+	// shedTxns is the number of transactions shed from intentQ.
+	shedTxns int64
 }
 
 func makeResolvedTimestamp() resolvedTimestamp {
@@ -104,6 +119,13 @@ func (rts *resolvedTimestamp) Init() bool {
 	// would drop below zero will all be due to aborted transactions. These
 	// can all be ignored.
 	rts.intentQ.AllowNegRefCount(false)
+	// The same holds for excluded transactions, which can be forgotten once
+	// all of their intents are resolved.
+	for txnID, refCount := range rts.excludedTxns {
+		if refCount <= 0 {
+			delete(rts.excludedTxns, txnID)
+		}
+	}
 	return rts.recompute()
 }
 
@@ -112,6 +134,21 @@ func (rts *resolvedTimestamp) IsInit() bool {
 	return rts.init
 }
 
+// OldestIntentTS returns the timestamp of the oldest unresolved intent that
+// holds back the resolved timestamp, including the intents of transactions
+// that were shed from the intent queue, or the closed timestamp if there is no
+// such intent.
+func (rts *resolvedTimestamp) OldestIntentTS() hlc.Timestamp {
+	ts := rts.overflowTS
+	if txn := rts.intentQ.Oldest(); txn != nil && (ts.IsEmpty() || txn.timestamp.Less(ts)) {
+		ts = txn.timestamp
+	}
+	if ts.IsEmpty() {
+		return rts.closedTS
+	}
+	return ts
+}
+
 // ForwardClosedTS indicates that the closed timestamp that serves as the basis
 // for the resolved timestamp has advanced. The method returns whether this
 // caused the resolved timestamp to move forward.
@@ -123,12 +160,58 @@ func (rts *resolvedTimestamp) ForwardClosedTS(newClosedTS hlc.Timestamp) bool {
 	return false
 }
 
+// ExcludeTxn informs the resolved timestamp that the intents of the provided
+// transaction must not hold it back. The transaction is no longer tracked in
+// the intent queue and operations on its intents do not affect the resolved
+// timestamp from then on. The exclusion is forgotten once the transaction is
+// aborted or, after initialization, once all of its known intents are
+// resolved. The method returns whether this caused the resolved timestamp to
+// move forward.
+func (rts *resolvedTimestamp) ExcludeTxn(txnID uuid.UUID) bool {
+	if rts.excludedTxns == nil {
+		rts.excludedTxns = make(map[uuid.UUID]int)
+	}
+	if _, ok := rts.excludedTxns[txnID]; ok {
+		rts.assertNoChange()
+		return false
+	}
+	var refCount int
+	if txn, ok := rts.intentQ.txns[txnID]; ok {
+		refCount = txn.refCount
+	}
+	rts.excludedTxns[txnID] = refCount
+	if rts.intentQ.Del(txnID) {
+		return rts.recompute()
+	}
+	rts.assertNoChange()
+	return false
+}
+
+// isExcluded returns whether the transaction was excluded using ExcludeTxn.
+func (rts *resolvedTimestamp) isExcluded(txnID uuid.UUID) bool {
+	_, ok := rts.excludedTxns[txnID]
+	return ok
+}
+
+// releaseExcludedIntent records the resolution of one of the intents of an
+// excluded transaction, forgetting the transaction if it was its last.
+func (rts *resolvedTimestamp) releaseExcludedIntent(txnID uuid.UUID) {
+	refCount := rts.excludedTxns[txnID] - 1
+	if refCount <= 0 && rts.IsInit() {
+		delete(rts.excludedTxns, txnID)
+		return
+	}
+	rts.excludedTxns[txnID] = refCount
+}
+
 // ConsumeLogicalOp informs the resolved timestamp of the occupance of a logical
 // operation within its range of tracked keys. This allows the structure to
 // update its internal intent tracking to reflect the change. The method returns
 // whether this caused the resolved timestamp to move forward.
 func (rts *resolvedTimestamp) ConsumeLogicalOp(op enginepb.MVCCLogicalOp) bool {
-	if rts.consumeLogicalOp(op) {
+	changed := rts.consumeLogicalOp(op)
+	rts.shedOverflow()
+	if changed {
 		return rts.recompute()
 	}
 	rts.assertNoChange()
@@ -143,12 +226,25 @@ func (rts *resolvedTimestamp) consumeLogicalOp(op enginepb.MVCCLogicalOp) bool {
 
 	case *enginepb.MVCCWriteIntentOp:
 		rts.assertOpAboveRTS(op, t.Timestamp)
+		if rts.isExcluded(t.TxnID) {
+			rts.excludedTxns[t.TxnID]++
+			return false
+		}
 		return rts.intentQ.IncRef(t.TxnID, t.TxnKey, t.TxnMinTimestamp, t.Timestamp)
 
 	case *enginepb.MVCCUpdateIntentOp:
+		if rts.isExcluded(t.TxnID) {
+			return false
+		}
 		return rts.intentQ.UpdateTS(t.TxnID, t.Timestamp)
 
 	case *enginepb.MVCCCommitIntentOp:
+		if rts.isExcluded(t.TxnID) {
+			// The transaction's intents are no longer tracked in the queue, so
+			// there is no reference to release there.
+			rts.releaseExcludedIntent(t.TxnID)
+			return false
+		}
 		return rts.intentQ.DecrRef(t.TxnID, t.Timestamp)
 
 	case *enginepb.MVCCAbortIntentOp:
@@ -157,6 +253,10 @@ func (rts *resolvedTimestamp) consumeLogicalOp(op enginepb.MVCCLogicalOp) bool {
 		// that was written only in an earlier epoch being resolved after its
 		// transaction committed in a later epoch. Don't make any assumptions
 		// about the transaction other than to decrement its reference count.
+		if rts.isExcluded(t.TxnID) {
+			rts.releaseExcludedIntent(t.TxnID)
+			return false
+		}
 		return rts.intentQ.DecrRef(t.TxnID, hlc.Timestamp{})
 
 	case *enginepb.MVCCAbortTxnOp:
@@ -202,13 +302,58 @@ func (rts *resolvedTimestamp) consumeLogicalOp(op enginepb.MVCCLogicalOp) bool {
 			// easier and more clear.
 			return false
 		}
+		// An aborted transaction that was excluded will not commit any
+		// values, so its exclusion can be forgotten.
+		delete(rts.excludedTxns, t.TxnID)
 		return rts.intentQ.Del(t.TxnID)
 
+	case *enginepb.MVCCSplitOp:
+		// A split does not affect the resolved timestamp.
+		return false
+
+	case *enginepb.MVCCDeleteRangeOp:
+		rts.assertOpAboveRTS(op, t.Timestamp)
+		return false
+
+	case *enginepb.MVCCIngestSSTableOp:
+		rts.assertOpAboveRTS(op, t.Timestamp)
+		return false
+
 	default:
 		panic(fmt.Sprintf("unknown logical op %T", t))
 	}
 }
 
+// shedOverflow stops tracking the oldest transactions in the intent queue
+// while it holds more than maxIntentQueueSize transactions, so that a range
+// with an enormous number of concurrent transactions does not grow it without
+// bound.
+//
+// A shed transaction may still have unresolved intents, and its operations
+// can no longer be accounted for, so the resolved timestamp is held below the
+// timestamp of the oldest shed transaction for the remainder of the resolved
+// timestamp's lifetime. This is safe because the timestamps of the intents
+// of a transaction only ever move forward. Shedding the oldest transaction
+// does not move the resolved timestamp, since it was already held below that
+// transaction's timestamp by the queue. Since the resolved timestamp can't
+// recover from this, the Processor stops once any transaction is shed.
+func (rts *resolvedTimestamp) shedOverflow() {
+	if rts.maxIntentQueueSize <= 0 {
+		return
+	}
+	for rts.intentQ.Len() > rts.maxIntentQueueSize {
+		txn := rts.intentQ.Oldest()
+		// Transactions with a non-positive reference count, which are only
+		// tracked before initialization, do not have any unresolved intents
+		// that the queue knows about.
+		if txn.refCount > 0 && (rts.overflowTS.IsEmpty() || txn.timestamp.Less(rts.overflowTS)) {
+			rts.overflowTS = txn.timestamp
+		}
+		rts.intentQ.Del(txn.txnID)
+		rts.shedTxns++
+	}
+}
+
 // recompute computes the resolved timestamp based on its respective closed
 // timestamp and the in-flight intents that it is tracking. The method returns
 // whether this caused the resolved timestamp to move forward.
@@ -223,6 +368,11 @@ func (rts *resolvedTimestamp) recompute() bool {
 			newTS = txnTS
 		}
 	}
+	if !rts.overflowTS.IsEmpty() {
+		if overflowTS := rts.overflowTS.FloorPrev(); overflowTS.Less(newTS) {
+			newTS = overflowTS
+		}
+	}
 	if newTS.Less(rts.resolvedTS) {
 		panic(fmt.Sprintf("resolved timestamp regression, was %s, recomputed as %s",
 			rts.resolvedTS, newTS))
@@ -355,6 +505,11 @@ type unresolvedIntentQueue struct {
 	txns             map[uuid.UUID]*unresolvedTxn
 	minHeap          unresolvedTxnHeap
 	allowNegRefCount bool
+
+	// Optional hooks notified when transactions are added to and removed from
+	// the queue. See Config.OnIntentQueueTxnAdded/Removed.
+	onTxnAdded   func(txnID uuid.UUID, ts hlc.Timestamp)
+	onTxnRemoved func(txnID uuid.UUID, ts hlc.Timestamp)
 }
 
 func makeUnresolvedIntentQueue() unresolvedIntentQueue {
@@ -380,6 +535,32 @@ func (uiq *unresolvedIntentQueue) Oldest() *unresolvedTxn {
 	return uiq.minHeap[0]
 }
 
+// IntentInfo describes a transaction with unresolved intents that holds back a
+// processor's resolved timestamp. It is intended for debugging only.
+type IntentInfo struct {
+	// TxnID is the ID of the transaction.
+	TxnID uuid.UUID
+	// Timestamp is the timestamp of the transaction's unresolved intents.
+	Timestamp hlc.Timestamp
+}
+
+// Snapshot returns a description of each transaction being tracked, ordered
+// by timestamp. Ties are broken by ID, as in Oldest. Returns an empty, non-nil
+// slice if the queue is empty.
+func (uiq *unresolvedIntentQueue) Snapshot() []IntentInfo {
+	infos := make([]IntentInfo, 0, uiq.Len())
+	for _, txn := range uiq.minHeap {
+		infos = append(infos, IntentInfo{TxnID: txn.txnID, Timestamp: txn.timestamp})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Timestamp == infos[j].Timestamp {
+			return bytes.Compare(infos[i].TxnID.GetBytes(), infos[j].TxnID.GetBytes()) < 0
+		}
+		return infos[i].Timestamp.Less(infos[j].Timestamp)
+	})
+	return infos
+}
+
 // Before returns all transactions that have timestamps before a certain
 // timestamp. It does so in O(n) time, where n is the number of matching
 // transactions, NOT the total number of transactions being tracked. The
@@ -441,6 +622,9 @@ func (uiq *unresolvedIntentQueue) updateTxn(
 		}
 		uiq.txns[txn.txnID] = txn
 		heap.Push(&uiq.minHeap, txn)
+		if uiq.onTxnAdded != nil {
+			uiq.onTxnAdded(txn.txnID, txn.timestamp)
+		}
 
 		// Adding a new txn can't advance the queue's earliest timestamp.
 		return false
@@ -455,8 +639,7 @@ func (uiq *unresolvedIntentQueue) updateTxn(
 		// NB: the txn.refCount < 0 case is not exercised by the external
 		// interface of this type because currently |delta| <= 1, but it
 		// is included for robustness.
-		delete(uiq.txns, txn.txnID)
-		heap.Remove(&uiq.minHeap, txn.index)
+		uiq.remove(txn)
 		return wasMin
 	}
 
@@ -485,9 +668,16 @@ func (uiq *unresolvedIntentQueue) Del(txnID uuid.UUID) bool {
 	wasMin := txn.index == 0
 
 	// Remove txn from the queue.
+	uiq.remove(txn)
+	return wasMin
+}
+
+func (uiq *unresolvedIntentQueue) remove(txn *unresolvedTxn) {
 	delete(uiq.txns, txn.txnID)
 	heap.Remove(&uiq.minHeap, txn.index)
-	return wasMin
+	if uiq.onTxnRemoved != nil {
+		uiq.onTxnRemoved(txn.txnID, txn.timestamp)
+	}
 }
 
 // AllowNegRefCount instruts the unresolvedIntentQueue on whether or not to
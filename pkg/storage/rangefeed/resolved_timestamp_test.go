@@ -173,6 +173,40 @@ func TestUnresolvedIntentQueue(t *testing.T) {
 	require.Equal(t, 0, uiq.Len())
 }
 
+func TestUnresolvedIntentQueueHooks(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	type change struct {
+		added bool
+		txnID uuid.UUID
+		ts    hlc.Timestamp
+	}
+	var changes []change
+	uiq := makeUnresolvedIntentQueue()
+	uiq.onTxnAdded = func(txnID uuid.UUID, ts hlc.Timestamp) {
+		changes = append(changes, change{true, txnID, ts})
+	}
+	uiq.onTxnRemoved = func(txnID uuid.UUID, ts hlc.Timestamp) {
+		changes = append(changes, change{false, txnID, ts})
+	}
+	uiq.AllowNegRefCount(false)
+
+	txn1, txn2 := uuid.MakeV4(), uuid.MakeV4()
+	uiq.IncRef(txn1, nil, hlc.Timestamp{WallTime: 1}, hlc.Timestamp{WallTime: 1})
+	uiq.IncRef(txn1, nil, hlc.Timestamp{WallTime: 1}, hlc.Timestamp{WallTime: 1})
+	uiq.IncRef(txn2, nil, hlc.Timestamp{WallTime: 2}, hlc.Timestamp{WallTime: 2})
+	uiq.UpdateTS(txn1, hlc.Timestamp{WallTime: 3})
+	uiq.DecrRef(txn1, hlc.Timestamp{WallTime: 4})
+	uiq.DecrRef(txn1, hlc.Timestamp{WallTime: 5})
+	uiq.Del(txn2)
+	uiq.Del(txn2)
+	require.Equal(t, []change{
+		{true, txn1, hlc.Timestamp{WallTime: 1}},
+		{true, txn2, hlc.Timestamp{WallTime: 2}},
+		{false, txn1, hlc.Timestamp{WallTime: 4}},
+		{false, txn2, hlc.Timestamp{WallTime: 2}},
+	}, changes)
+}
+
 func TestResolvedTimestamp(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	rts := makeResolvedTimestamp()
@@ -563,3 +597,163 @@ func TestResolvedTimestampTxnAborted(t *testing.T) {
 	require.True(t, fwd)
 	require.Equal(t, hlc.Timestamp{WallTime: 25}, rts.Get())
 }
+
+func TestResolvedTimestampTxnExcluded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	rts := makeResolvedTimestamp()
+	rts.Init()
+
+	// Set a closed timestamp. Resolved timestamp advances.
+	fwd := rts.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	require.True(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 5}, rts.Get())
+
+	// Add intents for two new transactions.
+	txn1, txn2 := uuid.MakeV4(), uuid.MakeV4()
+	fwd = rts.ConsumeLogicalOp(writeIntentOp(txn1, hlc.Timestamp{WallTime: 10}))
+	require.False(t, fwd)
+	fwd = rts.ConsumeLogicalOp(writeIntentOp(txn2, hlc.Timestamp{WallTime: 12}))
+	require.False(t, fwd)
+
+	// Set a new closed timestamp. Resolved timestamp advances up to txn1.
+	fwd = rts.ForwardClosedTS(hlc.Timestamp{WallTime: 20})
+	require.True(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 9}, rts.Get())
+
+	// Exclude txn1. Resolved timestamp advances up to txn2.
+	fwd = rts.ExcludeTxn(txn1)
+	require.True(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 11}, rts.Get())
+	require.Equal(t, 1, rts.intentQ.Len())
+
+	// Further intents of txn1 are ignored.
+	fwd = rts.ConsumeLogicalOp(writeIntentOp(txn1, hlc.Timestamp{WallTime: 21}))
+	require.False(t, fwd)
+	fwd = rts.ConsumeLogicalOp(updateIntentOp(txn1, hlc.Timestamp{WallTime: 22}))
+	require.False(t, fwd)
+	require.Equal(t, 1, rts.intentQ.Len())
+
+	// Committing txn1's intent does not affect the resolved timestamp.
+	fwd = rts.ConsumeLogicalOp(commitIntentOp(txn1, hlc.Timestamp{WallTime: 10}))
+	require.False(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 11}, rts.Get())
+
+	// Exclude txn2, which is the last transaction holding back the resolved
+	// timestamp. Resolved timestamp advances to the closed timestamp.
+	fwd = rts.ExcludeTxn(txn2)
+	require.True(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 20}, rts.Get())
+	require.Equal(t, 0, rts.intentQ.Len())
+
+	// Excluding an untracked transaction does not affect the resolved
+	// timestamp.
+	fwd = rts.ExcludeTxn(uuid.MakeV4())
+	require.False(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 20}, rts.Get())
+
+	// txn1 is forgotten once its last intent is resolved. Intents that it
+	// writes afterwards hold back the resolved timestamp again.
+	require.True(t, rts.isExcluded(txn1))
+	fwd = rts.ConsumeLogicalOp(commitIntentOp(txn1, hlc.Timestamp{WallTime: 22}))
+	require.False(t, fwd)
+	require.False(t, rts.isExcluded(txn1))
+	fwd = rts.ConsumeLogicalOp(writeIntentOp(txn1, hlc.Timestamp{WallTime: 25}))
+	require.False(t, fwd)
+	require.Equal(t, 1, rts.intentQ.Len())
+
+	// txn2 is forgotten once it is aborted, even though its intent has not
+	// been resolved.
+	require.True(t, rts.isExcluded(txn2))
+	fwd = rts.ConsumeLogicalOp(abortTxnOp(txn2))
+	require.False(t, fwd)
+	require.False(t, rts.isExcluded(txn2))
+}
+
+func TestResolvedTimestampTxnExcludedBeforeInit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	rts := makeResolvedTimestamp()
+
+	// Before initialization, the intent of an excluded transaction may be
+	// resolved before it is observed, so the transaction is not forgotten.
+	txn1 := uuid.MakeV4()
+	rts.ExcludeTxn(txn1)
+	rts.ConsumeLogicalOp(commitIntentOp(txn1, hlc.Timestamp{WallTime: 10}))
+	require.True(t, rts.isExcluded(txn1))
+	rts.ConsumeLogicalOp(writeIntentOp(txn1, hlc.Timestamp{WallTime: 10}))
+	require.True(t, rts.isExcluded(txn1))
+	require.Equal(t, 0, rts.intentQ.Len())
+
+	// Once initialized, transactions without unresolved intents are
+	// forgotten.
+	txn2 := uuid.MakeV4()
+	rts.ConsumeLogicalOp(writeIntentOp(txn2, hlc.Timestamp{WallTime: 12}))
+	rts.ExcludeTxn(txn2)
+	rts.Init()
+	require.False(t, rts.isExcluded(txn1))
+	require.True(t, rts.isExcluded(txn2))
+	require.Equal(t, 0, rts.intentQ.Len())
+}
+
+func TestResolvedTimestampIntentQueueOverflow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	rts := makeResolvedTimestamp()
+	rts.maxIntentQueueSize = 2
+	rts.Init()
+
+	// Set a closed timestamp. Resolved timestamp advances.
+	fwd := rts.ForwardClosedTS(hlc.Timestamp{WallTime: 5})
+	require.True(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 5}, rts.Get())
+
+	// Fill the queue.
+	txn1, txn2, txn3 := uuid.MakeV4(), uuid.MakeV4(), uuid.MakeV4()
+	fwd = rts.ConsumeLogicalOp(writeIntentOp(txn1, hlc.Timestamp{WallTime: 10}))
+	require.False(t, fwd)
+	fwd = rts.ConsumeLogicalOp(writeIntentOp(txn2, hlc.Timestamp{WallTime: 12}))
+	require.False(t, fwd)
+	require.Equal(t, 2, rts.intentQ.Len())
+	require.Zero(t, rts.shedTxns)
+
+	// Add an intent for a third, older transaction. The oldest transaction is
+	// shed from the queue, without moving the resolved timestamp.
+	fwd = rts.ConsumeLogicalOp(writeIntentOp(txn3, hlc.Timestamp{WallTime: 8}))
+	require.False(t, fwd)
+	require.Equal(t, 2, rts.intentQ.Len())
+	require.Equal(t, int64(1), rts.shedTxns)
+	require.Equal(t, hlc.Timestamp{WallTime: 8}, rts.overflowTS)
+	require.Equal(t, hlc.Timestamp{WallTime: 8}, rts.OldestIntentTS())
+	require.Equal(t, hlc.Timestamp{WallTime: 5}, rts.Get())
+
+	// Set a new closed timestamp. Resolved timestamp advances, but only up to
+	// the shed transaction.
+	fwd = rts.ForwardClosedTS(hlc.Timestamp{WallTime: 20})
+	require.True(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 7}, rts.Get())
+
+	// Resolve the intents of all transactions. Resolved timestamp does not
+	// advance, because the shed transaction's intents are no longer tracked.
+	fwd = rts.ConsumeLogicalOp(commitIntentOp(txn1, hlc.Timestamp{WallTime: 10}))
+	require.False(t, fwd)
+	fwd = rts.ConsumeLogicalOp(commitIntentOp(txn2, hlc.Timestamp{WallTime: 12}))
+	require.False(t, fwd)
+	fwd = rts.ConsumeLogicalOp(commitIntentOp(txn3, hlc.Timestamp{WallTime: 8}))
+	require.False(t, fwd)
+	require.Zero(t, rts.intentQ.Len())
+	fwd = rts.ForwardClosedTS(hlc.Timestamp{WallTime: 30})
+	require.False(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 7}, rts.Get())
+
+	// Overflow the queue again with newer transactions. The oldest one is
+	// shed, and the resolved timestamp remains held below the first shed
+	// transaction.
+	for i := int64(0); i < 3; i++ {
+		fwd = rts.ConsumeLogicalOp(writeIntentOp(uuid.MakeV4(), hlc.Timestamp{WallTime: 35 + i}))
+		require.False(t, fwd)
+	}
+	require.Equal(t, 2, rts.intentQ.Len())
+	require.Equal(t, int64(2), rts.shedTxns)
+	require.Equal(t, hlc.Timestamp{WallTime: 8}, rts.overflowTS)
+	fwd = rts.ForwardClosedTS(hlc.Timestamp{WallTime: 40})
+	require.False(t, fwd)
+	require.Equal(t, hlc.Timestamp{WallTime: 7}, rts.Get())
+}
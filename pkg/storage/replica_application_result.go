@@ -291,6 +291,12 @@ func (r *Replica) handleGCThresholdResult(ctx context.Context, thresh *hlc.Times
 	r.mu.Lock()
 	r.mu.state.GCThreshold = thresh
 	r.mu.Unlock()
+
+	// Disconnect the rangefeed registrations that can no longer be resumed.
+	if p := r.getRangefeedProcessor(); p != nil && !p.ForwardGCThreshold(*thresh) {
+		// Consumption failed and the rangefeed was stopped.
+		r.unsetRangefeedProcessor(p)
+	}
 }
 
 func (r *Replica) handleUsingAppliedStateKeyResult(ctx context.Context) {
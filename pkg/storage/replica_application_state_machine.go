@@ -600,6 +600,9 @@ func (b *replicaAppBatch) runPreApplyTriggersAfterStagingWriteBatch(
 		if added := res.Delta.KeyCount; added > 0 {
 			b.r.writeStats.recordCount(float64(added), 0)
 		}
+		if ops := cmd.raftCmd.LogicalOpLog; ops != nil {
+			populateSSTableInLogicalOpLog(ops, res.AddSSTable.Data)
+		}
 		res.AddSSTable = nil
 	}
 
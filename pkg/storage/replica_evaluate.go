@@ -20,9 +20,10 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/storage/spanset"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
+	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
-	"github.com/cockroachdb/errors"
 	"github.com/kr/pretty"
 )
 
@@ -134,7 +135,10 @@ func optimizePuts(
 
 // evaluateBatch evaluates a batch request by splitting it up into its
 // individual commands, passing them to evaluateCommand, and combining
-// the results.
+// the results. If the batch fails, the compensations of the commands that
+// evaluated successfully are run before returning. Otherwise, they are
+// returned to the caller, which must run them if the batch's Result is never
+// applied.
 func evaluateBatch(
 	ctx context.Context,
 	idKey storagebase.CmdIDKey,
@@ -143,7 +147,7 @@ func evaluateBatch(
 	ms *enginepb.MVCCStats,
 	ba *roachpb.BatchRequest,
 	readOnly bool,
-) (*roachpb.BatchResponse, result.Result, *roachpb.Error) {
+) (*roachpb.BatchResponse, result.Result, batcheval.Compensations, *roachpb.Error) {
 	// NB: Don't mutate BatchRequest directly.
 	baReqs := ba.Requests
 	baHeader := ba.Header
@@ -185,7 +189,7 @@ func evaluateBatch(
 			// we rationalize the TODO in txnHeartbeater.heartbeat.
 			if !ba.IsSingleAbortTxnRequest() && !ba.IsSingleHeartbeatTxnRequest() {
 				if pErr := checkIfTxnAborted(ctx, rec, readWriter, *baHeader.Txn); pErr != nil {
-					return nil, result.Result{}, pErr
+					return nil, result.Result{}, batcheval.Compensations{}, pErr
 				}
 			}
 		}
@@ -241,6 +245,10 @@ func evaluateBatch(
 		cantDeferWTOE bool
 	}
 
+	// compensations undo the side effects of the commands that evaluated
+	// successfully if the batch fails.
+	var compensations batcheval.Compensations
+
 	for index, union := range baReqs {
 		// Execute the command.
 		args := union.GetInner()
@@ -257,10 +265,12 @@ func evaluateBatch(
 		// TODO(tschottdorf): Change that. IIRC there is nontrivial use of it currently.
 		reply := br.Responses[index].GetInner()
 
-		var curResult result.Result
-		var pErr *roachpb.Error
-		curResult, pErr = evaluateCommand(
+		cmd, curResult, pErr := evaluateCommand(
 			ctx, idKey, index, readWriter, rec, ms, baHeader, maxKeys, args, reply)
+		cArgs := batcheval.CommandArgs{EvalCtx: rec, Header: baHeader, Args: args}
+		if pErr == nil {
+			compensations.Add(cmd, cArgs, curResult)
+		}
 
 		// If an EndTxn wants to restart because of a write too old, we
 		// might have a better error to return to the client.
@@ -273,14 +283,23 @@ func evaluateBatch(
 			writeTooOldState.cantDeferWTOE = true
 		}
 
-		if err := mergedResult.MergeAndDestroy(curResult); err != nil {
-			// TODO(tschottdorf): see whether we really need to pass nontrivial
-			// Result up on error and if so, formalize that.
-			log.Fatalf(
-				ctx,
-				"unable to absorb Result: %s\ndiff(new, old): %s",
-				err, pretty.Diff(curResult, mergedResult),
-			)
+		if err := mergedResult.MergeChecked(curResult); err != nil {
+			if _, ok := err.(*result.MergeConflictError); ok {
+				// The merged Result was left unmodified, so the batch can fail
+				// without side effects. This can only happen if the commands in
+				// the batch are buggy.
+				if pErr == nil {
+					pErr = roachpb.NewErrorf("unable to absorb Result of %s: %s", args.Method(), err)
+				}
+			} else {
+				// TODO(tschottdorf): see whether we really need to pass nontrivial
+				// Result up on error and if so, formalize that.
+				log.Fatalf(
+					ctx,
+					"unable to absorb Result: %s\ndiff(new, old): %s",
+					err, pretty.Diff(curResult, mergedResult),
+				)
+			}
 		}
 
 		if pErr != nil {
@@ -315,8 +334,12 @@ func evaluateBatch(
 				// pushed timestamp at commit time and refresh or retry the
 				// transaction.
 				pErr = nil
+				// The command's side effects stand now that its error is
+				// deferred, so they must be undone if the batch fails.
+				compensations.Add(cmd, cArgs, curResult)
 			default:
-				return nil, mergedResult, pErr
+				compensations.Run(ctx)
+				return nil, mergedResult, batcheval.Compensations{}, pErr
 			}
 		}
 
@@ -351,7 +374,8 @@ func evaluateBatch(
 	// If there's a write too old error that we don't want to defer, return.
 	if writeTooOldState.err != nil &&
 		(!baHeader.DeferWriteTooOldError || writeTooOldState.cantDeferWTOE) {
-		return nil, mergedResult, roachpb.NewErrorWithTxn(writeTooOldState.err, baHeader.Txn)
+		compensations.Run(ctx)
+		return nil, mergedResult, batcheval.Compensations{}, roachpb.NewErrorWithTxn(writeTooOldState.err, baHeader.Txn)
 	}
 
 	if baHeader.Txn != nil {
@@ -368,13 +392,14 @@ func evaluateBatch(
 		br.Timestamp.Forward(baHeader.Timestamp)
 	}
 
-	return br, mergedResult, nil
+	return br, mergedResult, compensations, nil
 }
 
 // evaluateCommand delegates to the eval method for the given
-// roachpb.Request. The returned Result may be partially valid
-// even if an error is returned. maxKeys is the number of scan results
-// remaining for this batch (MaxInt64 for no limit).
+// roachpb.Request and returns the Command it was evaluated with, which is
+// zero if the request was not evaluated. The returned Result may be
+// partially valid even if an error is returned. maxKeys is the number of
+// scan results remaining for this batch (MaxInt64 for no limit).
 func evaluateCommand(
 	ctx context.Context,
 	raftCmdID storagebase.CmdIDKey,
@@ -386,7 +411,7 @@ func evaluateCommand(
 	maxKeys int64,
 	args roachpb.Request,
 	reply roachpb.Response,
-) (result.Result, *roachpb.Error) {
+) (batcheval.Command, result.Result, *roachpb.Error) {
 	// If a unittest filter was installed, check for an injected error; otherwise, continue.
 	if filter := rec.EvalKnobs().TestingEvalFilter; filter != nil {
 		filterArgs := storagebase.FilterArgs{
@@ -402,7 +427,7 @@ func evaluateCommand(
 				pErr.SetTxn(h.Txn)
 			}
 			log.Infof(ctx, "test injecting error: %s", pErr)
-			return result.Result{}, pErr
+			return batcheval.Command{}, result.Result{}, pErr
 		}
 	}
 
@@ -410,20 +435,54 @@ func evaluateCommand(
 	var pd result.Result
 
 	cArgs := batcheval.CommandArgs{
-		EvalCtx: rec,
-		Header:  h,
-		Args:    args,
-		MaxKeys: maxKeys,
-		Stats:   ms,
+		EvalCtx:  rec,
+		Header:   h,
+		Args:     args,
+		MaxKeys:  maxKeys,
+		Stats:    ms,
+		Progress: batcheval.TraceProgress,
 	}
-	if cmd, ok := batcheval.LookupCommand(args.Method()); ok {
-		if cmd.EvalRW != nil {
-			pd, err = cmd.EvalRW(ctx, readWriter, cArgs, reply)
-		} else {
-			pd, err = cmd.EvalRO(ctx, readWriter, cArgs, reply)
-		}
+	cmd, ok := batcheval.LookupCommand(args.Method())
+	if !ok {
+		err = &batcheval.UnsupportedMethodError{Method: args.Method()}
+	} else if desc := rec.Desc(); !cmd.AppliesToRange(desc) {
+		err = batcheval.NewInapplicableCommandError(args.Method(), desc)
 	} else {
-		err = errors.AssertionFailedf("unrecognized command %s", args.Method())
+		// If span enforcement is enabled for the command, evaluate it against a
+		// ReadWriter that panics on access to any key it did not declare. In
+		// both this and the latch span report below, batches stay batches,
+		// since commands such as EndTxn rely on the engine.Batch interface.
+		if util.RaceEnabled && cmd.EnforceDeclaredSpans {
+			declared := spanset.MakeAssertingSpanSet()
+			cmd.DeclareKeys(desc, h, args, &declared)
+			if batch, ok := readWriter.(engine.Batch); ok {
+				readWriter = spanset.NewAssertingBatch(batch, &declared)
+			} else {
+				readWriter = spanset.NewAssertingReadWriter(readWriter, &declared)
+			}
+		}
+		// If the latch span report is enabled, evaluate the command against a
+		// ReadWriter that records the spans it accesses so that they can be
+		// compared with the spans it declares.
+		var accessed spanset.SpanSet
+		report := batcheval.GlobalLatchSpanReport()
+		if report != nil {
+			accessed = spanset.MakeRecordingSpanSet()
+			if batch, ok := readWriter.(engine.Batch); ok {
+				readWriter = spanset.NewRecordingBatch(batch, &accessed)
+			} else {
+				readWriter = spanset.NewRecordingReadWriter(readWriter, &accessed)
+			}
+		}
+		pd, err = cmd.Eval(ctx, readWriter, cArgs, reply)
+		if err == nil {
+			err = cmd.CheckResponseSize(args.Method(), reply)
+		}
+		if report != nil && err == nil {
+			var declared spanset.SpanSet
+			cmd.DeclareKeys(desc, h, args, &declared)
+			report.Record(args.Method(), &declared, &accessed)
+		}
 	}
 
 	if h.ReturnRangeInfo {
@@ -454,7 +513,7 @@ func evaluateCommand(
 		pErr = roachpb.NewErrorWithTxn(err, txn)
 	}
 
-	return pd, pErr
+	return cmd, pd, pErr
 }
 
 // returnRangeInfo populates RangeInfos in the response if the batch
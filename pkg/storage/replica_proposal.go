@@ -108,6 +108,11 @@ type ProposalData struct {
 	// done here).
 	Local *result.LocalResult
 
+	// compensations undo the side effects of the evaluation of the proposal's
+	// commands. They are run if the proposal fails without being applied. See
+	// batcheval.Command.Compensate.
+	compensations batcheval.Compensations
+
 	// Request is the client's original BatchRequest.
 	// TODO(tschottdorf): tests which use TestingCommandFilter use this.
 	// Decide how that will work in the future, presumably the
@@ -134,6 +139,7 @@ type ProposalData struct {
 // returned to the client.
 func (proposal *ProposalData) finishApplication(ctx context.Context, pr proposalResult) {
 	proposal.ec.done(ctx, proposal.Request, pr.Reply, pr.Err)
+	proposal.finishCompensations(ctx, pr.Err)
 	proposal.signalProposalResult(pr)
 	if proposal.sp != nil {
 		tracing.FinishSpan(proposal.sp)
@@ -141,6 +147,19 @@ func (proposal *ProposalData) finishApplication(ctx context.Context, pr proposal
 	}
 }
 
+// finishCompensations runs the proposal's compensations if it failed with pErr
+// and discards them otherwise. Compensations are not run for ambiguous
+// failures, since the proposal may have applied. The method is safe to call
+// more than once.
+func (proposal *ProposalData) finishCompensations(ctx context.Context, pErr *roachpb.Error) {
+	if pErr != nil {
+		if _, ok := pErr.GetDetail().(*roachpb.AmbiguousResultError); !ok {
+			proposal.compensations.Run(ctx)
+		}
+	}
+	proposal.compensations = batcheval.Compensations{}
+}
+
 // returnProposalResult signals proposal.doneCh with the proposal result if it
 // has not already been signaled. The method can be called even before the
 // proposal has finished replication and command application, and does not
@@ -690,12 +709,15 @@ type proposalResult struct {
 // case, the result can be sent directly back to the client without
 // going through Raft, but while still handling LocalEvalResult.
 //
+// The compensations of the evaluated commands are returned as well, to be
+// run if the proposal fails without being applied.
+//
 // Replica.mu must not be held.
 func (r *Replica) evaluateProposal(
 	ctx context.Context, idKey storagebase.CmdIDKey, ba *roachpb.BatchRequest, spans *spanset.SpanSet,
-) (*result.Result, bool, *roachpb.Error) {
+) (*result.Result, batcheval.Compensations, bool, *roachpb.Error) {
 	if ba.Timestamp == (hlc.Timestamp{}) {
-		return nil, false, roachpb.NewErrorf("can't propose Raft command with zero timestamp")
+		return nil, batcheval.Compensations{}, false, roachpb.NewErrorf("can't propose Raft command with zero timestamp")
 	}
 
 	// Evaluate the commands. If this returns without an error, the batch should
@@ -703,7 +725,7 @@ func (r *Replica) evaluateProposal(
 	// important since evaluating a proposal is expensive.
 	// TODO(tschottdorf): absorb all returned values in `res` below this point
 	// in the call stack as well.
-	batch, ms, br, res, pErr := r.evaluateWriteBatch(ctx, idKey, ba, spans)
+	batch, ms, br, res, compensations, pErr := r.evaluateWriteBatch(ctx, idKey, ba, spans)
 
 	// Note: reusing the proposer's batch when applying the command on the
 	// proposer was explored as an optimization but resulted in no performance
@@ -728,7 +750,7 @@ func (r *Replica) evaluateProposal(
 			Metrics:            res.Local.Metrics,
 		}
 		res.Replicated.Reset()
-		return &res, false /* needConsensus */, pErr
+		return &res, compensations, false /* needConsensus */, pErr
 	}
 
 	// Set the local reply, which is held only on the proposing replica and is
@@ -807,7 +829,7 @@ func (r *Replica) evaluateProposal(
 		}
 	}
 
-	return &res, needConsensus, nil
+	return &res, compensations, needConsensus, nil
 }
 
 // requestToProposal converts a BatchRequest into a ProposalData, by
@@ -817,15 +839,16 @@ func (r *Replica) evaluateProposal(
 func (r *Replica) requestToProposal(
 	ctx context.Context, idKey storagebase.CmdIDKey, ba *roachpb.BatchRequest, spans *spanset.SpanSet,
 ) (*ProposalData, *roachpb.Error) {
-	res, needConsensus, pErr := r.evaluateProposal(ctx, idKey, ba, spans)
+	res, compensations, needConsensus, pErr := r.evaluateProposal(ctx, idKey, ba, spans)
 
 	// Fill out the results even if pErr != nil; we'll return the error below.
 	proposal := &ProposalData{
-		ctx:     ctx,
-		idKey:   idKey,
-		doneCh:  make(chan proposalResult, 1),
-		Local:   &res.Local,
-		Request: ba,
+		ctx:           ctx,
+		idKey:         idKey,
+		doneCh:        make(chan proposalResult, 1),
+		Local:         &res.Local,
+		compensations: compensations,
+		Request:       ba,
 	}
 
 	if needConsensus {
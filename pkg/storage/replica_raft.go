@@ -81,6 +81,7 @@ func (r *Replica) evalAndPropose(
 	defer func() {
 		if pErr != nil {
 			proposal.ec.done(ctx, ba, nil /* br */, pErr)
+			proposal.finishCompensations(ctx, pErr)
 		}
 	}()
 
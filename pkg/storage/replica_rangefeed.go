@@ -312,7 +312,7 @@ func (r *Replica) registerWithRangefeedRaftMuLocked(
 	r.rangefeedMu.Lock()
 	p := r.rangefeedMu.proc
 	if p != nil {
-		reg, filter := p.Register(span, startTS, catchupIter, withDiff, stream, errC)
+		reg, filter := p.Register(ctx, span, startTS, catchupIter, withDiff, stream, errC)
 		if reg {
 			// Registered successfully with an existing processor.
 			// Update the rangefeed filter to avoid filtering ops
@@ -341,6 +341,7 @@ func (r *Replica) registerWithRangefeedRaftMuLocked(
 		PushTxnsAge:      r.store.TestingKnobs().RangeFeedPushTxnsAge,
 		EventChanCap:     defaultEventChanCap,
 		EventChanTimeout: 50 * time.Millisecond,
+		GCThreshold:      r.GetGCThreshold,
 		Metrics:          r.store.metrics.RangeFeedMetrics,
 	}
 	p = rangefeed.NewProcessor(cfg)
@@ -363,7 +364,7 @@ func (r *Replica) registerWithRangefeedRaftMuLocked(
 	// any other goroutines are able to stop the processor. In other words,
 	// this ensures that the only time the registration fails is during
 	// server shutdown.
-	reg, filter := p.Register(span, startTS, catchupIter, withDiff, stream, errC)
+	reg, filter := p.Register(ctx, span, startTS, catchupIter, withDiff, stream, errC)
 	if !reg {
 		catchupIter.Close() // clean up
 		select {
@@ -397,11 +398,17 @@ func (r *Replica) maybeDisconnectEmptyRangefeed(p *rangefeed.Processor) {
 		// The processor has already been removed or replaced.
 		return
 	}
-	if p.Len() == 0 || !r.updateRangefeedFilterLocked() {
-		// Stop the rangefeed processor if it has no registrations or if we are
-		// unable to update the operation filter.
+	if p.Len() == 0 {
+		// Stop the rangefeed processor if it has no registrations.
 		p.Stop()
 		r.unsetRangefeedProcessorLocked(p)
+	} else if !r.updateRangefeedFilterLocked() {
+		// Stop the rangefeed processor if we are unable to update the
+		// operation filter. Any registrations that remain must re-register.
+		p.StopWithErr(roachpb.NewError(
+			roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_PROCESSOR_STOPPED),
+		))
+		r.unsetRangefeedProcessorLocked(p)
 	}
 }
 
@@ -459,7 +466,10 @@ func (r *Replica) populatePrevValsInLogicalOpLogRaftMuLocked(
 		case *enginepb.MVCCWriteIntentOp,
 			*enginepb.MVCCUpdateIntentOp,
 			*enginepb.MVCCAbortIntentOp,
-			*enginepb.MVCCAbortTxnOp:
+			*enginepb.MVCCAbortTxnOp,
+			*enginepb.MVCCSplitOp,
+			*enginepb.MVCCDeleteRangeOp,
+			*enginepb.MVCCIngestSSTableOp:
 			// Nothing to do.
 			continue
 		default:
@@ -491,6 +501,18 @@ func (r *Replica) populatePrevValsInLogicalOpLogRaftMuLocked(
 	}
 }
 
+// populateSSTableInLogicalOpLog attaches the provided SSTable data to any
+// MVCCIngestSSTableOp in the logical op log that was proposed without it. The
+// data of SSTables ingested as a side effect of a Raft command is omitted from
+// the logical op log during evaluation to avoid duplicating it in the command.
+func populateSSTableInLogicalOpLog(ops *storagepb.LogicalOpLog, data []byte) {
+	for _, op := range ops.Ops {
+		if t, ok := op.GetValue().(*enginepb.MVCCIngestSSTableOp); ok && t.Data == nil {
+			t.Data = data
+		}
+	}
+}
+
 // handleLogicalOpLogRaftMuLocked passes the logical op log to the active
 // rangefeed, if one is running. The method accepts a reader, which is used to
 // look up the values associated with key-value writes in the log before handing
@@ -533,7 +555,10 @@ func (r *Replica) handleLogicalOpLogRaftMuLocked(
 		case *enginepb.MVCCWriteIntentOp,
 			*enginepb.MVCCUpdateIntentOp,
 			*enginepb.MVCCAbortIntentOp,
-			*enginepb.MVCCAbortTxnOp:
+			*enginepb.MVCCAbortTxnOp,
+			*enginepb.MVCCSplitOp,
+			*enginepb.MVCCDeleteRangeOp,
+			*enginepb.MVCCIngestSSTableOp:
 			// Nothing to do.
 			continue
 		default:
@@ -575,6 +600,24 @@ func (r *Replica) handleLogicalOpLogRaftMuLocked(
 	}
 }
 
+// handleSplitRangefeedRaftMuLocked informs the active rangefeed, if one is
+// running, that the range is being split at the provided key, so that the
+// registrations that opted into split events can be drained with a final
+// RangeFeedSplit event before the rangefeed is torn down. No-op if a rangefeed
+// is not active. Requires raftMu to be locked.
+func (r *Replica) handleSplitRangefeedRaftMuLocked(splitKey roachpb.RKey) {
+	p := r.getRangefeedProcessor()
+	if p == nil {
+		return
+	}
+	var op enginepb.MVCCLogicalOp
+	op.SetValue(&enginepb.MVCCSplitOp{SplitKey: splitKey.AsRawKey()})
+	if !p.ConsumeLogicalOps(op) {
+		// Consumption failed and the rangefeed was stopped.
+		r.unsetRangefeedProcessor(p)
+	}
+}
+
 // handleClosedTimestampUpdate determines the current maximum closed timestamp
 // for the replica and informs the rangefeed, if one is running. No-op if a
 // rangefeed is not active.
@@ -254,7 +254,7 @@ func TestReplicaRangefeed(t *testing.T) {
 		stream.Cancel()
 
 		pErr := <-streamErrC
-		if !testutils.IsPError(pErr, "context canceled") {
+		if !testutils.IsPError(pErr, "REASON_STREAM_CANCELED") {
 			t.Fatalf("got error for RangeFeed: %v", pErr)
 		}
 	}
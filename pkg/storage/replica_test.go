@@ -1385,6 +1385,43 @@ func TestReplicaLeaseRejectUnknownRaftNodeID(t *testing.T) {
 	}
 }
 
+// TestReplicaLeaseRequestRequiringLease verifies that a lease request, which
+// is evaluated without the range lease, is rejected with a
+// NotLeaseHolderError if its command is not exempt from the lease requirement.
+func TestReplicaLeaseRequestRequiringLease(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	prev, _ := batcheval.LookupCommand(roachpb.RequestLease)
+	mock := prev
+	mock.RequiresLease = true
+	batcheval.OverrideCommand(roachpb.RequestLease, mock)
+	defer batcheval.OverrideCommand(roachpb.RequestLease, prev)
+
+	replDesc, err := tc.repl.GetReplicaDescriptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := tc.Clock().Now()
+	_, pErr := tc.SendWrapped(&roachpb.RequestLeaseRequest{
+		RequestHeader: roachpb.RequestHeader{Key: tc.repl.Desc().StartKey.AsRawKey()},
+		Lease: roachpb.Lease{
+			Start:      now,
+			Expiration: now.Add(10, 0).Clone(),
+			Replica:    replDesc,
+		},
+	})
+	if _, ok := pErr.GetDetail().(*roachpb.NotLeaseHolderError); !ok {
+		t.Fatalf("expected NotLeaseHolderError, found %v", pErr)
+	}
+	if !testutils.IsPError(pErr, "RequestLease requires the range lease") {
+		t.Fatalf("unexpected error: %v", pErr)
+	}
+}
+
 // TestReplicaDrainLease makes sure that no new leases are granted when
 // the Store is draining.
 func TestReplicaDrainLease(t *testing.T) {
@@ -3117,6 +3154,50 @@ func TestReplicaNoTimestampIncrementWithinTxn(t *testing.T) {
 	}
 }
 
+// TestReplicaNoopWriteNotProposed verifies that a read-write command whose
+// evaluation has no effect, like the resolution of an intent that no longer
+// exists, is not proposed to Raft.
+func TestReplicaNoopWriteNotProposed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var proposals int32
+	tc := testContext{}
+	cfg := TestStoreConfig(nil)
+	cfg.TestingKnobs.TestingProposalFilter = func(args storagebase.ProposalFilterArgs) *roachpb.Error {
+		if _, ok := args.Req.GetArg(roachpb.ResolveIntent); ok {
+			atomic.AddInt32(&proposals, 1)
+		}
+		return nil
+	}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.StartWithStoreConfig(t, stopper, cfg)
+
+	key := roachpb.Key("a")
+	txn := newTransaction("test", key, 1, tc.Clock())
+	pArgs := putArgs(key, []byte("value"))
+	assignSeqNumsForReqs(txn, &pArgs)
+	if _, pErr := tc.SendWrappedWith(roachpb.Header{Txn: txn}, &pArgs); pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	rArgs := &roachpb.ResolveIntentRequest{
+		RequestHeader: pArgs.Header(),
+		IntentTxn:     txn.TxnMeta,
+		Status:        roachpb.COMMITTED,
+	}
+	// The first resolution commits the intent and must be proposed. The
+	// second one finds no intent to resolve.
+	for i, exp := range []int32{1, 1} {
+		if _, pErr := tc.SendWrappedWith(roachpb.Header{Timestamp: txn.WriteTimestamp}, rArgs); pErr != nil {
+			t.Fatal(pErr)
+		}
+		if n := atomic.LoadInt32(&proposals); n != exp {
+			t.Fatalf("%d: expected %d ResolveIntent proposals, got %d", i, exp, n)
+		}
+	}
+}
+
 // TestReplicaAbortSpanReadError verifies that an error is returned
 // to the client in the event that a AbortSpan entry is found but is
 // not decodable.
@@ -3898,6 +3979,86 @@ func Test1PCTransactionWriteTimestamp(t *testing.T) {
 	}
 }
 
+// TestEndTxnWithLatchSpanReport verifies that a transaction can be written and
+// committed while the latch span report wraps each command's ReadWriter, and
+// that the commands are recorded in the report.
+func TestEndTxnWithLatchSpanReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer batcheval.TestingSetLatchSpanReportEnabled(true)()
+	report := batcheval.GlobalLatchSpanReport()
+	report.Reset()
+	defer report.Reset()
+
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	key := roachpb.Key("a")
+	txn := newTransaction("test", key, 1, tc.Clock())
+	h := roachpb.Header{Txn: txn}
+
+	put := putArgs(key, []byte("value"))
+	assignSeqNumsForReqs(txn, &put)
+	if _, pErr := tc.SendWrappedWith(h, &put); pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	et, h := endTxnArgs(txn, true /* commit */)
+	et.IntentSpans = []roachpb.Span{{Key: key}}
+	assignSeqNumsForReqs(txn, &et)
+	resp, pErr := tc.SendWrappedWith(h, &et)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if status := resp.(*roachpb.EndTxnResponse).Txn.Status; status != roachpb.COMMITTED {
+		t.Fatalf("expected transaction status to be COMMITTED; got %s", status)
+	}
+
+	stats := report.Stats()
+	for _, m := range []roachpb.Method{roachpb.Put, roachpb.EndTxn} {
+		if stats[m].Evaluations == 0 {
+			t.Errorf("expected %s to be recorded in the latch span report: %s", m, report)
+		}
+	}
+}
+
+// TestEndTxnWithEnforcedCommandSpans verifies that a transaction can be
+// written and committed while its commands are evaluated against the
+// per-command span assertions, which are only active in race builds.
+func TestEndTxnWithEnforcedCommandSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer batcheval.RestoreRegistry(batcheval.SnapshotRegistry())
+	batcheval.EnforceCommandSpans(roachpb.Put)
+	batcheval.EnforceCommandSpans(roachpb.EndTxn)
+
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	key := roachpb.Key("a")
+	txn := newTransaction("test", key, 1, tc.Clock())
+	h := roachpb.Header{Txn: txn}
+
+	put := putArgs(key, []byte("value"))
+	assignSeqNumsForReqs(txn, &put)
+	if _, pErr := tc.SendWrappedWith(h, &put); pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	et, h := endTxnArgs(txn, true /* commit */)
+	et.IntentSpans = []roachpb.Span{{Key: key}}
+	assignSeqNumsForReqs(txn, &et)
+	resp, pErr := tc.SendWrappedWith(h, &et)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if status := resp.(*roachpb.EndTxnResponse).Txn.Status; status != roachpb.COMMITTED {
+		t.Fatalf("expected transaction status to be COMMITTED; got %s", status)
+	}
+}
+
 // TestEndTxnWithMalformedSplitTrigger verifies an EndTxn call with a malformed
 // commit trigger fails.
 func TestEndTxnWithMalformedSplitTrigger(t *testing.T) {
@@ -8389,7 +8550,7 @@ func TestReplicaEvaluationNotTxnMutation(t *testing.T) {
 	assignSeqNumsForReqs(txn, &txnPut, &txnPut2)
 	origTxn := txn.Clone()
 
-	batch, _, _, _, pErr := tc.repl.evaluateWriteBatch(ctx, makeIDKey(), &ba, &allSpans)
+	batch, _, _, _, _, pErr := tc.repl.evaluateWriteBatch(ctx, makeIDKey(), &ba, &allSpans)
 	defer batch.Close()
 	if pErr != nil {
 		t.Fatal(pErr)
@@ -12126,11 +12287,108 @@ func setMockPutWithEstimates(containsEstimatesDelta int64) (undo func()) {
 		return result.Result{}, engine.MVCCBlindPut(ctx, readWriter, ms, args.Key, ts, args.Value, cArgs.Header.Txn)
 	}
 
-	batcheval.UnregisterCommand(roachpb.Put)
-	batcheval.RegisterReadWriteCommand(roachpb.Put, batcheval.DefaultDeclareKeys, mockPut)
+	mock := prev
+	mock.DeclareKeys = batcheval.DefaultDeclareKeys
+	mock.EvalRW = mockPut
+	batcheval.OverrideCommand(roachpb.Put, mock)
 	return func() {
-		batcheval.UnregisterCommand(roachpb.Put)
-		batcheval.RegisterReadWriteCommand(roachpb.Put, prev.DeclareKeys, prev.EvalRW)
+		batcheval.OverrideCommand(roachpb.Put, prev)
+	}
+}
+
+// TestReplicaRejectedProposalRunsCompensations verifies that the
+// compensations of a proposal's commands are run if the proposal is rejected
+// below Raft, and not if it applies.
+func TestReplicaRejectedProposalRunsCompensations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	var rejectActive, compensated int32
+	tsc := TestStoreConfig(nil)
+	tsc.TestingKnobs.TestingApplyFilter = func(storagebase.ApplyFilterArgs) (int, *roachpb.Error) {
+		if atomic.LoadInt32(&rejectActive) != 0 {
+			return 0, roachpb.NewErrorf("rejected")
+		}
+		return 0, nil
+	}
+	var tc testContext
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.StartWithStoreConfig(t, stopper, tsc)
+
+	prev, _ := batcheval.LookupCommand(roachpb.Put)
+	mock := prev
+	mock.Compensate = func(context.Context, batcheval.CommandArgs, result.Result) {
+		atomic.AddInt32(&compensated, 1)
+	}
+	batcheval.OverrideCommand(roachpb.Put, mock)
+	defer batcheval.OverrideCommand(roachpb.Put, prev)
+
+	put := putArgs(roachpb.Key("a"), []byte("val"))
+	if _, pErr := tc.SendWrapped(&put); pErr != nil {
+		t.Fatal(pErr)
+	}
+	if n := atomic.LoadInt32(&compensated); n != 0 {
+		t.Fatalf("expected no compensations for an applied proposal, found %d", n)
+	}
+
+	atomic.StoreInt32(&rejectActive, 1)
+	_, pErr := tc.SendWrapped(&put)
+	atomic.StoreInt32(&rejectActive, 0)
+	if !testutils.IsPError(pErr, "rejected") {
+		t.Fatalf("expected rejection, found %v", pErr)
+	}
+	if n := atomic.LoadInt32(&compensated); n != 1 {
+		t.Fatalf("expected one compensation for a rejected proposal, found %d", n)
+	}
+}
+
+// TestReplicaDeferredWriteTooOldRunsCompensations verifies that the
+// compensation of a command whose WriteTooOldError was deferred is run if a
+// later command in the batch fails.
+func TestReplicaDeferredWriteTooOldRunsCompensations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tc := testContext{manualClock: hlc.NewManualClock(123)}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	cfg := TestStoreConfig(hlc.NewClock(tc.manualClock.UnixNano, time.Nanosecond))
+	tc.StartWithStoreConfig(t, stopper, cfg)
+
+	var compensated int32
+	prev, _ := batcheval.LookupCommand(roachpb.Put)
+	mock := prev
+	mock.Compensate = func(context.Context, batcheval.CommandArgs, result.Result) {
+		atomic.AddInt32(&compensated, 1)
+	}
+	batcheval.OverrideCommand(roachpb.Put, mock)
+	defer batcheval.OverrideCommand(roachpb.Put, prev)
+
+	// Write key "a" at t2.
+	t1 := makeTS(1*time.Second.Nanoseconds(), 0)
+	t2 := makeTS(2*time.Second.Nanoseconds(), 0)
+	tc.manualClock.Set(t2.WallTime)
+	put := putArgs(roachpb.Key("a"), []byte("val"))
+	if _, pErr := tc.SendWrappedWith(roachpb.Header{Timestamp: t2}, &put); pErr != nil {
+		t.Fatal(pErr)
+	}
+	if n := atomic.LoadInt32(&compensated); n != 0 {
+		t.Fatalf("expected no compensations for a successful batch, found %d", n)
+	}
+
+	// Writing key "a" at t1 hits a WriteTooOldError, which is deferred. The
+	// batch then fails on the ConditionalPut, so the Put is compensated.
+	var ba roachpb.BatchRequest
+	ba.Timestamp = t1
+	cput := cPutArgs(roachpb.Key("b"), []byte("val"), []byte("missing"))
+	ba.Add(&put, &cput)
+	_, pErr := tc.Sender().Send(ctx, ba)
+	if _, ok := pErr.GetDetail().(*roachpb.ConditionFailedError); !ok {
+		t.Fatalf("expected ConditionFailedError, found %v", pErr)
+	}
+	if n := atomic.LoadInt32(&compensated); n != 1 {
+		t.Fatalf("expected one compensation for the deferred write, found %d", n)
 	}
 }
 
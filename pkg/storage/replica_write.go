@@ -12,6 +12,7 @@ package storage
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
@@ -80,6 +81,13 @@ func (r *Replica) executeWriteBatch(
 	var status storagepb.LeaseStatus
 	// For lease commands, use the provided previous lease for verification.
 	if ba.IsSingleSkipLeaseCheckRequest() {
+		// Lease commands are evaluated without the range lease, which is only
+		// safe for commands that are exempt from the lease requirement.
+		if batcheval.BatchRequiresLease(ba) {
+			nlhe := newNotLeaseHolderError(nil, r.store.StoreID(), r.Desc())
+			nlhe.CustomMsg = fmt.Sprintf("%s requires the range lease", ba.Requests[0].GetInner().Method())
+			return nil, roachpb.NewError(nlhe)
+		}
 		lease = ba.GetPrevLeaseForLeaseRequest()
 	} else {
 		// Other write commands require that this replica has the range
@@ -249,9 +257,19 @@ and the following Raft status: %+v`,
 // at the intended timestamp, the batch's txn is restored and it's re-executed
 // in full. This allows it to lay down intents and return an appropriate
 // retryable error.
+//
+// On success, the compensations of the evaluated commands are returned. The
+// caller must run them if the batch is never applied.
 func (r *Replica) evaluateWriteBatch(
 	ctx context.Context, idKey storagebase.CmdIDKey, ba *roachpb.BatchRequest, spans *spanset.SpanSet,
-) (engine.Batch, enginepb.MVCCStats, *roachpb.BatchResponse, result.Result, *roachpb.Error) {
+) (
+	engine.Batch,
+	enginepb.MVCCStats,
+	*roachpb.BatchResponse,
+	result.Result,
+	batcheval.Compensations,
+	*roachpb.Error,
+) {
 	ms := enginepb.MVCCStats{}
 
 	// If the transaction has been pushed but it can commit at the higher
@@ -279,7 +297,7 @@ func (r *Replica) evaluateWriteBatch(
 		strippedBa.Requests = ba.Requests[:len(ba.Requests)-1] // strip end txn req
 
 		rec := NewReplicaEvalContext(r, spans)
-		batch, br, res, pErr := r.evaluateWriteBatchWithServersideRefreshes(
+		batch, br, res, compensations, pErr := r.evaluateWriteBatchWithServersideRefreshes(
 			ctx, idKey, rec, &ms, &strippedBa, spans,
 		)
 
@@ -354,23 +372,25 @@ func (r *Replica) evaluateWriteBatch(
 		}
 		onePCRes := synthesizeEndTxnResponse()
 		if onePCRes.success {
-			return batch, onePCRes.stats, onePCRes.br, onePCRes.res, nil
+			return batch, onePCRes.stats, onePCRes.br, onePCRes.res, compensations, nil
 		}
+		// The Result of the stripped batch is discarded.
+		compensations.Run(ctx)
 		if onePCRes.pErr != nil {
-			return batch, enginepb.MVCCStats{}, nil, result.Result{}, onePCRes.pErr
+			return batch, enginepb.MVCCStats{}, nil, result.Result{}, batcheval.Compensations{}, onePCRes.pErr
 		}
 
 		// Handle the case of a required one phase commit transaction.
 		if etArg.Require1PC {
 			// Make sure that there's a pErr returned.
 			if pErr != nil {
-				return batch, enginepb.MVCCStats{}, nil, result.Result{}, pErr
+				return batch, enginepb.MVCCStats{}, nil, result.Result{}, batcheval.Compensations{}, pErr
 			}
 			if ba.Timestamp != br.Timestamp {
 				onePCRes.pErr = roachpb.NewError(
 					roachpb.NewTransactionRetryError(
 						roachpb.RETRY_SERIALIZABLE, "Require1PC batch pushed"))
-				return batch, enginepb.MVCCStats{}, nil, result.Result{}, pErr
+				return batch, enginepb.MVCCStats{}, nil, result.Result{}, batcheval.Compensations{}, pErr
 			}
 			log.Fatal(ctx, "unreachable")
 		}
@@ -385,14 +405,15 @@ func (r *Replica) evaluateWriteBatch(
 	}
 
 	rec := NewReplicaEvalContext(r, spans)
-	batch, br, res, pErr := r.evaluateWriteBatchWithServersideRefreshes(
+	batch, br, res, compensations, pErr := r.evaluateWriteBatchWithServersideRefreshes(
 		ctx, idKey, rec, &ms, ba, spans)
-	return batch, ms, br, res, pErr
+	return batch, ms, br, res, compensations, pErr
 }
 
 // evaluateWriteBatchWithServersideRefreshes invokes evaluateBatch and retries
 // at a higher timestamp in the event of some retriable errors if allowed by the
-// batch/txn.
+// batch/txn. The compensations of the final attempt are returned if it
+// succeeds; those of failed attempts have already been run by evaluateBatch.
 func (r *Replica) evaluateWriteBatchWithServersideRefreshes(
 	ctx context.Context,
 	idKey storagebase.CmdIDKey,
@@ -400,7 +421,13 @@ func (r *Replica) evaluateWriteBatchWithServersideRefreshes(
 	ms *enginepb.MVCCStats,
 	ba *roachpb.BatchRequest,
 	spans *spanset.SpanSet,
-) (batch engine.Batch, br *roachpb.BatchResponse, res result.Result, pErr *roachpb.Error) {
+) (
+	batch engine.Batch,
+	br *roachpb.BatchResponse,
+	res result.Result,
+	compensations batcheval.Compensations,
+	pErr *roachpb.Error,
+) {
 	goldenMS := *ms
 	for retries := 0; ; retries++ {
 		if retries > 0 {
@@ -457,12 +484,20 @@ func (r *Replica) evaluateWriteBatchWithServersideRefreshes(
 			batch = spanset.NewBatch(batch, spans)
 		}
 
-		br, res, pErr = evaluateBatch(ctx, idKey, batch, rec, ms, ba, false /* readOnly */)
+		br, res, compensations, pErr = evaluateBatch(ctx, idKey, batch, rec, ms, ba, false /* readOnly */)
 		if pErr == nil {
 			if opLogger != nil {
-				res.LogicalOpLog = &storagepb.LogicalOpLog{
-					Ops: opLogger.LogicalOps(),
+				// Ops declared by the commands themselves follow the ones
+				// logged by the engine.
+				ops := opLogger.LogicalOps()
+				if res.LogicalOpLog != nil {
+					ops = append(ops, res.LogicalOpLog.Ops...)
 				}
+				res.LogicalOpLog = &storagepb.LogicalOpLog{Ops: ops}
+			} else {
+				// Without the engine's ops the log would be incomplete, and a
+				// rangefeed must see a missing log rather than a partial one.
+				res.LogicalOpLog = nil
 			}
 		}
 		// If we can retry, set a higher batch timestamp and continue.
@@ -503,6 +503,27 @@ func NewReadWriterAt(rw engine.ReadWriter, spans *SpanSet, ts hlc.Timestamp) eng
 	return makeSpanSetReadWriterAt(rw, spans, ts)
 }
 
+// NewRecordingReadWriter returns an engine.ReadWriter that permits all access
+// to the underlying ReadWriter and records each accessed span into the given
+// SpanSet, which must have been created with MakeRecordingSpanSet.
+func NewRecordingReadWriter(rw engine.ReadWriter, spans *SpanSet) engine.ReadWriter {
+	if !spans.recording {
+		panic("NewRecordingReadWriter called with non-recording SpanSet")
+	}
+	return makeSpanSetReadWriter(rw, spans)
+}
+
+// NewAssertingReadWriter returns an engine.ReadWriter that panics on any
+// access of the underlying ReadWriter outside of the given SpanSet, which must
+// have been created with MakeAssertingSpanSet. Timestamps are not considered,
+// only the span boundaries are checked.
+func NewAssertingReadWriter(rw engine.ReadWriter, spans *SpanSet) engine.ReadWriter {
+	if !spans.asserting {
+		panic("NewAssertingReadWriter called with non-asserting SpanSet")
+	}
+	return makeSpanSetReadWriter(rw, spans)
+}
+
 type spanSetBatch struct {
 	ReadWriter
 	b     engine.Batch
@@ -549,6 +570,25 @@ func NewBatch(b engine.Batch, spans *SpanSet) engine.Batch {
 	}
 }
 
+// NewRecordingBatch is like NewRecordingReadWriter, but preserves the
+// engine.Batch interface of the underlying Batch so that callers relying on
+// it (e.g. commit triggers, or blind writes through Distinct) are unaffected.
+func NewRecordingBatch(b engine.Batch, spans *SpanSet) engine.Batch {
+	if !spans.recording {
+		panic("NewRecordingBatch called with non-recording SpanSet")
+	}
+	return NewBatch(b, spans)
+}
+
+// NewAssertingBatch is like NewAssertingReadWriter, but preserves the
+// engine.Batch interface of the underlying Batch.
+func NewAssertingBatch(b engine.Batch, spans *SpanSet) engine.Batch {
+	if !spans.asserting {
+		panic("NewAssertingBatch called with non-asserting SpanSet")
+	}
+	return NewBatch(b, spans)
+}
+
 // NewBatchAt returns an engine.Batch that asserts access of the underlying
 // Batch against the given SpanSet at the given timestamp.
 // If the zero timestamp is used, all accesses are considered non-MVCC.
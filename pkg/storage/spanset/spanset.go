@@ -79,6 +79,30 @@ type Span struct {
 // use by the separate local and global latches).
 type SpanSet struct {
 	spans [NumSpanAccess][NumSpanScope][]Span
+
+	// recording, if set, causes the SpanSet to permit every access checked
+	// against it and to add the accessed span to itself instead. It is used
+	// to capture the spans that a command actually touches during evaluation.
+	// See NewRecordingReadWriter.
+	recording bool
+
+	// asserting, if set, causes the SpanSet to panic on any access checked
+	// against it that it does not permit, rather than returning an error that
+	// the command evaluating against it may swallow. See
+	// NewAssertingReadWriter.
+	asserting bool
+}
+
+// MakeRecordingSpanSet returns an empty SpanSet that allows all accesses and
+// records each of them. The accessed spans can be retrieved with GetSpans.
+func MakeRecordingSpanSet() SpanSet {
+	return SpanSet{recording: true}
+}
+
+// MakeAssertingSpanSet returns an empty SpanSet that panics on every access
+// that is checked against it and not permitted by the spans added to it.
+func MakeAssertingSpanSet() SpanSet {
+	return SpanSet{asserting: true}
 }
 
 // String prints a string representation of the SpanSet.
@@ -179,6 +203,11 @@ func (s *SpanSet) AssertAllowed(access SpanAccess, span roachpb.Span) {
 // is also a problem if the added spans were read only and the spanset wasn't
 // already SortAndDedup-ed.
 func (s *SpanSet) CheckAllowed(access SpanAccess, span roachpb.Span) error {
+	if s.recording {
+		s.AddNonMVCC(access, span)
+		return nil
+	}
+
 	scope := SpanGlobal
 	if keys.IsLocal(span.Key) {
 		scope = SpanLocal
@@ -192,7 +221,7 @@ func (s *SpanSet) CheckAllowed(access SpanAccess, span roachpb.Span) error {
 		}
 	}
 
-	return errors.Errorf("cannot %s undeclared span %s\ndeclared:\n%s", access, span, s)
+	return s.maybeAssert(errors.Errorf("cannot %s undeclared span %s\ndeclared:\n%s", access, span, s))
 }
 
 // CheckAllowedAt returns an error if the access is not allowed at over the given keyspan
@@ -200,6 +229,11 @@ func (s *SpanSet) CheckAllowed(access SpanAccess, span roachpb.Span) error {
 func (s *SpanSet) CheckAllowedAt(
 	access SpanAccess, span roachpb.Span, timestamp hlc.Timestamp,
 ) error {
+	if s.recording {
+		s.AddMVCC(access, span, timestamp)
+		return nil
+	}
+
 	scope := SpanGlobal
 	if keys.IsLocal(span.Key) {
 		scope = SpanLocal
@@ -232,8 +266,17 @@ func (s *SpanSet) CheckAllowedAt(
 		}
 	}
 
-	return errors.Errorf("cannot %s undeclared span %s at %s\ndeclared:\n%s",
-		access, span, timestamp.String(), s)
+	return s.maybeAssert(errors.Errorf("cannot %s undeclared span %s at %s\ndeclared:\n%s",
+		access, span, timestamp.String(), s))
+}
+
+// maybeAssert panics with the provided access error if the SpanSet is
+// asserting and returns it otherwise.
+func (s *SpanSet) maybeAssert(err error) error {
+	if s.asserting {
+		panic(errors.Wrap(err, "span enforcement"))
+	}
+	return err
 }
 
 // Validate returns an error if any spans that have been added to the set
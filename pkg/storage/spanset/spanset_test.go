@@ -242,3 +242,44 @@ func TestSpanSetWriteImpliesRead(t *testing.T) {
 		t.Errorf("expected to be allowed to read rwSpan, error: %+v", err)
 	}
 }
+
+// Test that an asserting SpanSet panics on undeclared accesses.
+func TestSpanSetAsserting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ss := MakeAssertingSpanSet()
+	ss.AddNonMVCC(SpanReadOnly, roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("d")})
+	ss.AddMVCC(SpanReadWrite, roachpb.Span{Key: roachpb.Key("f")}, hlc.Timestamp{WallTime: 2})
+
+	if err := ss.CheckAllowed(SpanReadOnly, roachpb.Span{Key: roachpb.Key("c")}); err != nil {
+		t.Fatalf("expected read of c to be allowed, but got error: %+v", err)
+	}
+	if err := ss.CheckAllowedAt(
+		SpanReadWrite, roachpb.Span{Key: roachpb.Key("f")}, hlc.Timestamp{WallTime: 2},
+	); err != nil {
+		t.Fatalf("expected write of f to be allowed, but got error: %+v", err)
+	}
+
+	expectPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expected %s to panic", name)
+			} else if !testutils.IsError(r.(error), "span enforcement: cannot") {
+				t.Errorf("unexpected panic for %s: %v", name, r)
+			}
+		}()
+		fn()
+	}
+	expectPanic("write of c", func() {
+		_ = ss.CheckAllowed(SpanReadWrite, roachpb.Span{Key: roachpb.Key("c")})
+	})
+	expectPanic("read of e", func() {
+		_ = ss.CheckAllowed(SpanReadOnly, roachpb.Span{Key: roachpb.Key("e")})
+	})
+	expectPanic("write of f at a different timestamp", func() {
+		_ = ss.CheckAllowedAt(
+			SpanReadWrite, roachpb.Span{Key: roachpb.Key("f")}, hlc.Timestamp{WallTime: 3},
+		)
+	})
+}
@@ -262,6 +262,9 @@ func (s *Store) SplitRange(
 	// TODO(nvanbenschoten): It should be possible to only reject registrations
 	// that overlap with the new range of the split and keep registrations that
 	// are only interested in keys that are still on the original range running.
+	// Registrations that opted into split events are instead drained with a
+	// final event carrying the split key before the rangefeed is shut down.
+	leftRepl.handleSplitRangefeedRaftMuLocked(rightDesc.StartKey)
 	leftRepl.disconnectRangefeedWithReason(
 		roachpb.RangeFeedRetryError_REASON_RANGE_SPLIT,
 	)
@@ -383,6 +383,62 @@ var charts = []sectionDescription{
 					"kv.rangefeed.catchup_scan_nanos",
 				},
 			},
+			{
+				Title: "Rangefeed Registrations",
+				Metrics: []string{
+					"kv.rangefeed.registrations",
+					"kv.rangefeed.unresolved_intents",
+				},
+			},
+			{
+				Title: "Rangefeed Throughput",
+				Metrics: []string{
+					"kv.rangefeed.logical_ops",
+					"kv.rangefeed.events_published",
+				},
+			},
+			{
+				Title: "Rangefeed Dropped Events",
+				Metrics: []string{
+					"kv.rangefeed.dropped_events",
+				},
+			},
+			{
+				Title: "Rangefeed Dropped Bytes",
+				Metrics: []string{
+					"kv.rangefeed.dropped_bytes",
+				},
+			},
+			{
+				Title: "Rangefeed Resolved Timestamp Lag",
+				Metrics: []string{
+					"kv.rangefeed.resolved_ts_lag_nanos",
+				},
+			},
+			{
+				Title: "Rangefeed Closed Timestamp Regressions",
+				Metrics: []string{
+					"kv.rangefeed.closed_ts_regressions",
+				},
+			},
+			{
+				Title: "Rangefeed Forced Transaction Pushes",
+				Metrics: []string{
+					"kv.rangefeed.forced_txn_pushes",
+				},
+			},
+			{
+				Title: "Rangefeed Shed Intent Transactions",
+				Metrics: []string{
+					"kv.rangefeed.shed_intent_txns",
+				},
+			},
+			{
+				Title: "Rangefeed Values Below Checkpoint",
+				Metrics: []string{
+					"kv.rangefeed.values_below_checkpoint",
+				},
+			},
 			{
 				Title: "Snapshots",
 				Metrics: []string{
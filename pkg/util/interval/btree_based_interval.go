@@ -1053,6 +1053,27 @@ func (t *btree) Len() int {
 	return t.length
 }
 
+// Shape implements the Tree interface. Each node of the tree holds between
+// minimumDegree-1 and 2*minimumDegree-1 intervals.
+func (t *btree) Shape() (depth, nodes int) {
+	if t.root == nil {
+		return 0, 0
+	}
+	return t.root.shape()
+}
+
+func (n *node) shape() (depth, nodes int) {
+	nodes = 1
+	for _, c := range n.children {
+		d, cn := c.shape()
+		if d > depth {
+			depth = d
+		}
+		nodes += cn
+	}
+	return depth + 1, nodes
+}
+
 type stackElem struct {
 	node  *node
 	index int
@@ -917,3 +917,28 @@ func BenchmarkBTreeOverlapScan(b *testing.B) {
 		}, cmd)
 	}
 }
+
+func TestShape(t *testing.T) {
+	tree := newBTreeWithDegree(InclusiveOverlapper, 2)
+	if depth, nodes := tree.Shape(); depth != 0 || nodes != 0 {
+		t.Fatalf("expected empty tree to have no nodes, found depth=%d nodes=%d", depth, nodes)
+	}
+	var ivs items
+	for i := uint32(0); i < 100; i++ {
+		ivs = append(ivs, makeMultiByteInterval(i, i+1, i))
+	}
+	for _, iv := range ivs {
+		if err := tree.Insert(iv, false); err != nil {
+			t.Fatalf("insert error: %s", err)
+		}
+	}
+	// Each node of a tree with minimum degree 2 holds between 1 and 3
+	// intervals, and all of its leaves are at the same depth.
+	depth, nodes := tree.Shape()
+	if nodes < len(ivs)/3 || nodes > len(ivs) {
+		t.Fatalf("unexpected node count %d for %d intervals", nodes, len(ivs))
+	}
+	if depth < 2 || 1<<uint(depth-1) > nodes {
+		t.Fatalf("unexpected depth %d for %d nodes", depth, nodes)
+	}
+}
@@ -222,6 +222,9 @@ type Tree interface {
 	Clear()
 	// Clone clones the tree, returning a copy.
 	Clone() Tree
+	// Shape returns the depth of the tree, i.e. the number of nodes on its
+	// longest root-to-leaf path, and the number of nodes in the tree.
+	Shape() (depth, nodes int)
 }
 
 // TreeIterator iterates over all intervals stored in the interval tree, in-order.
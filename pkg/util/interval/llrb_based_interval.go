@@ -666,6 +666,23 @@ func (t *llrbTree) Iterator() TreeIterator {
 	return &ti
 }
 
+// Shape implements the Tree interface.
+func (t *llrbTree) Shape() (depth, nodes int) {
+	return t.Root.shape()
+}
+
+func (n *llrbNode) shape() (depth, nodes int) {
+	if n == nil {
+		return 0, 0
+	}
+	ld, ln := n.Left.shape()
+	rd, rn := n.Right.shape()
+	if rd > ld {
+		ld = rd
+	}
+	return ld + 1, ln + rn + 1
+}
+
 func (t *llrbTree) Clear() {
 	t.Root = nil
 	t.Count = 0